@@ -7,6 +7,7 @@ import (
 
 	"github.com/canonical/ubuntu-image/internal/commands"
 	"github.com/canonical/ubuntu-image/internal/helper"
+	"github.com/canonical/ubuntu-image/internal/manifest"
 	"github.com/canonical/ubuntu-image/internal/statemachine"
 	"github.com/jessevdk/go-flags"
 )
@@ -59,6 +60,109 @@ func executeStateMachine(commonOpts *commands.CommonOpts, stateMachineOpts *comm
 
 }
 
+// executeManifestDiff reports the changes between two manifests. With --exit-code, the
+// exit status is 1 if the manifests differ and 2 on errors, as with diff(1)
+func executeManifestDiff(ubuntuImageCommand *commands.UbuntuImageCommand) {
+	args := ubuntuImageCommand.ManifestDiff.ManifestDiffArgsPassed
+	opts := ubuntuImageCommand.ManifestDiff.ManifestDiffOptsPassed
+	errorStatus := 1
+	if opts.ExitCode {
+		errorStatus = 2
+	}
+
+	oldVersions, err := manifest.Read(args.OldManifest)
+	if err != nil {
+		fmt.Printf("Error: %s\n", err.Error())
+		osExit(errorStatus)
+		return
+	}
+	newVersions, err := manifest.Read(args.NewManifest)
+	if err != nil {
+		fmt.Printf("Error: %s\n", err.Error())
+		osExit(errorStatus)
+		return
+	}
+
+	diff := manifest.Compare(oldVersions, newVersions)
+	if err := diff.Write(os.Stdout, opts.Format); err != nil {
+		fmt.Printf("Error: %s\n", err.Error())
+		osExit(errorStatus)
+		return
+	}
+	if opts.ExitCode && !diff.Empty() {
+		osExit(1)
+	}
+}
+
+// executeValidateGadget prints the problems found in the gadget.yaml of a gadget tree.
+// The exit status is 1 if there are any
+func executeValidateGadget(ubuntuImageCommand *commands.UbuntuImageCommand) {
+	gadgetTree := ubuntuImageCommand.ValidateGadget.ValidateGadgetArgsPassed.GadgetTree
+	diagnostics, err := statemachine.ValidateGadget(gadgetTree)
+	if err != nil {
+		fmt.Printf("Error: %s\n", err.Error())
+		osExit(1)
+		return
+	}
+	for _, diagnostic := range diagnostics {
+		fmt.Println(diagnostic)
+	}
+	if len(diagnostics) > 0 {
+		fmt.Printf("Found %d problem(s) in the gadget.yaml\n", len(diagnostics))
+		osExit(1)
+		return
+	}
+	fmt.Println("The gadget.yaml is valid")
+}
+
+// executeShowLayout prints the layout of the volumes of a gadget tree
+func executeShowLayout(ubuntuImageCommand *commands.UbuntuImageCommand) {
+	gadgetTree := ubuntuImageCommand.ShowLayout.ShowLayoutArgsPassed.GadgetTree
+	format := ubuntuImageCommand.ShowLayout.ShowLayoutOptsPassed.Format
+	if err := statemachine.WriteGadgetLayout(os.Stdout, gadgetTree, format); err != nil {
+		fmt.Printf("Error: %s\n", err.Error())
+		osExit(1)
+	}
+}
+
+// executeInspect prints the partitions and filesystems of a disk image, compared
+// with a gadget.yaml if one was given
+func executeInspect(ubuntuImageCommand *commands.UbuntuImageCommand) {
+	imagePath := ubuntuImageCommand.Inspect.InspectArgsPassed.Image
+	opts := ubuntuImageCommand.Inspect.InspectOptsPassed
+	report, err := statemachine.InspectImage(imagePath, opts.SectorSize)
+	if err != nil {
+		fmt.Printf("Error: %s\n", err.Error())
+		osExit(1)
+		return
+	}
+	if opts.GadgetYaml != "" {
+		if err := report.CompareWithGadget(opts.GadgetYaml, opts.Volume); err != nil {
+			fmt.Printf("Error: %s\n", err.Error())
+			osExit(1)
+			return
+		}
+	}
+	if err := report.Write(os.Stdout, opts.Format); err != nil {
+		fmt.Printf("Error: %s\n", err.Error())
+		osExit(1)
+		return
+	}
+	if len(report.Mismatches) > 0 {
+		osExit(1)
+	}
+}
+
+// executePlan prints the sizes that a build of a gadget tree would calculate
+func executePlan(commonOpts *commands.CommonOpts, ubuntuImageCommand *commands.UbuntuImageCommand) {
+	gadgetTree := ubuntuImageCommand.Plan.PlanArgsPassed.GadgetTree
+	planOpts := ubuntuImageCommand.Plan.PlanOptsPassed
+	if err := statemachine.WriteImagePlan(os.Stdout, gadgetTree, commonOpts, planOpts); err != nil {
+		fmt.Printf("Error: %s\n", err.Error())
+		osExit(1)
+	}
+}
+
 func main() {
 	// instantiate structs for
 	commonOpts := new(commands.CommonOpts)
@@ -138,6 +242,23 @@ func main() {
 		imageType = parser.Command.Active.Name
 	}
 
+	if imageType == "manifest-diff" {
+		executeManifestDiff(ubuntuImageCommand)
+		return
+	} else if imageType == "validate-gadget" {
+		executeValidateGadget(ubuntuImageCommand)
+		return
+	} else if imageType == "show-layout" {
+		executeShowLayout(ubuntuImageCommand)
+		return
+	} else if imageType == "inspect" {
+		executeInspect(ubuntuImageCommand)
+		return
+	} else if imageType == "plan" {
+		executePlan(commonOpts, ubuntuImageCommand)
+		return
+	}
+
 	// let the state machine handle the image build
 	executeStateMachine(commonOpts, stateMachineOpts, ubuntuImageCommand)
 }
@@ -138,6 +138,31 @@ func TestExitCode(t *testing.T) {
 		{"bad_state_machine_args_snap", []string{"snap", "model_assertion.yaml", "-u", "5", "-t", "6"}, 1},
 		{"no_command_given", []string{}, 1},
 		{"resume_without_workdir", []string{"--resume"}, 1},
+		{"manifest_diff_no_changes", []string{"manifest-diff", "--exit-code",
+			"../../internal/manifest/testdata/old.manifest", "../../internal/manifest/testdata/old.manifest"}, 0},
+		{"manifest_diff_changes", []string{"manifest-diff", "--exit-code",
+			"../../internal/manifest/testdata/old.manifest", "../../internal/manifest/testdata/new.manifest"}, 1},
+		{"manifest_diff_changes_no_exit_code", []string{"manifest-diff", "--format", "json",
+			"../../internal/manifest/testdata/old.manifest", "../../internal/manifest/testdata/new.manifest"}, 0},
+		{"manifest_diff_missing_manifest", []string{"manifest-diff", "--exit-code",
+			"../../internal/manifest/testdata/old.manifest", "missing.manifest"}, 2},
+		{"manifest_diff_one_manifest", []string{"manifest-diff", "old.manifest"}, 1},
+		{"validate_gadget_valid", []string{"validate-gadget",
+			"../../internal/statemachine/testdata/gadget_tree"}, 0},
+		{"validate_gadget_problems", []string{"validate-gadget",
+			"../../internal/statemachine/testdata/gadget_tree_problems"}, 1},
+		{"validate_gadget_missing", []string{"validate-gadget", "missing"}, 1},
+		{"show_layout", []string{"show-layout", "--format", "svg",
+			"../../internal/statemachine/testdata/gadget_tree"}, 0},
+		{"show_layout_missing", []string{"show-layout", "missing"}, 1},
+		{"plan", []string{"plan", "--image-size", "1G", "--filesystem",
+			"../../internal/statemachine/testdata/gadget_tree",
+			"../../internal/statemachine/testdata/gadget_tree"}, 0},
+		{"plan_no_rootfs", []string{"plan", "../../internal/statemachine/testdata/gadget_tree"}, 1},
+		{"inspect_missing", []string{"inspect", "missing.img"}, 1},
+		{"inspect_not_an_image", []string{"inspect", "--gadget-yaml",
+			"../../internal/statemachine/testdata/gadget-gpt.yaml",
+			"../../internal/statemachine/testdata/gadget_tree/pc-core.img"}, 1},
 	}
 	for _, tc := range testCases {
 		t.Run("test "+tc.name, func(t *testing.T) {
@@ -3,6 +3,7 @@ module github.com/canonical/ubuntu-image
 go 1.16
 
 require (
+	github.com/ProtonMail/go-crypto v0.0.0-20210512092938-c05353c2d58c
 	github.com/boltdb/bolt v1.3.1 // indirect
 	github.com/canonical/go-sp800.90a-drbg v0.0.0-20210314144037-6eeb1040d6c3 // indirect
 	github.com/canonical/go-tpm2 v0.0.0-20210630093425-c4bb37200aa6 // indirect
@@ -21,13 +22,13 @@ require (
 	github.com/snapcore/snapd v0.0.0-20210824074111-a3fe6b7e2554
 	github.com/snapcore/snapd/osutil/udev v0.0.0-00010101000000-000000000000 // indirect
 	github.com/snapcore/squashfuse v0.0.0-20171220165323-319f6d41a041 // indirect
-	go.mozilla.org/pkcs7 v0.0.0-20200128120323-432b2356ecb1 // indirect
+	go.mozilla.org/pkcs7 v0.0.0-20200128120323-432b2356ecb1
 	golang.org/x/crypto v0.0.0-20210711020723-a769d52b0f97 // indirect
 	golang.org/x/net v0.0.0-20210405180319-a5a99cb37ef4 // indirect
 	gopkg.in/macaroon.v1 v1.0.0 // indirect
 	gopkg.in/mgo.v2 v2.0.0-20190816093944-a6b53ec6cb22 // indirect
 	gopkg.in/retry.v1 v1.0.3 // indirect
-	gopkg.in/yaml.v2 v2.4.0 // indirect
+	gopkg.in/yaml.v2 v2.4.0
 	maze.io/x/crypto v0.0.0-20190131090603-9b94c9afe066 // indirect
 )
 
@@ -15,6 +15,7 @@ type ClassicOpts struct {
 	Subarch      string   `long:"subarch" description:"Sub architecture to be specified to livecd-rootfs." value-name:"SUBARCH"`
 	WithProposed bool     `long:"with-proposed" description:"Proposed repo to install, This is passed through to livecd-rootfs."`
 	ExtraPPAs    []string `long:"extra-ppas" description:"Extra ppas to install. This is passed through to livecd-rootfs."`
+	LiveISO      bool     `long:"live-iso" description:"Create a hybrid ISO 9660 live image of the rootfs in the output directory. The image boots from BIOS and EFI using the gadget's grub and shim."`
 }
 
 type classicCommand struct {
@@ -4,13 +4,35 @@ package commands
 
 // CommonOpts stores the options that are common to all image types
 type CommonOpts struct {
-	Debug            bool     `short:"d" long:"debug" description:"Enable debugging output"`
-	Size             string   `short:"i" long:"image-size" description:"The suggested size of the generated disk image file. If this size is smaller than the minimum calculated size of the image a warning will be issued and --image-size will be ignored. The value is the size in bytes, with allowable suffixes \"M\" for MiB and \"G\" for GiB. Use an extended syntax to define the suggested size for the disk images generated by a multi-volume gadget.yaml spec" value-name:"SIZE"`
-	ImageFileList    string   `long:"image-file-list" description:"Print to this file, a list of the file system paths to all the disk images created by the command, if any." value-name:"FILENAME"`
-	CloudInit        string   `long:"cloud-init" description:"cloud-config data to be copied to the image" value-name:"USER-DATA-FILE"`
-	HooksDirectories []string `long:"hooks-directory" description:"Path or comma-separated list of paths of directories in which scripts for build-time hooks will be located." value-name:"DIRECTORY"`
-	DiskInfo         string   `long:"disk-info" description:"File to be used as .disk/info on the image's rootfs. This file can contain useful information about the target image, like image identification data, system name, build timestamp etc." value-name:"DISK-INFO-CONTENTS"`
-	OutputDir        string   `short:"O" long:"output-dir" description:"The directory in which to put generated disk image files. The disk image files themselves will be named <volume>.img inside this directory, where <volume> is the volume name taken from the gadget.yaml file." value-name:"DIRECTORY"`
+	Debug             bool     `short:"d" long:"debug" description:"Enable debugging output"`
+	Size              string   `short:"i" long:"image-size" description:"The suggested size of the generated disk image file. If this size is smaller than the minimum calculated size of the image a warning will be issued and --image-size will be ignored. The value is the size in bytes, with allowable suffixes \"M\" for MiB and \"G\" for GiB. Use an extended syntax to define the suggested size for the disk images generated by a multi-volume gadget.yaml spec" value-name:"SIZE"`
+	ImageFileList     string   `long:"image-file-list" description:"Print to this file, a list of the file system paths to all the disk images created by the command, if any." value-name:"FILENAME"`
+	ImageFileListJSON string   `long:"image-file-list-json" description:"Write to this file a JSON list of all the files created in the output directory, including disk images, manifests and exported partitions, along with their volume, size, sha256 checksum and format." value-name:"FILENAME"`
+	CloudInit         string   `long:"cloud-init" description:"cloud-config data to be copied to the image" value-name:"USER-DATA-FILE"`
+	HooksDirectories  []string `long:"hooks-directory" description:"Path or comma-separated list of paths of directories in which scripts for build-time hooks will be located." value-name:"DIRECTORY"`
+	DiskInfo          string   `long:"disk-info" description:"File to be used as .disk/info on the image's rootfs. This file can contain useful information about the target image, like image identification data, system name, build timestamp etc." value-name:"DISK-INFO-CONTENTS"`
+	OutputDir         string   `short:"O" long:"output-dir" description:"The directory in which to put generated disk image files. The disk image files themselves will be named <volume>.img inside this directory, where <volume> is the volume name taken from the gadget.yaml file." value-name:"DIRECTORY"`
+	RootfsTarball     bool     `long:"rootfs-tarball" description:"Create a rootfs.tar.gz tarball of the root filesystem in the output directory, preserving ownership, extended attributes and device nodes."`
+	RootfsSquashfs    bool     `long:"rootfs-squashfs" description:"Create a rootfs.squashfs image of the root filesystem in the output directory."`
+	NoDiskImage       bool     `long:"no-disk-image" description:"Do not create any disk images. Useful in combination with --rootfs-tarball or --rootfs-squashfs."`
+	OutputDevice      string   `long:"output-device" description:"Write the disk image directly to this block device instead of a file in the output directory. The device must not be mounted and must be large enough for the image. Only gadgets with a single volume are supported." value-name:"DEVICE"`
+	ForceDevice       bool     `long:"force-output-device" description:"Allow --output-device to write to non-removable devices, which might be system disks."`
+	CloudProfile      string   `long:"cloud-profile" description:"Size and package the disk images for a cloud provider. \"gce\" creates a .tar.gz containing disk.raw, \"aws\" rounds the raw image up to a whole GiB, and \"azure\" creates a fixed VHD aligned to 1 MiB." value-name:"PROFILE" choice:"gce" choice:"aws" choice:"azure"`
+	OverwritePolicy   string   `long:"overwrite-policy" description:"What to do when a file created by the build already exists in the output directory. \"error\" fails the build without publishing anything, \"replace\" overwrites the existing file, and \"backup\" renames it with a .bak suffix first." value-name:"POLICY" choice:"error" choice:"replace" choice:"backup" default:"replace"`
+	ImageName         string   `long:"image-name" description:"A template for the names of the files created in the output directory. The placeholders {volume}, {model}, {arch}, {series}, {date} and {build-id} are expanded, and a suffix such as .img or .manifest is appended." value-name:"TEMPLATE"`
+	BuildID           string   `long:"build-id" description:"The value of the {build-id} placeholder of --image-name. A random identifier is used by default." value-name:"BUILD-ID"`
+	ExportPartitions  bool     `long:"export-partitions" description:"Copy the image of each individual partition to the output directory, named <volume>.<structure>.img, along with a <volume>.partitions.json manifest describing the layout of the partitions."`
+	Checksums         bool     `long:"checksums" description:"Write a SHA256SUMS file with the checksums of all the files created in the output directory."`
+	SHA512Sums        bool     `long:"sha512sums" description:"Also write a SHA512SUMS file. Implies --checksums."`
+	SignKey           string   `long:"sign-key" description:"Create a detached signature of the checksum files with this key. An OpenPGP secret key creates a .gpg signature, and a PEM file containing an x509 certificate and its private key creates a PKCS#7 .p7s signature. Implies --checksums." value-name:"KEY-FILE"`
+	Provenance        bool     `long:"provenance" description:"Write an in-toto statement with a SLSA provenance predicate describing the inputs of the build, the versions of the snaps, packages and tools used, and the digests of the images."`
+	SBOM              []string `long:"sbom" description:"Write a software bill of materials listing the Debian packages of classic images or the snaps of snap images. Can be given once per format." value-name:"FORMAT" choice:"spdx" choice:"cyclonedx"`
+	Reproducible      bool     `long:"reproducible" description:"Build the same images from the same inputs. All the identifiers, such as the disk and filesystem UUIDs, are derived from the inputs and SOURCE_DATE_EPOCH, which must be set, and timestamps are clamped to SOURCE_DATE_EPOCH."`
+	ManifestJSON      bool     `long:"manifest-json" description:"Also write the manifests of the packages or snaps included in the image in JSON, with more details than the plain text manifests."`
+	DiskGUID          string   `long:"disk-guid" description:"The GUID of the GPT partition table of the disk image, or the 8 hexadecimal digits of the identifier of an MBR partition table, overriding the id of the volume in gadget.yaml. Use the <volume>:<GUID> syntax, separated by commas, for gadgets with multiple volumes." value-name:"GUID"`
+	HybridMBR         string   `long:"hybrid-mbr" description:"Write a hybrid MBR on GPT disk images instead of a protective MBR, for firmware that reads the MBR of GPT disks: the selected structures also get an entry with their MBR type in the MBR. Select at most three structures with hybrid MBR,GPT types as a comma-separated list, using the <volume>:<structure> syntax for gadgets with multiple volumes. Without structures, all the structures with hybrid types are selected, as long as there are at most three of them." optional:"yes" optional-value:"auto" value-name:"STRUCTURES"`
+	SectorSize        string   `long:"sector-size" description:"The logical sector size of the disk images, in bytes, overriding the sector-size of the volumes in gadget.yaml. The partition tables, the filesystems and the offset-write values use this sector size. Disks written with --output-device use the sector size of the device, which the sector size of the volume must then match." value-name:"SIZE" choice:"512" choice:"4096"`
+	GPTAttributes     []string `long:"gpt-attributes" description:"The GPT attributes of a partition, overriding the attributes of the structure in gadget.yaml. The argument is <structure>=<attribute>[,<attribute>...], where the structure is given by its name or index, and the attributes are required, no-block-io, legacy-bios-bootable, successful, priority=<0-15>, tries=<0-15> or the number of a bit from 0 to 63. An empty list of attributes clears the attributes of the structure. Use the <volume>:<structure>=<attributes> syntax for gadgets with multiple volumes. Can be given once per partition." value-name:"ATTRIBUTES"`
 }
 
 // StateMachineOpts stores the options that are related to the state machine
@@ -31,6 +53,25 @@ type UbuntuImageCommand struct {
 		ClassicArgsPassed ClassicArgs `positional-args:"true" required:"false"`
 		ClassicOptsPassed ClassicOpts
 	} `command:"classic"`
+	ManifestDiff struct {
+		ManifestDiffArgsPassed ManifestDiffArgs `positional-args:"true" required:"true"`
+		ManifestDiffOptsPassed ManifestDiffOpts
+	} `command:"manifest-diff"`
+	ValidateGadget struct {
+		ValidateGadgetArgsPassed ValidateGadgetArgs `positional-args:"true" required:"true"`
+	} `command:"validate-gadget"`
+	ShowLayout struct {
+		ShowLayoutArgsPassed ShowLayoutArgs `positional-args:"true" required:"true"`
+		ShowLayoutOptsPassed ShowLayoutOpts
+	} `command:"show-layout"`
+	Inspect struct {
+		InspectArgsPassed InspectArgs `positional-args:"true" required:"true"`
+		InspectOptsPassed InspectOpts
+	} `command:"inspect"`
+	Plan struct {
+		PlanArgsPassed PlanArgs `positional-args:"true" required:"true"`
+		PlanOptsPassed PlanOpts
+	} `command:"plan"`
 }
 
 type commonOptions struct {
@@ -0,0 +1,14 @@
+package commands
+
+// InspectArgs holds the disk image to inspect
+type InspectArgs struct {
+	Image string `positional-arg-name:"image" description:"Disk image to inspect."`
+}
+
+// InspectOpts holds all flags that are specific to the inspect command
+type InspectOpts struct {
+	GadgetYaml string `long:"gadget-yaml" description:"Compare the image with the volume of this gadget.yaml, and exit with a non-zero status on mismatches." value-name:"FILE"`
+	Volume     string `long:"volume" description:"The volume of the gadget.yaml the image was built from. Only needed for gadgets with several volumes." value-name:"NAME"`
+	Format     string `long:"format" description:"The format of the report." value-name:"FORMAT" choice:"text" choice:"json" default:"text"`
+	SectorSize int64  `long:"sector-size" description:"The logical sector size of the disk image, in bytes. It is detected for GPT disk images and block devices, while MBR disk images are assumed to have 512-byte sectors." value-name:"SIZE" choice:"512" choice:"4096"`
+}
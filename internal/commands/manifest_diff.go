@@ -0,0 +1,13 @@
+package commands
+
+// ManifestDiffArgs holds the manifests to compare
+type ManifestDiffArgs struct {
+	OldManifest string `positional-arg-name:"old_manifest" description:"Manifest of the previous build: a filesystem.manifest, snaps.manifest or seed.manifest file, or their JSON version."`
+	NewManifest string `positional-arg-name:"new_manifest" description:"Manifest of the new build, in any of the formats accepted for old_manifest."`
+}
+
+// ManifestDiffOpts holds all flags that are specific to the manifest-diff command
+type ManifestDiffOpts struct {
+	Format   string `long:"format" description:"The format of the report of the changes." value-name:"FORMAT" choice:"text" choice:"markdown" choice:"json" default:"text"`
+	ExitCode bool   `long:"exit-code" description:"Exit with status 1 if the manifests differ, and with status 2 on errors."`
+}
@@ -0,0 +1,12 @@
+package commands
+
+// PlanArgs holds the gadget tree whose image to plan
+type PlanArgs struct {
+	GadgetTree string `positional-arg-name:"gadget_tree" description:"Gadget tree whose meta/gadget.yaml to plan the image of."`
+}
+
+// PlanOpts holds all flags that are specific to the plan command
+type PlanOpts struct {
+	Filesystem        string `long:"filesystem" description:"Estimate the size of the rootfs from the files in this directory, as a build with --filesystem does." value-name:"DIRECTORY"`
+	PartitionManifest string `long:"partition-manifest" description:"Take the size of the rootfs from the system-data partition of a <volume>.partitions.json manifest written by a previous build with --export-partitions." value-name:"FILE"`
+}
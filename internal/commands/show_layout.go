@@ -0,0 +1,11 @@
+package commands
+
+// ShowLayoutArgs holds the gadget tree whose layout to show
+type ShowLayoutArgs struct {
+	GadgetTree string `positional-arg-name:"gadget_tree" description:"Gadget tree whose meta/gadget.yaml to lay out."`
+}
+
+// ShowLayoutOpts holds all flags that are specific to the show-layout command
+type ShowLayoutOpts struct {
+	Format string `long:"format" description:"The format of the layout: a table and an ASCII diagram of each volume, or an SVG diagram." value-name:"FORMAT" choice:"text" choice:"svg" default:"text"`
+}
@@ -0,0 +1,6 @@
+package commands
+
+// ValidateGadgetArgs holds the gadget tree to validate
+type ValidateGadgetArgs struct {
+	GadgetTree string `positional-arg-name:"gadget_tree" description:"Gadget tree whose meta/gadget.yaml to validate. The content referenced by the gadget.yaml is looked up relative to this directory."`
+}
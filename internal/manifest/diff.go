@@ -0,0 +1,160 @@
+package manifest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Change is a package or snap that was added, removed or changed between two manifests
+type Change struct {
+	Name       string `json:"name"`
+	OldVersion string `json:"old-version,omitempty"`
+	NewVersion string `json:"new-version,omitempty"`
+}
+
+// Diff lists the changes between two manifests, sorted by name
+type Diff struct {
+	Added      []Change `json:"added"`
+	Removed    []Change `json:"removed"`
+	Upgraded   []Change `json:"upgraded"`
+	Downgraded []Change `json:"downgraded"`
+}
+
+// Compare returns the changes from the oldVersions to the newVersions manifest. Entries
+// whose version string changed but compares as equal, such as "1.0" and "1.00", are
+// reported as upgraded
+func Compare(oldVersions, newVersions map[string]string) *Diff {
+	diff := &Diff{
+		Added:      []Change{},
+		Removed:    []Change{},
+		Upgraded:   []Change{},
+		Downgraded: []Change{},
+	}
+	for name, oldVersion := range oldVersions {
+		newVersion, found := newVersions[name]
+		switch {
+		case !found:
+			diff.Removed = append(diff.Removed, Change{Name: name, OldVersion: oldVersion})
+		case newVersion == oldVersion:
+			continue
+		case CompareVersions(newVersion, oldVersion) < 0:
+			diff.Downgraded = append(diff.Downgraded, Change{name, oldVersion, newVersion})
+		default:
+			diff.Upgraded = append(diff.Upgraded, Change{name, oldVersion, newVersion})
+		}
+	}
+	for name, newVersion := range newVersions {
+		if _, found := oldVersions[name]; !found {
+			diff.Added = append(diff.Added, Change{Name: name, NewVersion: newVersion})
+		}
+	}
+	for _, changes := range [][]Change{diff.Added, diff.Removed, diff.Upgraded, diff.Downgraded} {
+		sort.Slice(changes, func(i, j int) bool { return changes[i].Name < changes[j].Name })
+	}
+	return diff
+}
+
+// Empty returns whether the manifests are identical
+func (diff *Diff) Empty() bool {
+	return len(diff.Added)+len(diff.Removed)+len(diff.Upgraded)+len(diff.Downgraded) == 0
+}
+
+// diffSection is a kind of change and the changes of that kind
+type diffSection struct {
+	title   string
+	changes []Change
+}
+
+// sections returns the non-empty parts of the diff
+func (diff *Diff) sections() []diffSection {
+	var sections []diffSection
+	for _, section := range []diffSection{
+		{"Added", diff.Added},
+		{"Removed", diff.Removed},
+		{"Upgraded", diff.Upgraded},
+		{"Downgraded", diff.Downgraded},
+	} {
+		if len(section.changes) > 0 {
+			sections = append(sections, section)
+		}
+	}
+	return sections
+}
+
+// Write prints the diff in the given format, which is "text", "markdown" or "json"
+func (diff *Diff) Write(writer io.Writer, format string) error {
+	var err error
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(writer)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(diff)
+	case "markdown":
+		err = diff.writeMarkdown(writer)
+	case "text":
+		err = diff.writeText(writer)
+	default:
+		return fmt.Errorf("unknown format %q", format)
+	}
+	if err != nil {
+		return fmt.Errorf("Error writing manifest diff: %s", err.Error())
+	}
+	return nil
+}
+
+// writeText prints a section per kind of change, with an indented line per change
+func (diff *Diff) writeText(writer io.Writer) error {
+	if diff.Empty() {
+		_, err := fmt.Fprintln(writer, "No changes")
+		return err
+	}
+	for _, section := range diff.sections() {
+		if _, err := fmt.Fprintf(writer, "%s:\n", section.title); err != nil {
+			return err
+		}
+		for _, change := range section.changes {
+			if _, err := fmt.Fprintf(writer, "  %s %s\n", change.Name, change.versions(" -> ")); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeMarkdown prints a heading per kind of change, followed by a list of the changes,
+// suitable for release notes
+func (diff *Diff) writeMarkdown(writer io.Writer) error {
+	if diff.Empty() {
+		_, err := fmt.Fprintln(writer, "No changes.")
+		return err
+	}
+	for i, section := range diff.sections() {
+		separator := ""
+		if i > 0 {
+			separator = "\n"
+		}
+		if _, err := fmt.Fprintf(writer, "%s## %s\n\n", separator, section.title); err != nil {
+			return err
+		}
+		for _, change := range section.changes {
+			if _, err := fmt.Fprintf(writer, "- `%s` %s\n", change.Name, change.versions(" → ")); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// versions returns the old and/or new version of a change, joined with arrow
+func (change Change) versions(arrow string) string {
+	switch {
+	case change.OldVersion == "":
+		return change.NewVersion
+	case change.NewVersion == "":
+		return change.OldVersion
+	default:
+		return change.OldVersion + arrow + change.NewVersion
+	}
+}
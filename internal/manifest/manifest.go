@@ -0,0 +1,163 @@
+// Package manifest reads the package and snap manifests written by ubuntu-image
+// and compares the manifests of two builds
+package manifest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// helper variables for unit testing
+var ioutilReadFile = ioutil.ReadFile
+
+// Read returns the versions of the packages or snaps listed in a manifest, indexed by
+// name. Plain text manifests have a "<name> <version>" line per entry, as in
+// filesystem.manifest, snaps.manifest and seed.manifest. JSON manifests hold a list of
+// entries with a name and a version or revision, as written with --manifest-json.
+// Packages installed for several architectures have the same version and are listed once
+func Read(manifestPath string) (map[string]string, error) {
+	manifestBytes, err := ioutilReadFile(manifestPath)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading manifest: %s", err.Error())
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(manifestBytes), []byte("{")) {
+		return readJSON(manifestPath, manifestBytes)
+	}
+
+	versions := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(manifestBytes))
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("Error parsing manifest %s: invalid line %d: %q",
+				manifestPath, lineNumber, scanner.Text())
+		}
+		// dpkg-query manifests name packages <name>:<arch> for foreign architectures
+		versions[strings.SplitN(fields[0], ":", 2)[0]] = fields[1]
+	}
+	return versions, scanner.Err()
+}
+
+// readJSON returns the versions of the entries of a JSON manifest, which is an object
+// holding a single list of packages or snaps
+func readJSON(manifestPath string, manifestBytes []byte) (map[string]string, error) {
+	var manifest map[string][]struct {
+		Name     string `json:"name"`
+		Version  string `json:"version"`
+		Revision string `json:"revision"`
+	}
+	if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
+		return nil, fmt.Errorf("Error parsing manifest %s: %s", manifestPath, err.Error())
+	}
+	if len(manifest) != 1 {
+		return nil, fmt.Errorf("Error parsing manifest %s: expected a single list of entries, found %d",
+			manifestPath, len(manifest))
+	}
+
+	versions := make(map[string]string)
+	for _, entries := range manifest {
+		for _, entry := range entries {
+			version := entry.Version
+			if version == "" {
+				version = entry.Revision
+			}
+			if entry.Name == "" || version == "" {
+				return nil, fmt.Errorf("Error parsing manifest %s: entry without a name or version",
+					manifestPath)
+			}
+			versions[entry.Name] = version
+		}
+	}
+	return versions, nil
+}
+
+// CompareVersions compares two Debian package versions, or two snap revisions, as
+// dpkg does. The result is negative if a is older than b, 0 if they are equal and
+// positive if a is newer than b
+func CompareVersions(a, b string) int {
+	epochA, upstreamA, revisionA := splitVersion(a)
+	epochB, upstreamB, revisionB := splitVersion(b)
+	if result := compareVersionPart(epochA, epochB); result != 0 {
+		return result
+	}
+	if result := compareVersionPart(upstreamA, upstreamB); result != 0 {
+		return result
+	}
+	return compareVersionPart(revisionA, revisionB)
+}
+
+// splitVersion splits a version into its [epoch:]upstream[-revision] components
+func splitVersion(version string) (epoch, upstream, revision string) {
+	epoch = "0"
+	if colon := strings.Index(version, ":"); colon >= 0 {
+		epoch, version = version[:colon], version[colon+1:]
+	}
+	upstream = version
+	if dash := strings.LastIndex(version, "-"); dash >= 0 {
+		upstream, revision = version[:dash], version[dash+1:]
+	}
+	return epoch, upstream, revision
+}
+
+// compareVersionPart compares a component of two versions made of alternating
+// non-digit and digit strings. Non-digit strings are compared by character, where
+// letters sort before other characters and "~" sorts before anything, even the end of
+// the string. Digit strings are compared numerically
+func compareVersionPart(a, b string) int {
+	for a != "" || b != "" {
+		var nonDigitA, nonDigitB string
+		nonDigitA, a = splitLeading(a, false)
+		nonDigitB, b = splitLeading(b, false)
+		for i := 0; i < len(nonDigitA) || i < len(nonDigitB); i++ {
+			if result := versionCharOrder(nonDigitA, i) - versionCharOrder(nonDigitB, i); result != 0 {
+				return result
+			}
+		}
+
+		var digitsA, digitsB string
+		digitsA, a = splitLeading(a, true)
+		digitsB, b = splitLeading(b, true)
+		digitsA = strings.TrimLeft(digitsA, "0")
+		digitsB = strings.TrimLeft(digitsB, "0")
+		if len(digitsA) != len(digitsB) {
+			return len(digitsA) - len(digitsB)
+		}
+		if result := strings.Compare(digitsA, digitsB); result != 0 {
+			return result
+		}
+	}
+	return 0
+}
+
+// splitLeading splits the leading digits, or non-digits, from the rest of a string
+func splitLeading(s string, digits bool) (string, string) {
+	i := 0
+	for i < len(s) && (s[i] >= '0' && s[i] <= '9') == digits {
+		i++
+	}
+	return s[:i], s[i:]
+}
+
+// versionCharOrder returns the weight of the character at index i of s when comparing
+// versions. The end of the string weighs 0
+func versionCharOrder(s string, i int) int {
+	if i >= len(s) {
+		return 0
+	}
+	c := s[i]
+	switch {
+	case c == '~':
+		return -1
+	case (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z'):
+		return int(c)
+	default:
+		return int(c) + 256
+	}
+}
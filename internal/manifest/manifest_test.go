@@ -0,0 +1,177 @@
+package manifest
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+)
+
+// TestRead ensures that plain text and JSON manifests are read
+func TestRead(t *testing.T) {
+	testCases := []struct {
+		name     string
+		manifest string
+		expected map[string]string
+	}{
+		{"text", "old.manifest", map[string]string{
+			"bash":     "5.1-6ubuntu1",
+			"libc6":    "2.35-0ubuntu3",
+			"nano":     "6.2-1",
+			"vim-tiny": "2:8.2.3995-1ubuntu2",
+		}},
+		{"json_packages", "new.manifest.json", map[string]string{
+			"bash":     "5.1-6ubuntu1.1",
+			"curl":     "7.81.0-1",
+			"libc6":    "2.35-0ubuntu3",
+			"vim-tiny": "2:8.2.3995-1ubuntu1",
+		}},
+		{"json_snaps", "seed.manifest.json", map[string]string{
+			"core20": "1234",
+			"hello":  "x1",
+		}},
+	}
+	for _, tc := range testCases {
+		t.Run("test_read_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			versions, err := Read(filepath.Join("testdata", tc.manifest))
+			asserter.AssertErrNil(err, true)
+			if !reflect.DeepEqual(versions, tc.expected) {
+				t.Errorf("Expected %v, got %v", tc.expected, versions)
+			}
+		})
+	}
+}
+
+// TestFailedRead tests failures when reading manifests
+func TestFailedRead(t *testing.T) {
+	t.Run("test_failed_read", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+
+		// mock ioutil.ReadFile
+		ioutilReadFile = func(string) ([]byte, error) {
+			return nil, errors.New("Test error")
+		}
+		defer func() {
+			ioutilReadFile = ioutil.ReadFile
+		}()
+		_, err := Read(filepath.Join("testdata", "old.manifest"))
+		asserter.AssertErrContains(err, "Error reading manifest")
+		ioutilReadFile = ioutil.ReadFile
+
+		_, err = Read(filepath.Join("testdata", "invalid.manifest"))
+		asserter.AssertErrContains(err, "invalid line 1")
+
+		_, err = Read(filepath.Join("testdata", "invalid.manifest.json"))
+		asserter.AssertErrContains(err, "entry without a name or version")
+	})
+}
+
+// TestCompareVersions ensures that versions are ordered as dpkg does
+func TestCompareVersions(t *testing.T) {
+	testCases := []struct {
+		a, b     string
+		expected int
+	}{
+		{"1.0", "1.0", 0},
+		{"1.0", "1.00", 0},
+		{"1.0", "1.1", -1},
+		{"1.10", "1.9", 1},
+		{"1.0~rc1", "1.0", -1},
+		{"1.0", "1.0+b1", -1},
+		{"1.0a", "1.0+", -1},
+		{"1:1.0", "2.0", 1},
+		{"5.1-6ubuntu1", "5.1-6ubuntu1.1", -1},
+		{"2:8.2.3995-1ubuntu2", "2:8.2.3995-1ubuntu1", 1},
+		{"130", "99", 1},
+		{"x1", "x2", -1},
+	}
+	for _, tc := range testCases {
+		t.Run("test_compare_versions_"+tc.a+"_"+tc.b, func(t *testing.T) {
+			result := CompareVersions(tc.a, tc.b)
+			if (result < 0 && tc.expected >= 0) || (result > 0 && tc.expected <= 0) ||
+				(result == 0 && tc.expected != 0) {
+				t.Errorf("Expected %s compared to %s to be %d, got %d", tc.a, tc.b, tc.expected, result)
+			}
+		})
+	}
+}
+
+// TestDiff ensures that the changes between two manifests are reported in every format
+func TestDiff(t *testing.T) {
+	testCases := []struct {
+		name        string
+		newManifest string
+		format      string
+		expected    string
+	}{
+		{"text", "new.manifest", "text", `Added:
+  curl 7.81.0-1
+Removed:
+  nano 6.2-1
+Upgraded:
+  bash 5.1-6ubuntu1 -> 5.1-6ubuntu1.1
+Downgraded:
+  vim-tiny 2:8.2.3995-1ubuntu2 -> 2:8.2.3995-1ubuntu1
+`},
+		{"markdown", "new.manifest.json", "markdown", "## Added\n\n- `curl` 7.81.0-1\n\n" +
+			"## Removed\n\n- `nano` 6.2-1\n\n" +
+			"## Upgraded\n\n- `bash` 5.1-6ubuntu1 → 5.1-6ubuntu1.1\n\n" +
+			"## Downgraded\n\n- `vim-tiny` 2:8.2.3995-1ubuntu2 → 2:8.2.3995-1ubuntu1\n"},
+		{"json", "new.manifest", "json", `{
+  "added": [
+    {
+      "name": "curl",
+      "new-version": "7.81.0-1"
+    }
+  ],
+  "removed": [
+    {
+      "name": "nano",
+      "old-version": "6.2-1"
+    }
+  ],
+  "upgraded": [
+    {
+      "name": "bash",
+      "old-version": "5.1-6ubuntu1",
+      "new-version": "5.1-6ubuntu1.1"
+    }
+  ],
+  "downgraded": [
+    {
+      "name": "vim-tiny",
+      "old-version": "2:8.2.3995-1ubuntu2",
+      "new-version": "2:8.2.3995-1ubuntu1"
+    }
+  ]
+}
+`},
+		{"no_changes_text", "old.manifest", "text", "No changes\n"},
+		{"no_changes_markdown", "old.manifest", "markdown", "No changes.\n"},
+	}
+	for _, tc := range testCases {
+		t.Run("test_diff_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			oldVersions, err := Read(filepath.Join("testdata", "old.manifest"))
+			asserter.AssertErrNil(err, true)
+			newVersions, err := Read(filepath.Join("testdata", tc.newManifest))
+			asserter.AssertErrNil(err, true)
+
+			diff := Compare(oldVersions, newVersions)
+			var output bytes.Buffer
+			err = diff.Write(&output, tc.format)
+			asserter.AssertErrNil(err, true)
+			if output.String() != tc.expected {
+				t.Errorf("Expected diff:\n%s\ngot:\n%s", tc.expected, output.String())
+			}
+			if diff.Empty() != (tc.newManifest == "old.manifest") {
+				t.Errorf("Unexpected Empty() result %t", diff.Empty())
+			}
+		})
+	}
+}
@@ -0,0 +1,172 @@
+package statemachine
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"go.mozilla.org/pkcs7"
+)
+
+// writeChecksums writes SHA256SUMS, and SHA512SUMS if requested, for the staged artifacts
+// so that the checksums are calculated from the files before they are published. If a
+// signing key was given, a detached signature of each checksum file is created as well
+func (stateMachine *StateMachine) writeChecksums() error {
+	if !stateMachine.commonFlags.Checksums && !stateMachine.commonFlags.SHA512Sums &&
+		stateMachine.commonFlags.SignKey == "" {
+		return nil
+	}
+	if err := stateMachine.setupOutputDir(); err != nil {
+		return err
+	}
+
+	var sha256Sums, sha512Sums string
+	for _, artifact := range stateMachine.Artifacts {
+		switch artifact.Type {
+		case "checksums", "pgp-signature", "pkcs7-signature":
+			continue
+		}
+		artifactPath := filepath.Join(stateMachine.tempDirs.staging, artifact.Name)
+		artifactFile, err := os.Open(artifactPath)
+		if err != nil {
+			return fmt.Errorf("Error calculating checksum of %s: %s", artifact.Name, err.Error())
+		}
+		sha256Hash := sha256.New()
+		sha512Hash := sha512.New()
+		_, err = io.Copy(io.MultiWriter(sha256Hash, sha512Hash), artifactFile)
+		artifactFile.Close()
+		if err != nil {
+			return fmt.Errorf("Error calculating checksum of %s: %s", artifact.Name, err.Error())
+		}
+		sha256Sums += fmt.Sprintf("%s *%s\n", hex.EncodeToString(sha256Hash.Sum(nil)), artifact.Name)
+		sha512Sums += fmt.Sprintf("%s *%s\n", hex.EncodeToString(sha512Hash.Sum(nil)), artifact.Name)
+	}
+
+	checksumFiles := map[string]string{
+		stateMachine.outputName("", "SHA256SUMS", ".SHA256SUMS"): sha256Sums,
+	}
+	if stateMachine.commonFlags.SHA512Sums {
+		checksumFiles[stateMachine.outputName("", "SHA512SUMS", ".SHA512SUMS")] = sha512Sums
+	}
+	var checksumNames []string
+	for checksumName := range checksumFiles {
+		checksumNames = append(checksumNames, checksumName)
+	}
+	sort.Strings(checksumNames)
+
+	for _, checksumName := range checksumNames {
+		checksumPath := filepath.Join(stateMachine.tempDirs.staging, checksumName)
+		checksums := []byte(checksumFiles[checksumName])
+		if err := ioutilWriteFile(checksumPath, checksums, 0644); err != nil {
+			return fmt.Errorf("Error writing %s: %s", checksumName, err.Error())
+		}
+		stateMachine.recordArtifact(checksumName, "", "checksums")
+
+		if stateMachine.commonFlags.SignKey == "" {
+			continue
+		}
+		signature, signatureType, err := signDetached(stateMachine.commonFlags.SignKey, checksums)
+		if err != nil {
+			return fmt.Errorf("Error signing %s: %s", checksumName, err.Error())
+		}
+		signatureName := checksumName + ".gpg"
+		if signatureType == "pkcs7-signature" {
+			signatureName = checksumName + ".p7s"
+		}
+		err = ioutilWriteFile(filepath.Join(stateMachine.tempDirs.staging, signatureName),
+			signature, 0644)
+		if err != nil {
+			return fmt.Errorf("Error writing %s: %s", signatureName, err.Error())
+		}
+		stateMachine.recordArtifact(signatureName, "", signatureType)
+	}
+	return nil
+}
+
+// signDetached creates a detached signature of data. PEM files containing an x509
+// certificate produce a DER encoded PKCS#7 signature, any other file is read as an
+// armored or binary OpenPGP secret key and produces a binary OpenPGP signature
+func signDetached(keyFile string, data []byte) ([]byte, string, error) {
+	keyBytes, err := ioutilReadFile(keyFile)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var certificate *x509.Certificate
+	var privateKey crypto.PrivateKey
+	rest := keyBytes
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		switch block.Type {
+		case "CERTIFICATE":
+			if certificate == nil {
+				if certificate, err = x509.ParseCertificate(block.Bytes); err != nil {
+					return nil, "", fmt.Errorf("invalid certificate: %s", err.Error())
+				}
+			}
+		case "PRIVATE KEY":
+			privateKey, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		case "RSA PRIVATE KEY":
+			privateKey, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		case "EC PRIVATE KEY":
+			privateKey, err = x509.ParseECPrivateKey(block.Bytes)
+		}
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid private key: %s", err.Error())
+		}
+	}
+	if certificate != nil {
+		if privateKey == nil {
+			return nil, "", fmt.Errorf("no private key found for the certificate in %s", keyFile)
+		}
+		signedData, err := pkcs7.NewSignedData(data)
+		if err != nil {
+			return nil, "", err
+		}
+		signedData.SetDigestAlgorithm(pkcs7.OIDDigestAlgorithmSHA256)
+		if err := signedData.AddSigner(certificate, privateKey, pkcs7.SignerInfoConfig{}); err != nil {
+			return nil, "", err
+		}
+		signedData.Detach()
+		signature, err := signedData.Finish()
+		return signature, "pkcs7-signature", err
+	}
+
+	keyRing, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(keyBytes))
+	if err != nil {
+		keyRing, err = openpgp.ReadKeyRing(bytes.NewReader(keyBytes))
+		if err != nil {
+			return nil, "", fmt.Errorf("%s is neither an OpenPGP key nor an x509 certificate",
+				keyFile)
+		}
+	}
+	for _, entity := range keyRing {
+		if entity.PrivateKey == nil {
+			continue
+		}
+		if entity.PrivateKey.Encrypted {
+			return nil, "", fmt.Errorf("the OpenPGP key in %s is protected by a passphrase",
+				keyFile)
+		}
+		var signature bytes.Buffer
+		err := openpgp.DetachSign(&signature, entity, bytes.NewReader(data),
+			&packet.Config{DefaultHash: crypto.SHA256})
+		return signature.Bytes(), "pgp-signature", err
+	}
+	return nil, "", fmt.Errorf("no OpenPGP secret key found in %s", keyFile)
+}
@@ -0,0 +1,238 @@
+// This file contains unit tests for the checksum files and their signatures
+package statemachine
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/canonical/ubuntu-image/internal/helper"
+	"go.mozilla.org/pkcs7"
+)
+
+// generateOpenPGPKey writes an armored OpenPGP secret key to key.asc in dir
+func generateOpenPGPKey(t *testing.T, dir string) *openpgp.Entity {
+	asserter := helper.Asserter{T: t}
+	entity, err := openpgp.NewEntity("ubuntu-image", "", "test@example.com",
+		&packet.Config{RSABits: 1024})
+	asserter.AssertErrNil(err, true)
+	keyFile, err := os.Create(filepath.Join(dir, "key.asc"))
+	asserter.AssertErrNil(err, true)
+	defer keyFile.Close()
+	armorWriter, err := armor.Encode(keyFile, openpgp.PrivateKeyType, nil)
+	asserter.AssertErrNil(err, true)
+	err = entity.SerializePrivate(armorWriter, nil)
+	asserter.AssertErrNil(err, true)
+	armorWriter.Close()
+	return entity
+}
+
+// generateX509Key writes a self-signed certificate and its private key to key.pem in dir
+func generateX509Key(t *testing.T, dir string) *x509.Certificate {
+	asserter := helper.Asserter{T: t}
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	asserter.AssertErrNil(err, true)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "ubuntu-image"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	certBytes, err := x509.CreateCertificate(rand.Reader, template, template,
+		&privateKey.PublicKey, privateKey)
+	asserter.AssertErrNil(err, true)
+	certificate, err := x509.ParseCertificate(certBytes)
+	asserter.AssertErrNil(err, true)
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	asserter.AssertErrNil(err, true)
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certBytes})
+	pemBytes = append(pemBytes, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes})...)
+	err = ioutil.WriteFile(filepath.Join(dir, "key.pem"), pemBytes, 0600)
+	asserter.AssertErrNil(err, true)
+	return certificate
+}
+
+// TestWriteChecksums ensures that checksum files and their detached signatures are
+// created for the staged artifacts
+func TestWriteChecksums(t *testing.T) {
+	testCases := []struct {
+		name          string
+		keyType       string
+		signatureName string
+	}{
+		{"checksums_only", "", ""},
+		{"openpgp_signature", "openpgp", "SHA256SUMS.gpg"},
+		{"pkcs7_signature", "x509", "SHA256SUMS.p7s"},
+	}
+	for _, tc := range testCases {
+		t.Run("test_write_checksums_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			var stateMachine StateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+
+			err := stateMachine.makeTemporaryDirectories()
+			asserter.AssertErrNil(err, true)
+			defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+			stateMachine.commonFlags.Checksums = true
+			stateMachine.commonFlags.SHA512Sums = true
+
+			err = stateMachine.setupOutputDir()
+			asserter.AssertErrNil(err, true)
+			err = ioutil.WriteFile(filepath.Join(stateMachine.tempDirs.staging, "pc.img"),
+				[]byte("mbr"), 0644)
+			asserter.AssertErrNil(err, true)
+			stateMachine.recordArtifact("pc.img", "pc", "disk-image")
+
+			var entity *openpgp.Entity
+			var certificate *x509.Certificate
+			switch tc.keyType {
+			case "openpgp":
+				entity = generateOpenPGPKey(t, stateMachine.stateMachineFlags.WorkDir)
+				stateMachine.commonFlags.SignKey = filepath.Join(stateMachine.stateMachineFlags.WorkDir, "key.asc")
+			case "x509":
+				certificate = generateX509Key(t, stateMachine.stateMachineFlags.WorkDir)
+				stateMachine.commonFlags.SignKey = filepath.Join(stateMachine.stateMachineFlags.WorkDir, "key.pem")
+			}
+
+			err = stateMachine.writeChecksums()
+			asserter.AssertErrNil(err, true)
+
+			sha256Sums, err := ioutil.ReadFile(filepath.Join(stateMachine.tempDirs.staging, "SHA256SUMS"))
+			asserter.AssertErrNil(err, true)
+			expected := "f5662649c772d7d7c017ebf21784239b8a28836551f1d507dbb9f015240290ed *pc.img\n"
+			if string(sha256Sums) != expected {
+				t.Errorf("Expected SHA256SUMS \"%s\", got \"%s\"", expected, string(sha256Sums))
+			}
+			sha512Sums, err := ioutil.ReadFile(filepath.Join(stateMachine.tempDirs.staging, "SHA512SUMS"))
+			asserter.AssertErrNil(err, true)
+			if !strings.HasSuffix(string(sha512Sums), " *pc.img\n") || len(sha512Sums) != 128+9 {
+				t.Errorf("Unexpected SHA512SUMS \"%s\"", string(sha512Sums))
+			}
+
+			switch tc.keyType {
+			case "openpgp":
+				signature, err := os.Open(filepath.Join(stateMachine.tempDirs.staging, tc.signatureName))
+				asserter.AssertErrNil(err, true)
+				defer signature.Close()
+				_, err = openpgp.CheckDetachedSignature(openpgp.EntityList{entity},
+					bytes.NewReader(sha256Sums), signature, nil)
+				asserter.AssertErrNil(err, true)
+			case "x509":
+				signature, err := ioutil.ReadFile(filepath.Join(stateMachine.tempDirs.staging, tc.signatureName))
+				asserter.AssertErrNil(err, true)
+				p7, err := pkcs7.Parse(signature)
+				asserter.AssertErrNil(err, true)
+				p7.Content = sha256Sums
+				err = p7.Verify()
+				asserter.AssertErrNil(err, true)
+				if !p7.GetOnlySigner().Equal(certificate) {
+					t.Errorf("Expected the signature to be made with the given certificate")
+				}
+			}
+
+			// the checksum files are listed as artifacts but are not checksummed themselves
+			expectedArtifacts := 3
+			if tc.signatureName != "" {
+				expectedArtifacts = 5
+			}
+			if len(stateMachine.Artifacts) != expectedArtifacts {
+				t.Errorf("Expected %d artifacts, got %v", expectedArtifacts, stateMachine.Artifacts)
+			}
+			err = stateMachine.writeChecksums()
+			asserter.AssertErrNil(err, true)
+			sha256SumsAgain, err := ioutil.ReadFile(filepath.Join(stateMachine.tempDirs.staging, "SHA256SUMS"))
+			asserter.AssertErrNil(err, true)
+			if !bytes.Equal(sha256Sums, sha256SumsAgain) {
+				t.Errorf("Expected SHA256SUMS to only list pc.img, got \"%s\"", string(sha256SumsAgain))
+			}
+		})
+	}
+}
+
+// TestFailedWriteChecksums tests failures when writing and signing the checksum files
+func TestFailedWriteChecksums(t *testing.T) {
+	t.Run("test_failed_write_checksums", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine StateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+
+		err := stateMachine.makeTemporaryDirectories()
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+		stateMachine.commonFlags.Checksums = true
+
+		// the key has to exist
+		stateMachine.commonFlags.SignKey = "/does/not/exist.asc"
+		err = stateMachine.validateInput()
+		asserter.AssertErrContains(err, "could not read --sign-key")
+		stateMachine.commonFlags.SignKey = ""
+
+		// artifacts that were not staged can't be checksummed
+		stateMachine.recordArtifact("pc.img", "pc", "disk-image")
+		err = stateMachine.writeChecksums()
+		asserter.AssertErrContains(err, "Error calculating checksum of pc.img")
+		err = ioutil.WriteFile(filepath.Join(stateMachine.tempDirs.staging, "pc.img"),
+			[]byte("mbr"), 0644)
+		asserter.AssertErrNil(err, true)
+
+		// mock ioutil.WriteFile
+		ioutilWriteFile = mockWriteFile
+		defer func() {
+			ioutilWriteFile = ioutil.WriteFile
+		}()
+		err = stateMachine.writeChecksums()
+		asserter.AssertErrContains(err, "Error writing SHA256SUMS")
+		ioutilWriteFile = ioutil.WriteFile
+
+		// a key file that is neither OpenPGP nor x509
+		keyFile := filepath.Join(stateMachine.stateMachineFlags.WorkDir, "key")
+		err = ioutil.WriteFile(keyFile, []byte("not a key"), 0600)
+		asserter.AssertErrNil(err, true)
+		stateMachine.commonFlags.SignKey = keyFile
+		err = stateMachine.writeChecksums()
+		asserter.AssertErrContains(err, "is neither an OpenPGP key nor an x509 certificate")
+
+		// a certificate without its private key
+		generateX509Key(t, stateMachine.stateMachineFlags.WorkDir)
+		pemBytes, err := ioutil.ReadFile(filepath.Join(stateMachine.stateMachineFlags.WorkDir, "key.pem"))
+		asserter.AssertErrNil(err, true)
+		certBlock, _ := pem.Decode(pemBytes)
+		err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(certBlock), 0600)
+		asserter.AssertErrNil(err, true)
+		err = stateMachine.writeChecksums()
+		asserter.AssertErrContains(err, "no private key found for the certificate")
+
+		// an OpenPGP public key can't sign
+		entity := generateOpenPGPKey(t, stateMachine.stateMachineFlags.WorkDir)
+		publicKey, err := os.Create(keyFile)
+		asserter.AssertErrNil(err, true)
+		err = entity.Serialize(publicKey)
+		asserter.AssertErrNil(err, true)
+		publicKey.Close()
+		err = stateMachine.writeChecksums()
+		asserter.AssertErrContains(err, "no OpenPGP secret key found")
+
+		// mock ioutil.ReadFile
+		ioutilReadFile = mockReadFile
+		defer func() {
+			ioutilReadFile = ioutil.ReadFile
+		}()
+		err = stateMachine.writeChecksums()
+		asserter.AssertErrContains(err, "Error signing SHA256SUMS")
+		ioutilReadFile = ioutil.ReadFile
+	})
+}
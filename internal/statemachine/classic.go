@@ -18,8 +18,14 @@ var classicStates = []stateFunc{
 	{"calculate_rootfs_size", (*StateMachine).calculateRootfsSize},
 	{"populate_bootfs_contents", (*StateMachine).populateBootfsContents},
 	{"populate_prepare_partitions", (*StateMachine).populatePreparePartitions},
+	{"generate_rootfs_artifacts", (*StateMachine).generateRootfsArtifacts},
 	{"make_disk", (*StateMachine).makeDisk},
+	{"verify_image", (*StateMachine).verifyImage},
+	{"package_cloud_image", (*StateMachine).packageCloudImage},
+	{"make_live_iso", (*StateMachine).makeLiveISO},
+	{"export_partitions", (*StateMachine).exportPartitions},
 	{"generate_manifest", (*StateMachine).generatePackageManifest},
+	{"generate_sbom", (*StateMachine).generateSBOM},
 	{"finish", (*StateMachine).finish},
 }
 
@@ -4,12 +4,31 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/canonical/ubuntu-image/internal/helper"
+	"github.com/snapcore/snapd/gadget"
 	"github.com/snapcore/snapd/osutil"
 )
 
+// liveGrubConfig is the grub configuration used to boot the rootfs of live ISOs with casper
+const liveGrubConfig = `set timeout=5
+
+menuentry "Try or Install Ubuntu" {
+	set gfxpayload=keep
+	linux	/casper/vmlinuz boot=casper quiet splash ---
+	initrd	/casper/initrd
+}
+`
+
+// liveEFIGrubConfig is installed in the EFI boot image of live ISOs. It locates the
+// ISO filesystem and loads the main grub configuration from there
+const liveEFIGrubConfig = `search --set=root --file /.disk/info
+set prefix=($root)/boot/grub
+configfile $prefix/grub.cfg
+`
+
 // Prepare the gadget tree
 func (stateMachine *StateMachine) prepareGadgetTree() error {
 	var classicStateMachine *ClassicStateMachine
@@ -159,19 +178,169 @@ func (stateMachine *StateMachine) populateClassicRootfsContents() error {
 	return nil
 }
 
-// Generate the manifest
+// makeLiveISO packages the rootfs as a squashfs in a hybrid ISO 9660 image. The ISO
+// boots from EFI through the shim and grub shipped in the gadget, and from BIOS through
+// an El Torito grub image on architectures that support it
+func (stateMachine *StateMachine) makeLiveISO() error {
+	var classicStateMachine *ClassicStateMachine
+	classicStateMachine = stateMachine.parent.(*ClassicStateMachine)
+	if !classicStateMachine.Opts.LiveISO {
+		return nil
+	}
+	if err := stateMachine.setupOutputDir(); err != nil {
+		return err
+	}
+
+	// the EFI content comes from the first system-boot structure in the order of the
+	// gadget.yaml, populated by populate_bootfs_contents
+	var systemVolumeName, efiSrc string
+	for _, volumeName := range stateMachine.VolumeOrder {
+		volume := stateMachine.GadgetInfo.Volumes[volumeName]
+		for structureNumber, structure := range volume.Structure {
+			if efiSrc == "" &&
+				(structure.Role == gadget.SystemBoot || structure.Label == gadget.SystemBoot) {
+				systemVolumeName = volumeName
+				efiSrc = filepath.Join(stateMachine.tempDirs.volumes, volumeName,
+					"part"+strconv.Itoa(structureNumber), "EFI")
+			}
+		}
+	}
+	if _, err := os.Stat(efiSrc); efiSrc == "" || err != nil {
+		return fmt.Errorf("Error creating live ISO: no EFI content found in the system-boot structure")
+	}
+
+	isoRoot := filepath.Join(stateMachine.stateMachineFlags.WorkDir, "iso")
+	casperDir := filepath.Join(isoRoot, "casper")
+	grubDir := filepath.Join(isoRoot, "boot", "grub")
+	efiDir := filepath.Join(stateMachine.stateMachineFlags.WorkDir, "efi")
+	for _, dir := range []string{casperDir, grubDir, filepath.Join(isoRoot, ".disk"),
+		filepath.Join(efiDir, "EFI", "ubuntu")} {
+		if err := osMkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("Error creating live ISO directory: %s", err.Error())
+		}
+	}
+
+	// casper boots the rootfs from a squashfs with the kernel and initrd installed in it
+	if err := stateMachine.clampTimestamps(stateMachine.tempDirs.rootfs); err != nil {
+		return err
+	}
+	if err := createSquashfs(stateMachine.tempDirs.rootfs,
+		filepath.Join(casperDir, "filesystem.squashfs")); err != nil {
+		return fmt.Errorf("Error creating live ISO squashfs: %s", err.Error())
+	}
+	bootFiles := map[string]string{"vmlinuz": "vmlinuz", "initrd.img": "initrd"}
+	for src, dst := range bootFiles {
+		srcPath := resolveRootfsPath(stateMachine.tempDirs.rootfs, filepath.Join("boot", src))
+		if err := osutilCopyFile(srcPath, filepath.Join(casperDir, dst),
+			osutil.CopyFlagOverwrite); err != nil {
+			return fmt.Errorf("Error copying %s to the live ISO: %s", src, err.Error())
+		}
+	}
+
+	// grub finds the ISO filesystem by looking for .disk/info
+	diskInfo := []byte("Ubuntu live image")
+	if classicStateMachine.commonFlags.DiskInfo != "" {
+		var err error
+		if diskInfo, err = ioutilReadFile(classicStateMachine.commonFlags.DiskInfo); err != nil {
+			return fmt.Errorf("Error reading disk info file: %s", err.Error())
+		}
+	}
+	if err := ioutilWriteFile(filepath.Join(isoRoot, ".disk", "info"), diskInfo, 0644); err != nil {
+		return fmt.Errorf("Error writing live ISO disk info: %s", err.Error())
+	}
+	if err := ioutilWriteFile(filepath.Join(grubDir, "grub.cfg"), []byte(liveGrubConfig), 0644); err != nil {
+		return fmt.Errorf("Error writing live ISO grub configuration: %s", err.Error())
+	}
+
+	// the EFI boot image contains the gadget's shim and grub, with a grub.cfg that
+	// chainloads the configuration from the ISO filesystem
+	if err := osutilCopySpecialFile(efiSrc, efiDir); err != nil {
+		return fmt.Errorf("Error copying EFI content: %s", err.Error())
+	}
+	if err := ioutilWriteFile(filepath.Join(efiDir, "EFI", "ubuntu", "grub.cfg"),
+		[]byte(liveEFIGrubConfig), 0644); err != nil {
+		return fmt.Errorf("Error writing live ISO grub configuration: %s", err.Error())
+	}
+	efiImg := filepath.Join(grubDir, "efi.img")
+	if err := stateMachine.makeEFIImage(efiDir, efiImg); err != nil {
+		return err
+	}
+
+	isoName := stateMachine.outputName(systemVolumeName, systemVolumeName+".iso", ".iso")
+	xorrisoArgs := []string{"-as", "mkisofs", "-r", "-J", "-joliet-long", "-iso-level", "3",
+		"-V", "Ubuntu live", "-o", filepath.Join(stateMachine.tempDirs.staging, isoName)}
+
+	// BIOS boot is only possible on x86
+	arch := classicStateMachine.Opts.Arch
+	if arch == "" {
+		arch = getHostArch()
+	}
+	if arch == "amd64" || arch == "i386" {
+		eltoritoImg := filepath.Join(grubDir, "i386-pc", "eltorito.img")
+		if err := osMkdirAll(filepath.Dir(eltoritoImg), 0755); err != nil {
+			return fmt.Errorf("Error creating live ISO directory: %s", err.Error())
+		}
+		grubMkimageCommand := execCommand("grub-mkimage", "-O", "i386-pc-eltorito",
+			"-d", grubI386PCDir, "-p", "/boot/grub", "-o", eltoritoImg,
+			"biosdisk", "iso9660", "part_msdos", "part_gpt", "linux", "normal",
+			"configfile", "search", "search_fs_file")
+		if output, err := grubMkimageCommand.CombinedOutput(); err != nil {
+			return fmt.Errorf("Error running command \"%s\": %s. Output: %s",
+				grubMkimageCommand.String(), err.Error(), string(output))
+		}
+		xorrisoArgs = append(xorrisoArgs, "-b", "boot/grub/i386-pc/eltorito.img",
+			"-no-emul-boot", "-boot-load-size", "4", "-boot-info-table", "--grub2-boot-info",
+			"--grub2-mbr", filepath.Join(grubI386PCDir, "boot_hybrid.img"),
+			"-eltorito-alt-boot")
+	}
+	xorrisoArgs = append(xorrisoArgs, "-e", "boot/grub/efi.img", "-no-emul-boot",
+		"-isohybrid-gpt-basdat", isoRoot)
+	xorrisoCommand := execCommand("xorriso", xorrisoArgs...)
+	if output, err := xorrisoCommand.CombinedOutput(); err != nil {
+		return fmt.Errorf("Error running command \"%s\": %s. Output: %s",
+			xorrisoCommand.String(), err.Error(), string(output))
+	}
+	stateMachine.recordArtifact(isoName, systemVolumeName, "live-iso")
+	return nil
+}
+
+// Generate the manifest from the dpkg database of the rootfs
 func (stateMachine *StateMachine) generatePackageManifest() error {
-	// This is basically just a wrapper around dpkg-query
+	if err := stateMachine.setupOutputDir(); err != nil {
+		return err
+	}
+
+	packages, err := readDpkgStatus(stateMachine.tempDirs.rootfs)
+	if err != nil {
+		return err
+	}
+	var notInstalled []string
+	for _, dpkgPkg := range packages {
+		if dpkgPkg.Status != "installed" {
+			notInstalled = append(notInstalled, dpkgPkg.Name+" ("+dpkgPkg.Status+")")
+		}
+	}
+	if len(notInstalled) > 0 {
+		fmt.Printf("WARNING: the following packages are not fully installed in the rootfs: %s\n",
+			strings.Join(notInstalled, ", "))
+	}
 
-	outputPath := filepath.Join(stateMachine.commonFlags.OutputDir, "filesystem.manifest")
-	cmd := execCommand("sudo", "chroot", stateMachine.tempDirs.rootfs, "dpkg-query", "-W", "--showformat=${Package} ${Version}\n")
-	manifest, err := os.Create(outputPath)
+	manifestName := stateMachine.outputName("", "filesystem.manifest", ".filesystem.manifest")
+	manifest, err := osCreate(filepath.Join(stateMachine.tempDirs.staging, manifestName))
 	if err != nil {
 		return fmt.Errorf("Error creating manifest file: %s", err.Error())
 	}
 	defer manifest.Close()
+	for _, dpkgPkg := range packages {
+		if _, err := fmt.Fprintf(manifest, "%s %s\n", dpkgPkg.Name, dpkgPkg.Version); err != nil {
+			return fmt.Errorf("Error writing manifest file: %s", err.Error())
+		}
+	}
+	stateMachine.recordArtifact(manifestName, "", "manifest")
 
-	cmd.Stdout = manifest
-	err = cmd.Run()
-	return err
+	if stateMachine.commonFlags.ManifestJSON {
+		manifestName = stateMachine.outputName("", "filesystem.manifest.json", ".filesystem.manifest.json")
+		return stateMachine.writeManifestJSON(manifestName, "packages", packages)
+	}
+	return nil
 }
@@ -3,6 +3,7 @@
 package statemachine
 
 import (
+	"encoding/json"
 	"io/ioutil"
 	"os"
 	"os/exec"
@@ -11,7 +12,9 @@ import (
 	"testing"
 
 	"github.com/canonical/ubuntu-image/internal/helper"
+	"github.com/snapcore/snapd/gadget/quantity"
 	"github.com/snapcore/snapd/osutil"
+	"github.com/snapcore/snapd/osutil/mkfs"
 )
 
 // TestInvalidCommandLineClassic tests invalid command line input for classic images
@@ -429,36 +432,56 @@ func TestGeneratePackageManifest(t *testing.T) {
 	t.Run("test_generate_package_manifest", func(t *testing.T) {
 		asserter := helper.Asserter{T: t}
 
-		// Setup the exec.Command mock
-		testCaseName = "TestGeneratePackageManifest"
-		execCommand = fakeExecCommand
-		defer func() {
-			execCommand = exec.Command
-		}()
-		// We need the output directory set for this
-		outputDir, err := ioutil.TempDir("/tmp", "ubuntu-image-")
+		// We need the work directory set for this
+		workDir, err := ioutil.TempDir("/tmp", "ubuntu-image-")
 		asserter.AssertErrNil(err, true)
-		defer os.RemoveAll(outputDir)
+		defer os.RemoveAll(workDir)
 
 		var stateMachine ClassicStateMachine
 		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
 		stateMachine.parent = &stateMachine
-		stateMachine.commonFlags.OutputDir = outputDir
-		osMkdirAll(stateMachine.commonFlags.OutputDir, 0755)
+		stateMachine.stateMachineFlags.WorkDir = workDir
+		stateMachine.commonFlags.ManifestJSON = true
+		stateMachine.tempDirs.rootfs = filepath.Join("testdata", "dpkg_rootfs")
+
+		// capture stdout to check that unpacked packages are reported
+		stdout, restoreStdout, err := helper.CaptureStd(&os.Stdout)
+		defer restoreStdout()
+		asserter.AssertErrNil(err, true)
 
 		err = stateMachine.generatePackageManifest()
 		asserter.AssertErrNil(err, true)
 
-		// Check if manifest file got generated and if it has expected contents
-		manifestPath := filepath.Join(stateMachine.commonFlags.OutputDir, "filesystem.manifest")
+		restoreStdout()
+		readStdout, err := ioutil.ReadAll(stdout)
+		asserter.AssertErrNil(err, true)
+		if !strings.Contains(string(readStdout), "not fully installed in the rootfs: vim-tiny (unpacked)") {
+			t.Errorf("Expected a warning about vim-tiny, got \"%s\"", string(readStdout))
+		}
+
+		// Check if manifest file got generated in the staging directory with the expected contents
+		manifestPath := filepath.Join(stateMachine.tempDirs.staging, "filesystem.manifest")
 		manifestBytes, err := ioutil.ReadFile(manifestPath)
 		asserter.AssertErrNil(err, true)
-		// The order of packages shouldn't matter
-		examplePackages := []string{"foo 1.2", "bar 1.4-1ubuntu4.1", "libbaz 0.1.3ubuntu2"}
-		for _, pkg := range examplePackages {
-			if !strings.Contains(string(manifestBytes), pkg) {
-				t.Errorf("filesystem.manifest does not contain expected package: %s", pkg)
-			}
+		expectedManifest := "bash 5.1-6ubuntu1\nlibc6 2.35-0ubuntu3.1\nlibc6 2.35-0ubuntu3.1\n" +
+			"vim-tiny 2:8.2.3995-1ubuntu2.1\n"
+		if string(manifestBytes) != expectedManifest {
+			t.Errorf("Expected filesystem.manifest \"%s\", got \"%s\"", expectedManifest, string(manifestBytes))
+		}
+
+		// and the JSON form
+		manifestBytes, err = ioutil.ReadFile(manifestPath + ".json")
+		asserter.AssertErrNil(err, true)
+		var manifestJSON map[string][]dpkgPackage
+		err = json.Unmarshal(manifestBytes, &manifestJSON)
+		asserter.AssertErrNil(err, true)
+		if len(manifestJSON["packages"]) != 4 ||
+			manifestJSON["packages"][3] != (dpkgPackage{"vim-tiny", "2:8.2.3995-1ubuntu2.1", "amd64",
+				"vim", "2:8.2.3995-1ubuntu2", "unpacked", ""}) {
+			t.Errorf("Unexpected JSON manifest %s", string(manifestBytes))
+		}
+		if len(stateMachine.Artifacts) != 2 || stateMachine.Artifacts[1].Type != "manifest-json" {
+			t.Errorf("Expected both manifests to be recorded as artifacts, got %v", stateMachine.Artifacts)
 		}
 	})
 }
@@ -468,24 +491,217 @@ func TestFailedGeneratePackageManifest(t *testing.T) {
 	t.Run("test_failed_generate_package_manifest", func(t *testing.T) {
 		asserter := helper.Asserter{T: t}
 
-		// Setup the exec.Command mock - version from the success test
-		testCaseName = "TestGeneratePackageManifest"
-		execCommand = fakeExecCommand
-		defer func() {
-			execCommand = exec.Command
-		}()
+		workDir, err := ioutil.TempDir("/tmp", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(workDir)
+
+		var stateMachine ClassicStateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.parent = &stateMachine
+		stateMachine.stateMachineFlags.WorkDir = workDir
+		stateMachine.commonFlags.ManifestJSON = true
+
+		// the rootfs has no dpkg database
+		err = stateMachine.generatePackageManifest()
+		asserter.AssertErrContains(err, "Error opening dpkg status")
+		stateMachine.tempDirs.rootfs = filepath.Join("testdata", "dpkg_rootfs")
+
 		// Setup the mock for os.Create, making those fail
 		osCreate = mockCreate
 		defer func() {
 			osCreate = os.Create
 		}()
+		err = stateMachine.generatePackageManifest()
+		asserter.AssertErrContains(err, "Error creating manifest file")
+		osCreate = os.Create
 
+		// mock ioutil.WriteFile
+		ioutilWriteFile = mockWriteFile
+		defer func() {
+			ioutilWriteFile = ioutil.WriteFile
+		}()
+		err = stateMachine.generatePackageManifest()
+		asserter.AssertErrContains(err, "Error writing manifest file")
+	})
+}
+
+// TestMakeLiveISO tests that the live ISO tree is assembled and xorriso is called
+func TestMakeLiveISO(t *testing.T) {
+	t.Run("test_make_live_iso", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
 		var stateMachine ClassicStateMachine
 		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
 		stateMachine.parent = &stateMachine
-		stateMachine.commonFlags.OutputDir = "/dummy/path"
+		stateMachine.Opts.LiveISO = true
+		stateMachine.Opts.Arch = "amd64"
+		stateMachine.commonFlags.DiskInfo = filepath.Join("testdata", "disk_info")
 
-		err := stateMachine.generatePackageManifest()
-		asserter.AssertErrContains(err, "Error creating manifest file")
+		// need workdir set up for this
+		err := stateMachine.makeTemporaryDirectories()
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+
+		outDir, err := ioutil.TempDir("/tmp", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(outDir)
+		stateMachine.commonFlags.OutputDir = outDir
+
+		stateMachine.YamlFilePath = filepath.Join("testdata", "gadget-gpt.yaml")
+		err = stateMachine.loadGadgetYaml()
+		asserter.AssertErrNil(err, true)
+
+		// set up a kernel with an absolute symlink like the kernel packages do
+		bootDir := filepath.Join(stateMachine.tempDirs.rootfs, "boot")
+		err = os.MkdirAll(bootDir, 0755)
+		asserter.AssertErrNil(err, true)
+		err = ioutil.WriteFile(filepath.Join(bootDir, "vmlinuz-5.4.0"), []byte("kernel"), 0644)
+		asserter.AssertErrNil(err, true)
+		err = os.Symlink("/boot/vmlinuz-5.4.0", filepath.Join(bootDir, "vmlinuz"))
+		asserter.AssertErrNil(err, true)
+		err = ioutil.WriteFile(filepath.Join(bootDir, "initrd.img"), []byte("initrd"), 0644)
+		asserter.AssertErrNil(err, true)
+
+		// and the EFI content of the system-boot structure
+		efiBootDir := filepath.Join(stateMachine.tempDirs.volumes, "pc", "part2", "EFI", "boot")
+		err = os.MkdirAll(efiBootDir, 0755)
+		asserter.AssertErrNil(err, true)
+		err = ioutil.WriteFile(filepath.Join(efiBootDir, "bootx64.efi"), []byte("shim"), 0644)
+		asserter.AssertErrNil(err, true)
+
+		// mkfs.vfat, mksquashfs, grub-mkimage and xorriso might not be available
+		mkfsMakeWithContent = func(string, string, string, string, quantity.Size, quantity.Size) error {
+			return nil
+		}
+		testCaseName = "TestMakeLiveISO"
+		execCommand = fakeExecCommand
+		defer func() {
+			mkfsMakeWithContent = mkfs.MakeWithContent
+			execCommand = exec.Command
+		}()
+
+		err = stateMachine.makeLiveISO()
+		asserter.AssertErrNil(err, true)
+
+		isoRoot := filepath.Join(stateMachine.stateMachineFlags.WorkDir, "iso")
+		kernel, err := ioutil.ReadFile(filepath.Join(isoRoot, "casper", "vmlinuz"))
+		asserter.AssertErrNil(err, true)
+		if string(kernel) != "kernel" {
+			t.Errorf("Expected casper/vmlinuz to contain the kernel, got \"%s\"", string(kernel))
+		}
+		_, err = os.Stat(filepath.Join(isoRoot, "casper", "initrd"))
+		asserter.AssertErrNil(err, true)
+		_, err = os.Stat(filepath.Join(isoRoot, "boot", "grub", "grub.cfg"))
+		asserter.AssertErrNil(err, true)
+		efiGrubCfg, err := ioutil.ReadFile(filepath.Join(stateMachine.stateMachineFlags.WorkDir,
+			"efi", "EFI", "ubuntu", "grub.cfg"))
+		asserter.AssertErrNil(err, true)
+		if !strings.Contains(string(efiGrubCfg), "/.disk/info") {
+			t.Errorf("Expected EFI grub.cfg to search for .disk/info, got \"%s\"", string(efiGrubCfg))
+		}
+		diskInfo, err := ioutil.ReadFile(filepath.Join(isoRoot, ".disk", "info"))
+		asserter.AssertErrNil(err, true)
+		expectedDiskInfo, err := ioutil.ReadFile(stateMachine.commonFlags.DiskInfo)
+		asserter.AssertErrNil(err, true)
+		if string(diskInfo) != string(expectedDiskInfo) {
+			t.Errorf("Expected .disk/info \"%s\", got \"%s\"", string(expectedDiskInfo), string(diskInfo))
+		}
+
+		expectedArtifact := outputArtifact{"pc.iso", "pc", "live-iso"}
+		if len(stateMachine.Artifacts) != 1 || stateMachine.Artifacts[0] != expectedArtifact {
+			t.Errorf("Expected artifacts [%v], got %v", expectedArtifact, stateMachine.Artifacts)
+		}
+	})
+}
+
+// TestFailedMakeLiveISO tests failures when creating a live ISO
+func TestFailedMakeLiveISO(t *testing.T) {
+	t.Run("test_failed_make_live_iso", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine ClassicStateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.parent = &stateMachine
+		stateMachine.Opts.LiveISO = true
+		stateMachine.Opts.Arch = "amd64"
+
+		err := stateMachine.makeTemporaryDirectories()
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+
+		outDir, err := ioutil.TempDir("/tmp", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(outDir)
+		stateMachine.commonFlags.OutputDir = outDir
+
+		stateMachine.YamlFilePath = filepath.Join("testdata", "gadget-gpt.yaml")
+		err = stateMachine.loadGadgetYaml()
+		asserter.AssertErrNil(err, true)
+
+		// no EFI content has been populated yet
+		err = stateMachine.makeLiveISO()
+		asserter.AssertErrContains(err, "no EFI content found")
+
+		efiBootDir := filepath.Join(stateMachine.tempDirs.volumes, "pc", "part2", "EFI", "boot")
+		err = os.MkdirAll(efiBootDir, 0755)
+		asserter.AssertErrNil(err, true)
+
+		// mock os.MkdirAll
+		osMkdirAll = mockMkdirAll
+		defer func() {
+			osMkdirAll = os.MkdirAll
+		}()
+		err = stateMachine.makeLiveISO()
+		asserter.AssertErrContains(err, "Error creating staging directory")
+		osMkdirAll = os.MkdirAll
+
+		// mksquashfs failing
+		testCaseName = "TestFailedMakeLiveISO"
+		execCommand = fakeExecCommand
+		defer func() {
+			execCommand = exec.Command
+		}()
+		err = stateMachine.makeLiveISO()
+		asserter.AssertErrContains(err, "Error creating live ISO squashfs")
+		execCommand = exec.Command
+
+		// there is no kernel in the rootfs
+		testCaseName = "TestMakeLiveISO"
+		execCommand = fakeExecCommand
+		err = stateMachine.makeLiveISO()
+		asserter.AssertErrContains(err, "to the live ISO")
+
+		bootDir := filepath.Join(stateMachine.tempDirs.rootfs, "boot")
+		err = os.MkdirAll(bootDir, 0755)
+		asserter.AssertErrNil(err, true)
+		for _, bootFile := range []string{"vmlinuz", "initrd.img"} {
+			err = ioutil.WriteFile(filepath.Join(bootDir, bootFile), []byte(bootFile), 0644)
+			asserter.AssertErrNil(err, true)
+		}
+
+		// mock ioutil.WriteFile
+		ioutilWriteFile = mockWriteFile
+		defer func() {
+			ioutilWriteFile = ioutil.WriteFile
+		}()
+		err = stateMachine.makeLiveISO()
+		asserter.AssertErrContains(err, "Error writing live ISO disk info")
+		ioutilWriteFile = ioutil.WriteFile
+
+		// mock osutil.CopySpecialFile
+		osutilCopySpecialFile = mockCopySpecialFile
+		defer func() {
+			osutilCopySpecialFile = osutil.CopySpecialFile
+		}()
+		err = stateMachine.makeLiveISO()
+		asserter.AssertErrContains(err, "Error copying EFI content")
+		osutilCopySpecialFile = osutil.CopySpecialFile
+
+		// mock mkfs.MakeWithContent
+		mkfsMakeWithContent = mockMkfsWithContent
+		defer func() {
+			mkfsMakeWithContent = mkfs.MakeWithContent
+		}()
+		err = stateMachine.makeLiveISO()
+		asserter.AssertErrContains(err, "Error running mkfs")
+		mkfsMakeWithContent = mkfs.MakeWithContent
 	})
 }
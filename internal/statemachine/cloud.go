@@ -0,0 +1,89 @@
+package statemachine
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/snapcore/snapd/gadget/quantity"
+)
+
+// cloudProfileAlignment returns the size that disk images have to be a multiple of
+// for the --cloud-profile in use, or 0 if they do not need to be aligned
+func (stateMachine *StateMachine) cloudProfileAlignment() quantity.Size {
+	switch stateMachine.commonFlags.CloudProfile {
+	case "aws", "gce":
+		return quantity.SizeGiB
+	case "azure":
+		return quantity.SizeMiB
+	}
+	return 0
+}
+
+// roundUpSize rounds size up to a multiple of alignment
+func roundUpSize(size, alignment quantity.Size) quantity.Size {
+	return (size + alignment - 1) / alignment * alignment
+}
+
+// vhdGeometry calculates the CHS geometry stored in VHD footers, following the
+// algorithm from the VHD specification
+func vhdGeometry(size int64) (cylinders uint16, heads, sectorsPerTrack uint8) {
+	totalSectors := size / 512
+	if totalSectors > 65535*16*255 {
+		totalSectors = 65535 * 16 * 255
+	}
+	var cylinderTimesHeads, headsCount, sectors int64
+	if totalSectors >= 65535*16*63 {
+		sectors = 255
+		headsCount = 16
+		cylinderTimesHeads = totalSectors / sectors
+	} else {
+		sectors = 17
+		cylinderTimesHeads = totalSectors / sectors
+		headsCount = (cylinderTimesHeads + 1023) / 1024
+		if headsCount < 4 {
+			headsCount = 4
+		}
+		if cylinderTimesHeads >= headsCount*1024 || headsCount > 16 {
+			sectors = 31
+			headsCount = 16
+			cylinderTimesHeads = totalSectors / sectors
+		}
+		if cylinderTimesHeads >= headsCount*1024 {
+			sectors = 63
+			headsCount = 16
+			cylinderTimesHeads = totalSectors / sectors
+		}
+	}
+	return uint16(cylinderTimesHeads / headsCount), uint8(headsCount), uint8(sectors)
+}
+
+// vhdFooter creates the 512 byte footer of a fixed VHD image of the given size
+func vhdFooter(size int64, timestamp time.Time, uniqueID uuid.UUID) []byte {
+	footer := make([]byte, 512)
+	copy(footer[0:8], "conectix")
+	binary.BigEndian.PutUint32(footer[8:12], 2)           // features, always reserved
+	binary.BigEndian.PutUint32(footer[12:16], 0x00010000) // file format version
+	binary.BigEndian.PutUint64(footer[16:24], 0xFFFFFFFFFFFFFFFF)
+	vhdEpoch := time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+	binary.BigEndian.PutUint32(footer[24:28], uint32(timestamp.Sub(vhdEpoch)/time.Second))
+	copy(footer[28:32], "uimg")
+	binary.BigEndian.PutUint32(footer[32:36], 0x00010000) // creator version
+	copy(footer[36:40], "Wi2k")
+	binary.BigEndian.PutUint64(footer[40:48], uint64(size)) // original size
+	binary.BigEndian.PutUint64(footer[48:56], uint64(size)) // current size
+	cylinders, heads, sectorsPerTrack := vhdGeometry(size)
+	binary.BigEndian.PutUint16(footer[56:58], cylinders)
+	footer[58] = heads
+	footer[59] = sectorsPerTrack
+	binary.BigEndian.PutUint32(footer[60:64], 2) // fixed disk
+	copy(footer[68:84], uniqueID[:])
+
+	// the checksum is the one's complement of the sum of all the other bytes
+	var checksum uint32
+	for _, footerByte := range footer {
+		checksum += uint32(footerByte)
+	}
+	binary.BigEndian.PutUint32(footer[64:68], ^checksum)
+	return footer
+}
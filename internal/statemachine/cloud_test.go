@@ -0,0 +1,71 @@
+// This file contains unit tests for the packaging of cloud images
+package statemachine
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/snapcore/snapd/gadget/quantity"
+)
+
+// TestVHDFooter tests the footer appended to disk images to make fixed VHDs
+func TestVHDFooter(t *testing.T) {
+	t.Run("test_vhd_footer", func(t *testing.T) {
+		timestamp := time.Date(2021, time.October, 18, 0, 0, 0, 0, time.UTC)
+		uniqueID := uuid.MustParse("7d9f0ac2-7f4a-4d2c-9e3e-2d5c2b0e8c11")
+		footer := vhdFooter(int64(quantity.SizeGiB), timestamp, uniqueID)
+		if len(footer) != 512 {
+			t.Fatalf("Expected a 512 byte footer, got %d bytes", len(footer))
+		}
+		if string(footer[0:8]) != "conectix" {
+			t.Errorf("Expected the footer cookie to be conectix, got %s", string(footer[0:8]))
+		}
+		if binary.BigEndian.Uint64(footer[48:56]) != uint64(quantity.SizeGiB) {
+			t.Errorf("Wrong current size in the footer: %d", binary.BigEndian.Uint64(footer[48:56]))
+		}
+		if binary.BigEndian.Uint32(footer[60:64]) != 2 {
+			t.Errorf("Expected a fixed disk type, got %d", binary.BigEndian.Uint32(footer[60:64]))
+		}
+		if binary.BigEndian.Uint32(footer[24:28]) != 687830400 {
+			t.Errorf("Wrong timestamp in the footer: %d", binary.BigEndian.Uint32(footer[24:28]))
+		}
+		if string(footer[68:84]) != string(uniqueID[:]) {
+			t.Errorf("Wrong unique id in the footer")
+		}
+
+		// the checksum is the one's complement of the sum of the other bytes
+		var sum uint32
+		for ii, footerByte := range footer {
+			if ii < 64 || ii >= 68 {
+				sum += uint32(footerByte)
+			}
+		}
+		if binary.BigEndian.Uint32(footer[64:68]) != ^sum {
+			t.Errorf("Wrong footer checksum %x, expected %x", binary.BigEndian.Uint32(footer[64:68]), ^sum)
+		}
+	})
+}
+
+// TestVHDGeometry tests the CHS geometry calculation of VHD footers
+func TestVHDGeometry(t *testing.T) {
+	testCases := []struct {
+		size            int64
+		cylinders       uint16
+		heads           uint8
+		sectorsPerTrack uint8
+	}{
+		{int64(20 * quantity.SizeMiB), 602, 4, 17},
+		{int64(quantity.SizeGiB), 2080, 16, 63},
+		{int64(64 * quantity.SizeGiB), 32896, 16, 255},
+		{int64(4096 * quantity.SizeGiB), 65535, 16, 255},
+	}
+	for _, tc := range testCases {
+		cylinders, heads, sectorsPerTrack := vhdGeometry(tc.size)
+		if cylinders != tc.cylinders || heads != tc.heads || sectorsPerTrack != tc.sectorsPerTrack {
+			t.Errorf("Expected geometry %d/%d/%d for %d bytes, got %d/%d/%d", tc.cylinders,
+				tc.heads, tc.sectorsPerTrack, tc.size, cylinders, heads, sectorsPerTrack)
+		}
+	}
+}
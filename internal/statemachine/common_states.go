@@ -1,12 +1,14 @@
 package statemachine
 
 import (
-	"crypto/rand"
+	"encoding/json"
 	"fmt"
+	"io"
 	"math"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 
 	"github.com/canonical/ubuntu-image/internal/helper"
 	diskfs "github.com/diskfs/go-diskfs"
@@ -74,6 +76,11 @@ func (stateMachine *StateMachine) loadGadgetYaml() error {
 		}
 	}
 
+	// the sector sizes are needed to lay out the logical partitions
+	if err := stateMachine.parseSectorSizes(gadgetYamlBytes); err != nil {
+		return err
+	}
+
 	if err := stateMachine.postProcessGadgetYaml(); err != nil {
 		return err
 	}
@@ -88,6 +95,31 @@ func (stateMachine *StateMachine) loadGadgetYaml() error {
 		return err
 	}
 
+	if err := stateMachine.parseDiskIDs(); err != nil {
+		return err
+	}
+
+	if err := stateMachine.parsePartitionAttributes(gadgetYamlBytes); err != nil {
+		return err
+	}
+
+	for volumeName, sectorSize := range stateMachine.SectorSizes {
+		if err := sectorAlignmentError(volumeName, stateMachine.GadgetInfo.Volumes[volumeName],
+			sectorSize); err != nil {
+			return err
+		}
+	}
+
+	if stateMachine.commonFlags.OutputDevice != "" && len(stateMachine.GadgetInfo.Volumes) > 1 {
+		return fmt.Errorf("--output-device can only be used with gadgets that have a single volume")
+	}
+
+	// multiple volumes would overwrite each other's images without {volume}
+	if stateMachine.commonFlags.ImageName != "" && len(stateMachine.GadgetInfo.Volumes) > 1 &&
+		!strings.Contains(stateMachine.commonFlags.ImageName, "{volume}") {
+		return fmt.Errorf("--image-name must contain {volume} for gadgets with multiple volumes")
+	}
+
 	return nil
 }
 
@@ -146,10 +178,14 @@ func (stateMachine *StateMachine) calculateRootfsSize() error {
 	rootfsQuantity = quantity.Size(math.Ceil(float64(rootfsQuantity) * 1.5))
 	rootfsQuantity += rootfsPadding
 
-	stateMachine.RootfsSize = rootfsQuantity
+	stateMachine.setRootfsSize(rootfsQuantity)
+	return nil
+}
 
-	// we have already saved the rootfs size in the state machine struct, but we
-	// should also set it in the gadget.Structure that represents the rootfs
+// setRootfsSize saves the size of the rootfs in the state machine struct, and in the
+// gadget.Structure that represents the rootfs
+func (stateMachine *StateMachine) setRootfsSize(rootfsQuantity quantity.Size) {
+	stateMachine.RootfsSize = rootfsQuantity
 	for _, volume := range stateMachine.GadgetInfo.Volumes {
 		for structureNumber, structure := range volume.Structure {
 			if structure.Size == 0 {
@@ -158,7 +194,6 @@ func (stateMachine *StateMachine) calculateRootfsSize() error {
 			volume.Structure[structureNumber] = structure
 		}
 	}
-	return nil
 }
 
 // Populate the Bootfs Contents by using snapd's MountedFilesystemWriter
@@ -233,8 +268,7 @@ func (stateMachine *StateMachine) populatePreparePartitions() error {
 		if err := stateMachine.handleLkBootloader(volume); err != nil {
 			return err
 		}
-		var farthestOffset quantity.Offset = 0
-		//for structureNumber, structure := range volume.Structure {
+		farthestOffset := volumeFarthestOffset(volume)
 		for structureNumber, structure := range volume.Structure {
 			var contentRoot string
 			if structure.Role == gadget.SystemData || structure.Role == gadget.SystemSeed {
@@ -243,8 +277,6 @@ func (stateMachine *StateMachine) populatePreparePartitions() error {
 				contentRoot = filepath.Join(stateMachine.tempDirs.volumes, volumeName,
 					"part"+strconv.Itoa(structureNumber))
 			}
-			farthestOffset = maxOffset(farthestOffset,
-				quantity.Offset(structure.Size)+getStructureOffset(structure))
 			if shouldSkipStructure(structure, stateMachine.IsSeeded) {
 				continue
 			}
@@ -252,7 +284,7 @@ func (stateMachine *StateMachine) populatePreparePartitions() error {
 			// copy the data
 			partImg := filepath.Join(stateMachine.tempDirs.volumes, volumeName,
 				"part"+strconv.Itoa(structureNumber)+".img")
-			if err := stateMachine.copyStructureContent(volume, structure,
+			if err := stateMachine.copyStructureContent(volumeName, volume, structure,
 				structureNumber, contentRoot, partImg); err != nil {
 				return err
 			}
@@ -263,32 +295,71 @@ func (stateMachine *StateMachine) populatePreparePartitions() error {
 	return nil
 }
 
+// If --rootfs-tarball or --rootfs-squashfs were used, archive the populated rootfs
+// to the output directory
+func (stateMachine *StateMachine) generateRootfsArtifacts() error {
+	if !stateMachine.commonFlags.RootfsTarball && !stateMachine.commonFlags.RootfsSquashfs {
+		return nil
+	}
+	if err := stateMachine.setupOutputDir(); err != nil {
+		return err
+	}
+	if err := stateMachine.clampTimestamps(stateMachine.tempDirs.rootfs); err != nil {
+		return err
+	}
+	if stateMachine.commonFlags.RootfsTarball {
+		tarName := stateMachine.outputName("", "rootfs.tar.gz", ".rootfs.tar.gz")
+		tarPath := filepath.Join(stateMachine.tempDirs.staging, tarName)
+		if err := createTarball(stateMachine.tempDirs.rootfs, tarPath); err != nil {
+			return fmt.Errorf("Error creating rootfs tarball: %s", err.Error())
+		}
+		stateMachine.recordArtifact(tarName, "", "rootfs-tarball")
+	}
+	if stateMachine.commonFlags.RootfsSquashfs {
+		squashfsName := stateMachine.outputName("", "rootfs.squashfs", ".rootfs.squashfs")
+		squashfsPath := filepath.Join(stateMachine.tempDirs.staging, squashfsName)
+		if err := createSquashfs(stateMachine.tempDirs.rootfs, squashfsPath); err != nil {
+			return fmt.Errorf("Error creating rootfs squashfs: %s", err.Error())
+		}
+		stateMachine.recordArtifact(squashfsName, "", "rootfs-squashfs")
+	}
+	return nil
+}
+
 // Make the disk
 func (stateMachine *StateMachine) makeDisk() error {
 	// ensure the output dir exists
-	if stateMachine.commonFlags.OutputDir == "" {
-		if stateMachine.cleanWorkDir { // no workdir specified, so create the image in the pwd
-			stateMachine.commonFlags.OutputDir, _ = os.Getwd()
-		} else {
-			stateMachine.commonFlags.OutputDir = stateMachine.stateMachineFlags.WorkDir
-		}
-	} else {
-		err := osMkdirAll(stateMachine.commonFlags.OutputDir, 0755)
-		if err != nil && !os.IsExist(err) {
-			return fmt.Errorf("Error creating OutputDir: %s", err.Error())
-		}
+	if err := stateMachine.setupOutputDir(); err != nil {
+		return err
+	}
+	if stateMachine.commonFlags.NoDiskImage {
+		return nil
+	}
+	if stateMachine.commonFlags.OutputDevice != "" {
+		return stateMachine.makeDiskOnDevice()
 	}
 	for volumeName, volume := range stateMachine.GadgetInfo.Volumes {
-		imgName := filepath.Join(stateMachine.commonFlags.OutputDir, volumeName+".img")
+		imgFileName := stateMachine.outputName(volumeName, volumeName+".img", ".img")
+		imgName := filepath.Join(stateMachine.tempDirs.staging, imgFileName)
 
-		// Create the disk image
-		imgSize, _ := stateMachine.calculateImageSize()
+		// a resumed build may have left a partial image behind
+		if err := osRemoveAll(imgName); err != nil {
+			return fmt.Errorf("Error removing old disk image: %s", err.Error())
+		}
 
+		// Create the disk image
+		imgSize := stateMachine.diskImageSize(volumeName)
 		diskImg, err := diskfsCreate(imgName, imgSize, diskfs.Raw)
 		if err != nil {
 			return fmt.Errorf("Error creating disk image: %s", err.Error())
 		}
 
+		// diskfs.Create always gives image files 512-byte sectors, use the sector size
+		// of the volume instead
+		sectorSize := uint64(stateMachine.sectorSize(volumeName))
+		diskImg.LogicalBlocksize = int64(sectorSize)
+		diskImg.PhysicalBlocksize = int64(sectorSize)
+
 		// make sure the disk image size is a multiple of its block size
 		imgSize = int64(math.Ceil(float64(imgSize)/float64(diskImg.LogicalBlocksize))) *
 			int64(diskImg.LogicalBlocksize)
@@ -296,30 +367,41 @@ func (stateMachine *StateMachine) makeDisk() error {
 			return fmt.Errorf("Error resizing disk image to a multiple of its block size: %s",
 				err.Error())
 		}
-
-		// snapd always populates Schema, so it cannot be empty. Use the blocksize of the created disk
-		sectorSize := uint64(diskImg.LogicalBlocksize)
+		diskImg.Size = imgSize
 
 		// set up the partitions on the device
-		partitionTable := createPartitionTable(volumeName, volume, sectorSize, stateMachine.IsSeeded)
+		if err := logicalPartitionsError(volumeName, volume, sectorSize,
+			stateMachine.IsSeeded); err != nil {
+			return err
+		}
+		partitionTable := createPartitionTable(volumeName, volume, sectorSize,
+			stateMachine.PartitionAttributes[volumeName], stateMachine.IsSeeded)
+		stateMachine.setPartitionGUIDs(volumeName, partitionTable)
 
 		// Write the partition table to disk
+		if err := writeExtendedBootRecords(diskImg.File, volume, sectorSize,
+			stateMachine.IsSeeded); err != nil {
+			return err
+		}
 		if err := diskImg.Partition(*partitionTable); err != nil {
 			return fmt.Errorf("Error partitioning image file: %s", err.Error())
 		}
+		if err := stateMachine.writeHybridMBR(diskImg.File, volumeName, volume,
+			sectorSize); err != nil {
+			return err
+		}
 
 		// TODO: go-diskfs doesn't set the disk ID when using an MBR partition table.
 		// this function is a temporary workaround, but we should change upstream go-diskfs
+		mbrDiskID := stateMachine.mbrDiskID(volumeName)
 		if volume.Schema == "mbr" {
-			randomBytes := make([]byte, 4)
-			rand.Read(randomBytes)
 			diskFile, err := osOpenFile(imgName, os.O_RDWR, 0755)
 			defer diskFile.Close()
 			if err != nil {
 				return fmt.Errorf("Error opening disk to write MBR disk identifier: %s",
 					err.Error())
 			}
-			_, err = diskFile.WriteAt(randomBytes, 440)
+			_, err = diskFile.WriteAt(mbrDiskID, 440)
 			if err != nil {
 				return fmt.Errorf("Error writing MBR disk identifier: %s", err.Error())
 			}
@@ -335,11 +417,284 @@ func (stateMachine *StateMachine) makeDisk() error {
 		if err := writeOffsetValues(volume, imgName, sectorSize, uint64(imgSize)); err != nil {
 			return err
 		}
+		stateMachine.recordArtifact(imgFileName, volumeName, "disk-image")
+		if err := stateMachine.writePartitionIDs(volumeName, volume, *partitionTable,
+			mbrDiskID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyImage re-opens the disk images written by make_disk and checks them against the
+// laid out volumes: the partition table, the raw content of the structures, the
+// offset-write values and the filesystems of the partitions
+func (stateMachine *StateMachine) verifyImage() error {
+	if stateMachine.commonFlags.NoDiskImage {
+		return nil
+	}
+	for volumeName, volume := range stateMachine.GadgetInfo.Volumes {
+		imgPath := stateMachine.commonFlags.OutputDevice
+		if imgPath == "" {
+			imgPath = filepath.Join(stateMachine.tempDirs.staging,
+				stateMachine.outputName(volumeName, volumeName+".img", ".img"))
+		}
+		problems, err := stateMachine.verifyVolume(volumeName, volume, imgPath)
+		if err != nil {
+			return fmt.Errorf("Error verifying disk image %s: %s", imgPath, err.Error())
+		}
+		if len(problems) > 0 {
+			return fmt.Errorf("Disk image %s does not match the gadget.yaml:\n  %s",
+				imgPath, strings.Join(problems, "\n  "))
+		}
+	}
+	return nil
+}
+
+// makeDiskOnDevice partitions the block device given with --output-device and writes
+// the partition images to it instead of creating an image file
+func (stateMachine *StateMachine) makeDiskOnDevice() error {
+	for volumeName, volume := range stateMachine.GadgetInfo.Volumes {
+		// the device has to hold the structures at their offsets
+		imgSize, _ := stateMachine.calculateImageSize()
+		for _, structure := range volume.Structure {
+			structureEnd := int64(getStructureOffset(structure)) + int64(structure.Size)
+			if structureEnd > imgSize {
+				imgSize = structureEnd
+			}
+		}
+		if err := stateMachine.checkOutputDevice(imgSize); err != nil {
+			return err
+		}
+		device := stateMachine.commonFlags.OutputDevice
+		diskImg, err := diskfsOpen(device)
+		if err != nil {
+			return fmt.Errorf("Error opening output device: %s", err.Error())
+		}
+		defer diskImg.File.Close()
+
+		// the sector size of the device can't be changed
+		sectorSize := uint64(diskImg.LogicalBlocksize)
+		if volumeSectorSize, found := stateMachine.SectorSizes[volumeName]; found &&
+			uint64(volumeSectorSize) != sectorSize {
+			return fmt.Errorf("Volume %s has %d-byte sectors, but output device %s has %d-byte "+
+				"sectors", volumeName, volumeSectorSize, device, sectorSize)
+		}
+		if err := logicalPartitionsError(volumeName, volume, sectorSize,
+			stateMachine.IsSeeded); err != nil {
+			return err
+		}
+		partitionTable := createPartitionTable(volumeName, volume, sectorSize,
+			stateMachine.PartitionAttributes[volumeName], stateMachine.IsSeeded)
+		stateMachine.setPartitionGUIDs(volumeName, partitionTable)
+		// the EBRs are written first, so that the kernel finds the logical partitions
+		// when it re-reads the partition table of the device
+		if err := writeExtendedBootRecords(diskImg.File, volume, sectorSize,
+			stateMachine.IsSeeded); err != nil {
+			return err
+		}
+		if err := diskImg.Partition(*partitionTable); err != nil {
+			return fmt.Errorf("Error partitioning output device: %s", err.Error())
+		}
+		if err := stateMachine.writeHybridMBR(diskImg.File, volumeName, volume,
+			sectorSize); err != nil {
+			return err
+		}
+		mbrDiskID := stateMachine.mbrDiskID(volumeName)
+		if volume.Schema == "mbr" {
+			if _, err := diskImg.File.WriteAt(mbrDiskID, 440); err != nil {
+				return fmt.Errorf("Error writing MBR disk identifier: %s", err.Error())
+			}
+		}
+		if err := stateMachine.writeToDevice(volumeName, volume, diskImg); err != nil {
+			return err
+		}
+		if err := writeOffsetValues(volume, device, sectorSize, uint64(diskImg.Size)); err != nil {
+			return err
+		}
+		if err := stateMachine.writePartitionIDs(volumeName, volume, *partitionTable,
+			mbrDiskID); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-// Finish step to show that the build was successful
+// If --cloud-profile was used, package the disk images the way the cloud provider
+// expects them. GCE needs a tarball containing disk.raw and Azure a fixed VHD, while
+// AWS imports the raw images directly
+func (stateMachine *StateMachine) packageCloudImage() error {
+	if stateMachine.commonFlags.CloudProfile != "gce" &&
+		stateMachine.commonFlags.CloudProfile != "azure" {
+		return nil
+	}
+	for ii, artifact := range stateMachine.Artifacts {
+		if artifact.Type != "disk-image" {
+			continue
+		}
+		imgPath := filepath.Join(stateMachine.tempDirs.staging, artifact.Name)
+		switch stateMachine.commonFlags.CloudProfile {
+		case "gce":
+			// the tarball has to contain a single file named disk.raw
+			gceDir := filepath.Join(stateMachine.stateMachineFlags.WorkDir, "gce", artifact.Volume)
+			if err := osMkdirAll(gceDir, 0755); err != nil {
+				return fmt.Errorf("Error creating GCE directory: %s", err.Error())
+			}
+			rawPath := filepath.Join(gceDir, "disk.raw")
+			if err := osRename(imgPath, rawPath); err != nil {
+				return fmt.Errorf("Error moving disk image: %s", err.Error())
+			}
+			tarName := stateMachine.outputName(artifact.Volume, artifact.Volume+".tar.gz", ".tar.gz")
+			tarCommand := execCommand("tar", "--format=oldgnu", "--sparse", "--create", "--gzip",
+				"--file", filepath.Join(stateMachine.tempDirs.staging, tarName),
+				"--directory", gceDir, "disk.raw")
+			if output, err := tarCommand.CombinedOutput(); err != nil {
+				return fmt.Errorf("Error creating GCE tarball: Error running command \"%s\": "+
+					"%s. Output: %s", tarCommand.String(), err.Error(), string(output))
+			}
+			if err := osRemoveAll(gceDir); err != nil {
+				return fmt.Errorf("Error cleaning up GCE directory: %s", err.Error())
+			}
+			stateMachine.Artifacts[ii] = outputArtifact{tarName, artifact.Volume, "gce-tarball"}
+		case "azure":
+			vhdName := stateMachine.outputName(artifact.Volume, artifact.Volume+".vhd", ".vhd")
+			vhdPath := filepath.Join(stateMachine.tempDirs.staging, vhdName)
+			if err := osRename(imgPath, vhdPath); err != nil {
+				return fmt.Errorf("Error moving disk image: %s", err.Error())
+			}
+			vhdFile, err := osOpenFile(vhdPath, os.O_RDWR, 0644)
+			if err != nil {
+				return fmt.Errorf("Error opening VHD image: %s", err.Error())
+			}
+			imgSize, err := vhdFile.Seek(0, io.SeekEnd)
+			if err != nil {
+				vhdFile.Close()
+				return fmt.Errorf("Error getting disk image size: %s", err.Error())
+			}
+			footer := vhdFooter(imgSize, stateMachine.buildTime(),
+				stateMachine.reproducibleUUID("volumes/"+artifact.Volume+"/vhd"))
+			if _, err := vhdFile.WriteAt(footer, imgSize); err != nil {
+				vhdFile.Close()
+				return fmt.Errorf("Error writing VHD footer: %s", err.Error())
+			}
+			if err := vhdFile.Close(); err != nil {
+				return fmt.Errorf("Error closing VHD image: %s", err.Error())
+			}
+			stateMachine.Artifacts[ii] = outputArtifact{vhdName, artifact.Volume, "azure-vhd"}
+		}
+	}
+	return nil
+}
+
+// If --export-partitions was used, copy the individual partition images to the
+// output directory and write a manifest describing them
+func (stateMachine *StateMachine) exportPartitions() error {
+	if !stateMachine.commonFlags.ExportPartitions {
+		return nil
+	}
+	if err := stateMachine.setupOutputDir(); err != nil {
+		return err
+	}
+	for volumeName, volume := range stateMachine.GadgetInfo.Volumes {
+		var partitions []exportedPartition
+		usedNames := make(map[string]bool)
+		for structureNumber, structure := range volume.Structure {
+			if shouldSkipStructure(structure, stateMachine.IsSeeded) {
+				continue
+			}
+			partImg := filepath.Join(stateMachine.tempDirs.volumes, volumeName,
+				"part"+strconv.Itoa(structureNumber)+".img")
+			if _, err := osStat(partImg); err != nil {
+				// structures without content do not have an image to export
+				continue
+			}
+
+			// structures with the same name get a suffix, which can itself be the
+			// name of another structure
+			baseName := getStructureFileName(structure, structureNumber)
+			partName := baseName
+			for suffix := structureNumber; usedNames[partName]; suffix++ {
+				partName = baseName + "-" + strconv.Itoa(suffix)
+			}
+			usedNames[partName] = true
+			exportName := stateMachine.outputName(volumeName,
+				volumeName+"."+partName+".img", "."+partName+".img")
+			exportPath := filepath.Join(stateMachine.tempDirs.staging, exportName)
+			if err := osutilCopyFile(partImg, exportPath, osutil.CopyFlagOverwrite); err != nil {
+				return fmt.Errorf("Error exporting partition image %s: %s", exportName, err.Error())
+			}
+			checksum, err := calculateSHA256(exportPath)
+			if err != nil {
+				return fmt.Errorf("Error calculating checksum of %s: %s", exportName, err.Error())
+			}
+
+			stateMachine.recordArtifact(exportName, volumeName, "partition-image")
+
+			mbrType, gptType := splitStructureType(structure.Type)
+			partitions = append(partitions, exportedPartition{
+				Image:      exportName,
+				Name:       structure.Name,
+				Role:       structure.Role,
+				Offset:     uint64(getStructureOffset(structure)),
+				Size:       uint64(structure.Size),
+				MBRType:    mbrType,
+				GPTType:    gptType,
+				Filesystem: structure.Filesystem,
+				Label:      structure.Label,
+				SHA256:     checksum,
+			})
+		}
+
+		manifestBytes, err := json.MarshalIndent(exportedVolume{
+			Volume:     volumeName,
+			Schema:     volume.Schema,
+			Partitions: partitions,
+		}, "", "  ")
+		if err != nil {
+			return fmt.Errorf("Error encoding partition manifest: %s", err.Error())
+		}
+		manifestName := stateMachine.outputName(volumeName,
+			volumeName+".partitions.json", ".partitions.json")
+		manifestPath := filepath.Join(stateMachine.tempDirs.staging, manifestName)
+		if err := ioutilWriteFile(manifestPath, manifestBytes, 0644); err != nil {
+			return fmt.Errorf("Error writing partition manifest: %s", err.Error())
+		}
+		stateMachine.recordArtifact(manifestName, volumeName, "partition-manifest")
+	}
+	return nil
+}
+
+// Finish step to show that the build was successful. The provenance and checksums are
+// written next to the staged artifacts, which are then moved from the staging directory
+// to the output directory, and if --image-file-list was used, the paths to the created
+// images are written to the given file
 func (stateMachine *StateMachine) finish() error {
+	if err := stateMachine.writeProvenance(); err != nil {
+		return err
+	}
+	if err := stateMachine.writeChecksums(); err != nil {
+		return err
+	}
+	if err := stateMachine.publishOutputs(); err != nil {
+		return err
+	}
+	if stateMachine.commonFlags.ImageFileList != "" {
+		var imageFileList string
+		for _, artifact := range stateMachine.Artifacts {
+			if !isImageArtifact(artifact) {
+				continue
+			}
+			imageFileList += filepath.Join(stateMachine.commonFlags.OutputDir, artifact.Name) + "\n"
+		}
+		err := ioutilWriteFile(stateMachine.commonFlags.ImageFileList, []byte(imageFileList), 0644)
+		if err != nil {
+			return fmt.Errorf("Error writing image file list: %s", err.Error())
+		}
+	}
+	if stateMachine.commonFlags.ImageFileListJSON != "" {
+		if err := stateMachine.writeArtifactList(); err != nil {
+			return err
+		}
+	}
 	return nil
 }
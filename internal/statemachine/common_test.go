@@ -3,10 +3,13 @@ package statemachine
 
 import (
 	"bytes"
+	"encoding/binary"
+	"encoding/json"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
 	"strconv"
 	"strings"
 	"testing"
@@ -192,6 +195,13 @@ func TestFailedLoadGadgetYaml(t *testing.T) {
 		stateMachine.commonFlags.Size = "test"
 		err = stateMachine.loadGadgetYaml()
 		asserter.AssertErrContains(err, "Failed to parse argument to --image-size")
+		stateMachine.commonFlags.Size = ""
+
+		// multiple volumes require {volume} in --image-name
+		stateMachine.YamlFilePath = filepath.Join("testdata", "gadget-multi.yaml")
+		stateMachine.commonFlags.ImageName = "{model}-{date}"
+		err = stateMachine.loadGadgetYaml()
+		asserter.AssertErrContains(err, "--image-name must contain {volume}")
 
 		os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
 	})
@@ -689,7 +699,7 @@ func TestMakeDiskPartitionSchemes(t *testing.T) {
 			asserter.AssertErrNil(err, true)
 
 			// now run "dumpe2fs" to ensure the correct type of partition table exists
-			imgFile := filepath.Join(stateMachine.commonFlags.OutputDir, "pc.img")
+			imgFile := filepath.Join(stateMachine.tempDirs.staging, "pc.img")
 			dumpe2fsCommand := *exec.Command("dumpe2fs", imgFile)
 
 			dumpe2fsBytes, _ := dumpe2fsCommand.CombinedOutput()
@@ -710,6 +720,94 @@ func TestMakeDiskPartitionSchemes(t *testing.T) {
 	}
 }
 
+// TestMakeDiskSectorSizes tests that the partition table, the filesystems and the
+// offset-write values of disk images use the sector size of the volume, from the
+// gadget.yaml or --sector-size
+func TestMakeDiskSectorSizes(t *testing.T) {
+	testCases := []struct {
+		name       string
+		sectorSize string
+		expected   int64
+		// ext4 filesystems of up to 32MiB have 1KiB blocks, unless sectors are larger
+		blockSize int64
+	}{
+		{"512", "512", 512, 1024},
+		{"4096", "", 4096, 4096},
+	}
+	for _, tc := range testCases {
+		t.Run("test_make_disk_sector_size_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			var stateMachine StateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.commonFlags.SectorSize = tc.sectorSize
+
+			err := stateMachine.makeTemporaryDirectories()
+			asserter.AssertErrNil(err, true)
+			defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+			stateMachine.commonFlags.OutputDir = filepath.Join(stateMachine.stateMachineFlags.WorkDir,
+				"output")
+
+			stateMachine.YamlFilePath = filepath.Join("testdata", "gadget-4k.yaml")
+			os.MkdirAll(filepath.Join(stateMachine.tempDirs.unpack, "gadget"), 0755)
+			err = stateMachine.loadGadgetYaml()
+			asserter.AssertErrNil(err, true)
+			if stateMachine.sectorSize("pc") != quantity.Size(tc.expected) {
+				t.Errorf("Expected %d-byte sectors, got %d", tc.expected, stateMachine.sectorSize("pc"))
+			}
+
+			os.MkdirAll(stateMachine.tempDirs.rootfs, 0755)
+			osutil.CopySpecialFile(filepath.Join("testdata", "gadget_tree"), stateMachine.tempDirs.rootfs)
+			err = stateMachine.calculateRootfsSize()
+			asserter.AssertErrNil(err, true)
+			os.MkdirAll(stateMachine.tempDirs.volumes, 0755)
+			files, _ := ioutil.ReadDir(filepath.Join("testdata", "gadget_tree"))
+			for _, srcFile := range files {
+				srcFile := filepath.Join("testdata", "gadget_tree", srcFile.Name())
+				osutil.CopySpecialFile(srcFile, filepath.Join(stateMachine.tempDirs.unpack, "gadget"))
+			}
+			err = stateMachine.populateBootfsContents()
+			asserter.AssertErrNil(err, true)
+			err = stateMachine.populatePreparePartitions()
+			asserter.AssertErrNil(err, true)
+			err = stateMachine.makeDisk()
+			asserter.AssertErrNil(err, true)
+
+			// the sector size of GPT disks is detected
+			imgPath := filepath.Join(stateMachine.tempDirs.staging, "pc.img")
+			report, err := InspectImage(imgPath, 0)
+			asserter.AssertErrNil(err, true)
+			if report.SectorSize != tc.expected {
+				t.Errorf("Expected the image to have %d-byte sectors, got %d", tc.expected,
+					report.SectorSize)
+			}
+			volume := stateMachine.GadgetInfo.Volumes["pc"]
+			report.compareWithVolume(volume, quantity.Size(tc.expected), nil, false)
+			if len(report.Mismatches) > 0 {
+				t.Errorf("Unexpected mismatches: %v", report.Mismatches)
+			}
+			problems, err := stateMachine.verifyVolume("pc", volume, imgPath)
+			asserter.AssertErrNil(err, true)
+			if len(problems) > 0 {
+				t.Errorf("Unexpected problems: %v", problems)
+			}
+
+			imgBytes, err := ioutil.ReadFile(imgPath)
+			asserter.AssertErrNil(err, true)
+			// the offset of the BIOS Boot structure is written at mbr+92, in sectors
+			if value := binary.LittleEndian.Uint32(imgBytes[92:96]); int64(value) !=
+				int64(quantity.OffsetMiB)/tc.expected {
+				t.Errorf("Expected the offset-write value %d, got %d",
+					int64(quantity.OffsetMiB)/tc.expected, value)
+			}
+			// the ext4 block size is 1024 << s_log_block_size
+			superblock := imgBytes[report.Partitions[1].Start+1024:]
+			if blockSize := int64(1024) << binary.LittleEndian.Uint32(superblock[24:28]); blockSize != tc.blockSize {
+				t.Errorf("Expected ext4 blocks of %d bytes, got %d", tc.blockSize, blockSize)
+			}
+		})
+	}
+}
+
 // TestFailedMakeDisk tests failures in the MakeDisk state
 func TestFailedMakeDisk(t *testing.T) {
 	t.Run("test_failed_make_disk", func(t *testing.T) {
@@ -755,7 +853,7 @@ func TestFailedMakeDisk(t *testing.T) {
 			osMkdirAll = os.MkdirAll
 		}()
 		err = stateMachine.makeDisk()
-		asserter.AssertErrContains(err, "Error creating OutputDir")
+		asserter.AssertErrContains(err, "Error creating staging directory")
 		osMkdirAll = os.MkdirAll
 
 		// mock diskfs.Create
@@ -766,7 +864,7 @@ func TestFailedMakeDisk(t *testing.T) {
 		err = stateMachine.makeDisk()
 		asserter.AssertErrContains(err, "Error creating disk image")
 		diskfsCreate = diskfs.Create
-		os.Remove(filepath.Join(outDir, "pc.img")) // clean up for the next test run
+		os.Remove(filepath.Join(stateMachine.tempDirs.staging, "pc.img")) // clean up for the next test run
 
 		// mock os.Truncate
 		osTruncate = mockTruncate
@@ -776,7 +874,7 @@ func TestFailedMakeDisk(t *testing.T) {
 		err = stateMachine.makeDisk()
 		asserter.AssertErrContains(err, "Error resizing disk image")
 		osTruncate = os.Truncate
-		os.Remove(filepath.Join(outDir, "pc.img")) // clean up for the next test run
+		os.Remove(filepath.Join(stateMachine.tempDirs.staging, "pc.img")) // clean up for the next test run
 
 		// mock diskfs.Create to create a read only disk
 		diskfsCreate = readOnlyDiskfsCreate
@@ -786,7 +884,7 @@ func TestFailedMakeDisk(t *testing.T) {
 		err = stateMachine.makeDisk()
 		asserter.AssertErrContains(err, "Error partitioning image file")
 		diskfsCreate = diskfs.Create
-		os.Remove(filepath.Join(outDir, "pc.img"))
+		os.Remove(filepath.Join(stateMachine.tempDirs.staging, "pc.img"))
 
 		// mock os.OpenFile
 		// errors in file.WriteAt()
@@ -797,7 +895,7 @@ func TestFailedMakeDisk(t *testing.T) {
 		err = stateMachine.makeDisk()
 		asserter.AssertErrContains(err, "Error opening disk to write MBR disk identifier")
 		osOpenFile = os.OpenFile
-		os.Remove(filepath.Join(outDir, "pc.img"))
+		os.Remove(filepath.Join(stateMachine.tempDirs.staging, "pc.img"))
 
 		// mock os.OpenFile to force it to use os.O_APPEND, which causes
 		// errors in file.WriteAt()
@@ -808,7 +906,7 @@ func TestFailedMakeDisk(t *testing.T) {
 		err = stateMachine.makeDisk()
 		asserter.AssertErrContains(err, "Error writing MBR disk identifier")
 		osOpenFile = os.OpenFile
-		os.Remove(filepath.Join(outDir, "pc.img"))
+		os.Remove(filepath.Join(stateMachine.tempDirs.staging, "pc.img"))
 
 		// mock helper.CopyBlob to simulate a failure in copyDataToImage
 		helperCopyBlob = mockCopyBlob
@@ -818,7 +916,7 @@ func TestFailedMakeDisk(t *testing.T) {
 		err = stateMachine.makeDisk()
 		asserter.AssertErrContains(err, "Error writing disk image")
 		helperCopyBlob = helper.CopyBlob
-		os.Remove(filepath.Join(outDir, "pc.img"))
+		os.Remove(filepath.Join(stateMachine.tempDirs.staging, "pc.img"))
 
 		// Change to GPT for these next tests
 		stateMachine.YamlFilePath = filepath.Join("testdata", "gadget-gpt.yaml")
@@ -845,7 +943,7 @@ func TestFailedMakeDisk(t *testing.T) {
 		asserter.AssertErrContains(err, "Error opening image file")
 		osOpenFile = os.OpenFile
 		helperCopyBlob = helper.CopyBlob
-		os.Remove(filepath.Join(outDir, "pc.img"))
+		os.Remove(filepath.Join(stateMachine.tempDirs.staging, "pc.img"))
 
 		helperCopyBlob = mockCopyBlob
 		defer func() {
@@ -855,7 +953,816 @@ func TestFailedMakeDisk(t *testing.T) {
 		stateMachine.commonFlags.OutputDir = ""
 		err = stateMachine.makeDisk()
 		asserter.AssertErrContains(err, "Error writing disk image")
-		os.Remove(filepath.Join(stateMachine.commonFlags.OutputDir, "pc.img"))
+		os.Remove(filepath.Join(stateMachine.tempDirs.staging, "pc.img"))
+		helperCopyBlob = helper.CopyBlob
+	})
+}
+
+// TestMakeDiskOnDevice ensures that the partition images are written to the regions
+// of the output device that they map to, and that holes are left untouched
+func TestMakeDiskOnDevice(t *testing.T) {
+	t.Run("test_make_disk_on_device", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine StateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+
+		err := stateMachine.makeTemporaryDirectories()
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+
+		stateMachine.YamlFilePath = filepath.Join("testdata", "gadget-mbr.yaml")
+		stateMachine.commonFlags.DiskGUID = "1234abcd"
+		err = stateMachine.loadGadgetYaml()
+		asserter.AssertErrNil(err, true)
+		err = stateMachine.calculateRootfsSize()
+		asserter.AssertErrNil(err, true)
+
+		// use a regular file filled with 0xFF as a block device
+		device := filepath.Join(stateMachine.stateMachineFlags.WorkDir, "sdz")
+		imgSize := 64 * quantity.SizeMiB
+		err = ioutil.WriteFile(device, bytes.Repeat([]byte{0xFF}, int(imgSize)), 0644)
+		asserter.AssertErrNil(err, true)
+		stateMachine.commonFlags.OutputDevice = device
+		stateMachine.commonFlags.ForceDevice = true
+		osStat = mockStatBlockDevice
+		defer func() {
+			osStat = os.Stat
+		}()
+
+		// create sparse partition images with some data in them
+		volume := stateMachine.GadgetInfo.Volumes["pc"]
+		for structureNumber, structure := range volume.Structure {
+			partImg := filepath.Join(stateMachine.tempDirs.volumes, "pc",
+				"part"+strconv.Itoa(structureNumber)+".img")
+			partFile, err := os.Create(partImg)
+			asserter.AssertErrNil(err, true)
+			if structure.Size > 8192 {
+				err = partFile.Truncate(int64(structure.Size))
+				asserter.AssertErrNil(err, true)
+				_, err = partFile.WriteAt([]byte(structure.Name), 0)
+				asserter.AssertErrNil(err, true)
+			} else {
+				_, err = partFile.Write(bytes.Repeat([]byte{0xAA}, int(structure.Size)))
+				asserter.AssertErrNil(err, true)
+			}
+			partFile.Close()
+		}
+
+		err = stateMachine.makeDisk()
+		asserter.AssertErrNil(err, true)
+
+		deviceBytes, err := ioutil.ReadFile(device)
+		asserter.AssertErrNil(err, true)
+		if deviceBytes[510] != 0x55 || deviceBytes[511] != 0xAA {
+			t.Errorf("Expected an MBR signature on the output device")
+		}
+		for _, structure := range volume.Structure {
+			offset := int(getStructureOffset(structure))
+			if structure.Size <= 8192 {
+				if deviceBytes[offset+int(structure.Size)-1] != 0xAA {
+					t.Errorf("Expected structure %s to be written to the device", structure.Name)
+				}
+				continue
+			}
+			data := string(deviceBytes[offset : offset+len(structure.Name)])
+			if data != structure.Name {
+				t.Errorf("Expected \"%s\" at offset %d, got \"%s\"", structure.Name, offset, data)
+			}
+			// holes in the partition images should not have been written
+			if deviceBytes[offset+int(structure.Size)-1] != 0xFF {
+				t.Errorf("Expected the hole in structure %s to be skipped", structure.Name)
+			}
+		}
+		// only the partition identifiers are written to the output directory
+		expectedArtifacts := []outputArtifact{{"pc.partition-ids.json", "pc", "partition-ids"}}
+		if !reflect.DeepEqual(stateMachine.Artifacts, expectedArtifacts) {
+			t.Errorf("Expected artifacts %v, got %v", expectedArtifacts, stateMachine.Artifacts)
+		}
+		if !bytes.Equal(deviceBytes[440:444], []byte{0xCD, 0xAB, 0x34, 0x12}) {
+			t.Errorf("Expected the disk identifier given with --disk-guid, got %x", deviceBytes[440:444])
+		}
+	})
+}
+
+// TestFailedMakeDiskOnDevice tests failures when writing the image to a device
+func TestFailedMakeDiskOnDevice(t *testing.T) {
+	t.Run("test_failed_make_disk_on_device", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine StateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+
+		err := stateMachine.makeTemporaryDirectories()
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+
+		stateMachine.YamlFilePath = filepath.Join("testdata", "gadget-mbr.yaml")
+		err = stateMachine.loadGadgetYaml()
+		asserter.AssertErrNil(err, true)
+		err = stateMachine.calculateRootfsSize()
+		asserter.AssertErrNil(err, true)
+
+		device := filepath.Join(stateMachine.stateMachineFlags.WorkDir, "sdz")
+		err = ioutil.WriteFile(device, make([]byte, 4096), 0644)
+		asserter.AssertErrNil(err, true)
+		stateMachine.commonFlags.OutputDevice = device
+		stateMachine.commonFlags.ForceDevice = true
+		osStat = mockStatBlockDevice
+		defer func() {
+			osStat = os.Stat
+		}()
+
+		// the device is smaller than the image
+		err = stateMachine.makeDisk()
+		asserter.AssertErrContains(err, "is too small")
+
+		err = os.Truncate(device, int64(64*quantity.SizeMiB))
+		asserter.AssertErrNil(err, true)
+
+		// mock diskfs.Open
+		diskfsOpen = mockDiskfsOpen
+		defer func() {
+			diskfsOpen = diskfs.Open
+		}()
+		err = stateMachine.makeDisk()
+		asserter.AssertErrContains(err, "Error opening output device")
+		diskfsOpen = diskfs.Open
+
+		// the sector size of the device can't be changed
+		stateMachine.SectorSizes = map[string]quantity.Size{"pc": 4096}
+		err = stateMachine.makeDisk()
+		asserter.AssertErrContains(err, "Volume pc has 4096-byte sectors, but output device")
+		stateMachine.SectorSizes = nil
+
+		// there are no partition images to write
+		err = stateMachine.makeDisk()
+		asserter.AssertErrContains(err, "Error writing to output device")
+
+		// --output-device only supports one volume
+		stateMachine.YamlFilePath = filepath.Join("testdata", "gadget-multi.yaml")
+		err = stateMachine.loadGadgetYaml()
+		asserter.AssertErrContains(err, "--output-device can only be used with gadgets that have a single volume")
+	})
+}
+
+// setUpVerifyImage creates a state machine with the gadget-verify.yaml volume laid out,
+// and the disk image make_disk would have written for it
+func setUpVerifyImage(t *testing.T) (*StateMachine, string) {
+	asserter := helper.Asserter{T: t}
+	var stateMachine StateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	workDir, err := ioutil.TempDir("/tmp", "ubuntu-image-")
+	asserter.AssertErrNil(err, true)
+	stateMachine.stateMachineFlags.WorkDir = workDir
+	stateMachine.tempDirs.unpack = filepath.Join(workDir, "unpack")
+	stateMachine.tempDirs.volumes = filepath.Join(workDir, "volumes")
+	stateMachine.tempDirs.staging = filepath.Join(workDir, "staging")
+	for _, dir := range []string{filepath.Join(stateMachine.tempDirs.unpack, "gadget"),
+		filepath.Join(stateMachine.tempDirs.volumes, "pc"), stateMachine.tempDirs.staging} {
+		err = os.MkdirAll(dir, 0755)
+		asserter.AssertErrNil(err, true)
+	}
+	err = osutil.CopyFile(filepath.Join("testdata", "gadget_tree", "pc-boot.img"),
+		filepath.Join(stateMachine.tempDirs.unpack, "gadget", "pc-boot.img"), 0)
+	asserter.AssertErrNil(err, true)
+
+	gadgetYamlBytes, err := ioutil.ReadFile(filepath.Join("testdata", "gadget-verify.yaml"))
+	asserter.AssertErrNil(err, true)
+	stateMachine.GadgetInfo, err = gadget.InfoFromGadgetYaml(gadgetYamlBytes, nil)
+	asserter.AssertErrNil(err, true)
+	_, err = layoutGadget(stateMachine.GadgetInfo, nil)
+	asserter.AssertErrNil(err, true)
+
+	// write the raw content and the offset-write values as make_disk does
+	imgPath := filepath.Join(stateMachine.tempDirs.staging, "pc.img")
+	makeInspectImage(t, imgPath)
+	imgFile, err := os.OpenFile(imgPath, os.O_RDWR, 0)
+	asserter.AssertErrNil(err, true)
+	defer imgFile.Close()
+	pcBoot, err := ioutil.ReadFile(filepath.Join("testdata", "gadget_tree", "pc-boot.img"))
+	asserter.AssertErrNil(err, true)
+	_, err = imgFile.WriteAt(pcBoot, 0)
+	asserter.AssertErrNil(err, true)
+	err = writeOffsetValues(stateMachine.GadgetInfo.Volumes["pc"], imgPath, 512, 48*1024*1024)
+	asserter.AssertErrNil(err, true)
+	return &stateMachine, imgPath
+}
+
+// TestVerifyImage tests that the verify_image state accepts the disk images that
+// match the gadget.yaml
+func TestVerifyImage(t *testing.T) {
+	t.Run("test_verify_image", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		stateMachine, _ := setUpVerifyImage(t)
+		defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+
+		// fsck.vfat might not be available, so mock it
+		testCaseName = "TestVerifyImage"
+		execCommand = fakeExecCommand
+		defer func() {
+			execCommand = exec.Command
+		}()
+		err := stateMachine.verifyImage()
+		asserter.AssertErrNil(err, true)
+
+		// the copies of the partitions are removed
+		files, err := ioutil.ReadDir(filepath.Join(stateMachine.tempDirs.volumes, "pc"))
+		asserter.AssertErrNil(err, true)
+		if len(files) != 0 {
+			t.Errorf("Expected the partition copies to be removed, found %d files", len(files))
+		}
+
+		// nothing is verified without a disk image
+		stateMachine.commonFlags.NoDiskImage = true
+		stateMachine.tempDirs.staging = filepath.Join(stateMachine.stateMachineFlags.WorkDir, "missing")
+		err = stateMachine.verifyImage()
+		asserter.AssertErrNil(err, true)
+	})
+}
+
+// TestFailedVerifyImage tests that the verify_image state reports the differences
+// between the disk images and the gadget.yaml
+func TestFailedVerifyImage(t *testing.T) {
+	t.Run("test_failed_verify_image", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		stateMachine, imgPath := setUpVerifyImage(t)
+		defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+
+		testCaseName = "TestFailedVerifyImage"
+		execCommand = fakeExecCommand
+		defer func() {
+			execCommand = exec.Command
+		}()
+		err := stateMachine.verifyImage()
+		asserter.AssertErrContains(err, `structure #2 ("EFI System"): fsck.vfat reported errors in the vfat filesystem: Test Error`)
+		testCaseName = "TestVerifyImage"
+
+		// corrupt the raw content and the offset-write value
+		imgFile, err := os.OpenFile(imgPath, os.O_RDWR, 0)
+		asserter.AssertErrNil(err, true)
+		defer imgFile.Close()
+		_, err = imgFile.WriteAt([]byte{0xff}, 8)
+		asserter.AssertErrNil(err, true)
+		_, err = imgFile.WriteAt([]byte{0xff}, 92)
+		asserter.AssertErrNil(err, true)
+		err = stateMachine.verifyImage()
+		asserter.AssertErrContains(err, `structure #0 ("mbr"): content pc-boot.img differs from the image at byte 8`)
+		asserter.AssertErrContains(err, `structure #1 ("BIOS Boot"): expected offset-write value 2048 at byte 92, found 2303`)
+
+		// a different partition table
+		stateMachine.GadgetInfo.Volumes["pc"].Structure[2].Size = quantity.Size(32 * 1024 * 1024)
+		err = stateMachine.verifyImage()
+		asserter.AssertErrContains(err, `partition 2, structure #2 ("EFI System"): expected size 33554432, found 35651584`)
+
+		// mock os.OpenFile
+		osOpenFile = mockOpenFile
+		defer func() {
+			osOpenFile = os.OpenFile
+		}()
+		err = stateMachine.verifyImage()
+		asserter.AssertErrContains(err, "Error opening disk image")
+		osOpenFile = os.OpenFile
+
+		// mock helper.CopyBlob
+		stateMachine.GadgetInfo.Volumes["pc"].Structure[2].Size = quantity.Size(34 * 1024 * 1024)
+		_, err = imgFile.WriteAt([]byte{0x00, 0x08}, 92)
+		asserter.AssertErrNil(err, true)
+		_, err = imgFile.WriteAt([]byte("L"), 8)
+		asserter.AssertErrNil(err, true)
+		helperCopyBlob = mockCopyBlob
+		defer func() {
+			helperCopyBlob = helper.CopyBlob
+		}()
+		err = stateMachine.verifyImage()
+		asserter.AssertErrContains(err, "Error copying partition 2 out of the disk image")
 		helperCopyBlob = helper.CopyBlob
+
+		// mock ioutil.ReadFile
+		ioutilReadFile = mockReadFile
+		defer func() {
+			ioutilReadFile = ioutil.ReadFile
+		}()
+		err = stateMachine.verifyImage()
+		asserter.AssertErrContains(err, `Error reading content of structure "mbr"`)
+		ioutilReadFile = ioutil.ReadFile
+
+		// the disk image is missing
+		os.Remove(imgPath)
+		err = stateMachine.verifyImage()
+		asserter.AssertErrContains(err, "Error verifying disk image")
+	})
+}
+
+// TestPackageCloudImage tests that disk images are packaged for each cloud profile
+func TestPackageCloudImage(t *testing.T) {
+	testCases := []struct {
+		name             string
+		cloudProfile     string
+		expectedArtifact outputArtifact
+	}{
+		{"no_profile", "", outputArtifact{"pc.img", "pc", "disk-image"}},
+		{"aws", "aws", outputArtifact{"pc.img", "pc", "disk-image"}},
+		{"gce", "gce", outputArtifact{"pc.tar.gz", "pc", "gce-tarball"}},
+		{"azure", "azure", outputArtifact{"pc.vhd", "pc", "azure-vhd"}},
+	}
+	for _, tc := range testCases {
+		t.Run("test_package_cloud_image_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			var stateMachine StateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.commonFlags.CloudProfile = tc.cloudProfile
+
+			err := stateMachine.makeTemporaryDirectories()
+			asserter.AssertErrNil(err, true)
+			defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+			err = stateMachine.setupOutputDir()
+			asserter.AssertErrNil(err, true)
+
+			imgSize := int64(quantity.SizeMiB)
+			imgPath := filepath.Join(stateMachine.tempDirs.staging, "pc.img")
+			err = ioutil.WriteFile(imgPath, make([]byte, imgSize), 0644)
+			asserter.AssertErrNil(err, true)
+			stateMachine.recordArtifact("pc.img", "pc", "disk-image")
+
+			err = stateMachine.packageCloudImage()
+			asserter.AssertErrNil(err, true)
+
+			if len(stateMachine.Artifacts) != 1 || stateMachine.Artifacts[0] != tc.expectedArtifact {
+				t.Errorf("Expected artifacts [%v], got %v", tc.expectedArtifact, stateMachine.Artifacts)
+			}
+			artifactPath := filepath.Join(stateMachine.tempDirs.staging, tc.expectedArtifact.Name)
+			switch tc.cloudProfile {
+			case "gce":
+				tarBytes, err := exec.Command("tar", "--list", "--file", artifactPath).CombinedOutput()
+				asserter.AssertErrNil(err, true)
+				if strings.TrimSpace(string(tarBytes)) != "disk.raw" {
+					t.Errorf("Expected the tarball to only contain disk.raw, got \"%s\"", string(tarBytes))
+				}
+				if _, err := os.Stat(imgPath); err == nil {
+					t.Errorf("File %s should not exist, but does", imgPath)
+				}
+			case "azure":
+				vhdBytes, err := ioutil.ReadFile(artifactPath)
+				asserter.AssertErrNil(err, true)
+				if int64(len(vhdBytes)) != imgSize+512 {
+					t.Fatalf("Expected a %d byte VHD, got %d bytes", imgSize+512, len(vhdBytes))
+				}
+				if string(vhdBytes[imgSize:imgSize+8]) != "conectix" {
+					t.Errorf("Expected a VHD footer at the end of the image")
+				}
+			default:
+				imgInfo, err := os.Stat(artifactPath)
+				asserter.AssertErrNil(err, true)
+				if imgInfo.Size() != imgSize {
+					t.Errorf("Expected the raw image to be left untouched")
+				}
+			}
+		})
+	}
+}
+
+// TestFailedPackageCloudImage tests failures when packaging images for cloud providers
+func TestFailedPackageCloudImage(t *testing.T) {
+	t.Run("test_failed_package_cloud_image", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine StateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.commonFlags.CloudProfile = "gce"
+
+		err := stateMachine.makeTemporaryDirectories()
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+		err = stateMachine.setupOutputDir()
+		asserter.AssertErrNil(err, true)
+
+		imgPath := filepath.Join(stateMachine.tempDirs.staging, "pc.img")
+		err = ioutil.WriteFile(imgPath, make([]byte, 512), 0644)
+		asserter.AssertErrNil(err, true)
+		stateMachine.recordArtifact("pc.img", "pc", "disk-image")
+
+		// mock os.MkdirAll
+		osMkdirAll = mockMkdirAll
+		defer func() {
+			osMkdirAll = os.MkdirAll
+		}()
+		err = stateMachine.packageCloudImage()
+		asserter.AssertErrContains(err, "Error creating GCE directory")
+		osMkdirAll = os.MkdirAll
+
+		// mock os.Rename
+		osRename = mockRename
+		defer func() {
+			osRename = os.Rename
+		}()
+		err = stateMachine.packageCloudImage()
+		asserter.AssertErrContains(err, "Error moving disk image")
+		stateMachine.commonFlags.CloudProfile = "azure"
+		err = stateMachine.packageCloudImage()
+		asserter.AssertErrContains(err, "Error moving disk image")
+		osRename = os.Rename
+
+		// mock os.OpenFile
+		osOpenFile = mockOpenFile
+		defer func() {
+			osOpenFile = os.OpenFile
+		}()
+		err = stateMachine.packageCloudImage()
+		asserter.AssertErrContains(err, "Error opening VHD image")
+		osOpenFile = os.OpenFile
+
+		// the image was already moved to its VHD name, open it read-only so that
+		// the footer can't be written
+		stateMachine.Artifacts[0].Name = "pc.vhd"
+		osOpenFile = mockOpenFileReadOnly
+		err = stateMachine.packageCloudImage()
+		asserter.AssertErrContains(err, "Error writing VHD footer")
+		osOpenFile = os.OpenFile
+
+		// make tar fail
+		stateMachine.commonFlags.CloudProfile = "gce"
+		testCaseName = "TestFailedPackageCloudImage"
+		execCommand = fakeExecCommand
+		defer func() {
+			execCommand = exec.Command
+		}()
+		err = stateMachine.packageCloudImage()
+		asserter.AssertErrContains(err, "Error creating GCE tarball")
+	})
+}
+
+// TestExportPartitions tests a successful run of the exportPartitions state and
+// ensures that the partition images and the manifest describing them are created
+func TestExportPartitions(t *testing.T) {
+	t.Run("test_export_partitions", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine StateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.commonFlags.ExportPartitions = true
+
+		// need workdir set up for this
+		err := stateMachine.makeTemporaryDirectories()
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+
+		// also set up an output directory
+		outDir, err := ioutil.TempDir("/tmp", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(outDir)
+		stateMachine.commonFlags.OutputDir = outDir
+
+		stateMachine.YamlFilePath = filepath.Join("testdata", "gadget-gpt.yaml")
+		err = stateMachine.loadGadgetYaml()
+		asserter.AssertErrNil(err, true)
+
+		// create fake partition images for every structure except the rootfs
+		volume := stateMachine.GadgetInfo.Volumes["pc"]
+		for structureNumber, structure := range volume.Structure {
+			if structure.Role == gadget.SystemData {
+				continue
+			}
+			partImg := filepath.Join(stateMachine.tempDirs.volumes, "pc",
+				"part"+strconv.Itoa(structureNumber)+".img")
+			err = ioutil.WriteFile(partImg, []byte(structure.Name), 0644)
+			asserter.AssertErrNil(err, true)
+		}
+
+		err = stateMachine.exportPartitions()
+		asserter.AssertErrNil(err, true)
+
+		manifestBytes, err := ioutil.ReadFile(filepath.Join(stateMachine.tempDirs.staging,
+			"pc.partitions.json"))
+		asserter.AssertErrNil(err, true)
+		var manifest exportedVolume
+		err = json.Unmarshal(manifestBytes, &manifest)
+		asserter.AssertErrNil(err, true)
+
+		expectedImages := []string{"pc.mbr.img", "pc.BIOS-Boot.img", "pc.EFI-System.img"}
+		if len(manifest.Partitions) != len(expectedImages) {
+			t.Fatalf("Expected %d exported partitions, got %d",
+				len(expectedImages), len(manifest.Partitions))
+		}
+		for ii, partition := range manifest.Partitions {
+			if partition.Image != expectedImages[ii] {
+				t.Errorf("Expected exported image %s, got %s", expectedImages[ii], partition.Image)
+			}
+			if _, err := os.Stat(filepath.Join(stateMachine.tempDirs.staging, partition.Image)); err != nil {
+				t.Errorf("File %s should exist, but does not", partition.Image)
+			}
+		}
+		if manifest.Partitions[2].GPTType != "C12A7328-F81F-11D2-BA4B-00A0C93EC93B" ||
+			manifest.Partitions[2].Filesystem != "vfat" ||
+			manifest.Partitions[2].Label != "system-boot" ||
+			manifest.Partitions[2].Offset != uint64(2*quantity.OffsetMiB) {
+			t.Errorf("Unexpected values in partition manifest: %+v", manifest.Partitions[2])
+		}
+		// sha256 of "mbr"
+		mbrChecksum := "f5662649c772d7d7c017ebf21784239b8a28836551f1d507dbb9f015240290ed"
+		if manifest.Partitions[0].SHA256 != mbrChecksum {
+			t.Errorf("Expected checksum %s, got %s", mbrChecksum, manifest.Partitions[0].SHA256)
+		}
+
+		// structures with the same name get a suffix that doesn't clash with the
+		// names of the other structures
+		volume.Structure[1].Name = "mbr-2"
+		volume.Structure[2].Name = "mbr"
+		err = stateMachine.exportPartitions()
+		asserter.AssertErrNil(err, true)
+		manifestBytes, err = ioutil.ReadFile(filepath.Join(stateMachine.tempDirs.staging,
+			"pc.partitions.json"))
+		asserter.AssertErrNil(err, true)
+		err = json.Unmarshal(manifestBytes, &manifest)
+		asserter.AssertErrNil(err, true)
+		expectedImages = []string{"pc.mbr.img", "pc.mbr-2.img", "pc.mbr-3.img"}
+		for ii, partition := range manifest.Partitions {
+			if partition.Image != expectedImages[ii] {
+				t.Errorf("Expected exported image %s, got %s", expectedImages[ii], partition.Image)
+			}
+		}
+	})
+}
+
+// TestFailedExportPartitions tests failures in the exportPartitions state
+func TestFailedExportPartitions(t *testing.T) {
+	t.Run("test_failed_export_partitions", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine StateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.commonFlags.ExportPartitions = true
+
+		// need workdir set up for this
+		err := stateMachine.makeTemporaryDirectories()
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+		stateMachine.commonFlags.OutputDir = stateMachine.stateMachineFlags.WorkDir
+
+		stateMachine.YamlFilePath = filepath.Join("testdata", "gadget-mbr.yaml")
+		err = stateMachine.loadGadgetYaml()
+		asserter.AssertErrNil(err, true)
+
+		// mock ioutil.WriteFile
+		ioutilWriteFile = mockWriteFile
+		defer func() {
+			ioutilWriteFile = ioutil.WriteFile
+		}()
+		err = stateMachine.exportPartitions()
+		asserter.AssertErrContains(err, "Error writing partition manifest")
+		ioutilWriteFile = ioutil.WriteFile
+
+		// create a partition image and mock osutil.CopyFile
+		partImg := filepath.Join(stateMachine.tempDirs.volumes, "pc", "part0.img")
+		err = ioutil.WriteFile(partImg, []byte("mbr"), 0644)
+		asserter.AssertErrNil(err, true)
+		osutilCopyFile = mockCopyFile
+		defer func() {
+			osutilCopyFile = osutil.CopyFile
+		}()
+		err = stateMachine.exportPartitions()
+		asserter.AssertErrContains(err, "Error exporting partition image")
+		osutilCopyFile = osutil.CopyFile
+	})
+}
+
+// TestGenerateRootfsArtifacts tests that a tarball and a squashfs of the rootfs
+// can be created and that they are recorded as build artifacts
+func TestGenerateRootfsArtifacts(t *testing.T) {
+	t.Run("test_generate_rootfs_artifacts", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine StateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.commonFlags.RootfsTarball = true
+
+		// need workdir set up for this
+		err := stateMachine.makeTemporaryDirectories()
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+		stateMachine.tempDirs.rootfs = filepath.Join("testdata", "filesystem")
+
+		// set up an output directory
+		outDir, err := ioutil.TempDir("/tmp", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(outDir)
+		stateMachine.commonFlags.OutputDir = outDir
+
+		err = stateMachine.generateRootfsArtifacts()
+		asserter.AssertErrNil(err, true)
+
+		// make sure the contents of the rootfs made it in the tarball
+		tarPath := filepath.Join(stateMachine.tempDirs.staging, "rootfs.tar.gz")
+		tarBytes, err := exec.Command("tar", "--list", "--file", tarPath).CombinedOutput()
+		asserter.AssertErrNil(err, true)
+		if !strings.Contains(string(tarBytes), "./testfile") {
+			t.Errorf("Expected rootfs tarball to contain ./testfile, got \"%s\"", string(tarBytes))
+		}
+
+		// mksquashfs might not be available, so mock it
+		testCaseName = "TestGenerateRootfsArtifacts"
+		execCommand = fakeExecCommand
+		defer func() {
+			execCommand = exec.Command
+		}()
+		stateMachine.commonFlags.RootfsTarball = false
+		stateMachine.commonFlags.RootfsSquashfs = true
+		err = stateMachine.generateRootfsArtifacts()
+		asserter.AssertErrNil(err, true)
+		execCommand = exec.Command
+
+		expectedArtifacts := []outputArtifact{
+			{"rootfs.tar.gz", "", "rootfs-tarball"},
+			{"rootfs.squashfs", "", "rootfs-squashfs"},
+		}
+		if len(stateMachine.Artifacts) != len(expectedArtifacts) {
+			t.Fatalf("Expected artifacts %v, got %v", expectedArtifacts, stateMachine.Artifacts)
+		}
+		for ii, artifact := range expectedArtifacts {
+			if stateMachine.Artifacts[ii] != artifact {
+				t.Errorf("Expected artifact %v, got %v", artifact, stateMachine.Artifacts[ii])
+			}
+		}
+	})
+}
+
+// TestFailedGenerateRootfsArtifacts tests failures in the generateRootfsArtifacts state
+func TestFailedGenerateRootfsArtifacts(t *testing.T) {
+	t.Run("test_failed_generate_rootfs_artifacts", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine StateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.commonFlags.RootfsTarball = true
+		stateMachine.commonFlags.OutputDir = filepath.Join("/tmp", "ubuntu-image-"+uuid.NewString())
+		defer os.RemoveAll(stateMachine.commonFlags.OutputDir)
+
+		// need workdir set up for this
+		err := stateMachine.makeTemporaryDirectories()
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+
+		// mock os.MkdirAll
+		osMkdirAll = mockMkdirAll
+		defer func() {
+			osMkdirAll = os.MkdirAll
+		}()
+		err = stateMachine.generateRootfsArtifacts()
+		asserter.AssertErrContains(err, "Error creating staging directory")
+		osMkdirAll = os.MkdirAll
+
+		// make tar and mksquashfs fail
+		testCaseName = "TestFailedGenerateRootfsArtifacts"
+		execCommand = fakeExecCommand
+		defer func() {
+			execCommand = exec.Command
+		}()
+		err = stateMachine.generateRootfsArtifacts()
+		asserter.AssertErrContains(err, "Error creating rootfs tarball")
+
+		stateMachine.commonFlags.RootfsTarball = false
+		stateMachine.commonFlags.RootfsSquashfs = true
+		err = stateMachine.generateRootfsArtifacts()
+		asserter.AssertErrContains(err, "Error creating rootfs squashfs")
+	})
+}
+
+// TestImageFileList ensures that the paths to the created images are written
+// to the file passed with --image-file-list
+func TestImageFileList(t *testing.T) {
+	t.Run("test_image_file_list", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine StateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+
+		workDir, err := ioutil.TempDir("/tmp", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(workDir)
+		stateMachine.commonFlags.OutputDir = workDir
+		stateMachine.commonFlags.ImageFileList = filepath.Join(workDir, "image-files.txt")
+		stateMachine.recordArtifact("pc.img", "pc", "disk-image")
+		stateMachine.recordArtifact("rootfs.tar.gz", "", "rootfs-tarball")
+		stateMachine.recordArtifact("pc.img", "pc", "disk-image")
+		stateMachine.recordArtifact("filesystem.manifest", "", "manifest")
+
+		err = stateMachine.finish()
+		asserter.AssertErrNil(err, true)
+
+		imageFileList, err := ioutil.ReadFile(stateMachine.commonFlags.ImageFileList)
+		asserter.AssertErrNil(err, true)
+		expected := filepath.Join(workDir, "pc.img") + "\n" +
+			filepath.Join(workDir, "rootfs.tar.gz") + "\n"
+		if string(imageFileList) != expected {
+			t.Errorf("Expected image file list \"%s\", got \"%s\"", expected, string(imageFileList))
+		}
+
+		// mock ioutil.WriteFile
+		ioutilWriteFile = mockWriteFile
+		defer func() {
+			ioutilWriteFile = ioutil.WriteFile
+		}()
+		err = stateMachine.finish()
+		asserter.AssertErrContains(err, "Error writing image file list")
+	})
+}
+
+// TestImageFileListJSON ensures that every artifact is described in the file passed
+// with --image-file-list-json
+func TestImageFileListJSON(t *testing.T) {
+	t.Run("test_image_file_list_json", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine StateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+
+		err := stateMachine.makeTemporaryDirectories()
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+
+		outDir, err := ioutil.TempDir("/tmp", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(outDir)
+		stateMachine.commonFlags.OutputDir = outDir
+		stateMachine.commonFlags.ImageFileListJSON = filepath.Join(
+			stateMachine.stateMachineFlags.WorkDir, "artifacts.json")
+
+		// stage an image and a manifest to be published
+		err = stateMachine.setupOutputDir()
+		asserter.AssertErrNil(err, true)
+		err = ioutil.WriteFile(filepath.Join(stateMachine.tempDirs.staging, "pc.img"),
+			[]byte("mbr"), 0644)
+		asserter.AssertErrNil(err, true)
+		stateMachine.recordArtifact("pc.img", "pc", "disk-image")
+		err = ioutil.WriteFile(filepath.Join(stateMachine.tempDirs.staging, "snaps.manifest"),
+			[]byte("core20 1234\n"), 0644)
+		asserter.AssertErrNil(err, true)
+		stateMachine.recordArtifact("snaps.manifest", "", "manifest")
+
+		err = stateMachine.finish()
+		asserter.AssertErrNil(err, true)
+
+		artifactBytes, err := ioutil.ReadFile(stateMachine.commonFlags.ImageFileListJSON)
+		asserter.AssertErrNil(err, true)
+		var artifactList map[string][]listedArtifact
+		err = json.Unmarshal(artifactBytes, &artifactList)
+		asserter.AssertErrNil(err, true)
+		expected := []listedArtifact{
+			{filepath.Join(outDir, "pc.img"), "disk-image", "pc", 3,
+				"f5662649c772d7d7c017ebf21784239b8a28836551f1d507dbb9f015240290ed", "raw"},
+			{filepath.Join(outDir, "snaps.manifest"), "manifest", "", 12,
+				"", "text"},
+		}
+		if len(artifactList["artifacts"]) != len(expected) {
+			t.Fatalf("Expected artifacts %v, got %v", expected, artifactList["artifacts"])
+		}
+		for ii, artifact := range artifactList["artifacts"] {
+			if expected[ii].SHA256 == "" {
+				expected[ii].SHA256 = artifact.SHA256
+			}
+			if artifact != expected[ii] {
+				t.Errorf("Expected artifact %v, got %v", expected[ii], artifact)
+			}
+		}
+
+		// mock ioutil.WriteFile
+		stateMachine.commonFlags.OverwritePolicy = "replace"
+		ioutilWriteFile = mockWriteFile
+		defer func() {
+			ioutilWriteFile = ioutil.WriteFile
+		}()
+		err = stateMachine.finish()
+		asserter.AssertErrContains(err, "Error writing artifact list")
+		ioutilWriteFile = ioutil.WriteFile
+
+		// the listed files have to exist
+		os.Remove(filepath.Join(outDir, "pc.img"))
+		err = stateMachine.finish()
+		asserter.AssertErrContains(err, "Error getting size of")
+	})
+}
+
+// TestNoDiskImage ensures that no disk image is created when --no-disk-image is used
+func TestNoDiskImage(t *testing.T) {
+	t.Run("test_no_disk_image", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine StateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.commonFlags.NoDiskImage = true
+
+		// need workdir set up for this
+		err := stateMachine.makeTemporaryDirectories()
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+
+		stateMachine.YamlFilePath = filepath.Join("testdata", "gadget-gpt.yaml")
+		err = stateMachine.loadGadgetYaml()
+		asserter.AssertErrNil(err, true)
+
+		err = stateMachine.makeDisk()
+		asserter.AssertErrNil(err, true)
+
+		// the output dir still has to be set for the following states
+		if stateMachine.commonFlags.OutputDir == "" {
+			t.Errorf("Expected the output directory to be set")
+		}
+		imgPath := filepath.Join(stateMachine.commonFlags.OutputDir, "pc.img")
+		if _, err := os.Stat(imgPath); err == nil {
+			t.Errorf("File %s should not exist, but does", imgPath)
+		}
+		if len(stateMachine.Artifacts) != 0 {
+			t.Errorf("Expected no artifacts, got %v", stateMachine.Artifacts)
+		}
 	})
 }
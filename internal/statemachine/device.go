@@ -0,0 +1,233 @@
+package statemachine
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/diskfs/go-diskfs/disk"
+	"github.com/snapcore/snapd/gadget"
+)
+
+// checkOutputDevice makes sure that --output-device is a block device that is safe to
+// overwrite: none of its partitions can be mounted or used as swap, it has to hold at
+// least minSize bytes, and non-removable devices require --force-output-device
+func (stateMachine *StateMachine) checkOutputDevice(minSize int64) error {
+	device, err := filepath.EvalSymlinks(stateMachine.commonFlags.OutputDevice)
+	if err != nil {
+		return fmt.Errorf("Error finding output device: %s", err.Error())
+	}
+	deviceInfo, err := osStat(device)
+	if err != nil {
+		return fmt.Errorf("Error finding output device: %s", err.Error())
+	}
+	if deviceInfo.Mode()&os.ModeDevice == 0 || deviceInfo.Mode()&os.ModeCharDevice != 0 {
+		return fmt.Errorf("Output device %s is not a block device", device)
+	}
+
+	// check the device itself as well as all of its partitions
+	deviceName := filepath.Base(device)
+	for _, usageFile := range []string{procMountsPath, procSwapsPath} {
+		usageBytes, err := ioutilReadFile(usageFile)
+		if err != nil {
+			return fmt.Errorf("Error reading %s: %s", usageFile, err.Error())
+		}
+		for _, line := range strings.Split(string(usageBytes), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) == 0 || !strings.HasPrefix(fields[0], "/dev/") {
+				continue
+			}
+			source := fields[0]
+			if resolved, err := filepath.EvalSymlinks(source); err == nil {
+				source = resolved
+			}
+			if isDeviceOrPartition(deviceName, filepath.Base(source)) {
+				return fmt.Errorf("Output device %s is in use: %s is mounted or used as swap",
+					device, source)
+			}
+		}
+	}
+
+	if !stateMachine.commonFlags.ForceDevice && !strings.HasPrefix(deviceName, "loop") {
+		removable, err := ioutilReadFile(filepath.Join(sysClassBlockPath, deviceName, "removable"))
+		if err != nil || strings.TrimSpace(string(removable)) != "1" {
+			return fmt.Errorf("Output device %s is not removable and might be a system disk. "+
+				"Use --force-output-device to write to it anyway", device)
+		}
+	}
+
+	if minSize > 0 {
+		deviceFile, err := osOpenFile(device, os.O_RDONLY, 0)
+		if err != nil {
+			return fmt.Errorf("Error opening output device: %s", err.Error())
+		}
+		defer deviceFile.Close()
+		deviceSize, err := deviceFile.Seek(0, io.SeekEnd)
+		if err != nil {
+			return fmt.Errorf("Error getting size of output device: %s", err.Error())
+		}
+		if deviceSize < minSize {
+			return fmt.Errorf("Output device %s is too small: the image needs %d bytes, "+
+				"but the device only has %d", device, minSize, deviceSize)
+		}
+	}
+	return nil
+}
+
+// isDeviceOrPartition checks whether name is the block device deviceName or one of
+// its partitions, e.g. sdb1 for sdb or mmcblk0p2 for mmcblk0. Partitions of devices
+// whose name ends with a digit are separated with a "p"
+func isDeviceOrPartition(deviceName, name string) bool {
+	if name == deviceName {
+		return true
+	}
+	prefix := deviceName
+	if lastChar := deviceName[len(deviceName)-1]; lastChar >= '0' && lastChar <= '9' {
+		prefix += "p"
+	}
+	if !strings.HasPrefix(name, prefix) {
+		return false
+	}
+	_, err := strconv.Atoi(strings.TrimPrefix(name, prefix))
+	return err == nil
+}
+
+// lseek whence values used to find the allocated regions of sparse files
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+// dataExtents returns the offsets and lengths of the regions of a file that contain
+// data. The whole file is returned if the filesystem can not report holes
+func dataExtents(file *os.File) ([][2]int64, error) {
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := fileInfo.Size()
+	var extents [][2]int64
+	var offset int64
+	for offset < size {
+		dataStart, err := file.Seek(offset, seekData)
+		if err != nil {
+			if errors.Is(err, syscall.ENXIO) {
+				// only a hole remains
+				break
+			}
+			return [][2]int64{{0, size}}, nil
+		}
+		dataEnd, err := file.Seek(dataStart, seekHole)
+		if err != nil {
+			return [][2]int64{{0, size}}, nil
+		}
+		extents = append(extents, [2]int64{dataStart, dataEnd - dataStart})
+		offset = dataEnd
+	}
+	return extents, nil
+}
+
+// copyMappedRegions writes the regions of partImg that contain data to the device at
+// the given offset. Holes are skipped, which saves writing the unused parts of sparse
+// filesystem images to slow media
+func copyMappedRegions(partImg string, device *os.File, offset int64) error {
+	partFile, err := os.Open(partImg)
+	if err != nil {
+		return err
+	}
+	defer partFile.Close()
+	extents, err := dataExtents(partFile)
+	if err != nil {
+		return err
+	}
+	const chunkSize = 1024 * 1024
+	buffer := make([]byte, chunkSize)
+	for _, extent := range extents {
+		for position := extent[0]; position < extent[0]+extent[1]; position += chunkSize {
+			length := extent[0] + extent[1] - position
+			if length > chunkSize {
+				length = chunkSize
+			}
+			if _, err := partFile.ReadAt(buffer[:length], position); err != nil {
+				return err
+			}
+			if _, err := device.WriteAt(buffer[:length], offset+position); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// verifyMappedRegions reads back the regions of partImg that contain data from the
+// device and compares them with the partition image
+func verifyMappedRegions(partImg string, device *os.File, offset int64) error {
+	partFile, err := os.Open(partImg)
+	if err != nil {
+		return err
+	}
+	defer partFile.Close()
+	extents, err := dataExtents(partFile)
+	if err != nil {
+		return err
+	}
+	const chunkSize = 1024 * 1024
+	expected := make([]byte, chunkSize)
+	actual := make([]byte, chunkSize)
+	for _, extent := range extents {
+		for position := extent[0]; position < extent[0]+extent[1]; position += chunkSize {
+			length := extent[0] + extent[1] - position
+			if length > chunkSize {
+				length = chunkSize
+			}
+			if _, err := partFile.ReadAt(expected[:length], position); err != nil {
+				return err
+			}
+			if _, err := device.ReadAt(actual[:length], offset+position); err != nil {
+				return err
+			}
+			if !bytes.Equal(expected[:length], actual[:length]) {
+				return fmt.Errorf("data at offset %d does not match %s", offset+position, partImg)
+			}
+		}
+	}
+	return nil
+}
+
+// writeToDevice copies the partition images of a volume to the block device and then
+// reads them back to make sure they were written correctly
+func (stateMachine *StateMachine) writeToDevice(volumeName string, volume *gadget.Volume,
+	diskImg *disk.Disk) error {
+	for structureNumber, structure := range volume.Structure {
+		if shouldSkipStructure(structure, stateMachine.IsSeeded) {
+			continue
+		}
+		partImg := filepath.Join(stateMachine.tempDirs.volumes, volumeName,
+			"part"+strconv.Itoa(structureNumber)+".img")
+		offset := int64(getStructureOffset(structure))
+		if err := copyMappedRegions(partImg, diskImg.File, offset); err != nil {
+			return fmt.Errorf("Error writing to output device: %s", err.Error())
+		}
+	}
+	if err := diskImg.File.Sync(); err != nil {
+		return fmt.Errorf("Error flushing output device: %s", err.Error())
+	}
+	for structureNumber, structure := range volume.Structure {
+		if shouldSkipStructure(structure, stateMachine.IsSeeded) {
+			continue
+		}
+		partImg := filepath.Join(stateMachine.tempDirs.volumes, volumeName,
+			"part"+strconv.Itoa(structureNumber)+".img")
+		offset := int64(getStructureOffset(structure))
+		if err := verifyMappedRegions(partImg, diskImg.File, offset); err != nil {
+			return fmt.Errorf("Error verifying output device: %s", err.Error())
+		}
+	}
+	return nil
+}
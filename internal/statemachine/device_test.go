@@ -0,0 +1,107 @@
+// This file contains unit tests for writing images to block devices
+package statemachine
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+)
+
+// TestCheckOutputDevice tests the safety checks done before writing to --output-device
+func TestCheckOutputDevice(t *testing.T) {
+	testCases := []struct {
+		name        string
+		blockDevice bool
+		mounts      string
+		swaps       string
+		removable   string
+		force       bool
+		minSize     int64
+		errMsg      string
+	}{
+		{"removable_device", true, "", "", "1", false, 4096, ""},
+		{"not_block_device", false, "", "", "1", false, 0, "is not a block device"},
+		{"mounted_partition", true, "/dev/sdz1 /mnt ext4 rw 0 0\n", "", "1", false, 0, "is in use"},
+		{"mounted_device", true, "/dev/sdz /mnt vfat rw 0 0\n", "", "1", false, 0, "is in use"},
+		{"other_device_mounted", true, "/dev/sdz10x /mnt ext4 rw 0 0\nproc /proc proc rw 0 0\n", "", "1", false, 0, ""},
+		{"swap_partition", true, "", "Filename Type Size Used Priority\n/dev/sdz2 partition 1024 0 -2\n", "1", false, 0, "is in use"},
+		{"system_disk", true, "", "", "0", false, 0, "is not removable"},
+		{"forced_system_disk", true, "", "", "0", true, 0, ""},
+		{"too_small", true, "", "", "1", false, 8192, "is too small"},
+	}
+	for _, tc := range testCases {
+		t.Run("test_check_output_device_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			testDir, err := ioutil.TempDir("/tmp", "ubuntu-image-")
+			asserter.AssertErrNil(err, true)
+			defer os.RemoveAll(testDir)
+
+			// set up a fake device along with its /proc and /sys entries
+			device := filepath.Join(testDir, "sdz")
+			err = ioutil.WriteFile(device, make([]byte, 4096), 0644)
+			asserter.AssertErrNil(err, true)
+			procMountsPath = filepath.Join(testDir, "mounts")
+			procSwapsPath = filepath.Join(testDir, "swaps")
+			sysClassBlockPath = filepath.Join(testDir, "block")
+			defer func() {
+				procMountsPath = "/proc/mounts"
+				procSwapsPath = "/proc/swaps"
+				sysClassBlockPath = "/sys/class/block"
+			}()
+			err = ioutil.WriteFile(procMountsPath, []byte(tc.mounts), 0644)
+			asserter.AssertErrNil(err, true)
+			err = ioutil.WriteFile(procSwapsPath, []byte(tc.swaps), 0644)
+			asserter.AssertErrNil(err, true)
+			err = os.MkdirAll(filepath.Join(sysClassBlockPath, "sdz"), 0755)
+			asserter.AssertErrNil(err, true)
+			err = ioutil.WriteFile(filepath.Join(sysClassBlockPath, "sdz", "removable"),
+				[]byte(tc.removable+"\n"), 0644)
+			asserter.AssertErrNil(err, true)
+			if tc.blockDevice {
+				osStat = mockStatBlockDevice
+				defer func() {
+					osStat = os.Stat
+				}()
+			}
+
+			var stateMachine StateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.commonFlags.OutputDevice = device
+			stateMachine.commonFlags.ForceDevice = tc.force
+			err = stateMachine.checkOutputDevice(tc.minSize)
+			if tc.errMsg == "" {
+				asserter.AssertErrNil(err, true)
+			} else {
+				asserter.AssertErrContains(err, tc.errMsg)
+			}
+		})
+	}
+}
+
+// TestIsDeviceOrPartition tests matching block devices with their partitions
+func TestIsDeviceOrPartition(t *testing.T) {
+	testCases := []struct {
+		device   string
+		name     string
+		expected bool
+	}{
+		{"sdb", "sdb", true},
+		{"sdb", "sdb1", true},
+		{"sdb", "sdba", false},
+		{"sdb", "sdb1a", false},
+		{"mmcblk0", "mmcblk0p2", true},
+		{"loop1", "loop10", false},
+		{"loop1", "loop1p1", true},
+		{"nvme0n1", "nvme0n1p1", true},
+		{"sdb", "sda1", false},
+	}
+	for _, tc := range testCases {
+		if isDeviceOrPartition(tc.device, tc.name) != tc.expected {
+			t.Errorf("Expected isDeviceOrPartition(%s, %s) to be %t",
+				tc.device, tc.name, tc.expected)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package statemachine
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// dpkgPackage is a package listed in the dpkg status database of a rootfs
+type dpkgPackage struct {
+	Name          string `json:"name"`
+	Version       string `json:"version"`
+	Architecture  string `json:"architecture"`
+	Source        string `json:"source"`
+	SourceVersion string `json:"source-version"`
+	Status        string `json:"status"`
+	Supplier      string `json:"-"`
+}
+
+// dpkgLicenses maps the license short names used in machine-readable debian/copyright
+// files to SPDX license identifiers
+var dpkgLicenses = map[string]string{
+	"apache-2.0":       "Apache-2.0",
+	"artistic":         "Artistic-1.0",
+	"artistic-2.0":     "Artistic-2.0",
+	"bsd-2-clause":     "BSD-2-Clause",
+	"bsd-3-clause":     "BSD-3-Clause",
+	"bsd-4-clause":     "BSD-4-Clause",
+	"cc0-1.0":          "CC0-1.0",
+	"expat":            "MIT",
+	"gfdl-1.2+":        "GFDL-1.2-or-later",
+	"gfdl-1.3+":        "GFDL-1.3-or-later",
+	"gpl-1+":           "GPL-1.0-or-later",
+	"gpl-2":            "GPL-2.0-only",
+	"gpl-2+":           "GPL-2.0-or-later",
+	"gpl-3":            "GPL-3.0-only",
+	"gpl-3+":           "GPL-3.0-or-later",
+	"isc":              "ISC",
+	"lgpl-2":           "LGPL-2.0-only",
+	"lgpl-2+":          "LGPL-2.0-or-later",
+	"lgpl-2.1":         "LGPL-2.1-only",
+	"lgpl-2.1+":        "LGPL-2.1-or-later",
+	"lgpl-3":           "LGPL-3.0-only",
+	"lgpl-3+":          "LGPL-3.0-or-later",
+	"mit":              "MIT",
+	"mpl-1.1":          "MPL-1.1",
+	"mpl-2.0":          "MPL-2.0",
+	"openssl":          "OpenSSL",
+	"python-2.0":       "Python-2.0",
+	"zlib":             "Zlib",
+	"public-domain":    "LicenseRef-public-domain",
+	"permissive":       "LicenseRef-permissive",
+	"x11":              "X11",
+	"unicode-dfs-2016": "Unicode-DFS-2016",
+}
+
+// spdxIDChars matches the characters that are not allowed in SPDX identifiers
+var spdxIDChars = regexp.MustCompile(`[^A-Za-z0-9.-]+`)
+
+// parseControlFile parses a file made of RFC 822 style paragraphs, such as the dpkg
+// status database or a machine-readable debian/copyright file. Continuation lines are
+// joined to the value of their field with a newline
+func parseControlFile(reader io.Reader) ([]map[string]string, error) {
+	var paragraphs []map[string]string
+	paragraph := make(map[string]string)
+	var field string
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.TrimSpace(line) == "":
+			if len(paragraph) > 0 {
+				paragraphs = append(paragraphs, paragraph)
+				paragraph = make(map[string]string)
+			}
+			field = ""
+		case line[0] == ' ' || line[0] == '\t':
+			if field == "" {
+				return nil, fmt.Errorf("continuation line without a field: %q", line)
+			}
+			paragraph[field] += "\n" + strings.TrimSpace(line)
+		case line[0] == '#':
+			continue
+		default:
+			separator := strings.Index(line, ":")
+			if separator < 1 {
+				return nil, fmt.Errorf("invalid line: %q", line)
+			}
+			field = line[:separator]
+			paragraph[field] = strings.TrimSpace(line[separator+1:])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(paragraph) > 0 {
+		paragraphs = append(paragraphs, paragraph)
+	}
+	return paragraphs, nil
+}
+
+// readDpkgStatus returns the packages of the dpkg status database of rootfs, sorted by
+// name. Packages that are not installed and only have configuration files left are
+// skipped. The status is the last word of the Status field, such as "installed" or
+// "half-configured"
+func readDpkgStatus(rootfs string) ([]dpkgPackage, error) {
+	statusFile, err := os.Open(filepath.Join(rootfs, "var", "lib", "dpkg", "status"))
+	if err != nil {
+		return nil, fmt.Errorf("Error opening dpkg status: %s", err.Error())
+	}
+	defer statusFile.Close()
+	paragraphs, err := parseControlFile(statusFile)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing dpkg status: %s", err.Error())
+	}
+
+	var packages []dpkgPackage
+	for _, paragraph := range paragraphs {
+		statusFields := strings.Fields(paragraph["Status"])
+		if len(statusFields) != 3 {
+			return nil, fmt.Errorf("Error parsing dpkg status: invalid status \"%s\" for package %s",
+				paragraph["Status"], paragraph["Package"])
+		}
+		status := statusFields[2]
+		if status == "not-installed" || status == "config-files" {
+			continue
+		}
+		dpkgPkg := dpkgPackage{
+			Name:          paragraph["Package"],
+			Version:       paragraph["Version"],
+			Architecture:  paragraph["Architecture"],
+			Source:        paragraph["Package"],
+			SourceVersion: paragraph["Version"],
+			Status:        status,
+			Supplier:      dpkgSupplier(paragraph),
+		}
+		// Source is either "name" or "name (version)" when it differs from the binary
+		if source := strings.Fields(paragraph["Source"]); len(source) > 0 {
+			dpkgPkg.Source = source[0]
+			if len(source) > 1 {
+				dpkgPkg.SourceVersion = strings.Trim(source[1], "()")
+			}
+		}
+		packages = append(packages, dpkgPkg)
+	}
+	sort.Slice(packages, func(i, j int) bool {
+		if packages[i].Name == packages[j].Name {
+			return packages[i].Architecture < packages[j].Architecture
+		}
+		return packages[i].Name < packages[j].Name
+	})
+	return packages, nil
+}
+
+// dpkgSupplier returns the SPDX supplier of a package from its Origin field, or from its
+// Maintainer field, which is usually a team for distribution packages. NOASSERTION is
+// returned when the package has neither
+func dpkgSupplier(paragraph map[string]string) string {
+	if origin := paragraph["Origin"]; origin != "" {
+		return "Organization: " + origin
+	}
+	maintainer := paragraph["Maintainer"]
+	if maintainer == "" {
+		return "NOASSERTION"
+	}
+	// the Maintainer field is "name <email>", SPDX expects "name (email)"
+	if start := strings.Index(maintainer, "<"); start != -1 && strings.HasSuffix(maintainer, ">") {
+		maintainer = strings.TrimSpace(maintainer[:start]) + " (" +
+			maintainer[start+1:len(maintainer)-1] + ")"
+	}
+	return "Organization: " + maintainer
+}
+
+// readPackageLicenses returns the distinct License fields of the Files paragraphs of the
+// machine-readable /usr/share/doc/<package>/copyright file of a package, sorted, or nil if
+// the file is missing or is not machine-readable. Only the first line of each field is
+// kept, as the rest is the text of the license
+func readPackageLicenses(rootfs, packageName string) []string {
+	copyrightFile, err := os.Open(filepath.Join(rootfs, "usr", "share", "doc", packageName, "copyright"))
+	if err != nil {
+		return nil
+	}
+	defer copyrightFile.Close()
+	paragraphs, err := parseControlFile(copyrightFile)
+	if err != nil || len(paragraphs) == 0 || paragraphs[0]["Format"] == "" {
+		return nil
+	}
+
+	licenseSet := make(map[string]bool)
+	for _, paragraph := range paragraphs[1:] {
+		license, found := paragraph["License"]
+		if !found || paragraph["Files"] == "" {
+			continue
+		}
+		if license = strings.TrimSpace(strings.SplitN(license, "\n", 2)[0]); license != "" {
+			licenseSet[license] = true
+		}
+	}
+	var licenses []string
+	for license := range licenseSet {
+		licenses = append(licenses, license)
+	}
+	sort.Strings(licenses)
+	return licenses
+}
+
+// spdxLicenseExpression converts a License field of a debian/copyright file, such as
+// "GPL-2+ or Artistic, and BSD-3-clause", to a SPDX license expression. "or" and "and"
+// are kept, a comma groups the licenses before it, and "with <exception>" is left out.
+// The short names of the licenses used by the expression are returned as well
+func spdxLicenseExpression(dpkgLicense string) (expression string, shortNames []string) {
+	var operator string
+	var compound, exception bool
+	tokens := strings.Fields(strings.NewReplacer(",", " , ", "(", " ", ")", " ").Replace(dpkgLicense))
+	for _, token := range tokens {
+		switch strings.ToLower(token) {
+		case ",":
+			if compound {
+				expression = "(" + expression + ")"
+				compound = false
+			}
+			exception = false
+		case "or", "and":
+			operator = strings.ToUpper(token)
+			exception = false
+		case "with":
+			exception = true
+		default:
+			if exception {
+				continue
+			}
+			license, _ := spdxLicense(token)
+			shortNames = append(shortNames, token)
+			if expression == "" {
+				expression = license
+				continue
+			}
+			if operator == "" {
+				operator = "AND"
+			}
+			expression += " " + operator + " " + license
+			operator = ""
+			compound = true
+		}
+	}
+	return expression, shortNames
+}
+
+// spdxLicense returns the SPDX identifier of a debian/copyright license short name.
+// Unknown licenses are returned as a LicenseRef, and known is false
+func spdxLicense(shortName string) (license string, known bool) {
+	if spdxID, found := dpkgLicenses[strings.ToLower(shortName)]; found {
+		return spdxID, !strings.HasPrefix(spdxID, "LicenseRef-")
+	}
+	return "LicenseRef-" + spdxIDChars.ReplaceAllString(shortName, "-"), false
+}
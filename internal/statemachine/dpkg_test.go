@@ -0,0 +1,135 @@
+// This file contains unit tests for reading the dpkg database of a rootfs
+package statemachine
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+)
+
+// TestReadDpkgStatus ensures that the installed packages are read from the dpkg status
+func TestReadDpkgStatus(t *testing.T) {
+	t.Run("test_read_dpkg_status", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		packages, err := readDpkgStatus(filepath.Join("testdata", "dpkg_rootfs"))
+		asserter.AssertErrNil(err, true)
+
+		ubuntuDevelopers := "Organization: Ubuntu Developers (ubuntu-devel-discuss@lists.ubuntu.com)"
+		expected := []dpkgPackage{
+			{"bash", "5.1-6ubuntu1", "amd64", "bash", "5.1-6ubuntu1", "installed", "Organization: Ubuntu"},
+			{"libc6", "2.35-0ubuntu3.1", "amd64", "glibc", "2.35-0ubuntu3.1", "installed", ubuntuDevelopers},
+			{"libc6", "2.35-0ubuntu3.1", "i386", "glibc", "2.35-0ubuntu3.1", "installed", ubuntuDevelopers},
+			{"vim-tiny", "2:8.2.3995-1ubuntu2.1", "amd64", "vim", "2:8.2.3995-1ubuntu2", "unpacked", ubuntuDevelopers},
+		}
+		if len(packages) != len(expected) {
+			t.Fatalf("Expected packages %v, got %v", expected, packages)
+		}
+		for ii, dpkgPkg := range packages {
+			if dpkgPkg != expected[ii] {
+				t.Errorf("Expected package %v, got %v", expected[ii], dpkgPkg)
+			}
+		}
+	})
+}
+
+// TestFailedReadDpkgStatus tests failures when reading the dpkg status
+func TestFailedReadDpkgStatus(t *testing.T) {
+	testCases := []struct {
+		name   string
+		status string
+		errMsg string
+	}{
+		{"missing_status", "", "Error opening dpkg status"},
+		{"continuation_without_field", " foo\n", "continuation line without a field"},
+		{"invalid_line", "Package: foo\nfoo\n", "invalid line"},
+		{"invalid_status", "Package: foo\nStatus: installed\n", "invalid status \"installed\" for package foo"},
+	}
+	for _, tc := range testCases {
+		t.Run("test_failed_read_dpkg_status_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			rootfs, err := ioutil.TempDir("/tmp", "ubuntu-image-")
+			asserter.AssertErrNil(err, true)
+			defer os.RemoveAll(rootfs)
+			if tc.status != "" {
+				statusDir := filepath.Join(rootfs, "var", "lib", "dpkg")
+				err = os.MkdirAll(statusDir, 0755)
+				asserter.AssertErrNil(err, true)
+				err = ioutil.WriteFile(filepath.Join(statusDir, "status"), []byte(tc.status), 0644)
+				asserter.AssertErrNil(err, true)
+			}
+			_, err = readDpkgStatus(rootfs)
+			asserter.AssertErrContains(err, tc.errMsg)
+		})
+	}
+}
+
+// TestReadPackageLicenses ensures that licenses are only read from machine-readable
+// copyright files, and that they are converted to SPDX license expressions
+func TestReadPackageLicenses(t *testing.T) {
+	testCases := []struct {
+		name        string
+		packageName string
+		expected    []string
+		spdx        []string
+	}{
+		{"machine_readable", "libc6", []string{"GPL-2+ with OpenSSL exception, or BSD-3-clause", "LGPL-2.1+"},
+			[]string{"GPL-2.0-or-later OR BSD-3-Clause", "LGPL-2.1-or-later"}},
+		{"unknown_license", "vim-tiny", []string{"Vim", "Vim or public-domain"},
+			[]string{"LicenseRef-Vim", "LicenseRef-Vim OR LicenseRef-public-domain"}},
+		{"not_machine_readable", "bash", nil, nil},
+		{"missing", "nano", nil, nil},
+	}
+	for _, tc := range testCases {
+		t.Run("test_read_package_licenses_"+tc.name, func(t *testing.T) {
+			licenses := readPackageLicenses(filepath.Join("testdata", "dpkg_rootfs"), tc.packageName)
+			if strings.Join(licenses, "|") != strings.Join(tc.expected, "|") {
+				t.Errorf("Expected licenses %v, got %v", tc.expected, licenses)
+			}
+			for ii, license := range licenses {
+				expression, _ := spdxLicenseExpression(license)
+				if expression != tc.spdx[ii] {
+					t.Errorf("Expected SPDX license %s, got %s", tc.spdx[ii], expression)
+				}
+			}
+		})
+	}
+}
+
+// TestSPDXLicenseExpression ensures that the choices and combinations of licenses of
+// debian/copyright files are kept in their SPDX license expressions
+func TestSPDXLicenseExpression(t *testing.T) {
+	testCases := []struct {
+		name       string
+		license    string
+		expression string
+		shortNames []string
+	}{
+		{"single", "GPL-2+", "GPL-2.0-or-later", []string{"GPL-2+"}},
+		{"disjunction", "GPL-1+ or Artistic", "GPL-1.0-or-later OR Artistic-1.0",
+			[]string{"GPL-1+", "Artistic"}},
+		{"conjunction", "BSD-3-clause and Expat", "BSD-3-Clause AND MIT",
+			[]string{"BSD-3-clause", "Expat"}},
+		{"comma", "GPL-2+ or Artistic-2.0, and BSD-3-clause",
+			"(GPL-2.0-or-later OR Artistic-2.0) AND BSD-3-Clause",
+			[]string{"GPL-2+", "Artistic-2.0", "BSD-3-clause"}},
+		{"exception", "GPL-3+ with Autoconf-data exception or Expat", "GPL-3.0-or-later OR MIT",
+			[]string{"GPL-3+", "Expat"}},
+		{"unknown", "Vim or public-domain", "LicenseRef-Vim OR LicenseRef-public-domain",
+			[]string{"Vim", "public-domain"}},
+	}
+	for _, tc := range testCases {
+		t.Run("test_spdx_license_expression_"+tc.name, func(t *testing.T) {
+			expression, shortNames := spdxLicenseExpression(tc.license)
+			if expression != tc.expression {
+				t.Errorf("Expected license expression %s, got %s", tc.expression, expression)
+			}
+			if strings.Join(shortNames, " ") != strings.Join(tc.shortNames, " ") {
+				t.Errorf("Expected license names %v, got %v", tc.shortNames, shortNames)
+			}
+		})
+	}
+}
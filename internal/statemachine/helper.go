@@ -1,8 +1,12 @@
 package statemachine
 
 import (
+	"crypto/sha256"
 	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
 	"math"
 	"os"
 	"os/exec"
@@ -16,6 +20,7 @@ import (
 	"github.com/diskfs/go-diskfs/partition/gpt"
 	"github.com/diskfs/go-diskfs/partition/mbr"
 
+	"github.com/snapcore/snapd/asserts"
 	"github.com/snapcore/snapd/gadget"
 	"github.com/snapcore/snapd/gadget/quantity"
 )
@@ -53,9 +58,128 @@ func (stateMachine *StateMachine) validateInput() error {
 		}
 	}
 
+	// make sure --image-name only uses known placeholders
+	if stateMachine.commonFlags.ImageName != "" {
+		if strings.Contains(stateMachine.commonFlags.ImageName, "/") {
+			return fmt.Errorf("--image-name cannot contain \"/\"")
+		}
+		for _, match := range imageNamePlaceholder.FindAllStringSubmatch(
+			stateMachine.commonFlags.ImageName, -1) {
+			var validPlaceholder bool = false
+			for _, placeholder := range imageNamePlaceholders {
+				if match[1] == placeholder {
+					validPlaceholder = true
+				}
+			}
+			if !validPlaceholder {
+				return fmt.Errorf("unknown placeholder {%s} in --image-name. Valid placeholders are {%s}",
+					match[1], strings.Join(imageNamePlaceholders, "}, {"))
+			}
+		}
+	}
+
+	if stateMachine.commonFlags.OutputDevice != "" {
+		if stateMachine.commonFlags.NoDiskImage {
+			return fmt.Errorf("--output-device and --no-disk-image are mutually exclusive")
+		}
+		// fail early, the device is checked again before it is written to
+		if err := stateMachine.checkOutputDevice(0); err != nil {
+			return err
+		}
+	} else if stateMachine.commonFlags.ForceDevice {
+		return fmt.Errorf("--force-output-device can only be used with --output-device")
+	}
+
+	if stateMachine.commonFlags.CloudProfile != "" &&
+		(stateMachine.commonFlags.NoDiskImage || stateMachine.commonFlags.OutputDevice != "") {
+		return fmt.Errorf("--cloud-profile requires a disk image file and cannot be used " +
+			"with --no-disk-image or --output-device")
+	}
+
+	if stateMachine.commonFlags.SignKey != "" {
+		if _, err := osStat(stateMachine.commonFlags.SignKey); err != nil {
+			return fmt.Errorf("could not read --sign-key: %s", err.Error())
+		}
+	}
+
+	if err := stateMachine.setupReproducible(); err != nil {
+		return err
+	}
+
+	// the build date and id are stored so that resumed builds produce the same names
+	stateMachine.BuildDate = stateMachine.buildTime().UTC().Format("20060102")
+	stateMachine.BuildID = stateMachine.commonFlags.BuildID
+	if stateMachine.BuildID == "" {
+		stateMachine.BuildID = strings.Split(stateMachine.reproducibleUUID("build-id").String(), "-")[0]
+	}
+
 	return nil
 }
 
+// outputName returns the name of a file in the output directory. Without --image-name
+// defaultName is used, otherwise the expanded template followed by suffix. Files that
+// do not belong to a volume expand {volume} to an empty string
+func (stateMachine *StateMachine) outputName(volumeName, defaultName, suffix string) string {
+	if stateMachine.commonFlags.ImageName == "" {
+		return defaultName
+	}
+	values := stateMachine.imageNameValues()
+	values["volume"] = volumeName
+	name := imageNamePlaceholder.ReplaceAllStringFunc(stateMachine.commonFlags.ImageName,
+		func(placeholder string) string {
+			value := values[strings.Trim(placeholder, "{}")]
+			return strings.ReplaceAll(value, "/", "-")
+		})
+	name = strings.Trim(name, "-_.")
+	if name == "" {
+		return defaultName
+	}
+	return name + suffix
+}
+
+// imageNameValues returns the values of the --image-name placeholders that do not
+// depend on the volume being written
+func (stateMachine *StateMachine) imageNameValues() map[string]string {
+	values := map[string]string{
+		"date":     stateMachine.BuildDate,
+		"build-id": stateMachine.BuildID,
+	}
+	switch parent := stateMachine.parent.(type) {
+	case *ClassicStateMachine:
+		values["model"] = "classic"
+		if parent.Opts.Project != "" {
+			values["model"] = parent.Opts.Project
+		}
+		values["arch"] = parent.Opts.Arch
+		if values["arch"] == "" {
+			values["arch"] = getHostArch()
+		}
+		values["series"] = parent.Opts.Suite
+		if values["series"] == "" {
+			values["series"] = getHostSuite()
+		}
+	case *SnapStateMachine:
+		// the model assertion has been validated by snapd by the time files are written
+		modelBytes, err := ioutilReadFile(parent.Args.ModelAssertion)
+		if err != nil {
+			break
+		}
+		assertion, err := asserts.Decode(modelBytes)
+		if err != nil {
+			break
+		}
+		if model, ok := assertion.(*asserts.Model); ok {
+			values["model"] = model.Model()
+			values["arch"] = model.Architecture()
+			values["series"] = model.Base()
+			if values["series"] == "" {
+				values["series"] = "core"
+			}
+		}
+	}
+	return values
+}
+
 // cleanup cleans the workdir. For now this is just deleting the temporary directory if necessary
 // but will have more functionality added to it later
 func (stateMachine *StateMachine) cleanup() error {
@@ -151,7 +275,7 @@ func shouldSkipStructure(structure gadget.VolumeStructure, isSeeded bool) bool {
 }
 
 // copyStructureContent handles copying raw blobs or creating formatted filesystems
-func (stateMachine *StateMachine) copyStructureContent(volume *gadget.Volume,
+func (stateMachine *StateMachine) copyStructureContent(volumeName string, volume *gadget.Volume,
 	structure gadget.VolumeStructure, structureNumber int,
 	contentRoot, partImg string) error {
 	if structure.Filesystem == "" {
@@ -214,8 +338,8 @@ func (stateMachine *StateMachine) copyStructureContent(volume *gadget.Volume,
 					partImg, err.Error())
 			}
 		}
-		err := mkfsMakeWithContent(structure.Filesystem, partImg, structure.Label,
-			contentRoot, structure.Size, quantity.Size(512))
+		err := stateMachine.makeFilesystem(structure.Filesystem, partImg, structure.Label,
+			contentRoot, structure.Size, stateMachine.sectorSize(volumeName))
 		if err != nil {
 			return fmt.Errorf("Error running mkfs: %s", err.Error())
 		}
@@ -262,7 +386,8 @@ func (stateMachine *StateMachine) handleSecureBoot(volume *gadget.Volume, target
 	return nil
 }
 
-// WriteSnapManifest generates a snap manifest based on the contents of the selected snapsDir
+// WriteSnapManifest generates a snap manifest based on the file names in the selected
+// snapsDir. ubuntu-image itself describes the snaps of its manifests from the seed
 func WriteSnapManifest(snapsDir string, outputPath string) error {
 	files, err := ioutilReadDir(snapsDir)
 	if err != nil {
@@ -286,6 +411,37 @@ func WriteSnapManifest(snapsDir string, outputPath string) error {
 	return nil
 }
 
+// writeSnapManifest writes a "<name> <revision>" line for each of snapFiles to manifestName,
+// and the JSON manifest next to it when --manifest-json is set
+func (stateMachine *StateMachine) writeSnapManifest(info *seedInfo, snapsDir string,
+	snapFiles []string, manifestName string) error {
+	// As per previous ubuntu-image manifest generation, we skip generating
+	// manifests for non-existent/invalid paths
+	if _, err := ioutilReadDir(snapsDir); err != nil {
+		return nil
+	}
+	snaps, err := info.describeSnaps(snapFiles)
+	if err != nil {
+		return err
+	}
+
+	manifest, err := osCreate(filepath.Join(stateMachine.tempDirs.staging, manifestName))
+	if err != nil {
+		return fmt.Errorf("Error creating manifest file: %s", err.Error())
+	}
+	defer manifest.Close()
+	for _, seeded := range snaps {
+		if _, err := fmt.Fprintf(manifest, "%s %s\n", seeded.Name, seeded.Revision); err != nil {
+			return fmt.Errorf("Error writing manifest file: %s", err.Error())
+		}
+	}
+	stateMachine.recordArtifact(manifestName, "", "manifest")
+	if !stateMachine.commonFlags.ManifestJSON {
+		return nil
+	}
+	return stateMachine.writeManifestJSON(manifestName+".json", "snaps", snaps)
+}
+
 // getHostArch uses dpkg to return the host architecture of the current system
 func getHostArch() string {
 	cmd := exec.Command("dpkg", "--print-architecture")
@@ -371,13 +527,15 @@ func maxOffset(offset1, offset2 quantity.Offset) quantity.Offset {
 	return offset2
 }
 
-// createPartitionTable creates a disk image file and writes the partition table to it
-func createPartitionTable(volumeName string, volume *gadget.Volume, sectorSize uint64, isSeeded bool) *partition.Table {
+// createPartitionTable creates a disk image file and writes the partition table to it.
+// The GPT partitions get the attributes of their structure index in attributes
+func createPartitionTable(volumeName string, volume *gadget.Volume, sectorSize uint64,
+	attributes map[int]uint64, isSeeded bool) *partition.Table {
 	var gptPartitions = make([]*gpt.Partition, 0)
 	var mbrPartitions = make([]*mbr.Partition, 0)
 	var partitionTable partition.Table
 
-	for _, structure := range volume.Structure {
+	for ii, structure := range volume.Structure {
 		if structure.Role == "mbr" || structure.Type == "bare" ||
 			shouldSkipStructure(structure, isSeeded) {
 			continue
@@ -397,33 +555,30 @@ func createPartitionTable(volumeName string, volume *gadget.Volume, sectorSize u
 		}
 
 		if volume.Schema == "mbr" {
-			bootable := false
-			if structure.Role == gadget.SystemBoot || structure.Label == gadget.SystemBoot {
-				bootable = true
-			}
-			// mbr.Type is a byte. snapd has already verified that this string
-			// is exactly two chars, so we can parse those two chars to a byte
-			partitionType, _ := strconv.ParseUint(structureType, 16, 8)
-			mbrPartition := &mbr.Partition{
-				Start:    uint32(math.Ceil(float64(*structure.Offset) / float64(sectorSize))),
-				Size:     uint32(math.Ceil(float64(structure.Size) / float64(sectorSize))),
-				Type:     mbr.Type(partitionType),
-				Bootable: bootable,
-			}
-			mbrPartitions = append(mbrPartitions, mbrPartition)
+			mbrPartitions = append(mbrPartitions, newMBRPartition(structure, structureType, sectorSize))
 		} else {
 			partitionType := gpt.Type(structureType)
 			gptPartition := &gpt.Partition{
 				Start: uint64(math.Ceil(float64(*structure.Offset) / float64(sectorSize))),
-				Size:  uint64(structure.Size),
-				Type:  partitionType,
-				Name:  structure.Name,
+				// go-diskfs expects partitions of whole sectors
+				Size:       (uint64(structure.Size) + sectorSize - 1) / sectorSize * sectorSize,
+				Type:       partitionType,
+				Name:       structure.Name,
+				GUID:       structure.ID,
+				Attributes: attributes[ii],
 			}
 			gptPartitions = append(gptPartitions, gptPartition)
 		}
 	}
 
 	if volume.Schema == "mbr" {
+		if len(mbrPartitions) > mbrPrimaryPartitions {
+			// the logical partitions are described by the EBRs that
+			// writeExtendedBootRecords writes once the partition table is written
+			logicalPartitions := mbrPartitions[mbrPrimaryPartitions-1:]
+			mbrPartitions = append(mbrPartitions[:mbrPrimaryPartitions-1:mbrPrimaryPartitions-1],
+				extendedPartition(logicalPartitions))
+		}
 		mbrTable := &mbr.Table{
 			Partitions:         mbrPartitions,
 			LogicalSectorSize:  int(sectorSize),
@@ -442,6 +597,17 @@ func createPartitionTable(volumeName string, volume *gadget.Volume, sectorSize u
 	return &partitionTable
 }
 
+// volumeFarthestOffset returns the end of the last structure of a volume, from which
+// handleContentSizes calculates the minimum size of the volume
+func volumeFarthestOffset(volume *gadget.Volume) quantity.Offset {
+	var farthestOffset quantity.Offset = 0
+	for _, structure := range volume.Structure {
+		farthestOffset = maxOffset(farthestOffset,
+			quantity.Offset(structure.Size)+getStructureOffset(structure))
+	}
+	return farthestOffset
+}
+
 // calculateImageSize calculates the total sum of all partition sizes in an image
 func (stateMachine *StateMachine) calculateImageSize() (int64, error) {
 	if stateMachine.GadgetInfo == nil {
@@ -456,6 +622,20 @@ func (stateMachine *StateMachine) calculateImageSize() (int64, error) {
 	return imgSize, nil
 }
 
+// diskImageSize returns the size of the disk image that make_disk creates for a volume,
+// before it is rounded up to a multiple of the block size
+func (stateMachine *StateMachine) diskImageSize(volumeName string) int64 {
+	imgSize, _ := stateMachine.calculateImageSize()
+	if alignment := stateMachine.cloudProfileAlignment(); alignment != 0 {
+		if volumeSize, found := stateMachine.ImageSizes[volumeName]; found &&
+			int64(volumeSize) > imgSize {
+			imgSize = int64(volumeSize)
+		}
+		imgSize = int64(roundUpSize(quantity.Size(imgSize), alignment))
+	}
+	return imgSize
+}
+
 // copyDataToImage runs dd commands to copy the raw data to the final image with appropriate offsets
 func (stateMachine *StateMachine) copyDataToImage(volumeName string, volume *gadget.Volume, diskImg *disk.Disk) error {
 	for structureNumber, structure := range volume.Structure {
@@ -466,13 +646,16 @@ func (stateMachine *StateMachine) copyDataToImage(volumeName string, volume *gad
 		// set up the arguments to dd the structures into an image
 		partImg := filepath.Join(stateMachine.tempDirs.volumes, volumeName,
 			"part"+strconv.Itoa(structureNumber)+".img")
-		seek := strconv.FormatInt(int64(getStructureOffset(structure))/sectorSize, 10)
+		// the offset is given in bytes, as structures such as bare ones don't have to
+		// start on a sector boundary
+		seek := strconv.FormatUint(uint64(getStructureOffset(structure)), 10)
 		count := strconv.FormatFloat(math.Ceil(float64(structure.Size)/float64(sectorSize)), 'f', 0, 64)
 		ddArgs := []string{
 			"if=" + partImg,
 			"of=" + diskImg.File.Name(),
 			"bs=" + strconv.FormatInt(sectorSize, 10),
 			"seek=" + seek,
+			"oflag=seek_bytes",
 			"count=" + count,
 			"conv=notrunc",
 			"conv=sparse",
@@ -485,27 +668,309 @@ func (stateMachine *StateMachine) copyDataToImage(volumeName string, volume *gad
 	return nil
 }
 
-// writeOffsetValues handles any OffsetWrite values present in the volume structures.
+// volumeOffsetWrite is a location of a volume where make_disk writes the offset, in
+// sectors, of a structure or of a content image of a structure
+type volumeOffsetWrite struct {
+	structure int
+	// content is the index of the content image in the structure, or -1
+	content  int
+	location quantity.Offset
+	value    uint64
+}
+
+// volumeOffsetWrites returns the offset-writes of the structures of a volume and of
+// their content images
+func volumeOffsetWrites(volume *gadget.Volume, sectorSize quantity.Size) []volumeOffsetWrite {
+	var offsetWrites []volumeOffsetWrite
+	for ii, structure := range volume.Structure {
+		start := getStructureOffset(structure)
+		if structure.OffsetWrite != nil {
+			offsetWrites = append(offsetWrites, volumeOffsetWrite{
+				structure: ii,
+				content:   -1,
+				location:  offsetWriteLocation(volume, structure.OffsetWrite),
+				value:     uint64(start) / uint64(sectorSize),
+			})
+		}
+		// the content images follow each other unless they have an offset
+		var contentOffset quantity.Offset
+		for jj, content := range structure.Content {
+			if content.Offset != nil {
+				contentOffset = *content.Offset
+			}
+			if content.OffsetWrite != nil {
+				offsetWrites = append(offsetWrites, volumeOffsetWrite{
+					structure: ii,
+					content:   jj,
+					location:  offsetWriteLocation(volume, content.OffsetWrite),
+					value:     uint64(start+contentOffset) / uint64(sectorSize),
+				})
+			}
+			contentOffset += quantity.Offset(content.Size)
+		}
+	}
+	return offsetWrites
+}
+
+// offsetWriteLocation returns the location in the volume of an offset-write, which may be
+// relative to a structure
+func offsetWriteLocation(volume *gadget.Volume, offsetWrite *gadget.RelativeOffset) quantity.Offset {
+	location := offsetWrite.Offset
+	for _, other := range volume.Structure {
+		if offsetWrite.RelativeTo != "" && other.Name == offsetWrite.RelativeTo {
+			location += getStructureOffset(other)
+		}
+	}
+	return location
+}
+
+// writeOffsetValues handles any OffsetWrite values present in the volume structures
+// and their content images.
 func writeOffsetValues(volume *gadget.Volume, imgName string, sectorSize, imgSize uint64) error {
 	imgFile, err := osOpenFile(imgName, os.O_RDWR, 0755)
 	if err != nil {
 		return fmt.Errorf("Error opening image file to write offsets: %s", err.Error())
 	}
 	defer imgFile.Close()
-	for _, structure := range volume.Structure {
-		if structure.OffsetWrite != nil {
-			offset := uint64(*structure.Offset) / sectorSize
-			if imgSize-4 < offset {
-				return fmt.Errorf("write offset beyond end of file")
-			}
-			offsetBytes := make([]byte, 4)
-			binary.LittleEndian.PutUint32(offsetBytes, uint32(offset))
-			_, err := imgFile.WriteAt(offsetBytes, int64(structure.OffsetWrite.Offset))
-			if err != nil {
-				return fmt.Errorf("Failed to write offset to disk at %d: %s",
-					structure.OffsetWrite.Offset, err.Error())
-			}
+	for _, offsetWrite := range volumeOffsetWrites(volume, quantity.Size(sectorSize)) {
+		if uint64(offsetWrite.location)+4 > imgSize {
+			return fmt.Errorf("write offset beyond end of file")
+		}
+		offsetBytes := make([]byte, 4)
+		binary.LittleEndian.PutUint32(offsetBytes, uint32(offsetWrite.value))
+		_, err := imgFile.WriteAt(offsetBytes, int64(offsetWrite.location))
+		if err != nil {
+			return fmt.Errorf("Failed to write offset to disk at %d: %s",
+				offsetWrite.location, err.Error())
+		}
+	}
+	return nil
+}
+
+// writePartitionIDs writes the identifiers of the disk and of the partitions of a volume
+// to <volume>.partition-ids.json in the output directory, so that they can be referenced,
+// e.g. as PARTUUID in fstab. The partition GUIDs of GPT partition tables are used, and
+// the PARTUUIDs of MBR partitions are made of the disk identifier and partition number
+func (stateMachine *StateMachine) writePartitionIDs(volumeName string, volume *gadget.Volume,
+	partitionTable partition.Table, mbrDiskID []byte) error {
+	ids := volumeIDs{Volume: volumeName, Schema: "mbr", Partitions: []partitionIDs{}}
+	gptTable, isGPT := partitionTable.(*gpt.Table)
+	if isGPT {
+		ids.Schema = "gpt"
+		ids.DiskID = strings.ToLower(gptTable.GUID)
+	} else {
+		ids.DiskID = fmt.Sprintf("%08x", binary.LittleEndian.Uint32(mbrDiskID))
+	}
+	structureNumbers := partitionStructures(volume, stateMachine.IsSeeded)
+	for jj, structureNumber := range structureNumbers {
+		structure := volume.Structure[structureNumber]
+		var partitionNumber int
+		var partUUID string
+		if isGPT {
+			partitionNumber = jj + 1
+			partUUID = strings.ToLower(gptTable.Partitions[jj].GUID)
+		} else {
+			partitionNumber = mbrPartitionNumber(jj, len(structureNumbers))
+			partUUID = fmt.Sprintf("%s-%02x", ids.DiskID, partitionNumber)
+		}
+		ids.Partitions = append(ids.Partitions, partitionIDs{
+			Number:   partitionNumber,
+			Name:     structure.Name,
+			Role:     structure.Role,
+			PartUUID: partUUID,
+		})
+	}
+	idsBytes, err := json.MarshalIndent(ids, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Error encoding partition identifiers: %s", err.Error())
+	}
+	idsName := stateMachine.outputName(volumeName, volumeName+".partition-ids.json",
+		".partition-ids.json")
+	err = ioutilWriteFile(filepath.Join(stateMachine.tempDirs.staging, idsName), idsBytes, 0644)
+	if err != nil {
+		return fmt.Errorf("Error writing partition identifiers: %s", err.Error())
+	}
+	stateMachine.recordArtifact(idsName, volumeName, "partition-ids")
+	return nil
+}
+
+// splitStructureType returns the MBR and GPT halves of a structure type. Either
+// of them can be empty if the structure type does not define it
+func splitStructureType(structureType string) (mbrType, gptType string) {
+	if strings.Contains(structureType, ",") {
+		types := strings.Split(structureType, ",")
+		return types[0], types[1]
+	}
+	switch {
+	case structureType == "bare" || structureType == "mbr":
+		return "", ""
+	case len(structureType) == 2:
+		return structureType, ""
+	default:
+		return "", structureType
+	}
+}
+
+// getStructureFileName returns a name for the structure that is safe to use in file
+// names. The structure name is preferred, followed by the role and its index
+func getStructureFileName(structure gadget.VolumeStructure, structureNumber int) string {
+	name := structure.Name
+	if name == "" {
+		name = structure.Role
+	}
+	if name == "" {
+		return "part" + strconv.Itoa(structureNumber)
+	}
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') ||
+			(r >= '0' && r <= '9') || r == '-' || r == '_' {
+			return r
 		}
+		return '-'
+	}, name)
+}
+
+// calculateSHA256 returns the hex encoded sha256 checksum of a file
+func calculateSHA256(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// isImageArtifact checks whether an artifact is an image that belongs in the plain
+// --image-file-list, as opposed to manifests and individual partitions
+func isImageArtifact(artifact outputArtifact) bool {
+	switch artifact.Type {
+	case "manifest", "manifest-json", "partition-manifest", "partition-ids", "partition-image", "checksums",
+		"pgp-signature", "pkcs7-signature", "provenance", "spdx-sbom", "cyclonedx-sbom":
+		return false
+	}
+	return true
+}
+
+// writeArtifactList writes a JSON description of every published artifact to the file
+// given with --image-file-list-json
+func (stateMachine *StateMachine) writeArtifactList() error {
+	artifacts := make([]listedArtifact, 0, len(stateMachine.Artifacts))
+	for _, artifact := range stateMachine.Artifacts {
+		artifactPath := filepath.Join(stateMachine.commonFlags.OutputDir, artifact.Name)
+		artifactInfo, err := os.Stat(artifactPath)
+		if err != nil {
+			return fmt.Errorf("Error getting size of %s: %s", artifactPath, err.Error())
+		}
+		checksum, err := calculateSHA256(artifactPath)
+		if err != nil {
+			return fmt.Errorf("Error calculating checksum of %s: %s", artifactPath, err.Error())
+		}
+		artifacts = append(artifacts, listedArtifact{
+			Path:   artifactPath,
+			Type:   artifact.Type,
+			Volume: artifact.Volume,
+			Size:   artifactInfo.Size(),
+			SHA256: checksum,
+			Format: artifactFormats[artifact.Type],
+		})
+	}
+	artifactBytes, err := json.MarshalIndent(map[string][]listedArtifact{
+		"artifacts": artifacts,
+	}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Error encoding artifact list: %s", err.Error())
+	}
+	err = ioutilWriteFile(stateMachine.commonFlags.ImageFileListJSON, artifactBytes, 0644)
+	if err != nil {
+		return fmt.Errorf("Error writing artifact list: %s", err.Error())
+	}
+	return nil
+}
+
+// writeManifestJSON writes the entries of a manifest as a JSON object to the staging
+// directory, for --manifest-json
+func (stateMachine *StateMachine) writeManifestJSON(manifestName, key string, entries interface{}) error {
+	manifestBytes, err := json.MarshalIndent(map[string]interface{}{key: entries}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Error encoding manifest: %s", err.Error())
+	}
+	err = ioutilWriteFile(filepath.Join(stateMachine.tempDirs.staging, manifestName), manifestBytes, 0644)
+	if err != nil {
+		return fmt.Errorf("Error writing manifest file: %s", err.Error())
+	}
+	stateMachine.recordArtifact(manifestName, "", "manifest-json")
+	return nil
+}
+
+// createTarball archives the contents of a directory in a gzip compressed tarball,
+// preserving ownership, extended attributes and device nodes. The files are sorted by
+// name so that the same contents produce the same tarball
+func createTarball(srcDir, tarPath string) error {
+	tarCommand := execCommand("tar", "--create", "--gzip", "--file", tarPath,
+		"--sort=name", "--numeric-owner", "--xattrs", "--xattrs-include=*", "--acls", "--sparse",
+		"--directory", srcDir, ".")
+	if output, err := tarCommand.CombinedOutput(); err != nil {
+		return fmt.Errorf("Error running command \"%s\": %s. Output: %s",
+			tarCommand.String(), err.Error(), string(output))
+	}
+	return nil
+}
+
+// createSquashfs creates a squashfs image with the contents of a directory
+func createSquashfs(srcDir, squashfsPath string) error {
+	mksquashfsCommand := execCommand("mksquashfs", srcDir, squashfsPath,
+		"-noappend", "-comp", "xz", "-xattrs")
+	if output, err := mksquashfsCommand.CombinedOutput(); err != nil {
+		return fmt.Errorf("Error running command \"%s\": %s. Output: %s",
+			mksquashfsCommand.String(), err.Error(), string(output))
+	}
+	return nil
+}
+
+// resolveRootfsPath resolves symlinks inside of a rootfs. Absolute links are
+// resolved relative to the rootfs instead of the host filesystem
+func resolveRootfsPath(rootfs, path string) string {
+	fullPath := filepath.Join(rootfs, path)
+	for ii := 0; ii < 40; ii++ {
+		target, err := os.Readlink(fullPath)
+		if err != nil {
+			return fullPath
+		}
+		if filepath.IsAbs(target) {
+			fullPath = filepath.Join(rootfs, target)
+		} else {
+			fullPath = filepath.Join(filepath.Dir(fullPath), target)
+		}
+	}
+	return fullPath
+}
+
+// makeEFIImage creates a vfat image containing the EFI boot files in efiDir. FAT32
+// requires at least 65525 clusters, a bit over 32MiB with the single-sector clusters
+// of mkfs, so the image gets 40MiB on top of the content and half of its size again
+// for the overhead of the filesystem, rounded up to the next MiB
+func (stateMachine *StateMachine) makeEFIImage(efiDir, efiImg string) error {
+	contentSize, err := helper.Du(efiDir)
+	if err != nil {
+		return fmt.Errorf("Error getting EFI content size: %s", err.Error())
+	}
+	efiSize := quantity.Size(math.Ceil(float64(contentSize)*1.5)) + 40*quantity.SizeMiB
+	efiSize = (efiSize/quantity.SizeMiB + 1) * quantity.SizeMiB
+	efiFile, err := osCreate(efiImg)
+	if err != nil {
+		return fmt.Errorf("Error creating EFI image: %s", err.Error())
+	}
+	efiFile.Close()
+	if err := osTruncate(efiImg, int64(efiSize)); err != nil {
+		return fmt.Errorf("Error resizing EFI image: %s", err.Error())
+	}
+	if err := stateMachine.makeFilesystem("vfat", efiImg, "", efiDir, efiSize,
+		defaultSectorSize); err != nil {
+		return fmt.Errorf("Error running mkfs: %s", err.Error())
 	}
 	return nil
 }
@@ -1,14 +1,20 @@
 package statemachine
 
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 
 	"github.com/canonical/ubuntu-image/internal/helper"
+	diskfs "github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/partition/gpt"
 	"github.com/google/uuid"
 	"github.com/snapcore/snapd/gadget"
 	"github.com/snapcore/snapd/gadget/quantity"
@@ -311,7 +317,7 @@ func TestFailedCopyStructureContent(t *testing.T) {
 		defer func() {
 			helperCopyBlob = helper.CopyBlob
 		}()
-		err = stateMachine.copyStructureContent(volume, mbrStruct, 0, "",
+		err = stateMachine.copyStructureContent("pc", volume, mbrStruct, 0, "",
 			filepath.Join("/tmp", uuid.NewString()+".img"))
 		asserter.AssertErrContains(err, "Error zeroing partition")
 		helperCopyBlob = helper.CopyBlob
@@ -321,7 +327,7 @@ func TestFailedCopyStructureContent(t *testing.T) {
 		defer func() {
 			mockableBlockSize = "1"
 		}()
-		err = stateMachine.copyStructureContent(volume, mbrStruct, 0, "",
+		err = stateMachine.copyStructureContent("pc", volume, mbrStruct, 0, "",
 			filepath.Join("/tmp", uuid.NewString()+".img"))
 		asserter.AssertErrContains(err, "Error copying image blob")
 		mockableBlockSize = "1"
@@ -331,7 +337,7 @@ func TestFailedCopyStructureContent(t *testing.T) {
 		defer func() {
 			helperCopyBlob = helper.CopyBlob
 		}()
-		err = stateMachine.copyStructureContent(volume, rootfsStruct, 0, "",
+		err = stateMachine.copyStructureContent("pc", volume, rootfsStruct, 0, "",
 			filepath.Join("/tmp", uuid.NewString()+".img"))
 		asserter.AssertErrContains(err, "Error zeroing image file")
 		helperCopyBlob = helper.CopyBlob
@@ -341,7 +347,7 @@ func TestFailedCopyStructureContent(t *testing.T) {
 		defer func() {
 			mkfsMakeWithContent = mkfs.MakeWithContent
 		}()
-		err = stateMachine.copyStructureContent(volume, rootfsStruct, 0, "",
+		err = stateMachine.copyStructureContent("pc", volume, rootfsStruct, 0, "",
 			filepath.Join("/tmp", uuid.NewString()+".img"))
 		asserter.AssertErrContains(err, "Error running mkfs")
 		mkfsMakeWithContent = mkfs.MakeWithContent
@@ -426,12 +432,275 @@ func TestFailedWriteOffsetValues(t *testing.T) {
 		defer func() {
 			osOpenFile = os.OpenFile
 		}()
-		err = writeOffsetValues(volume, imgPath, 512, 0)
+		err = writeOffsetValues(volume, imgPath, 512, 48*1024*1024)
 		asserter.AssertErrContains(err, "Failed to write offset to disk")
 		osOpenFile = os.OpenFile
 	})
 }
 
+// TestWriteOffsetValues ensures that the offsets of the structures and of their content
+// images are written where their offset-writes point to, as verify_image expects them
+func TestWriteOffsetValues(t *testing.T) {
+	t.Run("test_write_offset_values", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		gadgetYamlBytes, err := ioutil.ReadFile(filepath.Join("testdata", "gadget-content-offset-write.yaml"))
+		asserter.AssertErrNil(err, true)
+		gadgetInfo, err := gadget.InfoFromGadgetYaml(gadgetYamlBytes, nil)
+		asserter.AssertErrNil(err, true)
+		_, err = layoutGadget(gadgetInfo, nil)
+		asserter.AssertErrNil(err, true)
+		volume := gadgetInfo.Volumes["pc"]
+		// an offset-write relative to a structure that doesn't start at offset 0
+		volume.Structure[1].Content[0].OffsetWrite = &gadget.RelativeOffset{
+			RelativeTo: "BIOS Boot", Offset: 16}
+
+		imgFile, err := ioutil.TempFile("/tmp", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.Remove(imgFile.Name())
+		defer imgFile.Close()
+		err = imgFile.Truncate(4 * 1024 * 1024)
+		asserter.AssertErrNil(err, true)
+
+		err = writeOffsetValues(volume, imgFile.Name(), 512, 4*1024*1024)
+		asserter.AssertErrNil(err, true)
+		expected := map[int64]uint32{
+			92:      2048, // the BIOS Boot structure
+			100:     3072, // pc-core-extra.img, at 512KiB in BIOS Boot
+			1048592: 2048, // pc-core.img, relative to BIOS Boot
+		}
+		for location, value := range expected {
+			valueBytes := make([]byte, 4)
+			_, err = imgFile.ReadAt(valueBytes, location)
+			asserter.AssertErrNil(err, true)
+			if found := binary.LittleEndian.Uint32(valueBytes); found != value {
+				t.Errorf("Expected offset-write value %d at byte %d, found %d", value, location, found)
+			}
+		}
+
+		problems, err := checkOffsetWriteValues(volume, 512, imgFile)
+		asserter.AssertErrNil(err, true)
+		if len(problems) != 0 {
+			t.Errorf("Expected the offset-write values to be verified, got %v", problems)
+		}
+	})
+}
+
+// TestPartitionAttributes tests that the GPT attributes of the structures are written
+// in the partition table, and reported and compared when inspecting the image
+func TestPartitionAttributes(t *testing.T) {
+	t.Run("test_partition_attributes", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine StateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.YamlFilePath = filepath.Join("testdata", "gadget-attributes.yaml")
+		stateMachine.commonFlags.GPTAttributes = []string{"4=required"}
+		err := stateMachine.makeTemporaryDirectories()
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+		err = stateMachine.loadGadgetYaml()
+		asserter.AssertErrNil(err, true)
+		stateMachine.setRootfsSize(4 * quantity.SizeMiB)
+
+		volume := stateMachine.GadgetInfo.Volumes["pc"]
+		partitionTable := createPartitionTable("pc", volume, 512,
+			stateMachine.PartitionAttributes["pc"], false)
+		gptTable := (*partitionTable).(*gpt.Table)
+		expectedAttributes := []uint64{1 << 2, 0xf<<48 | 1<<56, 1<<48 | 3<<52, 1}
+		if len(gptTable.Partitions) != len(expectedAttributes) {
+			t.Fatalf("Expected %d partitions, got %d", len(expectedAttributes), len(gptTable.Partitions))
+		}
+		for ii, partition := range gptTable.Partitions {
+			if partition.Attributes != expectedAttributes[ii] {
+				t.Errorf("Expected partition %d to have the attributes %#x, got %#x", ii+1,
+					expectedAttributes[ii], partition.Attributes)
+			}
+		}
+
+		imgPath := filepath.Join(stateMachine.stateMachineFlags.WorkDir, "pc.img")
+		diskImg, err := diskfs.Create(imgPath, 32*1024*1024, diskfs.Raw)
+		asserter.AssertErrNil(err, true)
+		err = diskImg.Partition(*partitionTable)
+		asserter.AssertErrNil(err, true)
+		diskImg.File.Close()
+
+		report, err := InspectImage(imgPath, 0)
+		asserter.AssertErrNil(err, true)
+		expectedReport := [][]string{{"legacy-bios-bootable"}, {"priority=15", "successful"},
+			{"priority=1", "tries=3"}, {"required"}}
+		if len(report.Partitions) != len(expectedReport) {
+			t.Fatalf("Expected %d partitions, got %+v", len(expectedReport), report.Partitions)
+		}
+		for ii, partition := range report.Partitions {
+			if !reflect.DeepEqual(partition.Attributes, expectedReport[ii]) {
+				t.Errorf("Expected partition %d to have the attributes %v, got %v",
+					partition.Number, expectedReport[ii], partition.Attributes)
+			}
+		}
+		var output bytes.Buffer
+		err = report.Write(&output, "text")
+		asserter.AssertErrNil(err, true)
+		if !strings.Contains(output.String(), "ATTRIBUTES\n") ||
+			!strings.Contains(output.String(), " priority=15,successful\n") {
+			t.Errorf("Expected the attributes in the report, got:\n%s", output.String())
+		}
+
+		report.compareWithVolume(volume, defaultSectorSize, stateMachine.PartitionAttributes["pc"], false)
+		for _, mismatch := range report.Mismatches {
+			if strings.Contains(mismatch, "attributes") {
+				t.Errorf("Unexpected mismatch: %s", mismatch)
+			}
+		}
+		report.compareWithVolume(volume, defaultSectorSize, map[int]uint64{2: 1 << 56}, false)
+		expectedMismatch := `partition 2, structure #2 ("kernel-a"): expected attributes "successful", ` +
+			`found "priority=15,successful"`
+		if !strings.Contains(strings.Join(report.Mismatches, "\n"), expectedMismatch) {
+			t.Errorf("Expected mismatch %q, got %v", expectedMismatch, report.Mismatches)
+		}
+	})
+}
+
+// TestWritePartitionIDs tests that the GUIDs of gadget.yaml are used in GPT partition
+// tables, and that the identifiers of the disk and of its partitions are recorded
+func TestWritePartitionIDs(t *testing.T) {
+	t.Run("test_write_partition_ids", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine StateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.YamlFilePath = filepath.Join("testdata", "gadget-ids.yaml")
+		err := stateMachine.makeTemporaryDirectories()
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+		err = stateMachine.loadGadgetYaml()
+		asserter.AssertErrNil(err, true)
+		err = stateMachine.setupOutputDir()
+		asserter.AssertErrNil(err, true)
+
+		volume := stateMachine.GadgetInfo.Volumes["pc"]
+		partitionTable := createPartitionTable("pc", volume, 512, nil, false)
+		stateMachine.setPartitionGUIDs("pc", partitionTable)
+		err = stateMachine.writePartitionIDs("pc", volume, *partitionTable, nil)
+		asserter.AssertErrNil(err, true)
+
+		idsBytes, err := ioutil.ReadFile(filepath.Join(stateMachine.tempDirs.staging,
+			"pc.partition-ids.json"))
+		asserter.AssertErrNil(err, true)
+		var ids volumeIDs
+		err = json.Unmarshal(idsBytes, &ids)
+		asserter.AssertErrNil(err, true)
+		if ids.Schema != "gpt" || ids.DiskID != "6f3a1b2c-9d4e-4f5a-8b6c-7d8e9f0a1b2c" ||
+			len(ids.Partitions) != 3 {
+			t.Fatalf("Unexpected partition identifiers %+v", ids)
+		}
+		expectedGUIDs := []string{"1c2d3e4f-5a6b-4c7d-8e9f-0a1b2c3d4e5f", "",
+			"9a8b7c6d-5e4f-4a3b-9c2d-1e0f9a8b7c6d"}
+		for ii, partition := range ids.Partitions {
+			if partition.Number != ii+1 || partition.Name != volume.Structure[ii].Name {
+				t.Errorf("Unexpected partition %+v", partition)
+			}
+			if expectedGUIDs[ii] != "" && partition.PartUUID != expectedGUIDs[ii] {
+				t.Errorf("Expected partition %d to have the GUID %s, got %s",
+					partition.Number, expectedGUIDs[ii], partition.PartUUID)
+			}
+			if _, err := uuid.Parse(partition.PartUUID); err != nil {
+				t.Errorf("Expected the PARTUUID of partition %d to be a GUID, got %s",
+					partition.Number, partition.PartUUID)
+			}
+		}
+		if len(stateMachine.Artifacts) != 1 || stateMachine.Artifacts[0].Type != "partition-ids" {
+			t.Errorf("Expected a partition-ids artifact, got %v", stateMachine.Artifacts)
+		}
+
+		// the PARTUUIDs of MBR partitions are made of the disk identifier
+		stateMachine.YamlFilePath = filepath.Join("testdata", "gadget-mbr.yaml")
+		stateMachine.commonFlags.DiskGUID = "1234ABCD"
+		err = stateMachine.loadGadgetYaml()
+		asserter.AssertErrNil(err, true)
+		volume = stateMachine.GadgetInfo.Volumes["pc"]
+		partitionTable = createPartitionTable("pc", volume, 512, nil, false)
+		err = stateMachine.writePartitionIDs("pc", volume, *partitionTable,
+			stateMachine.mbrDiskID("pc"))
+		asserter.AssertErrNil(err, true)
+		idsBytes, err = ioutil.ReadFile(filepath.Join(stateMachine.tempDirs.staging,
+			"pc.partition-ids.json"))
+		asserter.AssertErrNil(err, true)
+		err = json.Unmarshal(idsBytes, &ids)
+		asserter.AssertErrNil(err, true)
+		if ids.Schema != "mbr" || ids.DiskID != "1234abcd" || len(ids.Partitions) != 3 ||
+			ids.Partitions[1].PartUUID != "1234abcd-02" {
+			t.Errorf("Unexpected partition identifiers %+v", ids)
+		}
+	})
+}
+
+// TestFailedWritePartitionIDs tests failures when recording the partition identifiers
+func TestFailedWritePartitionIDs(t *testing.T) {
+	t.Run("test_failed_write_partition_ids", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine StateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.YamlFilePath = filepath.Join("testdata", "gadget-ids.yaml")
+		err := stateMachine.makeTemporaryDirectories()
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+		err = stateMachine.loadGadgetYaml()
+		asserter.AssertErrNil(err, true)
+
+		volume := stateMachine.GadgetInfo.Volumes["pc"]
+		partitionTable := createPartitionTable("pc", volume, 512, nil, false)
+		ioutilWriteFile = mockWriteFile
+		defer func() {
+			ioutilWriteFile = ioutil.WriteFile
+		}()
+		err = stateMachine.writePartitionIDs("pc", volume, *partitionTable, nil)
+		asserter.AssertErrContains(err, "Error writing partition identifiers")
+		ioutilWriteFile = ioutil.WriteFile
+	})
+}
+
+// TestCopyDataToImageUnaligned ensures that structures which don't start on a sector
+// boundary are copied to their exact offset with 4096 byte sectors
+func TestCopyDataToImageUnaligned(t *testing.T) {
+	t.Run("test_copy_data_to_image_unaligned", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine StateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		err := stateMachine.makeTemporaryDirectories()
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+
+		offset := quantity.Offset(quantity.SizeMiB + 512)
+		volume := &gadget.Volume{
+			Schema: "gpt",
+			Structure: []gadget.VolumeStructure{
+				{Name: "bare", Type: "bare", Offset: &offset, Size: 1024},
+			},
+		}
+		err = os.MkdirAll(filepath.Join(stateMachine.tempDirs.volumes, "pc"), 0755)
+		asserter.AssertErrNil(err, true)
+		partImg := filepath.Join(stateMachine.tempDirs.volumes, "pc", "part0.img")
+		err = ioutil.WriteFile(partImg, bytes.Repeat([]byte{0xAB}, 1024), 0644)
+		asserter.AssertErrNil(err, true)
+
+		imgPath := filepath.Join(stateMachine.stateMachineFlags.WorkDir, "pc.img")
+		diskImg, err := diskfs.Create(imgPath, 4*1024*1024, diskfs.Raw)
+		asserter.AssertErrNil(err, true)
+		diskImg.LogicalBlocksize = 4096
+		err = stateMachine.copyDataToImage("pc", volume, diskImg)
+		asserter.AssertErrNil(err, true)
+		diskImg.File.Close()
+
+		imgBytes, err := ioutil.ReadFile(imgPath)
+		asserter.AssertErrNil(err, true)
+		start := int(offset)
+		if imgBytes[start-1] != 0 || imgBytes[start+1024] != 0 {
+			t.Errorf("Expected the data around the bare structure to be untouched")
+		}
+		if !bytes.Equal(imgBytes[start:start+1024], bytes.Repeat([]byte{0xAB}, 1024)) {
+			t.Errorf("Expected the bare structure to be copied at offset %d", start)
+		}
+	})
+}
+
 // TestWarningRootfsSizeTooSmall tests that a warning is thrown if the structure size
 // for the rootfs specified in gadget.yaml is smaller than the calculated rootfs size.
 // It also ensures that the size is corrected in the structure struct
@@ -478,7 +747,7 @@ func TestWarningRootfsSizeTooSmall(t *testing.T) {
 		defer restoreStdout()
 		asserter.AssertErrNil(err, true)
 
-		err = stateMachine.copyStructureContent(volume,
+		err = stateMachine.copyStructureContent("pc", volume,
 			rootfsStructure,
 			rootfsStructureNumber,
 			stateMachine.tempDirs.rootfs,
@@ -527,3 +796,69 @@ func TestGetStructureOffset(t *testing.T) {
 		})
 	}
 }
+
+// TestSplitStructureType ensures the MBR and GPT halves of a structure type are found
+func TestSplitStructureType(t *testing.T) {
+	testCases := []struct {
+		name          string
+		structureType string
+		mbrType       string
+		gptType       string
+	}{
+		{"hybrid", "EF,C12A7328-F81F-11D2-BA4B-00A0C93EC93B", "EF", "C12A7328-F81F-11D2-BA4B-00A0C93EC93B"},
+		{"mbr", "83", "83", ""},
+		{"gpt", "0FC63DAF-8483-4772-8E79-3D69D8477DE4", "", "0FC63DAF-8483-4772-8E79-3D69D8477DE4"},
+		{"bare", "bare", "", ""},
+	}
+	for _, tc := range testCases {
+		t.Run("test_split_structure_type_"+tc.name, func(t *testing.T) {
+			mbrType, gptType := splitStructureType(tc.structureType)
+			if mbrType != tc.mbrType || gptType != tc.gptType {
+				t.Errorf("Expected types \"%s\" and \"%s\", got \"%s\" and \"%s\"",
+					tc.mbrType, tc.gptType, mbrType, gptType)
+			}
+		})
+	}
+}
+
+// TestOutputName tests the expansion of the --image-name placeholders
+func TestOutputName(t *testing.T) {
+	t.Run("test_output_name", func(t *testing.T) {
+		var classicStateMachine ClassicStateMachine
+		classicStateMachine.commonFlags, classicStateMachine.stateMachineFlags = helper.InitCommonOpts()
+		classicStateMachine.parent = &classicStateMachine
+		classicStateMachine.Opts.Project = "ubuntu-cpc"
+		classicStateMachine.Opts.Arch = "arm64"
+		classicStateMachine.Opts.Suite = "focal"
+		classicStateMachine.BuildDate = "20211018"
+		classicStateMachine.BuildID = "1234"
+
+		var snapStateMachine SnapStateMachine
+		snapStateMachine.commonFlags, snapStateMachine.stateMachineFlags = helper.InitCommonOpts()
+		snapStateMachine.parent = &snapStateMachine
+		snapStateMachine.Args.ModelAssertion = filepath.Join("testdata", "modelAssertion20")
+
+		testCases := []struct {
+			name         string
+			stateMachine *StateMachine
+			imageName    string
+			volumeName   string
+			defaultName  string
+			suffix       string
+			expectedName string
+		}{
+			{"no_template", &classicStateMachine.StateMachine, "", "pc", "pc.img", ".img", "pc.img"},
+			{"classic_image", &classicStateMachine.StateMachine, "{model}-{series}-{arch}-{volume}-{date}-{build-id}", "pc", "pc.img", ".img", "ubuntu-cpc-focal-arm64-pc-20211018-1234.img"},
+			{"classic_manifest", &classicStateMachine.StateMachine, "{model}-{volume}", "", "filesystem.manifest", ".filesystem.manifest", "ubuntu-cpc.filesystem.manifest"},
+			{"snap_image", &snapStateMachine.StateMachine, "{model}_{series}_{arch}", "pc", "pc.img", ".img", "ubuntu-core-20-amd64_core20_amd64.img"},
+			{"empty_expansion", &snapStateMachine.StateMachine, "{volume}", "", "seed.manifest", ".seed.manifest", "seed.manifest"},
+		}
+		for _, tc := range testCases {
+			tc.stateMachine.commonFlags.ImageName = tc.imageName
+			name := tc.stateMachine.outputName(tc.volumeName, tc.defaultName, tc.suffix)
+			if name != tc.expectedName {
+				t.Errorf("%s: expected output name %s, got %s", tc.name, tc.expectedName, name)
+			}
+		}
+	})
+}
@@ -0,0 +1,554 @@
+package statemachine
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	diskfs "github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/disk"
+	"github.com/diskfs/go-diskfs/filesystem/fat32"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+	"github.com/diskfs/go-diskfs/partition/mbr"
+	"github.com/google/uuid"
+	"github.com/snapcore/snapd/gadget"
+	"github.com/snapcore/snapd/gadget/quantity"
+)
+
+// ImageReport describes the partition table and filesystems of a disk image
+type ImageReport struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	// SectorSize is the logical sector size used to read the partition table
+	SectorSize int64 `json:"sector-size"`
+	// Schema is "gpt" or "mbr"
+	Schema string `json:"schema"`
+	// DiskID is the GUID of GPT disks, or the disk signature of MBR disks
+	DiskID     string            `json:"disk-id"`
+	Partitions []PartitionReport `json:"partitions"`
+	// HybridMBR are the partitions of the hybrid MBR of GPT disks, if any
+	HybridMBR []PartitionReport `json:"hybrid-mbr,omitempty"`
+	// Mismatches are the differences with a gadget.yaml, set by CompareWithGadget
+	Mismatches []string `json:"mismatches,omitempty"`
+}
+
+// PartitionReport describes a partition of a disk image and the filesystem it holds
+type PartitionReport struct {
+	// Number is the index of the partition in the partition table, starting at 1
+	Number int   `json:"number"`
+	Start  int64 `json:"start"`
+	Size   int64 `json:"size"`
+	// Type is the type GUID of GPT partitions, or the hexadecimal type of MBR partitions
+	Type       string `json:"type"`
+	Name       string `json:"name,omitempty"`
+	GUID       string `json:"guid,omitempty"`
+	Bootable   bool   `json:"bootable,omitempty"`
+	Filesystem string `json:"filesystem,omitempty"`
+	Label      string `json:"label,omitempty"`
+	UUID       string `json:"uuid,omitempty"`
+	// Attributes are the attributes of GPT partitions, in the syntax of --gpt-attributes
+	Attributes []string `json:"attributes,omitempty"`
+	// Files lists the contents of vfat filesystems
+	Files []string `json:"files,omitempty"`
+}
+
+// InspectImage reads the partition table of a disk image, and identifies the
+// filesystems of its partitions. The contents of vfat filesystems are listed. A
+// sectorSize of 0 uses the sector size of block devices, and detects the one of GPT
+// disk images. MBR disk images then have 512-byte sectors
+func InspectImage(imagePath string, sectorSize int64) (*ImageReport, error) {
+	diskImg, err := diskfsOpenWithMode(imagePath, diskfs.ReadOnly)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening disk image %s: %s", imagePath, err.Error())
+	}
+	defer diskImg.File.Close()
+
+	// go-diskfs assumes that image files have 512-byte sectors
+	if sectorSize == 0 {
+		sectorSize = diskImg.LogicalBlocksize
+		if diskImg.Type == disk.File {
+			sectorSize = detectSectorSize(diskImg.File)
+		}
+	}
+	diskImg.LogicalBlocksize, diskImg.PhysicalBlocksize = sectorSize, sectorSize
+
+	report := &ImageReport{Path: imagePath, Size: diskImg.Size, SectorSize: sectorSize}
+	partitionTable, err := diskImg.GetPartitionTable()
+	if err != nil {
+		return nil, fmt.Errorf("Error reading partition table of %s: %s", imagePath, err.Error())
+	}
+	switch table := partitionTable.(type) {
+	case *gpt.Table:
+		report.Schema, report.DiskID = "gpt", table.GUID
+		for ii, gptPartition := range table.Partitions {
+			if gptPartition.Type == gpt.Unused {
+				continue
+			}
+			report.Partitions = append(report.Partitions, PartitionReport{
+				Number:     ii + 1,
+				Start:      gptPartition.GetStart(),
+				Size:       gptPartition.GetSize(),
+				Type:       string(gptPartition.Type),
+				Name:       gptPartition.Name,
+				GUID:       gptPartition.GUID,
+				Attributes: formatGPTAttributes(gptPartition.Attributes),
+			})
+		}
+		if report.HybridMBR, err = readHybridMBR(diskImg.File, int64(table.LogicalSectorSize)); err != nil {
+			return nil, fmt.Errorf("Error reading MBR of %s: %s", imagePath, err.Error())
+		}
+	case *mbr.Table:
+		report.Schema = "mbr"
+		signature := make([]byte, 4)
+		if _, err := diskImg.File.ReadAt(signature, 440); err != nil {
+			return nil, fmt.Errorf("Error reading disk signature of %s: %s", imagePath, err.Error())
+		}
+		report.DiskID = fmt.Sprintf("0x%08x", binary.LittleEndian.Uint32(signature))
+		// the logical partitions are numbered from 5, after the primary partitions
+		var logicalPartitions []PartitionReport
+		for ii, mbrPartition := range table.Partitions {
+			if mbrPartition.Type == mbr.Empty {
+				continue
+			}
+			if isExtendedPartition(mbrPartition.Type) {
+				logicalPartitions, err = readLogicalPartitions(diskImg.File, mbrPartition.Start,
+					int64(table.LogicalSectorSize))
+				if err != nil {
+					return nil, fmt.Errorf("Error reading logical partitions of %s: %s",
+						imagePath, err.Error())
+				}
+				continue
+			}
+			report.Partitions = append(report.Partitions, PartitionReport{
+				Number:   ii + 1,
+				Start:    mbrPartition.GetStart(),
+				Size:     mbrPartition.GetSize(),
+				Type:     fmt.Sprintf("%02X", byte(mbrPartition.Type)),
+				Bootable: mbrPartition.Bootable,
+			})
+		}
+		report.Partitions = append(report.Partitions, logicalPartitions...)
+	}
+
+	for ii := range report.Partitions {
+		if err := inspectFilesystem(diskImg, &report.Partitions[ii]); err != nil {
+			return nil, fmt.Errorf("Error inspecting partition %d of %s: %s",
+				report.Partitions[ii].Number, imagePath, err.Error())
+		}
+	}
+	return report, nil
+}
+
+// detectSectorSize returns the sector size of a GPT disk, after which its header is
+// found, or defaultSectorSize
+func detectSectorSize(file io.ReaderAt) int64 {
+	for _, sectorSize := range []int64{512, 4096} {
+		signature := make([]byte, 8)
+		if _, err := file.ReadAt(signature, sectorSize); err == nil && string(signature) == "EFI PART" {
+			return sectorSize
+		}
+	}
+	return defaultSectorSize
+}
+
+// readHybridMBR returns the partitions of the MBR of a GPT disk other than the
+// protective partition of type 0xEE
+func readHybridMBR(file io.ReaderAt, sectorSize int64) ([]PartitionReport, error) {
+	entries := make([]byte, 16*mbrPrimaryPartitions)
+	if _, err := file.ReadAt(entries, 446); err != nil {
+		return nil, err
+	}
+	var partitions []PartitionReport
+	for ii := 0; ii < mbrPrimaryPartitions; ii++ {
+		entry := entries[16*ii : 16*(ii+1)]
+		if entry[4] == byte(mbr.Empty) || entry[4] == 0xEE {
+			continue
+		}
+		partitions = append(partitions, PartitionReport{
+			Number:   ii + 1,
+			Start:    int64(binary.LittleEndian.Uint32(entry[8:12])) * sectorSize,
+			Size:     int64(binary.LittleEndian.Uint32(entry[12:16])) * sectorSize,
+			Type:     fmt.Sprintf("%02X", entry[4]),
+			Bootable: entry[0] == 0x80,
+		})
+	}
+	return partitions, nil
+}
+
+// isExtendedPartition returns whether an MBR partition holds logical partitions
+func isExtendedPartition(partitionType mbr.Type) bool {
+	return partitionType == mbr.ExtendedCHS || partitionType == mbr.ExtendedLBA ||
+		partitionType == mbr.LinuxExtended
+}
+
+// readLogicalPartitions follows the chain of EBRs of the extended partition that starts
+// at sector extendedStart, and returns the logical partitions it describes
+func readLogicalPartitions(file io.ReaderAt, extendedStart uint32, sectorSize int64) ([]PartitionReport, error) {
+	var partitions []PartitionReport
+	visited := make(map[uint32]bool)
+	ebrSector := extendedStart
+	for !visited[ebrSector] {
+		visited[ebrSector] = true
+		ebr := make([]byte, 512)
+		if _, err := file.ReadAt(ebr, int64(ebrSector)*sectorSize); err != nil {
+			return nil, fmt.Errorf("Error reading EBR at sector %d: %s", ebrSector, err.Error())
+		}
+		if ebr[510] != 0x55 || ebr[511] != 0xAA {
+			return nil, fmt.Errorf("invalid EBR signature at sector %d", ebrSector)
+		}
+		entry, next := ebr[446:462], ebr[462:478]
+		if entry[4] != byte(mbr.Empty) {
+			partitions = append(partitions, PartitionReport{
+				Number:   mbrPrimaryPartitions + 1 + len(partitions),
+				Start:    int64(ebrSector+binary.LittleEndian.Uint32(entry[8:12])) * sectorSize,
+				Size:     int64(binary.LittleEndian.Uint32(entry[12:16])) * sectorSize,
+				Type:     fmt.Sprintf("%02X", entry[4]),
+				Bootable: entry[0] == 0x80,
+			})
+		}
+		if !isExtendedPartition(mbr.Type(next[4])) {
+			break
+		}
+		ebrSector = extendedStart + binary.LittleEndian.Uint32(next[8:12])
+	}
+	return partitions, nil
+}
+
+// inspectFilesystem identifies the filesystem of a partition from its superblock, and
+// lists the contents of vfat filesystems
+func inspectFilesystem(diskImg *disk.Disk, partition *PartitionReport) error {
+	superblock := make([]byte, 2048)
+	if _, err := diskImg.File.ReadAt(superblock, partition.Start); err != nil && err != io.EOF {
+		return err
+	}
+	switch {
+	case string(superblock[0:4]) == "hsqs":
+		partition.Filesystem = "squashfs"
+	case binary.LittleEndian.Uint16(superblock[1024+56:]) == 0xEF53:
+		// the ext2/3/4 superblock starts at byte 1024
+		ext := superblock[1024:]
+		partition.Filesystem = "ext2"
+		if binary.LittleEndian.Uint32(ext[96:])&0x40 != 0 {
+			// the extents feature
+			partition.Filesystem = "ext4"
+		} else if binary.LittleEndian.Uint32(ext[92:])&0x4 != 0 {
+			// the journal feature
+			partition.Filesystem = "ext3"
+		}
+		partition.Label = strings.TrimRight(string(ext[120:136]), "\x00")
+		if fsUUID, err := uuid.FromBytes(ext[104:120]); err == nil {
+			partition.UUID = fsUUID.String()
+		}
+	case superblock[510] == 0x55 && superblock[511] == 0xAA &&
+		(string(superblock[82:87]) == "FAT32" || string(superblock[54:57]) == "FAT"):
+		partition.Filesystem = "vfat"
+		// the extended boot record is at byte 64 of FAT32 filesystems and 36 of FAT12/16
+		ebr := superblock[36:]
+		if string(superblock[82:87]) == "FAT32" {
+			ebr = superblock[64:]
+		}
+		partition.Label = strings.TrimRight(string(ebr[7:18]), " ")
+		if partition.Label == "NO NAME" {
+			partition.Label = ""
+		}
+		volumeID := binary.LittleEndian.Uint32(ebr[3:7])
+		partition.UUID = fmt.Sprintf("%04X-%04X", volumeID>>16, volumeID&0xFFFF)
+		// go-diskfs only reads FAT32 filesystems with 512-byte sectors
+		if string(superblock[82:87]) == "FAT32" && binary.LittleEndian.Uint16(superblock[11:13]) == 512 {
+			fatFilesystem, err := fat32.Read(diskImg.File, partition.Size, partition.Start, 512)
+			if err != nil {
+				return fmt.Errorf("Error reading vfat filesystem: %s", err.Error())
+			}
+			partition.Files, err = listFATFiles(fatFilesystem, "/")
+			if err != nil {
+				return fmt.Errorf("Error listing vfat filesystem: %s", err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// listFATFiles returns the paths of the files and directories in dir, recursively.
+// Directories end with a slash. go-diskfs reports the volume label as an entry of the
+// root directory, so it is skipped
+func listFATFiles(fatFilesystem *fat32.FileSystem, dir string) ([]string, error) {
+	entries, err := fatFilesystem.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, entry := range entries {
+		if entry.Name() == "." || entry.Name() == ".." {
+			continue
+		}
+		if dir == "/" && !entry.IsDir() && entry.Size() == 0 &&
+			strings.EqualFold(strings.Replace(entry.Name(), ".", "", 1),
+				strings.TrimSpace(fatFilesystem.Label())) {
+			continue
+		}
+		entryPath := path.Join(dir, entry.Name())
+		if !entry.IsDir() {
+			files = append(files, strings.TrimPrefix(entryPath, "/"))
+			continue
+		}
+		files = append(files, strings.TrimPrefix(entryPath, "/")+"/")
+		subdirFiles, err := listFATFiles(fatFilesystem, entryPath)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, subdirFiles...)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// CompareWithGadget records in the report the differences between the image and the
+// volume called volumeName of the gadget.yaml at gadgetYamlPath. The volume name can be
+// empty for gadgets with a single volume
+func (report *ImageReport) CompareWithGadget(gadgetYamlPath, volumeName string) error {
+	gadgetYamlBytes, err := ioutilReadFile(gadgetYamlPath)
+	if err != nil {
+		return fmt.Errorf("Error reading gadget.yaml bytes: %s", err.Error())
+	}
+	gadgetInfo, err := gadget.InfoFromGadgetYaml(gadgetYamlBytes, nil)
+	if err != nil {
+		return fmt.Errorf("Error running InfoFromGadgetYaml: %s", err.Error())
+	}
+	sectorSizes, err := gadgetSectorSizes(gadgetYamlBytes)
+	if err != nil {
+		return err
+	}
+	partitionAttributes, err := gadgetPartitionAttributes(gadgetYamlBytes)
+	if err != nil {
+		return err
+	}
+	if volumeName == "" {
+		if len(gadgetInfo.Volumes) != 1 {
+			return fmt.Errorf("the gadget.yaml has %d volumes, the volume of the image must be given",
+				len(gadgetInfo.Volumes))
+		}
+		for name := range gadgetInfo.Volumes {
+			volumeName = name
+		}
+	}
+	volume, found := gadgetInfo.Volumes[volumeName]
+	if !found {
+		return fmt.Errorf("volume %s not found in the gadget.yaml", volumeName)
+	}
+	// images of volumes without a sector-size may have been built with --sector-size
+	sectorSize, found := sectorSizes[volumeName]
+	if !found {
+		sectorSize = quantity.Size(report.SectorSize)
+		sectorSizes[volumeName] = sectorSize
+	}
+	if _, err := layoutGadget(gadgetInfo, sectorSizes); err != nil {
+		return err
+	}
+	isSeeded := false
+	for _, structure := range volume.Structure {
+		isSeeded = isSeeded || structure.Role == gadget.SystemSeed
+	}
+	report.compareWithVolume(volume, sectorSize, partitionAttributes[volumeName], isSeeded)
+	return nil
+}
+
+// partitionStructures returns the indexes of the structures of the volume that have
+// a partition, as in createPartitionTable
+func partitionStructures(volume *gadget.Volume, isSeeded bool) []int {
+	var structureNumbers []int
+	for ii, structure := range volume.Structure {
+		if structure.Role != "mbr" && structure.Type != "bare" && structure.Type != "mbr" &&
+			!shouldSkipStructure(structure, isSeeded) {
+			structureNumbers = append(structureNumbers, ii)
+		}
+	}
+	return structureNumbers
+}
+
+// compareWithVolume records in the report the differences between the image and a
+// volume whose structures have been laid out with the given sector size, and whose
+// GPT partitions have the given attributes
+func (report *ImageReport) compareWithVolume(volume *gadget.Volume, sectorSize quantity.Size,
+	attributes map[int]uint64, isSeeded bool) {
+	report.Mismatches = []string{}
+	mismatch := func(format string, args ...interface{}) {
+		report.Mismatches = append(report.Mismatches, fmt.Sprintf(format, args...))
+	}
+	schema := volume.Schema
+	if schema == "" {
+		schema = "gpt"
+	}
+	if report.Schema != schema {
+		mismatch("expected a %s partition table, found %s", schema, report.Schema)
+		return
+	}
+	if report.SectorSize != int64(sectorSize) {
+		mismatch("expected %d-byte sectors, found %d-byte sectors", sectorSize, report.SectorSize)
+		return
+	}
+
+	structureNumbers := partitionStructures(volume, isSeeded)
+	if len(report.Partitions) != len(structureNumbers) {
+		mismatch("expected %d partitions, found %d", len(structureNumbers), len(report.Partitions))
+	}
+
+	for jj, ii := range structureNumbers {
+		if jj >= len(report.Partitions) {
+			break
+		}
+		structure := volume.Structure[ii]
+		partition := report.Partitions[jj]
+		partitionMismatch := func(format string, args ...interface{}) {
+			mismatch("partition %d, structure #%d (%q): %s", partition.Number, ii, structure.Name,
+				fmt.Sprintf(format, args...))
+		}
+		if start := int64(getStructureOffset(structure)); partition.Start != start {
+			partitionMismatch("expected start %d, found %d", start, partition.Start)
+		}
+		expectedSize := (int64(structure.Size) + int64(sectorSize) - 1) / int64(sectorSize) *
+			int64(sectorSize)
+		if structure.Role == gadget.SystemData || structure.Role == gadget.SystemSeed {
+			// the rootfs structures are grown to fit their contents
+			if partition.Size < expectedSize {
+				partitionMismatch("expected a size of at least %d, found %d", expectedSize, partition.Size)
+			}
+		} else if partition.Size != expectedSize {
+			partitionMismatch("expected size %d, found %d", expectedSize, partition.Size)
+		}
+
+		mbrType, gptType := splitStructureType(structure.Type)
+		expectedType := gptType
+		if schema == "mbr" {
+			expectedType = mbrType
+		}
+		if !strings.EqualFold(partition.Type, expectedType) {
+			partitionMismatch("expected type %s, found %s", expectedType, partition.Type)
+		}
+		if schema == "gpt" && partition.Name != structure.Name {
+			partitionMismatch("expected name %q, found %q", structure.Name, partition.Name)
+		}
+		if schema == "gpt" {
+			expectedAttributes := strings.Join(formatGPTAttributes(attributes[ii]), ",")
+			foundAttributes := strings.Join(partition.Attributes, ",")
+			if foundAttributes != expectedAttributes {
+				partitionMismatch("expected attributes %q, found %q", expectedAttributes, foundAttributes)
+			}
+		}
+		if structure.Filesystem == "" {
+			continue
+		}
+		if partition.Filesystem != structure.Filesystem {
+			partitionMismatch("expected a %s filesystem, found %q", structure.Filesystem, partition.Filesystem)
+			continue
+		}
+		if structure.Label != "" && !strings.EqualFold(partition.Label, structure.Label) {
+			partitionMismatch("expected filesystem label %q, found %q", structure.Label, partition.Label)
+		}
+		if partition.Files == nil {
+			continue
+		}
+		for _, content := range structure.Content {
+			target := strings.Trim(content.Target, "/")
+			if target != "" && !containsFATFile(partition.Files, target) {
+				partitionMismatch("content target %s not found in the filesystem", content.Target)
+			}
+		}
+	}
+}
+
+// containsFATFile returns whether the file or directory target is in files. FAT
+// filesystems are case insensitive
+func containsFATFile(files []string, target string) bool {
+	for _, file := range files {
+		if strings.EqualFold(strings.TrimSuffix(file, "/"), target) {
+			return true
+		}
+	}
+	return false
+}
+
+// Write prints the report in the given format, which is "text" or "json"
+func (report *ImageReport) Write(writer io.Writer, format string) error {
+	var err error
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(writer)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(report)
+	case "text":
+		err = report.writeText(writer)
+	default:
+		return fmt.Errorf("unknown format %q", format)
+	}
+	if err != nil {
+		return fmt.Errorf("Error writing image report: %s", err.Error())
+	}
+	return nil
+}
+
+// writeText prints a table of the partitions, followed by the contents of the vfat
+// filesystems and the mismatches with the gadget.yaml
+func (report *ImageReport) writeText(writer io.Writer) error {
+	imageSize := quantity.Size(report.Size)
+	if _, err := fmt.Fprintf(writer, "%s: %s partition table, disk ID %s, size %s, %d-byte sectors\n\n",
+		report.Path, report.Schema, report.DiskID, imageSize.IECString(), report.SectorSize); err != nil {
+		return err
+	}
+	table := tabwriter.NewWriter(writer, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "#\tSTART\tSIZE\tTYPE\tNAME\tGUID\tFILESYSTEM\tLABEL\tUUID\tATTRIBUTES")
+	for _, partition := range report.Partitions {
+		partitionSize := quantity.Size(partition.Size)
+		partitionType := partition.Type
+		if partition.Bootable {
+			partitionType += " (bootable)"
+		}
+		fmt.Fprintf(table, "%d\t%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", partition.Number,
+			partition.Start, partitionSize.IECString(), partitionType, orDash(partition.Name),
+			orDash(partition.GUID), orDash(partition.Filesystem), orDash(partition.Label),
+			orDash(partition.UUID), orDash(strings.Join(partition.Attributes, ",")))
+	}
+	if err := table.Flush(); err != nil {
+		return err
+	}
+
+	if len(report.HybridMBR) > 0 {
+		fmt.Fprintln(writer, "\nHybrid MBR:")
+		for _, partition := range report.HybridMBR {
+			partitionSize := quantity.Size(partition.Size)
+			partitionType := partition.Type
+			if partition.Bootable {
+				partitionType += " (bootable)"
+			}
+			if _, err := fmt.Fprintf(writer, "  %d: start %d, size %s, type %s\n", partition.Number,
+				partition.Start, partitionSize.IECString(), partitionType); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, partition := range report.Partitions {
+		if len(partition.Files) == 0 {
+			continue
+		}
+		if _, err := fmt.Fprintf(writer, "\nFiles of partition %d:\n  %s\n", partition.Number,
+			strings.Join(partition.Files, "\n  ")); err != nil {
+			return err
+		}
+	}
+
+	if report.Mismatches == nil {
+		return nil
+	}
+	if len(report.Mismatches) == 0 {
+		_, err := fmt.Fprintln(writer, "\nThe image matches the gadget.yaml")
+		return err
+	}
+	_, err := fmt.Fprintf(writer, "\n%d mismatch(es) with the gadget.yaml:\n  %s\n",
+		len(report.Mismatches), strings.Join(report.Mismatches, "\n  "))
+	return err
+}
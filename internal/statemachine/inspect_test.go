@@ -0,0 +1,191 @@
+// This file contains unit tests for the inspection of disk images
+package statemachine
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+	diskfs "github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/disk"
+	"github.com/diskfs/go-diskfs/filesystem"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+)
+
+// makeInspectImage creates the image described by gadget-inspect.yaml: a GPT disk with
+// a BIOS Boot partition, a vfat EFI System partition and an ext4 rootfs partition
+func makeInspectImage(t *testing.T, imgPath string) {
+	asserter := helper.Asserter{T: t}
+	diskImg, err := diskfs.Create(imgPath, 48*1024*1024, diskfs.Raw)
+	asserter.AssertErrNil(err, true)
+	defer diskImg.File.Close()
+	err = diskImg.Partition(&gpt.Table{
+		Partitions: []*gpt.Partition{
+			{Start: 2048, Size: 1024 * 1024, Type: "21686148-6449-6E6F-744E-656564454649", Name: "BIOS Boot"},
+			{Start: 4096, Size: 34 * 1024 * 1024, Type: gpt.EFISystemPartition, Name: "EFI System"},
+			{Start: 73728, Size: 4 * 1024 * 1024, Type: gpt.LinuxFilesystem},
+		},
+		LogicalSectorSize:  512,
+		PhysicalSectorSize: 512,
+		ProtectiveMBR:      true,
+	})
+	asserter.AssertErrNil(err, true)
+
+	fatFilesystem, err := diskImg.CreateFilesystem(disk.FilesystemSpec{
+		Partition:   2,
+		FSType:      filesystem.TypeFat32,
+		VolumeLabel: "system-boot",
+	})
+	asserter.AssertErrNil(err, true)
+	for _, dir := range []string{"/EFI/boot", "/EFI/ubuntu"} {
+		err = fatFilesystem.Mkdir(dir)
+		asserter.AssertErrNil(err, true)
+	}
+	for _, file := range []string{"/EFI/boot/grubx64.efi", "/EFI/ubuntu/grub.cfg"} {
+		fatFile, err := fatFilesystem.OpenFile(file, os.O_CREATE|os.O_RDWR)
+		asserter.AssertErrNil(err, true)
+		_, err = fatFile.Write([]byte("test"))
+		asserter.AssertErrNil(err, true)
+	}
+
+	// create the rootfs separately, and copy it in the partition
+	rootfsImg := imgPath + ".writable"
+	defer os.Remove(rootfsImg)
+	mkfsCommand := exec.Command("mkfs.ext4", "-q", "-L", "writable", "-U",
+		"8ec1b2b4-6f3e-4a5e-9c49-0a4e5b6f3c21", rootfsImg, "4M")
+	output, err := mkfsCommand.CombinedOutput()
+	if err != nil {
+		t.Fatalf("Error creating ext4 filesystem: %s", string(output))
+	}
+	rootfs, err := os.Open(rootfsImg)
+	asserter.AssertErrNil(err, true)
+	defer rootfs.Close()
+	_, err = diskImg.WritePartitionContents(3, rootfs)
+	asserter.AssertErrNil(err, true)
+}
+
+// TestInspectImage ensures that the partitions and filesystems of an image are
+// reported and compared with a gadget.yaml
+func TestInspectImage(t *testing.T) {
+	t.Run("test_inspect_image", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		workDir, err := ioutil.TempDir("/tmp", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(workDir)
+		imgPath := filepath.Join(workDir, "pc.img")
+		makeInspectImage(t, imgPath)
+
+		report, err := InspectImage(imgPath, 0)
+		asserter.AssertErrNil(err, true)
+		if report.Schema != "gpt" || report.SectorSize != 512 || len(report.Partitions) != 3 {
+			t.Fatalf("Unexpected report %+v", report)
+		}
+		expected := []PartitionReport{
+			{Number: 1, Start: 1048576, Size: 1048576, Type: "21686148-6449-6E6F-744E-656564454649",
+				Name: "BIOS Boot"},
+			{Number: 2, Start: 2097152, Size: 35651584, Type: "C12A7328-F81F-11D2-BA4B-00A0C93EC93B",
+				Name: "EFI System", Filesystem: "vfat", Label: "system-boot",
+				Files: []string{"EFI/", "EFI/boot/", "EFI/boot/grubx64.efi", "EFI/ubuntu/",
+					"EFI/ubuntu/grub.cfg"}},
+			{Number: 3, Start: 37748736, Size: 4194304, Type: "0FC63DAF-8483-4772-8E79-3D69D8477DE4",
+				Filesystem: "ext4", Label: "writable", UUID: "8ec1b2b4-6f3e-4a5e-9c49-0a4e5b6f3c21"},
+		}
+		for ii, partition := range report.Partitions {
+			// the GUIDs are random, and so is the vfat volume ID
+			if partition.GUID == "" {
+				t.Errorf("Expected partition %d to have a GUID", partition.Number)
+			}
+			partition.GUID = ""
+			if partition.Filesystem == "vfat" {
+				partition.UUID = ""
+			}
+			if !reflect.DeepEqual(partition, expected[ii]) {
+				t.Errorf("Expected partition %+v, got %+v", expected[ii], partition)
+			}
+		}
+
+		err = report.CompareWithGadget(filepath.Join("testdata", "gadget-inspect.yaml"), "")
+		asserter.AssertErrNil(err, true)
+		if len(report.Mismatches) != 0 {
+			t.Errorf("Expected the image to match the gadget.yaml, got %v", report.Mismatches)
+		}
+		var output bytes.Buffer
+		err = report.Write(&output, "text")
+		asserter.AssertErrNil(err, true)
+		for _, expected := range []string{"pc.img: gpt partition table, disk ID ",
+			"\nFiles of partition 2:\n  EFI/\n", "The image matches the gadget.yaml"} {
+			if !strings.Contains(output.String(), expected) {
+				t.Errorf("Expected the report to contain %q, got:\n%s", expected, output.String())
+			}
+		}
+
+		// the gadget.yaml of another layout doesn't match
+		err = report.CompareWithGadget(filepath.Join("testdata", "gadget-gpt.yaml"), "pc")
+		asserter.AssertErrNil(err, true)
+		for _, expected := range []string{
+			`partition 2, structure #2 ("EFI System"): expected size 52428800, found 35651584`,
+			`partition 2, structure #2 ("EFI System"): content target EFI/boot/bootx64.efi not found`,
+			`partition 3, structure #3 (""): expected start 54525952, found 37748736`,
+		} {
+			if !strings.Contains(strings.Join(report.Mismatches, "\n"), expected) {
+				t.Errorf("Expected mismatch %q, got %v", expected, report.Mismatches)
+			}
+		}
+		err = report.CompareWithGadget(filepath.Join("testdata", "gadget-mbr.yaml"), "")
+		asserter.AssertErrNil(err, true)
+		if !reflect.DeepEqual(report.Mismatches, []string{"expected a mbr partition table, found gpt"}) {
+			t.Errorf("Unexpected mismatches %v", report.Mismatches)
+		}
+
+		output.Reset()
+		err = report.Write(&output, "json")
+		asserter.AssertErrNil(err, true)
+		var jsonReport ImageReport
+		err = json.Unmarshal(output.Bytes(), &jsonReport)
+		asserter.AssertErrNil(err, true)
+		if !reflect.DeepEqual(&jsonReport, report) {
+			t.Errorf("Expected the JSON report to match %+v, got %+v", report, jsonReport)
+		}
+	})
+}
+
+// TestFailedInspectImage tests failures when inspecting disk images
+func TestFailedInspectImage(t *testing.T) {
+	t.Run("test_failed_inspect_image", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		_, err := InspectImage(filepath.Join("testdata", "missing.img"), 0)
+		asserter.AssertErrContains(err, "Error opening disk image")
+
+		_, err = InspectImage(filepath.Join("testdata", "gadget_tree", "pc-core.img"), 0)
+		asserter.AssertErrContains(err, "Error reading partition table")
+
+		workDir, err := ioutil.TempDir("/tmp", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(workDir)
+		imgPath := filepath.Join(workDir, "pc.img")
+		makeInspectImage(t, imgPath)
+		report, err := InspectImage(imgPath, 0)
+		asserter.AssertErrNil(err, true)
+
+		err = report.CompareWithGadget(filepath.Join("testdata", "missing.yaml"), "")
+		asserter.AssertErrContains(err, "Error reading gadget.yaml bytes")
+		err = report.CompareWithGadget(filepath.Join("testdata", "gadget_tree_invalid", "meta", "gadget.yaml"), "")
+		asserter.AssertErrContains(err, "Error running InfoFromGadgetYaml")
+		err = report.CompareWithGadget(filepath.Join("testdata", "gadget-multi.yaml"), "")
+		asserter.AssertErrContains(err, "the volume of the image must be given")
+		err = report.CompareWithGadget(filepath.Join("testdata", "gadget-multi.yaml"), "fifth")
+		asserter.AssertErrContains(err, "volume fifth not found")
+
+		err = report.Write(&bytes.Buffer{}, "yaml")
+		asserter.AssertErrContains(err, "unknown format")
+		err = report.Write(failingWriter{}, "text")
+		asserter.AssertErrContains(err, "Error writing image report")
+	})
+}
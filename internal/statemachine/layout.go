@@ -0,0 +1,517 @@
+package statemachine
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/snapcore/snapd/gadget"
+	"github.com/snapcore/snapd/gadget/quantity"
+)
+
+// layoutDiagramWidth is the number of columns shared by the regions of a volume in the
+// diagrams, in proportion to their sizes
+const layoutDiagramWidth = 72
+
+// layoutRegion is a part of a volume: a structure, a partition table or a gap
+type layoutRegion struct {
+	kind  string
+	start quantity.Offset
+	size  quantity.Size
+	// the size of the rootfs is only known at build time
+	sizeKnown bool
+	// structure is the index of the structure, or -1
+	structure     int
+	name          string
+	role          string
+	partitionType string
+	filesystem    string
+	offsetWrite   string
+	// attributes are the GPT attributes of the partition, in the syntax of --gpt-attributes
+	attributes string
+}
+
+// the kinds of regions
+const (
+	regionStructure      = "structure"
+	regionPartitionTable = "partition-table"
+	regionGap            = "gap"
+)
+
+// layoutOffsetWrite is a location where a build writes the offset of a structure, or
+// of a content image of a structure
+type layoutOffsetWrite struct {
+	volumeOffsetWrite
+	name        string
+	contentName string
+}
+
+// description describes what the value of the offset-write is the offset of
+func (offsetWrite layoutOffsetWrite) description() string {
+	description := fmt.Sprintf("structure #%d (%s)", offsetWrite.structure, offsetWrite.name)
+	if offsetWrite.content >= 0 {
+		description = fmt.Sprintf("content #%d (%s) of %s", offsetWrite.content,
+			offsetWrite.contentName, description)
+	}
+	return description
+}
+
+// volumeLayout is the layout of a volume as a build would create it
+type volumeLayout struct {
+	name         string
+	schema       string
+	hybrid       bool
+	sectorSize   quantity.Size
+	regions      []layoutRegion
+	offsetWrites []layoutOffsetWrite
+	// size is the size of the image without --image-size, or 0 if it depends on the rootfs
+	size quantity.Size
+}
+
+// end returns the offset following the region
+func (region layoutRegion) end() quantity.Offset {
+	return region.start + quantity.Offset(region.size)
+}
+
+// label returns the name of the region in tables
+func (region layoutRegion) label() string {
+	switch {
+	case region.kind == regionGap:
+		return "(gap)"
+	case region.kind == regionPartitionTable:
+		return "(" + region.name + ")"
+	case region.name != "":
+		return region.name
+	case region.role != "":
+		return region.role
+	default:
+		return "-"
+	}
+}
+
+// WriteGadgetLayout prints the layout of the volumes of a gadget tree once the offsets
+// of the structures are assigned and the rootfs structure is added, as a build would.
+// The format is "text", for a table and a diagram of each volume, or "svg"
+func WriteGadgetLayout(writer io.Writer, gadgetTree, format string) error {
+	gadgetYamlPath := filepath.Join(gadgetTree, "meta", "gadget.yaml")
+	gadgetYamlBytes, err := ioutilReadFile(gadgetYamlPath)
+	if err != nil {
+		return fmt.Errorf("Error reading gadget.yaml bytes: %s", err.Error())
+	}
+	gadgetInfo, err := gadget.InfoFromGadgetYaml(gadgetYamlBytes, nil)
+	if err != nil {
+		return fmt.Errorf("Error running InfoFromGadgetYaml: %s", err.Error())
+	}
+	sectorSizes, err := gadgetSectorSizes(gadgetYamlBytes)
+	if err != nil {
+		return err
+	}
+	partitionAttributes, err := gadgetPartitionAttributes(gadgetYamlBytes)
+	if err != nil {
+		return err
+	}
+	structureCounts, err := layoutGadget(gadgetInfo, sectorSizes)
+	if err != nil {
+		return err
+	}
+
+	var layouts []volumeLayout
+	lines := findGadgetYamlLines(string(gadgetYamlBytes))
+	for _, volumeName := range lines.volumeOrder(gadgetInfo) {
+		sectorSize, found := sectorSizes[volumeName]
+		if !found {
+			sectorSize = defaultSectorSize
+		}
+		layouts = append(layouts, newVolumeLayout(volumeName, gadgetInfo.Volumes[volumeName],
+			structureCounts[volumeName], sectorSize, partitionAttributes[volumeName]))
+	}
+
+	switch format {
+	case "text":
+		for ii, layout := range layouts {
+			if ii > 0 {
+				fmt.Fprintln(writer)
+			}
+			if err = layout.writeText(writer); err != nil {
+				break
+			}
+		}
+	case "svg":
+		err = writeLayoutSVG(writer, layouts)
+	default:
+		return fmt.Errorf("unknown format %q", format)
+	}
+	if err != nil {
+		return fmt.Errorf("Error writing gadget layout: %s", err.Error())
+	}
+	return nil
+}
+
+// newVolumeLayout returns the regions of a volume sorted by offset, including the
+// partition tables and the gaps between the structures. The first structureCount
+// structures are declared in the gadget.yaml, and the partitions have the GPT
+// attributes of their structure index in attributes
+func newVolumeLayout(volumeName string, volume *gadget.Volume, structureCount int,
+	sectorSize quantity.Size, attributes map[int]uint64) volumeLayout {
+	layout := volumeLayout{name: volumeName, schema: volume.Schema, sectorSize: sectorSize}
+	if layout.schema == "" {
+		layout.schema = "gpt"
+	}
+
+	var structures []layoutRegion
+	sizeKnown := true
+	var farthestOffset quantity.Offset
+	for ii, structure := range volume.Structure {
+		region := layoutRegion{
+			kind:       regionStructure,
+			start:      getStructureOffset(structure),
+			size:       structure.Size,
+			sizeKnown:  structure.Size != 0 || structure.Role != gadget.SystemData,
+			structure:  ii,
+			name:       structure.Name,
+			role:       structure.Role,
+			filesystem: structure.Filesystem,
+			attributes: strings.Join(formatGPTAttributes(attributes[ii]), ","),
+		}
+		mbrType, gptType := splitStructureType(structure.Type)
+		if mbrType != "" && gptType != "" && ii < structureCount {
+			layout.hybrid = true
+		}
+		switch {
+		case structure.Role == "mbr" || structure.Type == "mbr":
+			region.partitionType = "mbr"
+		case structure.Type == "bare":
+			region.partitionType = "bare"
+		case layout.schema == "mbr":
+			region.partitionType = mbrType
+		default:
+			region.partitionType = gptType
+		}
+		if structure.OffsetWrite != nil {
+			region.offsetWrite = structure.OffsetWrite.String()
+		}
+		sizeKnown = sizeKnown && region.sizeKnown
+		farthestOffset = maxOffset(farthestOffset, region.end())
+		structures = append(structures, region)
+	}
+	// the offset-writes are those that make_disk writes
+	for _, offsetWrite := range volumeOffsetWrites(volume, sectorSize) {
+		layoutWrite := layoutOffsetWrite{volumeOffsetWrite: offsetWrite,
+			name: structures[offsetWrite.structure].label()}
+		if offsetWrite.content >= 0 {
+			layoutWrite.contentName = volume.Structure[offsetWrite.structure].Content[offsetWrite.content].Image
+		}
+		layout.offsetWrites = append(layout.offsetWrites, layoutWrite)
+	}
+	if sizeKnown {
+		// the default size of the image, as calculated by handleContentSizes
+		layout.size = quantity.Size((farthestOffset/quantity.OffsetMiB + 17) * quantity.OffsetMiB)
+	}
+
+	// the partition tables, where they are not covered by structures such as the mbr
+	// the GPT header takes a sector, followed by 16KiB of partition entries
+	tables := []layoutRegion{{start: 0, size: sectorSize, name: "MBR partition table"}}
+	gptSize := sectorSize + 128*128
+	if layout.schema != "mbr" {
+		tables[0].name = "protective MBR"
+		tables = append(tables, layoutRegion{start: quantity.Offset(sectorSize), size: gptSize,
+			name: "GPT header and entries"})
+		if layout.size != 0 {
+			tables = append(tables, layoutRegion{start: quantity.Offset(layout.size - gptSize),
+				size: gptSize, name: "backup GPT"})
+		}
+	}
+	// the EBRs of the logical partitions, in the sector before each of them
+	for jj, structureNumber := range mbrLogicalPartitions(volume, false) {
+		start := (getStructureOffset(volume.Structure[structureNumber]) + quantity.Offset(sectorSize) - 1) /
+			quantity.Offset(sectorSize) * quantity.Offset(sectorSize)
+		tables = append(tables, layoutRegion{start: start - quantity.Offset(sectorSize), size: sectorSize,
+			name: fmt.Sprintf("EBR of partition %d", mbrPrimaryPartitions+1+jj)})
+	}
+	regions := append([]layoutRegion{}, structures...)
+	for _, table := range tables {
+		for _, structure := range structures {
+			if structure.start <= table.start && structure.end() > table.start {
+				start := minOffset(structure.end(), table.end())
+				table.size -= quantity.Size(start - table.start)
+				table.start = start
+			}
+		}
+		if table.size > 0 {
+			table.kind, table.sizeKnown, table.structure = regionPartitionTable, true, -1
+			regions = append(regions, table)
+		}
+	}
+	sort.SliceStable(regions, func(i, j int) bool { return regions[i].start < regions[j].start })
+
+	// fill the gaps between the regions
+	var end quantity.Offset
+	for ii, region := range regions {
+		if region.start > end && (ii == 0 || regions[ii-1].sizeKnown) {
+			layout.regions = append(layout.regions, layoutRegion{kind: regionGap, start: end,
+				size: quantity.Size(region.start - end), sizeKnown: true, structure: -1})
+		}
+		layout.regions = append(layout.regions, region)
+		end = maxOffset(end, region.end())
+	}
+	return layout
+}
+
+// minOffset returns the smaller of two offsets
+func minOffset(offset1, offset2 quantity.Offset) quantity.Offset {
+	if offset1 < offset2 {
+		return offset1
+	}
+	return offset2
+}
+
+// description returns the schema of the volume and its default size
+func (layout volumeLayout) description() string {
+	description := fmt.Sprintf("Volume %s, schema %s", layout.name, layout.schema)
+	if layout.hybrid {
+		description += fmt.Sprintf(" with hybrid MBR,GPT structure types, of which the %s types are used",
+			strings.ToUpper(layout.schema))
+	}
+	if layout.sectorSize != defaultSectorSize {
+		description += fmt.Sprintf(", %d-byte sectors", layout.sectorSize)
+	}
+	if layout.size != 0 {
+		description += ", size " + layout.size.IECString()
+	} else {
+		description += ", size calculated at build time from the rootfs"
+	}
+	return description
+}
+
+// findRegion returns the region holding offset, preferring structures
+func (layout volumeLayout) findRegion(offset quantity.Offset) (layoutRegion, bool) {
+	var found layoutRegion
+	var isFound bool
+	for _, region := range layout.regions {
+		if offset >= region.start && (offset < region.end() || !region.sizeKnown) {
+			if !isFound || region.kind == regionStructure {
+				found, isFound = region, true
+			}
+		}
+	}
+	return found, isFound
+}
+
+// writeText prints a table of the regions of the volume, followed by a diagram, the
+// locations of the offset-writes and the GPT attributes of the partitions
+func (layout volumeLayout) writeText(writer io.Writer) error {
+	if _, err := fmt.Fprintf(writer, "%s:\n\n", layout.description()); err != nil {
+		return err
+	}
+	table := tabwriter.NewWriter(writer, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "#\tNAME\tROLE\tSTART\tEND\tSIZE\tTYPE\tFILESYSTEM\tOFFSET-WRITE")
+	for _, region := range layout.regions {
+		index, end, size := "-", "?", "(rootfs)"
+		if region.structure >= 0 {
+			index = strconv.Itoa(region.structure)
+		}
+		if region.sizeKnown {
+			end = strconv.FormatUint(uint64(region.end()), 10)
+			size = region.size.IECString()
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%d\t%s\t%s\t%s\t%s\t%s\n", index, region.label(),
+			orDash(region.role), region.start, end, size, orDash(region.partitionType),
+			orDash(region.filesystem), orDash(region.offsetWrite))
+	}
+	if err := table.Flush(); err != nil {
+		return err
+	}
+
+	columns, widths := layout.diagramColumns(layoutDiagramWidth)
+	var bar, border, markers strings.Builder
+	for ii, region := range layout.regions {
+		label := ""
+		switch region.kind {
+		case regionStructure:
+			label = strconv.Itoa(region.structure)
+		case regionPartitionTable:
+			label = "pt"
+		}
+		fill := " "
+		if region.kind == regionGap {
+			fill = "."
+		}
+		bar.WriteString("|" + centerLabel(label, widths[ii]-1, fill))
+		border.WriteString("+" + strings.Repeat("-", widths[ii]-1))
+	}
+	bar.WriteString("|")
+	border.WriteString("+")
+	if len(layout.offsetWrites) > 0 {
+		line := []byte(strings.Repeat(" ", border.Len()))
+		for _, offsetWrite := range layout.offsetWrites {
+			if column := layout.diagramColumn(offsetWrite.location, columns, widths); column >= 0 {
+				line[column] = '^'
+			}
+		}
+		markers.WriteString(strings.TrimRight(string(line), " ") + " offset-writes\n")
+	}
+	if _, err := fmt.Fprintf(writer, "\n%s\n%s\n%s\n%s", border.String(), bar.String(),
+		border.String(), markers.String()); err != nil {
+		return err
+	}
+
+	if len(layout.offsetWrites) > 0 {
+		fmt.Fprintln(writer, "\nOffset writes:")
+	}
+	for _, offsetWrite := range layout.offsetWrites {
+		target := "outside of the volume"
+		if region, found := layout.findRegion(offsetWrite.location); found {
+			target = "in " + region.label()
+		}
+		if _, err := fmt.Fprintf(writer, "  offset of %s, %d in %d-byte sectors, "+
+			"written at byte %d, %s\n", offsetWrite.description(), offsetWrite.value,
+			layout.sectorSize, offsetWrite.location, target); err != nil {
+			return err
+		}
+	}
+
+	printedHeader := false
+	for _, region := range layout.regions {
+		if region.attributes == "" {
+			continue
+		}
+		if !printedHeader {
+			fmt.Fprintln(writer, "\nPartition attributes:")
+			printedHeader = true
+		}
+		if _, err := fmt.Fprintf(writer, "  structure #%d (%s): %s\n", region.structure,
+			region.label(), region.attributes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// orDash returns value, or "-" for empty values in tables
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+// centerLabel centers label in width characters, padded with fill
+func centerLabel(label string, width int, fill string) string {
+	if len(label) > width {
+		label = label[:width]
+	}
+	left := (width - len(label)) / 2
+	return strings.Repeat(fill, left) + label + strings.Repeat(fill, width-len(label)-left)
+}
+
+// diagramColumns returns the first column and the width of each region in a diagram
+// where the regions share width columns in proportion to their sizes. Each region is
+// at least 4 columns wide so that its label fits, and regions of unknown size 8 columns
+func (layout volumeLayout) diagramColumns(width int) (columns, widths []int) {
+	var total quantity.Size
+	for _, region := range layout.regions {
+		total += region.size
+	}
+	column := 0
+	for _, region := range layout.regions {
+		regionWidth := 8
+		if region.sizeKnown {
+			regionWidth = 4
+			if total != 0 {
+				if proportional := int(uint64(width) * uint64(region.size) / uint64(total)); proportional > 4 {
+					regionWidth = proportional
+				}
+			}
+		}
+		columns = append(columns, column)
+		widths = append(widths, regionWidth)
+		column += regionWidth
+	}
+	return columns, widths
+}
+
+// diagramColumn returns the column of offset in a diagram, or -1 if it is outside of the
+// regions. The column is interpolated within the region holding offset
+func (layout volumeLayout) diagramColumn(offset quantity.Offset, columns, widths []int) int {
+	for ii, region := range layout.regions {
+		if offset < region.start || (region.sizeKnown && offset >= region.end()) {
+			continue
+		}
+		position := 0
+		if region.sizeKnown && region.size > 0 {
+			position = int(uint64(offset-region.start) * uint64(widths[ii]-1) / uint64(region.size))
+		}
+		return columns[ii] + 1 + position
+	}
+	return -1
+}
+
+// the fill colors of the regions in SVG diagrams
+var layoutSVGColors = map[string]string{
+	regionStructure:      "#9ecae1",
+	regionPartitionTable: "#d9d9d9",
+	regionGap:            "#ffffff",
+}
+
+// writeLayoutSVG draws the volumes as bars of regions, one below the other. The details
+// of each region are shown as tooltips
+func writeLayoutSVG(writer io.Writer, layouts []volumeLayout) error {
+	const scale, left, volumeHeight = 12, 10, 110
+	var svg strings.Builder
+	fmt.Fprintf(&svg, "<svg xmlns=\"http://www.w3.org/2000/svg\" width=\"%d\" height=\"%d\" "+
+		"font-family=\"sans-serif\" font-size=\"12\">\n", 2*left+scale*(layoutDiagramWidth+40),
+		volumeHeight*len(layouts)+10)
+	for ii, layout := range layouts {
+		top := volumeHeight*ii + 20
+		fmt.Fprintf(&svg, "  <text x=\"%d\" y=\"%d\" font-weight=\"bold\">%s</text>\n",
+			left, top, html.EscapeString(layout.description()))
+		columns, widths := layout.diagramColumns(layoutDiagramWidth)
+		for jj, region := range layout.regions {
+			fill := layoutSVGColors[region.kind]
+			if region.kind == regionStructure && region.filesystem == "" {
+				fill = "#fdd0a2"
+			}
+			x, width := left+scale*columns[jj], scale*widths[jj]
+			details := fmt.Sprintf("%s: offset %d, size %s", region.label(), region.start, region.size.IECString())
+			if !region.sizeKnown {
+				details = fmt.Sprintf("%s: offset %d, size calculated at build time", region.label(), region.start)
+			}
+			for _, detail := range []struct{ name, value string }{{"role", region.role},
+				{"type", region.partitionType}, {"filesystem", region.filesystem},
+				{"offset-write", region.offsetWrite}, {"attributes", region.attributes}} {
+				if detail.value != "" {
+					details += fmt.Sprintf(", %s %s", detail.name, detail.value)
+				}
+			}
+			fmt.Fprintf(&svg, "  <g>\n    <title>%s</title>\n", html.EscapeString(details))
+			fmt.Fprintf(&svg, "    <rect x=\"%d\" y=\"%d\" width=\"%d\" height=\"40\" fill=\"%s\" "+
+				"stroke=\"#333333\"/>\n", x, top+10, width, fill)
+			if region.kind == regionStructure {
+				fmt.Fprintf(&svg, "    <text x=\"%d\" y=\"%d\" text-anchor=\"middle\">%d</text>\n",
+					x+width/2, top+35, region.structure)
+			}
+			fmt.Fprintf(&svg, "  </g>\n")
+		}
+		for _, offsetWrite := range layout.offsetWrites {
+			column := layout.diagramColumn(offsetWrite.location, columns, widths)
+			if column < 0 {
+				continue
+			}
+			x := left + scale*column
+			fmt.Fprintf(&svg, "  <g>\n    <title>%s</title>\n", html.EscapeString(fmt.Sprintf(
+				"offset of %s, %d in %d-byte sectors, written at byte %d",
+				offsetWrite.description(), offsetWrite.value, layout.sectorSize,
+				offsetWrite.location)))
+			fmt.Fprintf(&svg, "    <path d=\"M %d %d l -5 10 l 10 0 z\" fill=\"#d62728\"/>\n  </g>\n",
+				x, top+52)
+		}
+	}
+	svg.WriteString("</svg>\n")
+	_, err := io.WriteString(writer, svg.String())
+	return err
+}
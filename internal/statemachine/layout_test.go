@@ -0,0 +1,188 @@
+// This file contains unit tests for the layout of gadget volumes
+package statemachine
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+)
+
+// makeGadgetTree creates a gadget tree in a temporary directory with gadgetYaml from
+// the testdata directory as its meta/gadget.yaml
+func makeGadgetTree(t *testing.T, gadgetYaml string) string {
+	asserter := helper.Asserter{T: t}
+	gadgetTree, err := ioutil.TempDir("/tmp", "ubuntu-image-")
+	asserter.AssertErrNil(err, true)
+	err = os.MkdirAll(filepath.Join(gadgetTree, "meta"), 0755)
+	asserter.AssertErrNil(err, true)
+	gadgetYamlBytes, err := ioutil.ReadFile(filepath.Join("testdata", gadgetYaml))
+	asserter.AssertErrNil(err, true)
+	err = ioutil.WriteFile(filepath.Join(gadgetTree, "meta", "gadget.yaml"), gadgetYamlBytes, 0644)
+	asserter.AssertErrNil(err, true)
+	return gadgetTree
+}
+
+// TestWriteGadgetLayout ensures that the volumes are laid out with their partition
+// tables, gaps and offset-writes
+func TestWriteGadgetLayout(t *testing.T) {
+	testCases := []struct {
+		name       string
+		gadgetYaml string
+		expected   []string
+	}{
+		{"hybrid", "gadget-hybrid.yaml", []string{
+			`^Volume pc, schema gpt with hybrid MBR,GPT structure types, of which the GPT types are used, size calculated at build time from the rootfs:`,
+			`\n0 +mbr +mbr +0 +440 +440 B +mbr +- +-\n`,
+			`\n- +\(protective MBR\) +- +440 +512 +72 B `,
+			`\n- +\(GPT header and entries\) +- +512 +17408 +16.50 KiB `,
+			`\n- +\(gap\) +- +17408 +1048576 +1007 KiB `,
+			`\n1 +BIOS Boot +- +1048576 +2097152 +1 MiB +21686148-6449-6E6F-744E-656564454649 +- +mbr\+92\n`,
+			`\n3 +system-data +system-data +54525952 +\? +\(rootfs\) +0FC63DAF-8483-4772-8E79-3D69D8477DE4 +ext4 +0\n`,
+			`\n\| 0 \|pt \|pt \|\.+\| 1 \| +2 +\| +3 +\|\n`,
+			`offset of structure #1 \(BIOS Boot\), 2048 in 512-byte sectors, written at byte 92, in mbr`,
+		}},
+		{"mbr", "gadget-mbr.yaml", []string{
+			`^Volume pc, schema mbr, size calculated`,
+			`\n- +\(MBR partition table\) +- +440 +512 +72 B `,
+			`\n1 +BIOS Boot +- +1048576 +2097152 +1 MiB +DA +- +mbr\+92\n`,
+		}},
+		{"4k", "gadget-4k.yaml", []string{
+			`^Volume pc, schema gpt, 4096-byte sectors, size calculated at build time from the rootfs:`,
+			`\n- +\(protective MBR\) +- +440 +4096 +3.57 KiB `,
+			`\n- +\(GPT header and entries\) +- +4096 +24576 +20 KiB `,
+			`offset of structure #1 \(BIOS Boot\), 256 in 4096-byte sectors, written at byte 92, in mbr`,
+		}},
+		{"content_offset_write", "gadget-content-offset-write.yaml", []string{
+			`offset of structure #1 \(BIOS Boot\), 2048 in 512-byte sectors, written at byte 92, in mbr`,
+			`offset of content #1 \(pc-core-extra.img\) of structure #1 \(BIOS Boot\), 3072 in ` +
+				`512-byte sectors, written at byte 100, in mbr`,
+			`\n +\^ +offset-writes\n`,
+		}},
+		{"attributes", "gadget-attributes.yaml", []string{
+			`\n2 +kernel-a +- +2097152 +6291456 +4 MiB +FE3A2A5D-4F32-41A7-B725-ACCC3285A309 +- +-\n`,
+			`\nPartition attributes:\n  structure #1 \(BIOS Boot\): legacy-bios-bootable\n` +
+				`  structure #2 \(kernel-a\): priority=15,successful\n` +
+				`  structure #3 \(kernel-b\): priority=1,tries=3\n$`,
+		}},
+		{"logical", "gadget-logical.yaml", []string{
+			`\n- +\(EBR of partition 5\) +- +14679552 +14680064 +512 B `,
+			`\n4 +recovery +- +14680064 +18874368 +4 MiB +83 `,
+			`\n- +\(EBR of partition 7\) +- +26213888 +26214400 +512 B `,
+		}},
+		{"multi_volume", "gadget-multi.yaml", []string{
+			`^Volume first, schema gpt with hybrid MBR,GPT structure types, of which the GPT types are used, size `,
+			`\n\nVolume second, schema gpt, size [0-9]+ MiB:`,
+			`\n\nVolume third, schema gpt, size`,
+			`\n- +\(backup GPT\) `,
+		}},
+	}
+	for _, tc := range testCases {
+		t.Run("test_write_gadget_layout_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			gadgetTree := makeGadgetTree(t, tc.gadgetYaml)
+			defer os.RemoveAll(gadgetTree)
+
+			var output bytes.Buffer
+			err := WriteGadgetLayout(&output, gadgetTree, "text")
+			asserter.AssertErrNil(err, true)
+			for _, expected := range tc.expected {
+				if !regexp.MustCompile(expected).MatchString(output.String()) {
+					t.Errorf("Expected the layout to match %q, got:\n%s", expected, output.String())
+				}
+			}
+
+			// the SVG diagram is valid XML and has a tooltip per region and offset-write
+			output.Reset()
+			err = WriteGadgetLayout(&output, gadgetTree, "svg")
+			asserter.AssertErrNil(err, true)
+			var svg struct {
+				Groups []struct {
+					Title string `xml:"title"`
+				} `xml:"g"`
+			}
+			err = xml.Unmarshal(output.Bytes(), &svg)
+			asserter.AssertErrNil(err, true)
+			if len(svg.Groups) == 0 || !strings.Contains(svg.Groups[0].Title, ": offset 0,") {
+				t.Errorf("Unexpected SVG diagram:\n%s", output.String())
+			}
+		})
+	}
+}
+
+// TestWriteGadgetLayoutSVGStdout ensures that the SVG diagram written to stdout, as
+// show-layout --format svg does, is not mixed with the warnings about the gadget.yaml
+func TestWriteGadgetLayoutSVGStdout(t *testing.T) {
+	t.Run("test_write_gadget_layout_svg_stdout", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		// the EFI System structure has a system-boot filesystem label and no role
+		gadgetTree := makeGadgetTree(t, "gadget-hybrid.yaml")
+		defer os.RemoveAll(gadgetTree)
+
+		stdout, restoreStdout, err := helper.CaptureStd(&os.Stdout)
+		defer restoreStdout()
+		asserter.AssertErrNil(err, true)
+		stderr, restoreStderr, err := helper.CaptureStd(&os.Stderr)
+		defer restoreStderr()
+		asserter.AssertErrNil(err, true)
+
+		err = WriteGadgetLayout(os.Stdout, gadgetTree, "svg")
+		asserter.AssertErrNil(err, true)
+
+		restoreStdout()
+		restoreStderr()
+		readStdout, err := ioutil.ReadAll(stdout)
+		asserter.AssertErrNil(err, true)
+		readStderr, err := ioutil.ReadAll(stderr)
+		asserter.AssertErrNil(err, true)
+		if !strings.HasPrefix(string(readStdout), "<svg") {
+			t.Errorf("Expected the SVG diagram to start with <svg, got:\n%s", string(readStdout))
+		}
+		if !strings.Contains(string(readStderr), "WARNING: volumes:pc:structure:2:filesystem_label") {
+			t.Errorf("Expected the filesystem_label warning on stderr, got %q", string(readStderr))
+		}
+	})
+}
+
+// failingWriter is an io.Writer that always fails
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("Test error")
+}
+
+// TestFailedWriteGadgetLayout tests failures when writing the layout of gadget volumes
+func TestFailedWriteGadgetLayout(t *testing.T) {
+	t.Run("test_failed_write_gadget_layout", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var output bytes.Buffer
+		err := WriteGadgetLayout(&output, filepath.Join("testdata", "missing"), "text")
+		asserter.AssertErrContains(err, "Error reading gadget.yaml bytes")
+
+		err = WriteGadgetLayout(&output, filepath.Join("testdata", "gadget_tree_invalid"), "text")
+		asserter.AssertErrContains(err, "Error running InfoFromGadgetYaml")
+
+		err = WriteGadgetLayout(&output, filepath.Join("testdata", "gadget_tree"), "pdf")
+		asserter.AssertErrContains(err, "unknown format")
+
+		for _, format := range []string{"text", "svg"} {
+			err = WriteGadgetLayout(failingWriter{}, filepath.Join("testdata", "gadget_tree"), format)
+			asserter.AssertErrContains(err, "Error writing gadget layout")
+		}
+
+		// mock os.MkdirAll
+		osMkdirAll = mockMkdirAll
+		defer func() {
+			osMkdirAll = os.MkdirAll
+		}()
+		err = WriteGadgetLayout(&output, filepath.Join("testdata", "gadget_tree"), "text")
+		asserter.AssertErrContains(err, "Error creating volume dir")
+	})
+}
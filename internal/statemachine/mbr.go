@@ -0,0 +1,294 @@
+package statemachine
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/diskfs/go-diskfs/partition/mbr"
+	"github.com/snapcore/snapd/gadget"
+	"github.com/snapcore/snapd/gadget/quantity"
+)
+
+// newMBRPartition returns the MBR partition of a structure with the given MBR type
+func newMBRPartition(structure gadget.VolumeStructure, structureType string,
+	sectorSize uint64) *mbr.Partition {
+	bootable := false
+	if structure.Role == gadget.SystemBoot || structure.Label == gadget.SystemBoot {
+		bootable = true
+	}
+	// mbr.Type is a byte. snapd has already verified that this string
+	// is exactly two chars, so we can parse those two chars to a byte
+	partitionType, _ := strconv.ParseUint(structureType, 16, 8)
+	return &mbr.Partition{
+		Start:    uint32(math.Ceil(float64(*structure.Offset) / float64(sectorSize))),
+		Size:     uint32(math.Ceil(float64(structure.Size) / float64(sectorSize))),
+		Type:     mbr.Type(partitionType),
+		Bootable: bootable,
+	}
+}
+
+// mbrPrimaryPartitions is the number of partitions that an MBR partition table holds.
+// When a volume has more partitions, the first three are primary partitions and the
+// fourth entry of the partition table is an extended partition holding the others as
+// logical partitions, each described by an extended boot record (EBR) in the sector
+// before it
+const mbrPrimaryPartitions = 4
+
+// mbrLogicalPartitions returns the indexes of the structures of a volume that are
+// logical partitions of an extended partition
+func mbrLogicalPartitions(volume *gadget.Volume, isSeeded bool) []int {
+	structureNumbers := partitionStructures(volume, isSeeded)
+	if volume.Schema != "mbr" || len(structureNumbers) <= mbrPrimaryPartitions {
+		return nil
+	}
+	return structureNumbers[mbrPrimaryPartitions-1:]
+}
+
+// mbrPartitionNumber returns the number of the partition at index partitionIndex of the
+// partitionCount partitions of a volume. The logical partitions of MBR volumes are
+// numbered from 5, after the extended partition
+func mbrPartitionNumber(partitionIndex, partitionCount int) int {
+	if partitionCount > mbrPrimaryPartitions && partitionIndex >= mbrPrimaryPartitions-1 {
+		return partitionIndex + 2
+	}
+	return partitionIndex + 1
+}
+
+// extendedPartition returns the extended partition that holds the logical partitions
+// and their EBRs
+func extendedPartition(logicalPartitions []*mbr.Partition) *mbr.Partition {
+	first, last := logicalPartitions[0], logicalPartitions[len(logicalPartitions)-1]
+	return &mbr.Partition{
+		Start: first.Start - 1,
+		Size:  last.Start + last.Size - (first.Start - 1),
+		Type:  mbr.ExtendedLBA,
+	}
+}
+
+// writeMBREntry writes a partition entry of an MBR or EBR. The CHS addresses are left
+// empty, as go-diskfs does for the partition table
+func writeMBREntry(entry []byte, bootable bool, partitionType mbr.Type, start, size uint32) {
+	if bootable {
+		entry[0] = 0x80
+	}
+	entry[4] = byte(partitionType)
+	binary.LittleEndian.PutUint32(entry[8:12], start)
+	binary.LittleEndian.PutUint32(entry[12:16], size)
+}
+
+// writeExtendedBootRecords writes the chain of EBRs of the logical partitions of an MBR
+// volume, which go-diskfs doesn't support. The first entry of each EBR is the logical
+// partition, relative to the EBR, and the second one links to the next EBR, relative
+// to the extended partition
+func writeExtendedBootRecords(file io.WriterAt, volume *gadget.Volume, sectorSize uint64,
+	isSeeded bool) error {
+	var logicalPartitions []*mbr.Partition
+	for _, structureNumber := range mbrLogicalPartitions(volume, isSeeded) {
+		structure := volume.Structure[structureNumber]
+		mbrType, _ := splitStructureType(structure.Type)
+		logicalPartitions = append(logicalPartitions, newMBRPartition(structure, mbrType, sectorSize))
+	}
+	if len(logicalPartitions) == 0 {
+		return nil
+	}
+	extended := extendedPartition(logicalPartitions)
+	for ii, logical := range logicalPartitions {
+		ebr := make([]byte, sectorSize)
+		ebrSector := logical.Start - 1
+		writeMBREntry(ebr[446:462], logical.Bootable, logical.Type, logical.Start-ebrSector, logical.Size)
+		if ii+1 < len(logicalPartitions) {
+			next := logicalPartitions[ii+1]
+			writeMBREntry(ebr[462:478], false, mbr.ExtendedCHS, next.Start-1-extended.Start,
+				next.Size+1)
+		}
+		ebr[510], ebr[511] = 0x55, 0xAA
+		if _, err := file.WriteAt(ebr, int64(ebrSector)*int64(sectorSize)); err != nil {
+			return fmt.Errorf("Error writing EBR of logical partition %d: %s",
+				mbrPrimaryPartitions+1+ii, err.Error())
+		}
+	}
+	return nil
+}
+
+// checkLogicalPartitions reports the logical partitions of an MBR volume that don't
+// leave a free sector before them for their EBR, and the partitions that would be out
+// of order in the extended partition or within it without being logical partitions
+func checkLogicalPartitions(volume *gadget.Volume, sectorSize uint64, isSeeded bool,
+	report func(int, string, ...interface{})) {
+	logicalNumbers := mbrLogicalPartitions(volume, isSeeded)
+	if len(logicalNumbers) == 0 {
+		return
+	}
+	isLogical := make(map[int]bool)
+	for _, structureNumber := range logicalNumbers {
+		isLogical[structureNumber] = true
+	}
+	sectorOffset := func(offset quantity.Offset) quantity.Offset {
+		sectors := (uint64(offset) + sectorSize - 1) / sectorSize
+		return quantity.Offset(sectors * sectorSize)
+	}
+
+	var previousStart quantity.Offset
+	for jj, structureNumber := range logicalNumbers {
+		structure := volume.Structure[structureNumber]
+		partitionNumber := mbrPrimaryPartitions + 1 + jj
+		start := sectorOffset(getStructureOffset(structure))
+		if jj > 0 && start <= previousStart {
+			report(structureNumber, "logical partition %d at offset %d must come after logical "+
+				"partition %d at offset %d", partitionNumber, start, partitionNumber-1, previousStart)
+		}
+		previousStart = start
+		ebrStart := start - quantity.Offset(sectorSize)
+		for ii, other := range volume.Structure {
+			if ii == structureNumber || shouldSkipStructure(other, isSeeded) {
+				continue
+			}
+			otherStart := getStructureOffset(other)
+			otherEnd := otherStart + quantity.Offset(other.Size)
+			if otherStart < start && ebrStart < otherEnd {
+				report(structureNumber, "the EBR of logical partition %d at offset %d overlaps "+
+					"with structure #%d (%q): leave a free sector before the structure",
+					partitionNumber, ebrStart, ii, other.Name)
+			}
+		}
+	}
+
+	first := volume.Structure[logicalNumbers[0]]
+	last := volume.Structure[logicalNumbers[len(logicalNumbers)-1]]
+	extendedStart := sectorOffset(getStructureOffset(first)) - quantity.Offset(sectorSize)
+	extendedEnd := getStructureOffset(last) + quantity.Offset(last.Size)
+	for jj, structureNumber := range partitionStructures(volume, isSeeded) {
+		if isLogical[structureNumber] {
+			continue
+		}
+		structure := volume.Structure[structureNumber]
+		start := getStructureOffset(structure)
+		if start < extendedEnd && extendedStart < start+quantity.Offset(structure.Size) {
+			report(structureNumber, "partition %d is within the extended partition from offset "+
+				"%d to %d, which holds the logical partitions", jj+1, extendedStart, extendedEnd)
+		}
+	}
+}
+
+// logicalPartitionsError returns an error for the first problem that checkLogicalPartitions
+// reports for a volume
+func logicalPartitionsError(volumeName string, volume *gadget.Volume, sectorSize uint64,
+	isSeeded bool) error {
+	var err error
+	checkLogicalPartitions(volume, sectorSize, isSeeded,
+		func(structureNumber int, format string, args ...interface{}) {
+			if err == nil {
+				err = fmt.Errorf("Error laying out the logical partitions of volume %s: "+
+					"structure #%d (%q): %s", volumeName, structureNumber,
+					volume.Structure[structureNumber].Name, fmt.Sprintf(format, args...))
+			}
+		})
+	return err
+}
+
+// hybridMBRStructures returns the structures of a volume that get an entry in its hybrid
+// MBR: the ones selected with --hybrid-mbr=[<volume>:]<structure>[,...], or all the
+// structures with hybrid MBR,GPT types when no structures are selected, as long as they
+// fit in the MBR
+func (stateMachine *StateMachine) hybridMBRStructures(volumeName string,
+	volume *gadget.Volume) ([]int, error) {
+	var structureNumbers []int
+	if stateMachine.commonFlags.HybridMBR == "auto" {
+		for _, structureNumber := range partitionStructures(volume, stateMachine.IsSeeded) {
+			if strings.Contains(volume.Structure[structureNumber].Type, ",") {
+				structureNumbers = append(structureNumbers, structureNumber)
+			}
+		}
+		if len(structureNumbers) > mbrPrimaryPartitions-1 {
+			return nil, fmt.Errorf("%d structures have hybrid MBR,GPT types, but the hybrid "+
+				"MBR can hold at most %d of them. Select them with --hybrid-mbr=<structure>[,...]",
+				len(structureNumbers), mbrPrimaryPartitions-1)
+		}
+		return structureNumbers, nil
+	}
+
+	for _, argument := range strings.Split(stateMachine.commonFlags.HybridMBR, ",") {
+		structure := argument
+		if splitArgument := strings.SplitN(argument, ":", 2); len(splitArgument) == 2 {
+			if splitArgument[0] != volumeName {
+				continue
+			}
+			structure = splitArgument[1]
+		} else if len(stateMachine.GadgetInfo.Volumes) > 1 {
+			return nil, fmt.Errorf("--hybrid-mbr must be given as <volume>:<structure> for " +
+				"gadgets with multiple volumes")
+		}
+		structureNumber, found := findStructure(volume, structure)
+		if !found {
+			return nil, fmt.Errorf("Structure %s does not exist in volume %s", structure, volumeName)
+		}
+		if !strings.Contains(volume.Structure[structureNumber].Type, ",") {
+			return nil, fmt.Errorf("structure #%d (%q) selected with --hybrid-mbr does not have "+
+				"a hybrid MBR,GPT type", structureNumber, volume.Structure[structureNumber].Name)
+		}
+		structureNumbers = append(structureNumbers, structureNumber)
+	}
+	if len(structureNumbers) > mbrPrimaryPartitions-1 {
+		return nil, fmt.Errorf("%d structures are selected with --hybrid-mbr, but the hybrid "+
+			"MBR can hold at most %d of them", len(structureNumbers), mbrPrimaryPartitions-1)
+	}
+	sort.Ints(structureNumbers)
+	return structureNumbers, nil
+}
+
+// writeHybridMBR replaces the protective MBR of a GPT volume with a hybrid MBR when
+// --hybrid-mbr is used. The structures returned by hybridMBRStructures get an entry with
+// their MBR type, after the protective partition of type 0xEE, which covers the GPT
+// header and entries up to the first of them
+func (stateMachine *StateMachine) writeHybridMBR(file io.WriterAt, volumeName string,
+	volume *gadget.Volume, sectorSize uint64) error {
+	if stateMachine.commonFlags.HybridMBR == "" || volume.Schema == "mbr" {
+		return nil
+	}
+	structureNumbers, err := stateMachine.hybridMBRStructures(volumeName, volume)
+	if err != nil {
+		return fmt.Errorf("Error writing hybrid MBR of volume %s: %s", volumeName, err.Error())
+	}
+	var hybridPartitions []*mbr.Partition
+	for _, structureNumber := range structureNumbers {
+		structure := volume.Structure[structureNumber]
+		end := (uint64(getStructureOffset(structure)) + uint64(structure.Size) + sectorSize - 1) /
+			sectorSize
+		if end > math.MaxUint32 {
+			return fmt.Errorf("Error writing hybrid MBR of volume %s: structure #%d (%q) ends "+
+				"beyond the sectors that an MBR can address", volumeName, structureNumber,
+				structure.Name)
+		}
+		mbrType, _ := splitStructureType(structure.Type)
+		hybridPartitions = append(hybridPartitions, newMBRPartition(structure, mbrType, sectorSize))
+	}
+	if len(hybridPartitions) == 0 {
+		if stateMachine.commonFlags.HybridMBR == "auto" {
+			fmt.Printf("WARNING: --hybrid-mbr is ignored for volume %s, which has no structures "+
+				"with hybrid MBR,GPT types\n", volumeName)
+		}
+		return nil
+	}
+
+	protectiveSize := hybridPartitions[0].Start
+	for _, hybridPartition := range hybridPartitions {
+		if hybridPartition.Start < protectiveSize {
+			protectiveSize = hybridPartition.Start
+		}
+	}
+	entries := make([]byte, 16*mbrPrimaryPartitions)
+	writeMBREntry(entries[0:16], false, mbr.Type(0xEE), 1, protectiveSize-1)
+	for ii, hybridPartition := range hybridPartitions {
+		writeMBREntry(entries[16*(ii+1):16*(ii+2)], hybridPartition.Bootable, hybridPartition.Type,
+			hybridPartition.Start, hybridPartition.Size)
+	}
+	if _, err := file.WriteAt(entries, 446); err != nil {
+		return fmt.Errorf("Error writing hybrid MBR: %s", err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,276 @@
+// This file contains unit tests for the MBR partition tables
+package statemachine
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+	diskfs "github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/partition/mbr"
+	"github.com/snapcore/snapd/gadget"
+	"github.com/snapcore/snapd/gadget/quantity"
+)
+
+// TestExtendedPartitions ensures that the partitions of MBR volumes after the third one
+// are logical partitions of an extended partition, with room left for their EBRs
+func TestExtendedPartitions(t *testing.T) {
+	t.Run("test_extended_partitions", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine StateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.YamlFilePath = filepath.Join("testdata", "gadget-logical.yaml")
+		err := stateMachine.makeTemporaryDirectories()
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+		err = stateMachine.loadGadgetYaml()
+		asserter.AssertErrNil(err, true)
+		err = stateMachine.setupOutputDir()
+		asserter.AssertErrNil(err, true)
+
+		// the implicit offsets of the logical partitions leave room for their EBR
+		volume := stateMachine.GadgetInfo.Volumes["pc"]
+		expectedOffsets := []quantity.Offset{0, 1, 5, 9, 14, 20, 25}
+		if len(volume.Structure) != len(expectedOffsets) {
+			t.Fatalf("Expected the rootfs structure to be added, got %d structures",
+				len(volume.Structure))
+		}
+		for ii, expectedOffset := range expectedOffsets {
+			if *volume.Structure[ii].Offset != expectedOffset*quantity.OffsetMiB {
+				t.Errorf("Expected structure #%d at offset %d MiB, got %d", ii, expectedOffset,
+					*volume.Structure[ii].Offset)
+			}
+		}
+		stateMachine.setRootfsSize(4 * quantity.SizeMiB)
+		err = logicalPartitionsError("pc", volume, 512, false)
+		asserter.AssertErrNil(err, true)
+
+		partitionTable := createPartitionTable("pc", volume, 512, nil, false)
+		mbrTable := (*partitionTable).(*mbr.Table)
+		if len(mbrTable.Partitions) != 4 {
+			t.Fatalf("Expected 3 primary partitions and an extended partition, got %d",
+				len(mbrTable.Partitions))
+		}
+		extended := mbrTable.Partitions[3]
+		if extended.Type != mbr.ExtendedLBA || extended.Start != 14*2048-1 ||
+			extended.Size != 29*2048-(14*2048-1) {
+			t.Errorf("Unexpected extended partition %+v", extended)
+		}
+
+		imgPath := filepath.Join(stateMachine.stateMachineFlags.WorkDir, "pc.img")
+		diskImg, err := diskfs.Create(imgPath, 32*1024*1024, diskfs.Raw)
+		asserter.AssertErrNil(err, true)
+		err = writeExtendedBootRecords(diskImg.File, volume, 512, false)
+		asserter.AssertErrNil(err, true)
+		err = diskImg.Partition(*partitionTable)
+		asserter.AssertErrNil(err, true)
+		diskImg.File.Close()
+
+		report, err := InspectImage(imgPath, 0)
+		asserter.AssertErrNil(err, true)
+		expectedNumbers := []int{1, 2, 3, 5, 6, 7}
+		if len(report.Partitions) != len(expectedNumbers) {
+			t.Fatalf("Expected %d partitions, got %+v", len(expectedNumbers), report.Partitions)
+		}
+		for ii, partition := range report.Partitions {
+			if partition.Number != expectedNumbers[ii] {
+				t.Errorf("Expected partition number %d, got %d", expectedNumbers[ii], partition.Number)
+			}
+		}
+		report.compareWithVolume(volume, defaultSectorSize, nil, false)
+		for _, mismatch := range report.Mismatches {
+			// the partitions are empty
+			if !strings.Contains(mismatch, "filesystem") {
+				t.Errorf("Unexpected mismatch: %s", mismatch)
+			}
+		}
+
+		// the logical partitions are numbered from 5 in their PARTUUIDs
+		err = stateMachine.writePartitionIDs("pc", volume, *partitionTable, []byte{1, 2, 3, 4})
+		asserter.AssertErrNil(err, true)
+		idsBytes, err := ioutil.ReadFile(filepath.Join(stateMachine.tempDirs.staging,
+			"pc.partition-ids.json"))
+		asserter.AssertErrNil(err, true)
+		var ids volumeIDs
+		err = json.Unmarshal(idsBytes, &ids)
+		asserter.AssertErrNil(err, true)
+		if len(ids.Partitions) != 6 || ids.Partitions[3].Number != 5 ||
+			ids.Partitions[5].PartUUID != "04030201-07" {
+			t.Errorf("Unexpected partition identifiers %+v", ids)
+		}
+	})
+}
+
+// TestFailedExtendedPartitions tests the logical partitions that leave no room for
+// their EBR or that are not laid out in order
+func TestFailedExtendedPartitions(t *testing.T) {
+	testCases := []struct {
+		name          string
+		offsets       map[int]quantity.Offset
+		expectedError string
+	}{
+		{"no_room_for_ebr", map[int]quantity.Offset{5: 18 * quantity.OffsetMiB},
+			`structure #5 ("data"): the EBR of logical partition 6 at offset 18873856 overlaps with structure #4 ("recovery")`},
+		{"out_of_order", map[int]quantity.Offset{4: 30 * quantity.OffsetMiB},
+			`structure #5 ("data"): logical partition 6 at offset 20971520 must come after logical partition 5`},
+		{"primary_in_extended", map[int]quantity.Offset{3: 30 * quantity.OffsetMiB, 6: 36 * quantity.OffsetMiB},
+			`structure #3 ("config"): partition 3 is within the extended partition`},
+	}
+	for _, tc := range testCases {
+		t.Run("test_failed_extended_partitions_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			var stateMachine StateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.YamlFilePath = filepath.Join("testdata", "gadget-logical.yaml")
+			err := stateMachine.makeTemporaryDirectories()
+			asserter.AssertErrNil(err, true)
+			defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+			err = stateMachine.loadGadgetYaml()
+			asserter.AssertErrNil(err, true)
+			stateMachine.setRootfsSize(4 * quantity.SizeMiB)
+
+			volume := stateMachine.GadgetInfo.Volumes["pc"]
+			for structureNumber, offset := range tc.offsets {
+				offset := offset
+				volume.Structure[structureNumber].Offset = &offset
+			}
+			err = logicalPartitionsError("pc", volume, 512, false)
+			asserter.AssertErrContains(err, tc.expectedError)
+		})
+	}
+}
+
+// TestWriteHybridMBR ensures that the structures with hybrid types of GPT volumes get
+// an entry in the MBR with --hybrid-mbr
+func TestWriteHybridMBR(t *testing.T) {
+	t.Run("test_write_hybrid_mbr", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine StateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.commonFlags.HybridMBR = "auto"
+		stateMachine.YamlFilePath = filepath.Join("testdata", "gadget-hybrid.yaml")
+		err := stateMachine.makeTemporaryDirectories()
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+		err = stateMachine.loadGadgetYaml()
+		asserter.AssertErrNil(err, true)
+		stateMachine.setRootfsSize(4 * quantity.SizeMiB)
+
+		volume := stateMachine.GadgetInfo.Volumes["pc"]
+		imgPath := filepath.Join(stateMachine.stateMachineFlags.WorkDir, "pc.img")
+		diskImg, err := diskfs.Create(imgPath, 64*1024*1024, diskfs.Raw)
+		asserter.AssertErrNil(err, true)
+		partitionTable := createPartitionTable("pc", volume, 512, nil, false)
+		err = diskImg.Partition(*partitionTable)
+		asserter.AssertErrNil(err, true)
+		err = stateMachine.writeHybridMBR(diskImg.File, "pc", volume, 512)
+		asserter.AssertErrNil(err, true)
+		diskImg.File.Close()
+
+		// the GPT is still read, and the MBR has the hybrid partitions after the
+		// protective partition
+		report, err := InspectImage(imgPath, 0)
+		asserter.AssertErrNil(err, true)
+		if report.Schema != "gpt" || len(report.Partitions) != 3 {
+			t.Fatalf("Expected a GPT with 3 partitions, got %+v", report)
+		}
+		expected := []PartitionReport{
+			{Number: 2, Start: 1048576, Size: 1048576, Type: "DA"},
+			{Number: 3, Start: 2097152, Size: 52428800, Type: "EF", Bootable: true},
+			{Number: 4, Start: 54525952, Size: 4194304, Type: "83"},
+		}
+		if !reflect.DeepEqual(report.HybridMBR, expected) {
+			t.Errorf("Expected the hybrid MBR partitions %+v, got %+v", expected, report.HybridMBR)
+		}
+		imgBytes, err := ioutil.ReadFile(imgPath)
+		asserter.AssertErrNil(err, true)
+		if imgBytes[446+4] != 0xEE || binary.LittleEndian.Uint32(imgBytes[446+12:]) != 2047 {
+			t.Errorf("Expected a protective partition up to the first hybrid partition, got %x",
+				imgBytes[446:462])
+		}
+
+		// only the selected structures get an entry
+		stateMachine.commonFlags.HybridMBR = "EFI System"
+		diskImg, err = diskfs.Open(imgPath)
+		asserter.AssertErrNil(err, true)
+		err = stateMachine.writeHybridMBR(diskImg.File, "pc", volume, 512)
+		asserter.AssertErrNil(err, true)
+		diskImg.File.Close()
+		report, err = InspectImage(imgPath, 0)
+		asserter.AssertErrNil(err, true)
+		expected = []PartitionReport{{Number: 2, Start: 2097152, Size: 52428800, Type: "EF", Bootable: true}}
+		if !reflect.DeepEqual(report.HybridMBR, expected) {
+			t.Errorf("Expected the hybrid MBR partitions %+v, got %+v", expected, report.HybridMBR)
+		}
+
+		// the MBR of MBR volumes is left alone
+		volume.Schema = "mbr"
+		err = stateMachine.writeHybridMBR(nil, "pc", volume, 512)
+		asserter.AssertErrNil(err, true)
+	})
+}
+
+// TestFailedWriteHybridMBR tests failures when writing a hybrid MBR
+func TestFailedWriteHybridMBR(t *testing.T) {
+	t.Run("test_failed_write_hybrid_mbr", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine StateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.commonFlags.HybridMBR = "auto"
+		stateMachine.YamlFilePath = filepath.Join("testdata", "gadget-hybrid.yaml")
+		err := stateMachine.makeTemporaryDirectories()
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+		err = stateMachine.loadGadgetYaml()
+		asserter.AssertErrNil(err, true)
+		stateMachine.setRootfsSize(4 * quantity.SizeMiB)
+		volume := stateMachine.GadgetInfo.Volumes["pc"]
+
+		// the image can't be written
+		imgFile, err := os.Open(filepath.Join("testdata", "gadget-hybrid.yaml"))
+		asserter.AssertErrNil(err, true)
+		defer imgFile.Close()
+		err = stateMachine.writeHybridMBR(imgFile, "pc", volume, 512)
+		asserter.AssertErrContains(err, "Error writing hybrid MBR")
+
+		// a structure beyond the sectors of the MBR
+		rootfsOffset := volume.Structure[3].Offset
+		offset := quantity.Offset(3 << 40)
+		volume.Structure[3].Offset = &offset
+		err = stateMachine.writeHybridMBR(imgFile, "pc", volume, 512)
+		asserter.AssertErrContains(err, `structure #3 ("") ends beyond the sectors that an MBR can address`)
+		volume.Structure[3].Offset = rootfsOffset
+
+		// too many hybrid structures
+		offset = 80 * quantity.OffsetMiB
+		volume.Structure = append(volume.Structure, gadget.VolumeStructure{
+			Name:   "data",
+			Offset: &offset,
+			Size:   quantity.SizeMiB,
+			Type:   "83,0FC63DAF-8483-4772-8E79-3D69D8477DE4",
+		})
+		err = stateMachine.writeHybridMBR(imgFile, "pc", volume, 512)
+		asserter.AssertErrContains(err, "4 structures have hybrid MBR,GPT types, but the hybrid MBR can hold at most 3")
+
+		// invalid selections of structures
+		testCases := []struct {
+			hybridMBR string
+			errMsg    string
+		}{
+			{"1,2,3,data", "4 structures are selected with --hybrid-mbr, but the hybrid MBR can hold at most 3"},
+			{"missing", "Structure missing does not exist in volume pc"},
+			{"mbr", `structure #0 ("mbr") selected with --hybrid-mbr does not have a hybrid MBR,GPT type`},
+		}
+		for _, tc := range testCases {
+			stateMachine.commonFlags.HybridMBR = tc.hybridMBR
+			err = stateMachine.writeHybridMBR(imgFile, "pc", volume, 512)
+			asserter.AssertErrContains(err, tc.errMsg)
+		}
+	})
+}
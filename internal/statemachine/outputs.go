@@ -0,0 +1,114 @@
+package statemachine
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/snapcore/snapd/osutil"
+)
+
+// setupOutputDir makes sure the output directory is set and that the staging directory in
+// which the artifacts are created exists. If --output-dir was not used, images are published
+// to the working directory, or to the current directory if the working directory is a
+// temporary one
+func (stateMachine *StateMachine) setupOutputDir() error {
+	if stateMachine.commonFlags.OutputDir == "" {
+		if stateMachine.cleanWorkDir { // no workdir specified, so create the image in the pwd
+			stateMachine.commonFlags.OutputDir, _ = os.Getwd()
+		} else {
+			stateMachine.commonFlags.OutputDir = stateMachine.stateMachineFlags.WorkDir
+		}
+	}
+	stateMachine.tempDirs.staging = filepath.Join(stateMachine.stateMachineFlags.WorkDir, "staging")
+	err := osMkdirAll(stateMachine.tempDirs.staging, 0755)
+	if err != nil && !os.IsExist(err) {
+		return fmt.Errorf("Error creating staging directory: %s", err.Error())
+	}
+	return nil
+}
+
+// publishOutputs moves the files from the staging directory to the output directory.
+// Every file is renamed into place, so the output directory never contains partial
+// files. Files that already exist in the output directory are handled according to
+// --overwrite-policy, and are all checked before anything is moved
+func (stateMachine *StateMachine) publishOutputs() error {
+	if stateMachine.tempDirs.staging == "" {
+		return nil
+	}
+	if err := stateMachine.setupOutputDir(); err != nil {
+		return err
+	}
+	stagedFiles, err := ioutilReadDir(stateMachine.tempDirs.staging)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("Error reading staging directory: %s", err.Error())
+	}
+	err = osMkdirAll(stateMachine.commonFlags.OutputDir, 0755)
+	if err != nil && !os.IsExist(err) {
+		return fmt.Errorf("Error creating OutputDir: %s", err.Error())
+	}
+
+	if stateMachine.commonFlags.OverwritePolicy == "error" {
+		for _, stagedFile := range stagedFiles {
+			outputPath := filepath.Join(stateMachine.commonFlags.OutputDir, stagedFile.Name())
+			if _, err := os.Lstat(outputPath); err == nil {
+				return fmt.Errorf("Error publishing %s: the file already exists in the output "+
+					"directory. Use --overwrite-policy to replace it", stagedFile.Name())
+			}
+		}
+	}
+
+	for _, stagedFile := range stagedFiles {
+		stagedPath := filepath.Join(stateMachine.tempDirs.staging, stagedFile.Name())
+		outputPath := filepath.Join(stateMachine.commonFlags.OutputDir, stagedFile.Name())
+		if stateMachine.commonFlags.OverwritePolicy == "backup" {
+			if _, err := os.Lstat(outputPath); err == nil {
+				if err := osRename(outputPath, outputPath+".bak"); err != nil {
+					return fmt.Errorf("Error backing up %s: %s", outputPath, err.Error())
+				}
+			}
+		}
+		if err := moveFile(stagedPath, outputPath); err != nil {
+			return fmt.Errorf("Error publishing %s: %s", stagedFile.Name(), err.Error())
+		}
+	}
+	return nil
+}
+
+// moveFile atomically moves src to dst. When they are on different filesystems, src is
+// first copied next to dst and then renamed into place
+func moveFile(src, dst string) error {
+	err := osRename(src, dst)
+	if err == nil || !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	partialDst := filepath.Join(filepath.Dir(dst), "."+filepath.Base(dst)+".partial")
+	if err := osutilCopyFile(src, partialDst, osutil.CopyFlagOverwrite); err != nil {
+		os.Remove(partialDst)
+		return err
+	}
+	if err := osRename(partialDst, dst); err != nil {
+		os.Remove(partialDst)
+		return err
+	}
+	return osRemoveAll(src)
+}
+
+// recordArtifact keeps track of a file created in the output directory
+func (stateMachine *StateMachine) recordArtifact(name, volumeName, artifactType string) {
+	for _, artifact := range stateMachine.Artifacts {
+		if artifact.Name == name {
+			return
+		}
+	}
+	stateMachine.Artifacts = append(stateMachine.Artifacts, outputArtifact{
+		Name:   name,
+		Volume: volumeName,
+		Type:   artifactType,
+	})
+}
@@ -0,0 +1,198 @@
+// This file contains unit tests for the staging and publishing of the output files
+package statemachine
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+)
+
+// TestPublishOutputs ensures that the staged files are moved to the output directory
+// according to the --overwrite-policy
+func TestPublishOutputs(t *testing.T) {
+	testCases := []struct {
+		name           string
+		policy         string
+		expectedImg    string
+		expectedBackup string
+		errMsg         string
+	}{
+		{"no_existing_file", "", "new", "", ""},
+		{"policy_default", "", "new", "", ""},
+		{"policy_error", "error", "old", "", "the file already exists in the output directory"},
+		{"policy_replace", "replace", "new", "", ""},
+		{"policy_backup", "backup", "new", "old", ""},
+	}
+	for _, tc := range testCases {
+		t.Run("test_publish_outputs_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			var stateMachine StateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.commonFlags.OverwritePolicy = tc.policy
+
+			err := stateMachine.makeTemporaryDirectories()
+			asserter.AssertErrNil(err, true)
+			defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+
+			outDir, err := ioutil.TempDir("/tmp", "ubuntu-image-")
+			asserter.AssertErrNil(err, true)
+			defer os.RemoveAll(outDir)
+			stateMachine.commonFlags.OutputDir = outDir
+
+			err = stateMachine.setupOutputDir()
+			asserter.AssertErrNil(err, true)
+			err = ioutil.WriteFile(filepath.Join(stateMachine.tempDirs.staging, "pc.img"),
+				[]byte("new"), 0644)
+			asserter.AssertErrNil(err, true)
+			err = ioutil.WriteFile(filepath.Join(stateMachine.tempDirs.staging, "pc.manifest"),
+				[]byte("manifest"), 0644)
+			asserter.AssertErrNil(err, true)
+			if tc.name != "no_existing_file" {
+				err = ioutil.WriteFile(filepath.Join(outDir, "pc.img"), []byte("old"), 0644)
+				asserter.AssertErrNil(err, true)
+			}
+
+			err = stateMachine.publishOutputs()
+			if tc.errMsg != "" {
+				asserter.AssertErrContains(err, tc.errMsg)
+				// nothing should have been published
+				if _, err := os.Stat(filepath.Join(outDir, "pc.manifest")); err == nil {
+					t.Errorf("pc.manifest should not have been published")
+				}
+			} else {
+				asserter.AssertErrNil(err, true)
+				if _, err := os.Stat(filepath.Join(stateMachine.tempDirs.staging, "pc.img")); err == nil {
+					t.Errorf("pc.img should have been moved out of the staging directory")
+				}
+			}
+
+			imgBytes, err := ioutil.ReadFile(filepath.Join(outDir, "pc.img"))
+			asserter.AssertErrNil(err, true)
+			if string(imgBytes) != tc.expectedImg {
+				t.Errorf("Expected pc.img to contain \"%s\", got \"%s\"", tc.expectedImg, string(imgBytes))
+			}
+			if tc.expectedBackup != "" {
+				backupBytes, err := ioutil.ReadFile(filepath.Join(outDir, "pc.img.bak"))
+				asserter.AssertErrNil(err, true)
+				if string(backupBytes) != tc.expectedBackup {
+					t.Errorf("Expected pc.img.bak to contain \"%s\", got \"%s\"",
+						tc.expectedBackup, string(backupBytes))
+				}
+			}
+		})
+	}
+}
+
+// TestPublishOutputsCrossDevice ensures that files are copied and then renamed into
+// place when the staging and output directories are on different filesystems
+func TestPublishOutputsCrossDevice(t *testing.T) {
+	t.Run("test_publish_outputs_cross_device", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine StateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+
+		err := stateMachine.makeTemporaryDirectories()
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+
+		outDir, err := ioutil.TempDir("/tmp", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(outDir)
+		stateMachine.commonFlags.OutputDir = outDir
+
+		err = stateMachine.setupOutputDir()
+		asserter.AssertErrNil(err, true)
+		stagedImg := filepath.Join(stateMachine.tempDirs.staging, "pc.img")
+		err = ioutil.WriteFile(stagedImg, []byte("image"), 0644)
+		asserter.AssertErrNil(err, true)
+
+		// only allow renames within the output directory
+		osRename = func(oldpath, newpath string) error {
+			if filepath.Dir(oldpath) != outDir {
+				return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EXDEV}
+			}
+			return os.Rename(oldpath, newpath)
+		}
+		defer func() {
+			osRename = os.Rename
+		}()
+		err = stateMachine.publishOutputs()
+		asserter.AssertErrNil(err, true)
+
+		imgBytes, err := ioutil.ReadFile(filepath.Join(outDir, "pc.img"))
+		asserter.AssertErrNil(err, true)
+		if string(imgBytes) != "image" {
+			t.Errorf("Expected pc.img to contain \"image\", got \"%s\"", string(imgBytes))
+		}
+		if _, err := os.Stat(stagedImg); err == nil {
+			t.Errorf("File %s should have been removed, but was not", stagedImg)
+		}
+		outFiles, err := ioutil.ReadDir(outDir)
+		asserter.AssertErrNil(err, true)
+		if len(outFiles) != 1 {
+			t.Errorf("Expected only pc.img in the output directory, got %d files", len(outFiles))
+		}
+	})
+}
+
+// TestFailedPublishOutputs tests failures when moving the staged files to the output directory
+func TestFailedPublishOutputs(t *testing.T) {
+	t.Run("test_failed_publish_outputs", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine StateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.commonFlags.OverwritePolicy = "backup"
+
+		err := stateMachine.makeTemporaryDirectories()
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+
+		outDir, err := ioutil.TempDir("/tmp", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(outDir)
+		stateMachine.commonFlags.OutputDir = outDir
+
+		err = stateMachine.setupOutputDir()
+		asserter.AssertErrNil(err, true)
+		err = ioutil.WriteFile(filepath.Join(stateMachine.tempDirs.staging, "pc.img"),
+			[]byte("new"), 0644)
+		asserter.AssertErrNil(err, true)
+		err = ioutil.WriteFile(filepath.Join(outDir, "pc.img"), []byte("old"), 0644)
+		asserter.AssertErrNil(err, true)
+
+		// mock ioutil.ReadDir
+		ioutilReadDir = mockReadDir
+		defer func() {
+			ioutilReadDir = ioutil.ReadDir
+		}()
+		err = stateMachine.publishOutputs()
+		asserter.AssertErrContains(err, "Error reading staging directory")
+		ioutilReadDir = ioutil.ReadDir
+
+		// mock os.Rename
+		osRename = mockRename
+		defer func() {
+			osRename = os.Rename
+		}()
+		err = stateMachine.publishOutputs()
+		asserter.AssertErrContains(err, "Error backing up")
+
+		stateMachine.commonFlags.OverwritePolicy = "replace"
+		err = stateMachine.publishOutputs()
+		asserter.AssertErrContains(err, "Error publishing pc.img")
+		osRename = os.Rename
+
+		// mock os.MkdirAll
+		osMkdirAll = mockMkdirAll
+		defer func() {
+			osMkdirAll = os.MkdirAll
+		}()
+		err = stateMachine.publishOutputs()
+		asserter.AssertErrContains(err, "Error creating staging directory")
+		osMkdirAll = os.MkdirAll
+	})
+}
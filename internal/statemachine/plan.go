@@ -0,0 +1,187 @@
+package statemachine
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/canonical/ubuntu-image/internal/commands"
+	"github.com/snapcore/snapd/gadget"
+	"github.com/snapcore/snapd/gadget/quantity"
+)
+
+// volumePlan holds the sizes that a build would calculate for a volume
+type volumePlan struct {
+	name   string
+	volume *gadget.Volume
+	// minimumSize is the size calculated by handleContentSizes
+	minimumSize quantity.Size
+	// requestedSize is the size given with --image-size, or 0
+	requestedSize quantity.Size
+	imageSize     quantity.Size
+	diskImageSize int64
+	// cloudProfile is set when the disk image is sized from the volume size by --cloud-profile
+	cloudProfile bool
+}
+
+// WriteImagePlan runs the sizing logic of a build of the gadget tree without building
+// the image, and prints the minimum size of each volume, the final offset and size of
+// each structure, and whether --image-size would be honored. The size of the rootfs is
+// estimated from the tree given with --filesystem, or taken from the partition manifest
+// of a previous build
+func WriteImagePlan(writer io.Writer, gadgetTree string, commonOpts *commands.CommonOpts,
+	planOpts commands.PlanOpts) error {
+	var stateMachine StateMachine
+	stateMachine.commonFlags = commonOpts
+	stateMachine.stateMachineFlags = new(commands.StateMachineOpts)
+	workDir, err := ioutil.TempDir("", "ubuntu-image-plan-")
+	if err != nil {
+		return fmt.Errorf("Error creating temporary directory: %s", err.Error())
+	}
+	defer os.RemoveAll(workDir)
+	stateMachine.stateMachineFlags.WorkDir = workDir
+	stateMachine.tempDirs.volumes = filepath.Join(workDir, "volumes")
+	stateMachine.YamlFilePath = filepath.Join(gadgetTree, "meta", "gadget.yaml")
+	if err := stateMachine.loadGadgetYaml(); err != nil {
+		return err
+	}
+
+	rootfsSource := ""
+	if planOpts.Filesystem != "" {
+		stateMachine.tempDirs.rootfs = planOpts.Filesystem
+		if err := stateMachine.calculateRootfsSize(); err != nil {
+			return err
+		}
+		rootfsSource = "estimated from the files in " + planOpts.Filesystem
+	} else if planOpts.PartitionManifest != "" {
+		rootfsSize, err := readManifestRootfsSize(planOpts.PartitionManifest)
+		if err != nil {
+			return err
+		}
+		stateMachine.setRootfsSize(rootfsSize)
+		rootfsSource = "taken from the system-data partition in " + planOpts.PartitionManifest
+	}
+	for volumeName, volume := range stateMachine.GadgetInfo.Volumes {
+		for structureNumber, structure := range volume.Structure {
+			if structure.Size == 0 {
+				return fmt.Errorf("the size of structure #%d of volume %s depends on the rootfs: "+
+					"use --filesystem or --partition-manifest to estimate it",
+					structureNumber, volumeName)
+			}
+		}
+	}
+
+	gadgetYamlBytes, err := ioutilReadFile(stateMachine.YamlFilePath)
+	if err != nil {
+		return fmt.Errorf("Error reading gadget.yaml bytes: %s", err.Error())
+	}
+	var plans []volumePlan
+	lines := findGadgetYamlLines(string(gadgetYamlBytes))
+	for _, volumeName := range lines.volumeOrder(stateMachine.GadgetInfo) {
+		volume := stateMachine.GadgetInfo.Volumes[volumeName]
+		plan := volumePlan{name: volumeName, volume: volume,
+			requestedSize: stateMachine.ImageSizes[volumeName]}
+		stateMachine.handleContentSizes(volumeFarthestOffset(volume), volumeName)
+		plan.imageSize = stateMachine.ImageSizes[volumeName]
+		plan.minimumSize = minimumVolumeSize(volumeFarthestOffset(volume))
+		plans = append(plans, plan)
+	}
+
+	// as in copyStructureContent, the rootfs structures grow to fit the rootfs
+	for _, plan := range plans {
+		for structureNumber, structure := range plan.volume.Structure {
+			if (structure.Role == gadget.SystemData || structure.Role == gadget.SystemSeed) &&
+				structure.Size < stateMachine.RootfsSize {
+				structure.Size = stateMachine.RootfsSize
+				plan.volume.Structure[structureNumber] = structure
+			}
+		}
+	}
+	// as in makeDisk, the disk image is rounded up to a whole sector
+	for ii := range plans {
+		plans[ii].diskImageSize = int64(roundUpSize(quantity.Size(stateMachine.diskImageSize(plans[ii].name)),
+			stateMachine.sectorSize(plans[ii].name)))
+		plans[ii].cloudProfile = stateMachine.cloudProfileAlignment() != 0
+	}
+
+	if err := writeImagePlan(writer, plans, stateMachine.RootfsSize, rootfsSource); err != nil {
+		return fmt.Errorf("Error writing image plan: %s", err.Error())
+	}
+	return nil
+}
+
+// readManifestRootfsSize returns the size of the system-data partition in a
+// <volume>.partitions.json manifest written by --export-partitions
+func readManifestRootfsSize(manifestPath string) (quantity.Size, error) {
+	manifestBytes, err := ioutilReadFile(manifestPath)
+	if err != nil {
+		return 0, fmt.Errorf("Error reading partition manifest: %s", err.Error())
+	}
+	var manifest exportedVolume
+	if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
+		return 0, fmt.Errorf("Error parsing partition manifest: %s", err.Error())
+	}
+	for _, partition := range manifest.Partitions {
+		if partition.Role == gadget.SystemData {
+			return quantity.Size(partition.Size), nil
+		}
+	}
+	return 0, fmt.Errorf("the partition manifest %s has no system-data partition", manifestPath)
+}
+
+// writeImagePlan prints the plans of the volumes
+func writeImagePlan(writer io.Writer, plans []volumePlan, rootfsSize quantity.Size,
+	rootfsSource string) error {
+	if rootfsSource != "" {
+		if _, err := fmt.Fprintf(writer, "Rootfs: %s, %s\n\n", rootfsSize.IECString(),
+			rootfsSource); err != nil {
+			return err
+		}
+	}
+	for ii, plan := range plans {
+		if ii > 0 {
+			fmt.Fprintln(writer)
+		}
+		fmt.Fprintf(writer, "Volume %s: minimum size %s (%d bytes)\n", plan.name,
+			plan.minimumSize.IECString(), plan.minimumSize)
+		switch {
+		case plan.requestedSize == 0:
+			fmt.Fprintf(writer, "  no --image-size given, the volume size is %s\n",
+				plan.imageSize.IECString())
+		case plan.requestedSize < plan.minimumSize:
+			fmt.Fprintf(writer, "  --image-size %s would be ignored, as it is smaller than "+
+				"the minimum size\n", plan.requestedSize.IECString())
+		default:
+			fmt.Fprintf(writer, "  --image-size %s would be honored, the volume size is %s\n",
+				plan.requestedSize.IECString(), plan.imageSize.IECString())
+		}
+		if plan.cloudProfile {
+			fmt.Fprintf(writer, "  make_disk creates a disk image of %d bytes, the larger of the "+
+				"volume size and the structure sizes, aligned for --cloud-profile\n", plan.diskImageSize)
+		} else {
+			fmt.Fprintf(writer, "  make_disk creates a disk image of %d bytes from the structure "+
+				"sizes, rounded up to a whole sector, and ignores the volume size\n", plan.diskImageSize)
+		}
+
+		table := tabwriter.NewWriter(writer, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(table, "  #\tNAME\tROLE\tOFFSET\tSIZE\tBYTES")
+		for structureNumber, structure := range plan.volume.Structure {
+			name := structure.Name
+			if name == "" {
+				name = structure.Label
+			}
+			fmt.Fprintf(table, "  %s\t%s\t%s\t%d\t%s\t%d\n", strconv.Itoa(structureNumber),
+				orDash(name), orDash(structure.Role), getStructureOffset(structure),
+				structure.Size.IECString(), structure.Size)
+		}
+		if err := table.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+// This file contains unit tests for the planning of image sizes
+package statemachine
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"testing"
+
+	"github.com/canonical/ubuntu-image/internal/commands"
+	"github.com/canonical/ubuntu-image/internal/helper"
+)
+
+// TestWriteImagePlan tests that the sizes calculated by a build are printed
+func TestWriteImagePlan(t *testing.T) {
+	testCases := []struct {
+		name      string
+		imageSize string
+		manifest  bool
+		expected  []string
+	}{
+		{"filesystem", "", false, []string{
+			`Rootfs: 8.06 MiB, estimated from the files in testdata/gadget_tree\n`,
+			`Volume pc: minimum size 77 MiB \(80740352 bytes\)\n`,
+			`  no --image-size given, the volume size is 77 MiB\n`,
+			`  make_disk creates a disk image of [0-9]+ bytes from the structure sizes, ` +
+				`rounded up to a whole sector, and ignores the volume size\n`,
+			`\n  3 +writable +system-data +54525952 +8.06 MiB +8450048\n`,
+		}},
+		{"honored", "100M", false, []string{
+			`  --image-size 100 MiB would be honored, the volume size is 100 MiB\n`,
+		}},
+		{"cloud_profile", "100M", false, []string{
+			`  make_disk creates a disk image of 1073741824 bytes, the larger of the volume ` +
+				`size and the structure sizes, aligned for --cloud-profile\n`,
+		}},
+		{"ignored", "10M", false, []string{
+			`  --image-size 10 MiB would be ignored, as it is smaller than the minimum size\n`,
+		}},
+		{"manifest", "pc:1G", true, []string{
+			`Rootfs: 500 MiB, taken from the system-data partition in .*pc.partitions.json\n`,
+			`Volume pc: minimum size 569 MiB \(596639744 bytes\)\n`,
+			`  --image-size 1 GiB would be honored, the volume size is 1 GiB\n`,
+			`\n  3 +writable +system-data +54525952 +500 MiB +524288000\n`,
+		}},
+	}
+	for _, tc := range testCases {
+		t.Run("test_write_image_plan_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			commonOpts := &commands.CommonOpts{Size: tc.imageSize}
+			if tc.name == "cloud_profile" {
+				commonOpts.CloudProfile = "aws"
+			}
+			planOpts := commands.PlanOpts{Filesystem: filepath.Join("testdata", "gadget_tree")}
+			if tc.manifest {
+				manifestDir, err := ioutil.TempDir("/tmp", "ubuntu-image-")
+				asserter.AssertErrNil(err, true)
+				defer os.RemoveAll(manifestDir)
+				planOpts.Filesystem = ""
+				planOpts.PartitionManifest = filepath.Join(manifestDir, "pc.partitions.json")
+				err = ioutil.WriteFile(planOpts.PartitionManifest, []byte(`{"volume": "pc",
+"partitions": [{"image": "pc-writable.img", "role": "system-data", "offset": 54525952,
+"size": 524288000, "sha256": ""}]}`), 0644)
+				asserter.AssertErrNil(err, true)
+			}
+
+			var output bytes.Buffer
+			err := WriteImagePlan(&output, filepath.Join("testdata", "gadget_tree"), commonOpts, planOpts)
+			asserter.AssertErrNil(err, true)
+			for _, expected := range tc.expected {
+				if !regexp.MustCompile(expected).MatchString(output.String()) {
+					t.Errorf("Expected the plan to match %q, got:\n%s", expected, output.String())
+				}
+			}
+			// the disk image is a whole number of sectors, as make_disk creates it
+			diskImageSize := regexp.MustCompile(`disk image of ([0-9]+) bytes`).FindStringSubmatch(output.String())
+			if len(diskImageSize) != 2 {
+				t.Fatalf("Expected the plan to give the disk image size, got:\n%s", output.String())
+			}
+			if size, _ := strconv.Atoi(diskImageSize[1]); size%512 != 0 {
+				t.Errorf("Expected the disk image size to be a multiple of 512, got %d", size)
+			}
+		})
+	}
+}
+
+// TestFailedWriteImagePlan tests failures when planning image sizes
+func TestFailedWriteImagePlan(t *testing.T) {
+	t.Run("test_failed_write_image_plan", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		gadgetTree := filepath.Join("testdata", "gadget_tree")
+		var output bytes.Buffer
+
+		err := WriteImagePlan(&output, filepath.Join("testdata", "missing"),
+			&commands.CommonOpts{}, commands.PlanOpts{})
+		asserter.AssertErrContains(err, "Error copying gadget.yaml")
+
+		err = WriteImagePlan(&output, gadgetTree, &commands.CommonOpts{}, commands.PlanOpts{})
+		asserter.AssertErrContains(err, "use --filesystem or --partition-manifest to estimate it")
+
+		err = WriteImagePlan(&output, gadgetTree, &commands.CommonOpts{Size: "pc:1Q"},
+			commands.PlanOpts{})
+		asserter.AssertErrContains(err, "Failed to parse argument to --image-size")
+
+		err = WriteImagePlan(&output, gadgetTree, &commands.CommonOpts{},
+			commands.PlanOpts{Filesystem: filepath.Join("testdata", "missing")})
+		asserter.AssertErrContains(err, "Error getting rootfs size")
+
+		manifestDir, err := ioutil.TempDir("/tmp", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(manifestDir)
+		manifestPath := filepath.Join(manifestDir, "pc.partitions.json")
+		err = WriteImagePlan(&output, gadgetTree, &commands.CommonOpts{},
+			commands.PlanOpts{PartitionManifest: manifestPath})
+		asserter.AssertErrContains(err, "Error reading partition manifest")
+		err = ioutil.WriteFile(manifestPath, []byte("{"), 0644)
+		asserter.AssertErrNil(err, true)
+		err = WriteImagePlan(&output, gadgetTree, &commands.CommonOpts{},
+			commands.PlanOpts{PartitionManifest: manifestPath})
+		asserter.AssertErrContains(err, "Error parsing partition manifest")
+		err = ioutil.WriteFile(manifestPath, []byte(`{"volume": "pc", "partitions": []}`), 0644)
+		asserter.AssertErrNil(err, true)
+		err = WriteImagePlan(&output, gadgetTree, &commands.CommonOpts{},
+			commands.PlanOpts{PartitionManifest: manifestPath})
+		asserter.AssertErrContains(err, "has no system-data partition")
+
+		err = WriteImagePlan(failingWriter{}, gadgetTree, &commands.CommonOpts{},
+			commands.PlanOpts{Filesystem: gadgetTree})
+		asserter.AssertErrContains(err, "Error writing image plan")
+	})
+}
@@ -0,0 +1,258 @@
+package statemachine
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Version is the version of ubuntu-image recorded in the build provenance. It is set at
+// build time with -ldflags "-X github.com/canonical/ubuntu-image/internal/statemachine.Version=..."
+var Version = "dev"
+
+const (
+	inTotoStatementType     = "https://in-toto.io/Statement/v0.1"
+	slsaProvenancePredicate = "https://slsa.dev/provenance/v0.2"
+	provenanceBuilderID     = "https://github.com/canonical/ubuntu-image"
+)
+
+// provenanceHostTools are the host tools whose version is recorded in the provenance,
+// along with the arguments that make them print it
+var provenanceHostTools = map[string][]string{
+	"lb":        {"--version"},
+	"mkfs.ext4": {"-V"},
+	"dd":        {"--version"},
+}
+
+// inTotoStatement is an in-toto attestation about the published images
+type inTotoStatement struct {
+	Type          string          `json:"_type"`
+	Subject       []inTotoSubject `json:"subject"`
+	PredicateType string          `json:"predicateType"`
+	Predicate     slsaProvenance  `json:"predicate"`
+}
+
+// inTotoSubject identifies an artifact by its name and digest
+type inTotoSubject struct {
+	Name   string            `json:"name"`
+	Digest map[string]string `json:"digest"`
+}
+
+// slsaProvenance is a SLSA v0.2 provenance predicate
+type slsaProvenance struct {
+	Builder struct {
+		ID string `json:"id"`
+	} `json:"builder"`
+	BuildType  string `json:"buildType"`
+	Invocation struct {
+		Parameters  map[string]interface{} `json:"parameters"`
+		Environment map[string]interface{} `json:"environment"`
+	} `json:"invocation"`
+	Metadata struct {
+		BuildInvocationID string `json:"buildInvocationId"`
+		BuildFinishedOn   string `json:"buildFinishedOn"`
+	} `json:"metadata"`
+	Materials []slsaMaterial `json:"materials"`
+}
+
+// slsaMaterial is an input of the build. Snaps and packages are identified by a
+// package URL and have no digest
+type slsaMaterial struct {
+	URI    string            `json:"uri"`
+	Digest map[string]string `json:"digest,omitempty"`
+}
+
+// writeProvenance writes an in-toto statement with a SLSA provenance predicate to the
+// staging directory. The images are the subjects, and the model assertion or gadget
+// tree, the gadget.yaml and the packages of the rootfs or the snaps of the seed are the
+// materials
+func (stateMachine *StateMachine) writeProvenance() error {
+	if !stateMachine.commonFlags.Provenance {
+		return nil
+	}
+	if err := stateMachine.setupOutputDir(); err != nil {
+		return err
+	}
+
+	var statement inTotoStatement
+	statement.Type = inTotoStatementType
+	statement.PredicateType = slsaProvenancePredicate
+	statement.Subject = []inTotoSubject{}
+	for _, artifact := range stateMachine.Artifacts {
+		if !isImageArtifact(artifact) {
+			continue
+		}
+		checksum, err := calculateSHA256(filepath.Join(stateMachine.tempDirs.staging, artifact.Name))
+		if err != nil {
+			return fmt.Errorf("Error calculating checksum of %s: %s", artifact.Name, err.Error())
+		}
+		statement.Subject = append(statement.Subject, inTotoSubject{
+			Name:   artifact.Name,
+			Digest: map[string]string{"sha256": checksum},
+		})
+	}
+
+	predicate := &statement.Predicate
+	predicate.Builder.ID = provenanceBuilderID + "@" + Version
+	predicate.Metadata.BuildInvocationID = stateMachine.BuildID
+	predicate.Metadata.BuildFinishedOn = stateMachine.buildTime().UTC().Format(time.RFC3339)
+	predicate.Invocation.Environment = map[string]interface{}{
+		"ubuntu-image": Version,
+		"arch":         getHostArch(),
+		"tools":        hostToolVersions(),
+	}
+	predicate.Materials = []slsaMaterial{}
+
+	// the resolved package versions come from the dpkg database of the rootfs, and the
+	// snap revisions from the seed
+	var packageURLs []string
+	switch parent := stateMachine.parent.(type) {
+	case *ClassicStateMachine:
+		predicate.BuildType = provenanceBuilderID + "/classic@v1"
+		predicate.Invocation.Parameters = map[string]interface{}{
+			"gadget-tree":   parent.Args.GadgetTree,
+			"project":       parent.Opts.Project,
+			"filesystem":    parent.Opts.Filesystem,
+			"suite":         parent.Opts.Suite,
+			"arch":          parent.Opts.Arch,
+			"subproject":    parent.Opts.Subproject,
+			"subarch":       parent.Opts.Subarch,
+			"with-proposed": parent.Opts.WithProposed,
+			"extra-ppas":    parent.Opts.ExtraPPAs,
+		}
+		treeDigest, err := directoryDigest(parent.Args.GadgetTree)
+		if err != nil {
+			return fmt.Errorf("Error calculating digest of gadget tree: %s", err.Error())
+		}
+		predicate.Materials = append(predicate.Materials, fileMaterial(parent.Args.GadgetTree, treeDigest))
+		packages, err := readDpkgStatus(stateMachine.tempDirs.rootfs)
+		if err != nil {
+			return err
+		}
+		series := stateMachine.imageNameValues()["series"]
+		for _, dpkgPkg := range packages {
+			packageURLs = append(packageURLs, debPackageURL(dpkgPkg, series))
+		}
+	case *SnapStateMachine:
+		predicate.BuildType = provenanceBuilderID + "/snap@v1"
+		predicate.Invocation.Parameters = map[string]interface{}{
+			"model-assertion":      parent.Args.ModelAssertion,
+			"snaps":                parent.Opts.Snaps,
+			"channel":              parent.Opts.Channel,
+			"disable-console-conf": parent.Opts.DisableConsoleConf,
+			"factory-image":        parent.Opts.FactoryImage,
+		}
+		modelDigest, err := calculateSHA256(parent.Args.ModelAssertion)
+		if err != nil {
+			return fmt.Errorf("Error calculating digest of model assertion: %s", err.Error())
+		}
+		predicate.Materials = append(predicate.Materials, fileMaterial(parent.Args.ModelAssertion, modelDigest))
+		snaps, err := readSeed(stateMachine.imageSeedDir())
+		if err != nil {
+			return err
+		}
+		for _, seeded := range snaps {
+			packageURLs = append(packageURLs, snapPackageURL(seeded))
+		}
+	}
+	predicate.Invocation.Parameters["image-size"] = stateMachine.commonFlags.Size
+	predicate.Invocation.Parameters["cloud-init"] = stateMachine.commonFlags.CloudInit
+
+	if stateMachine.YamlFilePath != "" {
+		gadgetDigest, err := calculateSHA256(stateMachine.YamlFilePath)
+		if err != nil {
+			return fmt.Errorf("Error calculating digest of gadget.yaml: %s", err.Error())
+		}
+		predicate.Materials = append(predicate.Materials, fileMaterial("gadget.yaml", gadgetDigest))
+	}
+
+	sort.Strings(packageURLs)
+	for _, packageURL := range packageURLs {
+		predicate.Materials = append(predicate.Materials, slsaMaterial{URI: packageURL})
+	}
+
+	statementBytes, err := json.MarshalIndent(statement, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Error encoding provenance: %s", err.Error())
+	}
+	provenanceName := stateMachine.outputName("", "provenance.intoto.json", ".provenance.intoto.json")
+	err = ioutilWriteFile(filepath.Join(stateMachine.tempDirs.staging, provenanceName),
+		statementBytes, 0644)
+	if err != nil {
+		return fmt.Errorf("Error writing provenance: %s", err.Error())
+	}
+	stateMachine.recordArtifact(provenanceName, "", "provenance")
+	return nil
+}
+
+// fileMaterial returns the material for a local file or directory
+func fileMaterial(path, digest string) slsaMaterial {
+	if absPath, err := filepath.Abs(path); err == nil {
+		path = absPath
+	}
+	return slsaMaterial{
+		URI:    "file://" + path,
+		Digest: map[string]string{"sha256": digest},
+	}
+}
+
+// directoryDigest calculates a sha256 digest of a directory tree from the sorted
+// relative paths and contents of the regular files and symlinks in it
+func directoryDigest(dir string) (string, error) {
+	hash := sha256.New()
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(hash, "%s -> %s\n", relPath, target)
+		case info.Mode().IsRegular():
+			file, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			fileHash := sha256.New()
+			if _, err := io.Copy(fileHash, file); err != nil {
+				return err
+			}
+			fmt.Fprintf(hash, "%s  %s\n", hex.EncodeToString(fileHash.Sum(nil)), relPath)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// hostToolVersions returns the first line printed by each of the provenanceHostTools
+// when asked for their version, or "unknown" if the tool can't be run
+func hostToolVersions() map[string]string {
+	versions := make(map[string]string)
+	for tool, args := range provenanceHostTools {
+		versionOutput, err := execCommand(tool, args...).CombinedOutput()
+		if err != nil {
+			versions[tool] = "unknown"
+			continue
+		}
+		versions[tool] = strings.TrimSpace(strings.SplitN(string(versionOutput), "\n", 2)[0])
+	}
+	return versions
+}
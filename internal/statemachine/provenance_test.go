@@ -0,0 +1,187 @@
+// This file contains unit tests for the build provenance
+package statemachine
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+)
+
+// TestWriteProvenance ensures that the provenance describes the inputs and outputs of
+// classic and snap builds
+func TestWriteProvenance(t *testing.T) {
+	testCases := []struct {
+		name              string
+		imageType         string
+		seeded            bool
+		buildType         string
+		expectedMaterials []string
+	}{
+		{"classic", "classic", false, "https://github.com/canonical/ubuntu-image/classic@v1",
+			[]string{"gadget_tree", "gadget.yaml",
+				"pkg:deb/ubuntu/bash@5.1-6ubuntu1?arch=amd64&distro=jammy",
+				"pkg:deb/ubuntu/libc6@2.35-0ubuntu3.1?arch=amd64&distro=jammy",
+				"pkg:deb/ubuntu/libc6@2.35-0ubuntu3.1?arch=i386&distro=jammy",
+				"pkg:deb/ubuntu/vim-tiny@2:8.2.3995-1ubuntu2.1?arch=amd64&distro=jammy"}},
+		{"snap_uc18", "snap", false, "https://github.com/canonical/ubuntu-image/snap@v1",
+			[]string{"modelAssertion20", "gadget.yaml",
+				"pkg:snap/core20@1234?channel=latest%2Fbeta",
+				"pkg:snap/hello@x1",
+				"pkg:snap/pc@130?channel=18%2Fstable"}},
+		{"snap_uc20", "snap", true, "https://github.com/canonical/ubuntu-image/snap@v1",
+			[]string{"modelAssertion20", "gadget.yaml",
+				"pkg:snap/core20@1234?channel=latest%2Fstable",
+				"pkg:snap/hello@x1?channel=edge",
+				"pkg:snap/pc@130?channel=20%2Fstable"}},
+	}
+	for _, tc := range testCases {
+		t.Run("test_write_provenance_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			var stateMachine *StateMachine
+			switch tc.imageType {
+			case "classic":
+				var classicStateMachine ClassicStateMachine
+				classicStateMachine.parent = &classicStateMachine
+				classicStateMachine.Args.GadgetTree = filepath.Join("testdata", "gadget_tree")
+				classicStateMachine.Opts.ExtraPPAs = []string{"canonical-foundations/ubuntu-image"}
+				classicStateMachine.Opts.Suite = "jammy"
+				stateMachine = &classicStateMachine.StateMachine
+			case "snap":
+				var snapStateMachine SnapStateMachine
+				snapStateMachine.parent = &snapStateMachine
+				snapStateMachine.Args.ModelAssertion = filepath.Join("testdata", "modelAssertion20")
+				snapStateMachine.Opts.Snaps = []string{"hello-world"}
+				stateMachine = &snapStateMachine.StateMachine
+			}
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.commonFlags.Provenance = true
+			stateMachine.YamlFilePath = filepath.Join("testdata", "gadget-mbr.yaml")
+			stateMachine.BuildID = "abcd1234"
+			stateMachine.IsSeeded = tc.seeded
+
+			testCaseName = "TestWriteProvenance"
+			execCommand = fakeExecCommand
+			defer func() {
+				execCommand = exec.Command
+			}()
+
+			err := stateMachine.makeTemporaryDirectories()
+			asserter.AssertErrNil(err, true)
+			defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+			err = stateMachine.setupOutputDir()
+			asserter.AssertErrNil(err, true)
+			err = ioutil.WriteFile(filepath.Join(stateMachine.tempDirs.staging, "pc.img"),
+				[]byte("mbr"), 0644)
+			asserter.AssertErrNil(err, true)
+			stateMachine.recordArtifact("pc.img", "pc", "disk-image")
+			// the packages come from the dpkg database of the rootfs and the snaps from
+			// the seed
+			switch {
+			case tc.imageType == "classic":
+				stateMachine.tempDirs.rootfs = filepath.Join("testdata", "dpkg_rootfs")
+			case tc.seeded:
+				writeTestSeed(t, stateMachine.tempDirs.rootfs, true)
+			default:
+				writeTestSeed(t, filepath.Join(stateMachine.tempDirs.rootfs,
+					"system-data", "var", "lib", "snapd", "seed"), false)
+			}
+
+			err = stateMachine.writeProvenance()
+			asserter.AssertErrNil(err, true)
+
+			statementBytes, err := ioutil.ReadFile(filepath.Join(stateMachine.tempDirs.staging,
+				"provenance.intoto.json"))
+			asserter.AssertErrNil(err, true)
+			var statement inTotoStatement
+			err = json.Unmarshal(statementBytes, &statement)
+			asserter.AssertErrNil(err, true)
+
+			if statement.Type != inTotoStatementType || statement.PredicateType != slsaProvenancePredicate {
+				t.Errorf("Unexpected statement type %s with predicate %s",
+					statement.Type, statement.PredicateType)
+			}
+			if len(statement.Subject) != 1 || statement.Subject[0].Name != "pc.img" ||
+				statement.Subject[0].Digest["sha256"] !=
+					"f5662649c772d7d7c017ebf21784239b8a28836551f1d507dbb9f015240290ed" {
+				t.Errorf("Expected pc.img to be the only subject, got %v", statement.Subject)
+			}
+			predicate := statement.Predicate
+			if predicate.BuildType != tc.buildType {
+				t.Errorf("Expected build type %s, got %s", tc.buildType, predicate.BuildType)
+			}
+			if predicate.Metadata.BuildInvocationID != "abcd1234" {
+				t.Errorf("Expected build invocation id abcd1234, got %s",
+					predicate.Metadata.BuildInvocationID)
+			}
+			tools := predicate.Invocation.Environment["tools"].(map[string]interface{})
+			for tool := range provenanceHostTools {
+				if tools[tool] != "tool 1.0" {
+					t.Errorf("Expected %s version \"tool 1.0\", got \"%v\"", tool, tools[tool])
+				}
+			}
+			if len(predicate.Materials) != len(tc.expectedMaterials) {
+				t.Fatalf("Expected materials %v, got %v", tc.expectedMaterials, predicate.Materials)
+			}
+			for ii, material := range predicate.Materials {
+				expected := tc.expectedMaterials[ii]
+				if ii < 2 {
+					if filepath.Base(material.URI) != expected || material.Digest["sha256"] == "" {
+						t.Errorf("Expected a digest of %s, got %v", expected, material)
+					}
+				} else if material.URI != expected {
+					t.Errorf("Expected material %s, got %s", expected, material.URI)
+				}
+			}
+			if stateMachine.Artifacts[len(stateMachine.Artifacts)-1].Type != "provenance" {
+				t.Errorf("Expected the provenance to be recorded as an artifact")
+			}
+		})
+	}
+}
+
+// TestFailedWriteProvenance tests failures when writing the provenance
+func TestFailedWriteProvenance(t *testing.T) {
+	t.Run("test_failed_write_provenance", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine ClassicStateMachine
+		stateMachine.parent = &stateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.commonFlags.Provenance = true
+		stateMachine.Args.GadgetTree = filepath.Join("testdata", "gadget_tree")
+		stateMachine.YamlFilePath = filepath.Join("testdata", "gadget-mbr.yaml")
+
+		err := stateMachine.makeTemporaryDirectories()
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+
+		// the images have to be staged
+		stateMachine.recordArtifact("pc.img", "pc", "disk-image")
+		err = stateMachine.writeProvenance()
+		asserter.AssertErrContains(err, "Error calculating checksum of pc.img")
+		stateMachine.Artifacts = nil
+
+		// the gadget tree has to exist
+		stateMachine.Args.GadgetTree = "/does/not/exist"
+		err = stateMachine.writeProvenance()
+		asserter.AssertErrContains(err, "Error calculating digest of gadget tree")
+		stateMachine.Args.GadgetTree = filepath.Join("testdata", "gadget_tree")
+
+		// so does the dpkg database of the rootfs
+		err = stateMachine.writeProvenance()
+		asserter.AssertErrContains(err, "Error opening dpkg status")
+		stateMachine.tempDirs.rootfs = filepath.Join("testdata", "dpkg_rootfs")
+
+		// mock ioutil.WriteFile
+		ioutilWriteFile = mockWriteFile
+		defer func() {
+			ioutilWriteFile = ioutil.WriteFile
+		}()
+		err = stateMachine.writeProvenance()
+		asserter.AssertErrContains(err, "Error writing provenance")
+	})
+}
@@ -0,0 +1,255 @@
+package statemachine
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/diskfs/go-diskfs/partition"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+	"github.com/google/uuid"
+	"github.com/snapcore/snapd/gadget/quantity"
+)
+
+// reproducibleNamespace is the namespace of the UUIDs derived from the inputs of
+// reproducible builds
+var reproducibleNamespace = uuid.NewSHA1(uuid.NameSpaceURL, []byte(provenanceBuilderID))
+
+// setupReproducible reads SOURCE_DATE_EPOCH and derives the seed of the identifiers of a
+// --reproducible build from it, the model assertion or gadget tree and the options of
+// the image type
+func (stateMachine *StateMachine) setupReproducible() error {
+	if !stateMachine.commonFlags.Reproducible {
+		return nil
+	}
+	sourceDateEpoch, found := os.LookupEnv("SOURCE_DATE_EPOCH")
+	if !found {
+		return fmt.Errorf("--reproducible requires SOURCE_DATE_EPOCH to be set")
+	}
+	epoch, err := strconv.ParseInt(sourceDateEpoch, 10, 64)
+	if err != nil || epoch < 0 {
+		return fmt.Errorf("invalid SOURCE_DATE_EPOCH \"%s\": it must be a number of seconds "+
+			"since the Unix epoch", sourceDateEpoch)
+	}
+	stateMachine.SourceDateEpoch = epoch
+
+	seed := sha256.New()
+	fmt.Fprintf(seed, "%d\n", epoch)
+	switch parent := stateMachine.parent.(type) {
+	case *ClassicStateMachine:
+		// the digest can't be calculated when resuming, the seed is then read from the metadata
+		if treeDigest, err := directoryDigest(parent.Args.GadgetTree); err == nil {
+			fmt.Fprintf(seed, "gadget-tree %s\n", treeDigest)
+		}
+		fmt.Fprintf(seed, "%+v\n", parent.Opts)
+	case *SnapStateMachine:
+		if modelDigest, err := calculateSHA256(parent.Args.ModelAssertion); err == nil {
+			fmt.Fprintf(seed, "model %s\n", modelDigest)
+		}
+		fmt.Fprintf(seed, "%+v\n", parent.Opts)
+	}
+	stateMachine.ReproducibleSeed = hex.EncodeToString(seed.Sum(nil))
+	return nil
+}
+
+// buildTime returns SOURCE_DATE_EPOCH for --reproducible builds and the current time otherwise
+func (stateMachine *StateMachine) buildTime() time.Time {
+	if stateMachine.commonFlags.Reproducible {
+		return time.Unix(stateMachine.SourceDateEpoch, 0).UTC()
+	}
+	return time.Now()
+}
+
+// reproducibleUUID returns the UUID of the identifier called name. It is derived from
+// the inputs of --reproducible builds and random otherwise
+func (stateMachine *StateMachine) reproducibleUUID(name string) uuid.UUID {
+	if stateMachine.commonFlags.Reproducible {
+		return uuid.NewSHA1(reproducibleNamespace, []byte(stateMachine.ReproducibleSeed+"/"+name))
+	}
+	return uuid.New()
+}
+
+// mbrDiskID returns the 4 bytes of the MBR disk identifier of a volume: the one given in
+// gadget.yaml or with --disk-guid, or one derived from SOURCE_DATE_EPOCH for
+// --reproducible builds, or a random one
+func (stateMachine *StateMachine) mbrDiskID(volumeName string) []byte {
+	diskID := make([]byte, 4)
+	if givenID, found := stateMachine.DiskIDs[volumeName]; found {
+		// parseDiskIDs has already checked that these are 8 hexadecimal digits
+		value, _ := strconv.ParseUint(givenID, 16, 32)
+		binary.LittleEndian.PutUint32(diskID, uint32(value))
+	} else if stateMachine.commonFlags.Reproducible {
+		volumeUUID := stateMachine.reproducibleUUID("volumes/" + volumeName)
+		copy(diskID, volumeUUID[:4])
+	} else {
+		rand.Read(diskID)
+	}
+	return diskID
+}
+
+// setPartitionGUIDs sets the disk and partition GUIDs of GPT partition tables. The GUIDs
+// given in gadget.yaml or with --disk-guid are kept, and the others are derived from
+// SOURCE_DATE_EPOCH for --reproducible builds or generated randomly, so that they are
+// known before go-diskfs writes the partition table
+func (stateMachine *StateMachine) setPartitionGUIDs(volumeName string, partitionTable *partition.Table) {
+	gptTable, isGPT := (*partitionTable).(*gpt.Table)
+	if !isGPT {
+		return
+	}
+	if diskGUID, found := stateMachine.DiskIDs[volumeName]; found {
+		gptTable.GUID = diskGUID
+	} else {
+		gptTable.GUID = stateMachine.reproducibleUUID("volumes/" + volumeName).String()
+	}
+	for ii, gptPartition := range gptTable.Partitions {
+		if gptPartition.GUID == "" {
+			gptPartition.GUID = stateMachine.reproducibleUUID(
+				fmt.Sprintf("volumes/%s/partitions/%d", volumeName, ii)).String()
+		}
+	}
+}
+
+// clampTimestamps sets the modification time of the files in dir that are newer than
+// SOURCE_DATE_EPOCH to SOURCE_DATE_EPOCH, for --reproducible builds
+func (stateMachine *StateMachine) clampTimestamps(dir string) error {
+	if !stateMachine.commonFlags.Reproducible {
+		return nil
+	}
+	epoch := "@" + strconv.FormatInt(stateMachine.SourceDateEpoch, 10)
+	findCommand := execCommand("find", dir, "-newermt", epoch,
+		"-exec", "touch", "--no-dereference", "--date="+epoch, "{}", "+")
+	if output, err := findCommand.CombinedOutput(); err != nil {
+		return fmt.Errorf("Error clamping timestamps: Error running command \"%s\": %s. Output: %s",
+			findCommand.String(), err.Error(), string(output))
+	}
+	return nil
+}
+
+// makeFilesystem creates a filesystem populated with the contents of contentRoot. For
+// --reproducible builds, the timestamps of the contents are clamped and the UUID, hash
+// seed and timestamps of ext4 and vfat filesystems are derived from the inputs and
+// SOURCE_DATE_EPOCH. The UUID depends on the path of img in the work directory. The
+// filesystem blocks are at least as large as the sectors of the disk image
+func (stateMachine *StateMachine) makeFilesystem(fsType, img, label, contentRoot string,
+	size, sectorSize quantity.Size) error {
+	if !stateMachine.commonFlags.Reproducible || (fsType != "ext4" && fsType != "vfat") {
+		return mkfsMakeWithContent(fsType, img, label, contentRoot, size, sectorSize)
+	}
+	if contentRoot != "" {
+		if err := stateMachine.clampTimestamps(contentRoot); err != nil {
+			return err
+		}
+	}
+	fsName, err := filepath.Rel(stateMachine.stateMachineFlags.WorkDir, img)
+	if err != nil {
+		fsName = img
+	}
+	fsUUID := stateMachine.reproducibleUUID("filesystems/" + fsName)
+	epoch := strconv.FormatInt(stateMachine.SourceDateEpoch, 10)
+	env := append(os.Environ(), "SOURCE_DATE_EPOCH="+epoch, "E2FSPROGS_FAKE_TIME="+epoch,
+		"MTOOLS_SKIP_CHECK=1")
+
+	// the options match the ones snapd uses, see osutil/mkfs
+	var commands [][]string
+	if fsType == "ext4" {
+		mkfsArgs := []string{"mkfs.ext4"}
+		if size != 0 && size <= 32*quantity.SizeMiB {
+			blockSize := quantity.SizeKiB
+			if sectorSize > blockSize {
+				blockSize = sectorSize
+			}
+			mkfsArgs = append(mkfsArgs, "-b", strconv.FormatUint(uint64(blockSize), 10))
+		}
+		if contentRoot != "" {
+			mkfsArgs = append(mkfsArgs, "-d", contentRoot)
+		}
+		if label != "" {
+			mkfsArgs = append(mkfsArgs, "-L", label)
+		}
+		mkfsArgs = append(mkfsArgs, "-U", fsUUID.String(), "-E", "hash_seed="+fsUUID.String(), img)
+		if os.Geteuid() != 0 {
+			// run through fakeroot so that files are owned by root
+			mkfsArgs = append([]string{"fakeroot"}, mkfsArgs...)
+		}
+		commands = append(commands, mkfsArgs)
+		if contentRoot != "" {
+			// mkfs.ext4 copies the change times of the contents, which can only be set
+			// once they are in the filesystem
+			debugfsScript, err := stateMachine.writeDebugfsTimesScript(contentRoot, img)
+			if err != nil {
+				return err
+			}
+			defer os.Remove(debugfsScript)
+			commands = append(commands, []string{"debugfs", "-w", "-f", debugfsScript, img})
+		}
+	} else {
+		vfatSectorSize := quantity.Size(512)
+		if sectorSize > vfatSectorSize {
+			vfatSectorSize = sectorSize
+		}
+		mkfsArgs := []string{"mkfs.vfat", "-S", strconv.FormatUint(uint64(vfatSectorSize), 10),
+			"-s", "1", "-F", "32", "--invariant", "-i", hex.EncodeToString(fsUUID[:4])}
+		if label != "" {
+			mkfsArgs = append(mkfsArgs, "-n", label)
+		}
+		commands = append(commands, append(mkfsArgs, img))
+		if contentRoot != "" {
+			files, err := ioutilReadDir(contentRoot)
+			if err != nil {
+				return fmt.Errorf("Error reading filesystem contents: %s", err.Error())
+			}
+			if len(files) > 0 {
+				// -m preserves the clamped modification times
+				mcopyArgs := []string{"mcopy", "-s", "-m", "-i", img}
+				for _, file := range files {
+					mcopyArgs = append(mcopyArgs, filepath.Join(contentRoot, file.Name()))
+				}
+				commands = append(commands, append(mcopyArgs, "::"))
+			}
+		}
+	}
+	for _, args := range commands {
+		command := execCommand(args[0], args[1:]...)
+		command.Env = env
+		if output, err := command.CombinedOutput(); err != nil {
+			return fmt.Errorf("Error running command \"%s\": %s. Output: %s",
+				command.String(), err.Error(), string(output))
+		}
+	}
+	return nil
+}
+
+// writeDebugfsTimesScript writes a debugfs script next to img that sets the access and
+// change times of the files copied from contentRoot to SOURCE_DATE_EPOCH
+func (stateMachine *StateMachine) writeDebugfsTimesScript(contentRoot, img string) (string, error) {
+	var script strings.Builder
+	err := filepath.Walk(contentRoot, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(contentRoot, path)
+		if err != nil {
+			return err
+		}
+		for _, field := range []string{"atime", "ctime"} {
+			fmt.Fprintf(&script, "set_inode_field \"%s\" %s @%d\n",
+				filepath.Join("/", relPath), field, stateMachine.SourceDateEpoch)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("Error listing filesystem contents: %s", err.Error())
+	}
+	scriptPath := img + ".debugfs"
+	if err := ioutilWriteFile(scriptPath, []byte(script.String()), 0644); err != nil {
+		return "", fmt.Errorf("Error writing debugfs script: %s", err.Error())
+	}
+	return scriptPath, nil
+}
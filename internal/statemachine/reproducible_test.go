@@ -0,0 +1,209 @@
+// This file contains unit tests for --reproducible builds
+package statemachine
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+	"github.com/snapcore/snapd/osutil"
+)
+
+// buildReproducibleImages builds the disk images of the gadget-reproducible.yaml fixture
+// with SOURCE_DATE_EPOCH set to epoch and returns their sha256 checksums. The files of
+// the rootfs and gadget are given the current time, which --reproducible clamps
+func buildReproducibleImages(t *testing.T, epoch string) map[string]string {
+	asserter := helper.Asserter{T: t}
+	os.Setenv("SOURCE_DATE_EPOCH", epoch)
+	defer os.Unsetenv("SOURCE_DATE_EPOCH")
+
+	var stateMachine StateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.commonFlags.Reproducible = true
+	err := stateMachine.setupReproducible()
+	asserter.AssertErrNil(err, true)
+
+	// each build uses its own work directory, as the paths don't change the images
+	workDir, err := ioutil.TempDir("/tmp", "ubuntu-image-")
+	asserter.AssertErrNil(err, true)
+	defer os.RemoveAll(workDir)
+	stateMachine.stateMachineFlags.WorkDir = workDir
+	err = stateMachine.makeTemporaryDirectories()
+	asserter.AssertErrNil(err, true)
+	stateMachine.commonFlags.OutputDir = filepath.Join(workDir, "output")
+
+	stateMachine.YamlFilePath = filepath.Join("testdata", "gadget-reproducible.yaml")
+	os.MkdirAll(filepath.Join(stateMachine.tempDirs.unpack, "gadget"), 0755)
+	err = stateMachine.loadGadgetYaml()
+	asserter.AssertErrNil(err, true)
+
+	// populate the rootfs and unpack directories
+	err = osutil.CopySpecialFile(filepath.Join("testdata", "gadget_tree"), stateMachine.tempDirs.rootfs)
+	asserter.AssertErrNil(err, true)
+	files, _ := ioutil.ReadDir(filepath.Join("testdata", "gadget_tree"))
+	for _, srcFile := range files {
+		srcFile := filepath.Join("testdata", "gadget_tree", srcFile.Name())
+		osutil.CopySpecialFile(srcFile, filepath.Join(stateMachine.tempDirs.unpack, "gadget"))
+	}
+	err = stateMachine.calculateRootfsSize()
+	asserter.AssertErrNil(err, true)
+	os.MkdirAll(stateMachine.tempDirs.volumes, 0755)
+
+	err = stateMachine.populateBootfsContents()
+	asserter.AssertErrNil(err, true)
+	err = stateMachine.populatePreparePartitions()
+	asserter.AssertErrNil(err, true)
+	err = stateMachine.makeDisk()
+	asserter.AssertErrNil(err, true)
+
+	checksums := make(map[string]string)
+	for _, artifact := range stateMachine.Artifacts {
+		checksums[artifact.Name], err = calculateSHA256(
+			filepath.Join(stateMachine.tempDirs.staging, artifact.Name))
+		asserter.AssertErrNil(err, true)
+	}
+	if len(checksums) != 4 {
+		t.Fatalf("Expected 2 disk images and their partition identifiers, got %v",
+			stateMachine.Artifacts)
+	}
+	return checksums
+}
+
+// TestReproducibleBuild ensures that building the same fixture twice with --reproducible
+// produces identical GPT and MBR disk images, and that SOURCE_DATE_EPOCH changes them
+func TestReproducibleBuild(t *testing.T) {
+	t.Run("test_reproducible_build", func(t *testing.T) {
+		firstBuild := buildReproducibleImages(t, "1666051200")
+		// make sure the second build happens at a different time
+		time.Sleep(time.Second)
+		secondBuild := buildReproducibleImages(t, "1666051200")
+		for imageName, checksum := range firstBuild {
+			if secondBuild[imageName] != checksum {
+				t.Errorf("Image %s differs between builds: %s != %s",
+					imageName, checksum, secondBuild[imageName])
+			}
+		}
+
+		otherEpochBuild := buildReproducibleImages(t, "1666137600")
+		for imageName, checksum := range firstBuild {
+			if otherEpochBuild[imageName] == checksum {
+				t.Errorf("Image %s should change with SOURCE_DATE_EPOCH", imageName)
+			}
+		}
+	})
+}
+
+// TestReproducibleIdentifiers ensures that the identifiers and build time are derived
+// from the inputs with --reproducible, and random otherwise
+func TestReproducibleIdentifiers(t *testing.T) {
+	t.Run("test_reproducible_identifiers", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		os.Setenv("SOURCE_DATE_EPOCH", "1666051200")
+		defer os.Unsetenv("SOURCE_DATE_EPOCH")
+
+		var stateMachine SnapStateMachine
+		stateMachine.parent = &stateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.Args.ModelAssertion = filepath.Join("testdata", "modelAssertion20")
+		stateMachine.commonFlags.Reproducible = true
+		err := stateMachine.validateInput()
+		asserter.AssertErrNil(err, true)
+
+		if stateMachine.BuildDate != "20221018" {
+			t.Errorf("Expected the build date to be 20221018, got %s", stateMachine.BuildDate)
+		}
+		buildID := stateMachine.BuildID
+		buildIDUUID := stateMachine.reproducibleUUID("build-id")
+		diskID := stateMachine.mbrDiskID("pc")
+
+		// the same inputs give the same identifiers
+		err = stateMachine.validateInput()
+		asserter.AssertErrNil(err, true)
+		if stateMachine.BuildID != buildID || stateMachine.reproducibleUUID("build-id") != buildIDUUID ||
+			string(stateMachine.mbrDiskID("pc")) != string(diskID) {
+			t.Error("Expected the identifiers to be the same for the same inputs")
+		}
+
+		// a different model gives different identifiers
+		stateMachine.Args.ModelAssertion = filepath.Join("testdata", "modelAssertion18")
+		err = stateMachine.validateInput()
+		asserter.AssertErrNil(err, true)
+		if stateMachine.BuildID == buildID || stateMachine.reproducibleUUID("build-id") == buildIDUUID {
+			t.Error("Expected the identifiers to change with the model assertion")
+		}
+
+		// without --reproducible the identifiers are random
+		stateMachine.commonFlags.Reproducible = false
+		if stateMachine.reproducibleUUID("build-id") == stateMachine.reproducibleUUID("build-id") {
+			t.Error("Expected random identifiers without --reproducible")
+		}
+	})
+}
+
+// TestReproducibleResume ensures that a resumed --reproducible build keeps the seed of
+// the first run, as the model assertion or gadget tree are not given again
+func TestReproducibleResume(t *testing.T) {
+	t.Run("test_reproducible_resume", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		os.Setenv("SOURCE_DATE_EPOCH", "1666051200")
+		defer os.Unsetenv("SOURCE_DATE_EPOCH")
+		workDir, err := ioutil.TempDir("/tmp", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(workDir)
+
+		var stateMachine SnapStateMachine
+		stateMachine.parent = &stateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.Args.ModelAssertion = filepath.Join("testdata", "modelAssertion20")
+		stateMachine.commonFlags.Reproducible = true
+		stateMachine.stateMachineFlags.WorkDir = workDir
+		err = stateMachine.validateInput()
+		asserter.AssertErrNil(err, true)
+		err = stateMachine.writeMetadata()
+		asserter.AssertErrNil(err, true)
+
+		var resumed SnapStateMachine
+		resumed.parent = &resumed
+		resumed.commonFlags, resumed.stateMachineFlags = helper.InitCommonOpts()
+		resumed.commonFlags.Reproducible = true
+		resumed.stateMachineFlags.Resume = true
+		resumed.stateMachineFlags.WorkDir = workDir
+		err = resumed.validateInput()
+		asserter.AssertErrNil(err, true)
+		err = resumed.readMetadata()
+		asserter.AssertErrNil(err, true)
+
+		if resumed.reproducibleUUID("build-id") != stateMachine.reproducibleUUID("build-id") {
+			t.Error("Expected the identifiers of the resumed build to be the same")
+		}
+	})
+}
+
+// TestFailedSetupReproducible tests failures when setting up a --reproducible build
+func TestFailedSetupReproducible(t *testing.T) {
+	t.Run("test_failed_setup_reproducible", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine StateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.commonFlags.Reproducible = true
+
+		os.Unsetenv("SOURCE_DATE_EPOCH")
+		err := stateMachine.setupReproducible()
+		asserter.AssertErrContains(err, "--reproducible requires SOURCE_DATE_EPOCH")
+
+		os.Setenv("SOURCE_DATE_EPOCH", "yesterday")
+		defer os.Unsetenv("SOURCE_DATE_EPOCH")
+		err = stateMachine.setupReproducible()
+		asserter.AssertErrContains(err, "invalid SOURCE_DATE_EPOCH")
+
+		// clamping timestamps fails on missing directories
+		os.Setenv("SOURCE_DATE_EPOCH", "1666051200")
+		err = stateMachine.setupReproducible()
+		asserter.AssertErrNil(err, true)
+		err = stateMachine.clampTimestamps("/nonexistent")
+		asserter.AssertErrContains(err, "Error clamping timestamps")
+	})
+}
@@ -0,0 +1,369 @@
+package statemachine
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// sbomComponent is a Debian package or a snap included in an image
+type sbomComponent struct {
+	Name       string
+	Version    string
+	PURL       string
+	Supplier   string
+	Licenses   []string // the License fields of the debian/copyright file of a package
+	Properties [][2]string
+}
+
+// spdxDocument is a SPDX 2.3 document in its JSON serialization
+type spdxDocument struct {
+	SPDXVersion       string `json:"spdxVersion"`
+	DataLicense       string `json:"dataLicense"`
+	SPDXID            string `json:"SPDXID"`
+	Name              string `json:"name"`
+	DocumentNamespace string `json:"documentNamespace"`
+	CreationInfo      struct {
+		Created  string   `json:"created"`
+		Creators []string `json:"creators"`
+	} `json:"creationInfo"`
+	Packages               []spdxPackage          `json:"packages"`
+	Relationships          []spdxRelationship     `json:"relationships"`
+	ExtractedLicensingInfo []spdxExtractedLicense `json:"hasExtractedLicensingInfos,omitempty"`
+}
+
+type spdxPackage struct {
+	SPDXID           string            `json:"SPDXID"`
+	Name             string            `json:"name"`
+	VersionInfo      string            `json:"versionInfo,omitempty"`
+	Supplier         string            `json:"supplier,omitempty"`
+	DownloadLocation string            `json:"downloadLocation"`
+	FilesAnalyzed    bool              `json:"filesAnalyzed"`
+	LicenseConcluded string            `json:"licenseConcluded"`
+	LicenseDeclared  string            `json:"licenseDeclared"`
+	CopyrightText    string            `json:"copyrightText"`
+	SourceInfo       string            `json:"sourceInfo,omitempty"`
+	PrimaryPurpose   string            `json:"primaryPackagePurpose,omitempty"`
+	ExternalRefs     []spdxExternalRef `json:"externalRefs,omitempty"`
+}
+
+type spdxExternalRef struct {
+	ReferenceCategory string `json:"referenceCategory"`
+	ReferenceType     string `json:"referenceType"`
+	ReferenceLocator  string `json:"referenceLocator"`
+}
+
+type spdxRelationship struct {
+	SPDXElementID      string `json:"spdxElementId"`
+	RelationshipType   string `json:"relationshipType"`
+	RelatedSPDXElement string `json:"relatedSpdxElement"`
+}
+
+type spdxExtractedLicense struct {
+	LicenseID     string `json:"licenseId"`
+	Name          string `json:"name"`
+	ExtractedText string `json:"extractedText"`
+}
+
+// cycloneDXDocument is a CycloneDX 1.4 BOM in its JSON serialization
+type cycloneDXDocument struct {
+	BOMFormat    string `json:"bomFormat"`
+	SpecVersion  string `json:"specVersion"`
+	SerialNumber string `json:"serialNumber"`
+	Version      int    `json:"version"`
+	Metadata     struct {
+		Timestamp string             `json:"timestamp"`
+		Tools     []cycloneDXTool    `json:"tools"`
+		Component cycloneDXComponent `json:"component"`
+	} `json:"metadata"`
+	Components []cycloneDXComponent `json:"components"`
+}
+
+type cycloneDXTool struct {
+	Vendor  string `json:"vendor"`
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type cycloneDXComponent struct {
+	Type       string              `json:"type"`
+	BOMRef     string              `json:"bom-ref,omitempty"`
+	Name       string              `json:"name"`
+	Version    string              `json:"version,omitempty"`
+	Publisher  string              `json:"publisher,omitempty"`
+	PURL       string              `json:"purl,omitempty"`
+	Licenses   []cycloneDXLicense  `json:"licenses,omitempty"`
+	Properties []cycloneDXProperty `json:"properties,omitempty"`
+}
+
+type cycloneDXLicense struct {
+	License    *cycloneDXLicenseID `json:"license,omitempty"`
+	Expression string              `json:"expression,omitempty"`
+}
+
+type cycloneDXLicenseID struct {
+	ID   string `json:"id,omitempty"`
+	Name string `json:"name,omitempty"`
+}
+
+type cycloneDXProperty struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// generateSBOM writes software bills of materials listing the Debian packages of classic
+// images or the snaps of snap images in the formats requested with --sbom
+func (stateMachine *StateMachine) generateSBOM() error {
+	if len(stateMachine.commonFlags.SBOM) == 0 {
+		return nil
+	}
+	if err := stateMachine.setupOutputDir(); err != nil {
+		return err
+	}
+
+	var components []sbomComponent
+	switch stateMachine.parent.(type) {
+	case *ClassicStateMachine:
+		series := stateMachine.imageNameValues()["series"]
+		packages, err := readDpkgStatus(stateMachine.tempDirs.rootfs)
+		if err != nil {
+			return err
+		}
+		for _, dpkgPkg := range packages {
+			components = append(components, sbomComponent{
+				Name:     dpkgPkg.Name,
+				Version:  dpkgPkg.Version,
+				PURL:     debPackageURL(dpkgPkg, series),
+				Supplier: dpkgPkg.Supplier,
+				Licenses: readPackageLicenses(stateMachine.tempDirs.rootfs, dpkgPkg.Name),
+				Properties: [][2]string{
+					{"source", dpkgPkg.Source},
+					{"source-version", dpkgPkg.SourceVersion},
+					{"architecture", dpkgPkg.Architecture},
+				},
+			})
+		}
+	case *SnapStateMachine:
+		snaps, err := readSeed(stateMachine.imageSeedDir())
+		if err != nil {
+			return err
+		}
+		for _, seeded := range snaps {
+			component := sbomComponent{
+				Name:    seeded.Name,
+				Version: seeded.Revision,
+				PURL:    snapPackageURL(seeded),
+				Properties: [][2]string{
+					{"revision", seeded.Revision},
+					{"channel", seeded.Channel},
+					{"snap-id", seeded.SnapID},
+					{"type", seeded.Type},
+				},
+			}
+			component.Supplier = "NOASSERTION"
+			if seeded.Publisher != "" {
+				component.Supplier = "Organization: " + seeded.Publisher
+			}
+			components = append(components, component)
+		}
+	}
+
+	imageName := stateMachine.imageNameValues()["model"]
+	created := stateMachine.buildTime().UTC().Format(time.RFC3339)
+	for _, sbomFormat := range stateMachine.commonFlags.SBOM {
+		var sbom interface{}
+		var sbomName, sbomType string
+		switch sbomFormat {
+		case "spdx":
+			sbom = spdxSBOM(imageName, created, stateMachine.reproducibleUUID("sbom/spdx"), components)
+			sbomName = stateMachine.outputName("", "sbom.spdx.json", ".sbom.spdx.json")
+			sbomType = "spdx-sbom"
+		case "cyclonedx":
+			sbom = cycloneDXSBOM(imageName, created, stateMachine.reproducibleUUID("sbom/cyclonedx"), components)
+			sbomName = stateMachine.outputName("", "sbom.cdx.json", ".sbom.cdx.json")
+			sbomType = "cyclonedx-sbom"
+		}
+		sbomBytes, err := json.MarshalIndent(sbom, "", "  ")
+		if err != nil {
+			return fmt.Errorf("Error encoding SBOM: %s", err.Error())
+		}
+		err = ioutilWriteFile(filepath.Join(stateMachine.tempDirs.staging, sbomName), sbomBytes, 0644)
+		if err != nil {
+			return fmt.Errorf("Error writing SBOM: %s", err.Error())
+		}
+		stateMachine.recordArtifact(sbomName, "", sbomType)
+	}
+	return nil
+}
+
+// debPackageURL returns the package URL of a Debian package of an image of the given series
+func debPackageURL(dpkgPkg dpkgPackage, series string) string {
+	return fmt.Sprintf("pkg:deb/ubuntu/%s@%s?arch=%s&distro=%s", dpkgPkg.Name,
+		url.PathEscape(dpkgPkg.Version), dpkgPkg.Architecture, series)
+}
+
+// snapPackageURL returns the package URL of a seeded snap, with its channel if known
+func snapPackageURL(seeded seedSnap) string {
+	purl := fmt.Sprintf("pkg:snap/%s@%s", seeded.Name, seeded.Revision)
+	if seeded.Channel != "" {
+		purl += "?channel=" + url.QueryEscape(seeded.Channel)
+	}
+	return purl
+}
+
+// spdxSBOM describes the image as a SPDX package that contains a package per component
+func spdxSBOM(imageName, created string, documentUUID uuid.UUID, components []sbomComponent) *spdxDocument {
+	document := &spdxDocument{
+		SPDXVersion:       "SPDX-2.3",
+		DataLicense:       "CC0-1.0",
+		SPDXID:            "SPDXRef-DOCUMENT",
+		Name:              imageName,
+		DocumentNamespace: provenanceBuilderID + "/spdx/" + imageName + "-" + documentUUID.String(),
+	}
+	document.CreationInfo.Created = created
+	document.CreationInfo.Creators = []string{"Tool: ubuntu-image-" + Version}
+	document.Packages = []spdxPackage{{
+		SPDXID:           "SPDXRef-image",
+		Name:             imageName,
+		DownloadLocation: "NOASSERTION",
+		LicenseConcluded: "NOASSERTION",
+		LicenseDeclared:  "NOASSERTION",
+		CopyrightText:    "NOASSERTION",
+		PrimaryPurpose:   "OPERATING-SYSTEM",
+	}}
+	document.Relationships = []spdxRelationship{{"SPDXRef-DOCUMENT", "DESCRIBES", "SPDXRef-image"}}
+
+	licenseRefs := make(map[string]bool)
+	for ii, component := range components {
+		spdxPkg := spdxPackage{
+			SPDXID: fmt.Sprintf("SPDXRef-%d-%s", ii,
+				spdxIDChars.ReplaceAllString(component.Name, "-")),
+			Name:             component.Name,
+			VersionInfo:      component.Version,
+			Supplier:         component.Supplier,
+			DownloadLocation: "NOASSERTION",
+			LicenseConcluded: "NOASSERTION",
+			LicenseDeclared:  "NOASSERTION",
+			CopyrightText:    "NOASSERTION",
+			ExternalRefs: []spdxExternalRef{{
+				ReferenceCategory: "PACKAGE-MANAGER",
+				ReferenceType:     "purl",
+				ReferenceLocator:  component.PURL,
+			}},
+		}
+		for _, property := range component.Properties {
+			if property[0] == "source" {
+				spdxPkg.SourceInfo = "built package from: " + property[1]
+			}
+		}
+		expression, shortNames := componentLicense(component)
+		for _, shortName := range shortNames {
+			license, known := spdxLicense(shortName)
+			if !known && !licenseRefs[license] {
+				licenseRefs[license] = true
+				document.ExtractedLicensingInfo = append(document.ExtractedLicensingInfo,
+					spdxExtractedLicense{
+						LicenseID:     license,
+						Name:          shortName,
+						ExtractedText: "See /usr/share/doc/" + component.Name + "/copyright",
+					})
+			}
+		}
+		if expression != "" {
+			spdxPkg.LicenseDeclared = expression
+		}
+		document.Packages = append(document.Packages, spdxPkg)
+		document.Relationships = append(document.Relationships,
+			spdxRelationship{"SPDXRef-image", "CONTAINS", spdxPkg.SPDXID})
+	}
+	return document
+}
+
+// cycloneDXSBOM describes the image as an operating-system component made of a component
+// per package or snap
+func cycloneDXSBOM(imageName, created string, serialNumber uuid.UUID, components []sbomComponent) *cycloneDXDocument {
+	document := &cycloneDXDocument{
+		BOMFormat:    "CycloneDX",
+		SpecVersion:  "1.4",
+		SerialNumber: "urn:uuid:" + serialNumber.String(),
+		Version:      1,
+	}
+	document.Metadata.Timestamp = created
+	document.Metadata.Tools = []cycloneDXTool{{"Canonical", "ubuntu-image", Version}}
+	document.Metadata.Component = cycloneDXComponent{Type: "operating-system", Name: imageName}
+
+	document.Components = []cycloneDXComponent{}
+	for _, component := range components {
+		cdxComponent := cycloneDXComponent{
+			Type:      "library",
+			BOMRef:    component.PURL,
+			Name:      component.Name,
+			Version:   component.Version,
+			Publisher: cycloneDXPublisher(component.Supplier),
+			PURL:      component.PURL,
+		}
+		if strings.HasPrefix(component.PURL, "pkg:snap/") {
+			cdxComponent.Type = "application"
+		}
+		// a list of licenses means that all of them apply, choices need an expression
+		expression, shortNames := componentLicense(component)
+		if strings.Contains(expression, " OR ") {
+			cdxComponent.Licenses = []cycloneDXLicense{{Expression: expression}}
+			shortNames = nil
+		}
+		for _, shortName := range shortNames {
+			cdxLicense := &cycloneDXLicenseID{Name: shortName}
+			if license, known := spdxLicense(shortName); known {
+				cdxLicense = &cycloneDXLicenseID{ID: license}
+			}
+			cdxComponent.Licenses = append(cdxComponent.Licenses, cycloneDXLicense{License: cdxLicense})
+		}
+		for _, property := range component.Properties {
+			if property[1] == "" {
+				continue
+			}
+			cdxComponent.Properties = append(cdxComponent.Properties,
+				cycloneDXProperty{"ubuntu-image:" + property[0], property[1]})
+		}
+		document.Components = append(document.Components, cdxComponent)
+	}
+	return document
+}
+
+// componentLicense returns the SPDX license expression that applies to a component, which
+// is the conjunction of the licenses of its files, and the distinct short names it uses
+func componentLicense(component sbomComponent) (expression string, shortNames []string) {
+	var expressions []string
+	seen := make(map[string]bool)
+	for _, dpkgLicense := range component.Licenses {
+		licenseExpression, licenseNames := spdxLicenseExpression(dpkgLicense)
+		if licenseExpression == "" {
+			continue
+		}
+		if len(component.Licenses) > 1 && strings.Contains(licenseExpression, " ") {
+			licenseExpression = "(" + licenseExpression + ")"
+		}
+		expressions = append(expressions, licenseExpression)
+		for _, shortName := range licenseNames {
+			if !seen[shortName] {
+				seen[shortName] = true
+				shortNames = append(shortNames, shortName)
+			}
+		}
+	}
+	return strings.Join(expressions, " AND "), shortNames
+}
+
+// cycloneDXPublisher returns the publisher of a component from its SPDX supplier, which
+// is left out when it is unknown
+func cycloneDXPublisher(supplier string) string {
+	if supplier == "NOASSERTION" {
+		return ""
+	}
+	return strings.TrimPrefix(supplier, "Organization: ")
+}
@@ -0,0 +1,233 @@
+// This file contains unit tests for the software bills of materials
+package statemachine
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+	"github.com/google/uuid"
+)
+
+// TestGenerateSBOM ensures that SPDX and CycloneDX SBOMs list the packages of classic
+// images and the snaps of snap images
+func TestGenerateSBOM(t *testing.T) {
+	testCases := []struct {
+		name          string
+		imageType     string
+		seeded        bool
+		component     string
+		purl          string
+		supplier      string
+		spdxLicense   string
+		cdxProperties []cycloneDXProperty
+	}{
+		{"classic", "classic", false, "libc6",
+			"pkg:deb/ubuntu/libc6@2.35-0ubuntu3.1?arch=amd64&distro=jammy",
+			"Organization: Ubuntu Developers (ubuntu-devel-discuss@lists.ubuntu.com)",
+			"(GPL-2.0-or-later OR BSD-3-Clause) AND LGPL-2.1-or-later",
+			[]cycloneDXProperty{
+				{"ubuntu-image:source", "glibc"},
+				{"ubuntu-image:source-version", "2.35-0ubuntu3.1"},
+				{"ubuntu-image:architecture", "amd64"},
+			}},
+		{"snap_uc18", "snap", false, "pc", "pkg:snap/pc@130?channel=18%2Fstable",
+			"Organization: canonical", "NOASSERTION",
+			[]cycloneDXProperty{
+				{"ubuntu-image:revision", "130"},
+				{"ubuntu-image:channel", "18/stable"},
+				{"ubuntu-image:snap-id", "UqFziVZDHLSyO3TqSWgNBoAdHbLI4dAH"},
+				{"ubuntu-image:type", "gadget"},
+			}},
+		{"snap_uc20", "snap", true, "pc", "pkg:snap/pc@130?channel=20%2Fstable",
+			"Organization: canonical", "NOASSERTION",
+			[]cycloneDXProperty{
+				{"ubuntu-image:revision", "130"},
+				{"ubuntu-image:channel", "20/stable"},
+				{"ubuntu-image:snap-id", "UqFziVZDHLSyO3TqSWgNBoAdHbLI4dAH"},
+				{"ubuntu-image:type", "gadget"},
+			}},
+	}
+	for _, tc := range testCases {
+		t.Run("test_generate_sbom_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			var stateMachine *StateMachine
+			switch tc.imageType {
+			case "classic":
+				var classicStateMachine ClassicStateMachine
+				classicStateMachine.parent = &classicStateMachine
+				classicStateMachine.Opts.Project = "ubuntu-cpc"
+				classicStateMachine.Opts.Suite = "jammy"
+				classicStateMachine.Opts.Arch = "amd64"
+				stateMachine = &classicStateMachine.StateMachine
+			case "snap":
+				var snapStateMachine SnapStateMachine
+				snapStateMachine.parent = &snapStateMachine
+				snapStateMachine.Args.ModelAssertion = filepath.Join("testdata", "modelAssertion20")
+				stateMachine = &snapStateMachine.StateMachine
+			}
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.commonFlags.SBOM = []string{"spdx", "cyclonedx"}
+			stateMachine.IsSeeded = tc.seeded
+
+			err := stateMachine.makeTemporaryDirectories()
+			asserter.AssertErrNil(err, true)
+			defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+			switch {
+			case tc.imageType == "classic":
+				stateMachine.tempDirs.rootfs = filepath.Join("testdata", "dpkg_rootfs")
+			case tc.seeded:
+				writeTestSeed(t, stateMachine.tempDirs.rootfs, true)
+			default:
+				writeTestSeed(t, filepath.Join(stateMachine.tempDirs.rootfs,
+					"system-data", "var", "lib", "snapd", "seed"), false)
+			}
+
+			err = stateMachine.generateSBOM()
+			asserter.AssertErrNil(err, true)
+
+			// SPDX
+			spdxBytes, err := ioutil.ReadFile(filepath.Join(stateMachine.tempDirs.staging, "sbom.spdx.json"))
+			asserter.AssertErrNil(err, true)
+			var spdx spdxDocument
+			err = json.Unmarshal(spdxBytes, &spdx)
+			asserter.AssertErrNil(err, true)
+			if spdx.SPDXVersion != "SPDX-2.3" || spdx.Packages[0].SPDXID != "SPDXRef-image" {
+				t.Errorf("Expected a SPDX 2.3 document describing the image, got %s", string(spdxBytes))
+			}
+			if len(spdx.Relationships) != len(spdx.Packages) {
+				t.Errorf("Expected a relationship for each package, got %v", spdx.Relationships)
+			}
+			var spdxPkg *spdxPackage
+			for ii := range spdx.Packages {
+				if spdx.Packages[ii].Name == tc.component {
+					spdxPkg = &spdx.Packages[ii]
+					break
+				}
+			}
+			if spdxPkg == nil {
+				t.Fatalf("Expected %s in the SPDX packages, got %v", tc.component, spdx.Packages)
+			}
+			if spdxPkg.ExternalRefs[0].ReferenceLocator != tc.purl || spdxPkg.Supplier != tc.supplier ||
+				spdxPkg.LicenseDeclared != tc.spdxLicense {
+				t.Errorf("Unexpected SPDX package %v", *spdxPkg)
+			}
+
+			// CycloneDX
+			cdxBytes, err := ioutil.ReadFile(filepath.Join(stateMachine.tempDirs.staging, "sbom.cdx.json"))
+			asserter.AssertErrNil(err, true)
+			var cdx cycloneDXDocument
+			err = json.Unmarshal(cdxBytes, &cdx)
+			asserter.AssertErrNil(err, true)
+			if cdx.BOMFormat != "CycloneDX" || cdx.Metadata.Component.Type != "operating-system" {
+				t.Errorf("Expected a CycloneDX BOM describing the image, got %s", string(cdxBytes))
+			}
+			var cdxComponent *cycloneDXComponent
+			for ii := range cdx.Components {
+				if cdx.Components[ii].PURL == tc.purl {
+					cdxComponent = &cdx.Components[ii]
+					break
+				}
+			}
+			if cdxComponent == nil {
+				t.Fatalf("Expected %s in the CycloneDX components, got %v", tc.purl, cdx.Components)
+			}
+			if len(cdxComponent.Properties) != len(tc.cdxProperties) {
+				t.Fatalf("Expected properties %v, got %v", tc.cdxProperties, cdxComponent.Properties)
+			}
+			for ii, property := range cdxComponent.Properties {
+				if property != tc.cdxProperties[ii] {
+					t.Errorf("Expected property %v, got %v", tc.cdxProperties[ii], property)
+				}
+			}
+
+			if len(stateMachine.Artifacts) != 2 || stateMachine.Artifacts[0].Type != "spdx-sbom" ||
+				stateMachine.Artifacts[1].Type != "cyclonedx-sbom" {
+				t.Errorf("Expected the SBOMs to be recorded as artifacts, got %v", stateMachine.Artifacts)
+			}
+		})
+	}
+}
+
+// TestSBOMLicenses ensures that the choices between licenses are kept, and that licenses
+// without an SPDX identifier are declared as extracted licenses in SPDX and by name in
+// CycloneDX
+func TestSBOMLicenses(t *testing.T) {
+	t.Run("test_sbom_licenses", func(t *testing.T) {
+		components := []sbomComponent{
+			{Name: "vim-tiny", PURL: "pkg:deb/ubuntu/vim-tiny@1", Licenses: []string{"Vim", "Vim or public-domain"}},
+			{Name: "vim", PURL: "pkg:deb/ubuntu/vim@1", Licenses: []string{"Vim"}},
+			{Name: "perl", PURL: "pkg:deb/ubuntu/perl@1", Licenses: []string{"GPL-1+ or Artistic"}},
+		}
+		spdx := spdxSBOM("test", "2022-10-18T00:00:00Z", uuid.New(), components)
+		expected := []string{"NOASSERTION", "LicenseRef-Vim AND (LicenseRef-Vim OR LicenseRef-public-domain)",
+			"LicenseRef-Vim", "GPL-1.0-or-later OR Artistic-1.0"}
+		for ii, spdxPkg := range spdx.Packages {
+			if spdxPkg.LicenseDeclared != expected[ii] {
+				t.Errorf("Expected declared license %s, got %s", expected[ii], spdxPkg.LicenseDeclared)
+			}
+		}
+		if len(spdx.ExtractedLicensingInfo) != 2 {
+			t.Errorf("Expected each LicenseRef to be extracted once, got %v", spdx.ExtractedLicensingInfo)
+		}
+		cdx := cycloneDXSBOM("test", "2022-10-18T00:00:00Z", uuid.New(), components)
+		if cdx.Components[1].Licenses[0].License.Name != "Vim" ||
+			cdx.Components[1].Licenses[0].License.ID != "" {
+			t.Errorf("Expected an unknown license to be given by name, got %v", cdx.Components[1].Licenses)
+		}
+		if len(cdx.Components[2].Licenses) != 1 ||
+			cdx.Components[2].Licenses[0].Expression != "GPL-1.0-or-later OR Artistic-1.0" {
+			t.Errorf("Expected a choice of licenses to be given as an expression, got %v",
+				cdx.Components[2].Licenses)
+		}
+	})
+}
+
+// TestFailedGenerateSBOM tests failures when generating the SBOMs
+func TestFailedGenerateSBOM(t *testing.T) {
+	t.Run("test_failed_generate_sbom", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine ClassicStateMachine
+		stateMachine.parent = &stateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.commonFlags.SBOM = []string{"spdx"}
+		stateMachine.Opts.Suite = "jammy"
+
+		err := stateMachine.makeTemporaryDirectories()
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+
+		// the rootfs has no dpkg database
+		err = stateMachine.generateSBOM()
+		asserter.AssertErrContains(err, "Error opening dpkg status")
+		stateMachine.tempDirs.rootfs = filepath.Join("testdata", "dpkg_rootfs")
+
+		// mock ioutil.WriteFile
+		ioutilWriteFile = mockWriteFile
+		defer func() {
+			ioutilWriteFile = ioutil.WriteFile
+		}()
+		err = stateMachine.generateSBOM()
+		asserter.AssertErrContains(err, "Error writing SBOM")
+		ioutilWriteFile = ioutil.WriteFile
+
+		// snap images need a seed with a single system
+		var snapStateMachine SnapStateMachine
+		snapStateMachine.parent = &snapStateMachine
+		snapStateMachine.commonFlags, snapStateMachine.stateMachineFlags = helper.InitCommonOpts()
+		snapStateMachine.commonFlags.SBOM = []string{"cyclonedx"}
+		snapStateMachine.stateMachineFlags.WorkDir = stateMachine.stateMachineFlags.WorkDir
+		snapStateMachine.tempDirs = stateMachine.tempDirs
+		snapStateMachine.tempDirs.rootfs = filepath.Join(stateMachine.stateMachineFlags.WorkDir, "root")
+		for _, label := range []string{"20220101", "20220202"} {
+			err = os.MkdirAll(filepath.Join(snapStateMachine.tempDirs.rootfs,
+				"system-data", "var", "lib", "snapd", "seed", "systems", label), 0755)
+			asserter.AssertErrNil(err, true)
+		}
+		err = snapStateMachine.generateSBOM()
+		asserter.AssertErrContains(err, "expected a single system")
+	})
+}
@@ -0,0 +1,257 @@
+package statemachine
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/snapcore/snapd/asserts"
+	"gopkg.in/yaml.v2"
+)
+
+// seedSnap describes a snap found in the seed of an image
+type seedSnap struct {
+	Name      string `json:"name"`
+	Revision  string `json:"revision"`
+	Channel   string `json:"channel,omitempty"`
+	SnapID    string `json:"snap-id,omitempty"`
+	Publisher string `json:"publisher,omitempty"`
+	Type      string `json:"type"`
+	File      string `json:"file"`
+}
+
+// seedYaml is the subset of the seed.yaml of UC16/18 seeds and the options.yaml of
+// UC20 seeds that is needed to describe the seeded snaps
+type seedYaml struct {
+	Snaps []struct {
+		Name       string `yaml:"name"`
+		Channel    string `yaml:"channel"`
+		File       string `yaml:"file"`
+		Unasserted string `yaml:"unasserted"`
+	} `yaml:"snaps"`
+}
+
+// seedAssertions indexes the assertions of a seed that describe its snaps
+type seedAssertions struct {
+	model        *asserts.Model
+	revisions    map[string]*asserts.SnapRevision
+	declarations map[string]*asserts.SnapDeclaration
+	accounts     map[string]*asserts.Account
+}
+
+// seedInfo holds the metadata of a seed that is needed to describe its snaps
+type seedInfo struct {
+	assertions *seedAssertions
+	channels   map[string]string
+	snapFiles  []string
+}
+
+// imageSeedDir returns the seed directory of the rootfs of a snap image. UC20 images are
+// seeded, and their rootfs is the seed partition
+func (stateMachine *StateMachine) imageSeedDir() string {
+	if stateMachine.IsSeeded {
+		return stateMachine.tempDirs.rootfs
+	}
+	return filepath.Join(stateMachine.tempDirs.rootfs, "system-data", "var", "lib", "snapd", "seed")
+}
+
+// readSeed returns the snaps of a UC16/18 seed, described by seed.yaml, or of the only
+// system of a UC20 seed
+func readSeed(seedDir string) ([]seedSnap, error) {
+	info, err := readSeedInfo(seedDir)
+	if err != nil {
+		return nil, err
+	}
+	return info.describeSnaps(info.snapFiles)
+}
+
+// readSeedInfo reads the snap files, channels and assertions of a UC16/18 seed or of the
+// only system of a UC20 seed. The snap files of seeds without seed.yaml or systems are
+// listed from the snaps directory, without any metadata
+func readSeedInfo(seedDir string) (*seedInfo, error) {
+	var assertionFiles []string
+	info := &seedInfo{channels: make(map[string]string)}
+
+	seedYamlPath := filepath.Join(seedDir, "seed.yaml")
+	labels, _ := filepath.Glob(filepath.Join(seedDir, "systems", "*"))
+	optionsPath := ""
+	if _, err := os.Stat(seedYamlPath); err == nil {
+		// UC16/18 seed
+		seedYamlBytes, err := ioutilReadFile(seedYamlPath)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading seed.yaml: %s", err.Error())
+		}
+		var seedInfo seedYaml
+		if err := yaml.Unmarshal(seedYamlBytes, &seedInfo); err != nil {
+			return nil, fmt.Errorf("Error parsing seed.yaml: %s", err.Error())
+		}
+		for _, seededSnap := range seedInfo.Snaps {
+			info.snapFiles = append(info.snapFiles, filepath.Join(seedDir, "snaps", seededSnap.File))
+			info.channels[seededSnap.Name] = seededSnap.Channel
+		}
+		assertionFiles, _ = filepath.Glob(filepath.Join(seedDir, "assertions", "*"))
+	} else if len(labels) > 0 {
+		// UC20 seed, the asserted snaps are shared by all systems
+		if len(labels) != 1 {
+			return nil, fmt.Errorf("Error reading seed: expected a single system in %s, found %d",
+				seedDir, len(labels))
+		}
+		systemDir := labels[0]
+		assertionFiles, _ = filepath.Glob(filepath.Join(systemDir, "assertions", "*"))
+		assertionFiles = append(assertionFiles, filepath.Join(systemDir, "model"))
+		info.snapFiles = listSnapFiles(filepath.Join(seedDir, "snaps"))
+		info.snapFiles = append(info.snapFiles, listSnapFiles(filepath.Join(systemDir, "snaps"))...)
+		optionsPath = filepath.Join(systemDir, "options.yaml")
+	} else {
+		info.snapFiles = listSnapFiles(filepath.Join(seedDir, "snaps"))
+	}
+
+	var err error
+	info.assertions, err = readSeedAssertions(assertionFiles)
+	if err != nil {
+		return nil, err
+	}
+	if info.assertions.model != nil {
+		for _, modelSnap := range modelSnaps(info.assertions.model) {
+			if _, found := info.channels[modelSnap.Name]; !found {
+				info.channels[modelSnap.Name] = modelSnap.DefaultChannel
+			}
+		}
+	}
+	if optionsPath != "" {
+		if optionsBytes, err := ioutilReadFile(optionsPath); err == nil {
+			var options seedYaml
+			if err := yaml.Unmarshal(optionsBytes, &options); err != nil {
+				return nil, fmt.Errorf("Error parsing options.yaml: %s", err.Error())
+			}
+			for _, optionsSnap := range options.Snaps {
+				if optionsSnap.Channel != "" {
+					info.channels[optionsSnap.Name] = optionsSnap.Channel
+				}
+			}
+		}
+	}
+	return info, nil
+}
+
+// describeSnaps describes snap files using the metadata of the seed, sorted by name. The
+// revision, snap id and publisher of asserted snaps come from their snap-revision and
+// snap-declaration assertions. Unasserted snaps get the revision in their file name,
+// which is a local "x" revision
+func (info *seedInfo) describeSnaps(snapFiles []string) ([]seedSnap, error) {
+	snaps := []seedSnap{}
+	for _, snapFile := range snapFiles {
+		seeded := seedSnap{File: filepath.Base(snapFile)}
+		digest, _, err := asserts.SnapFileSHA3_384(snapFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading seed: %s", err.Error())
+		}
+		if revision, found := info.assertions.revisions[digest]; found {
+			seeded.Revision = strconv.Itoa(revision.SnapRevision())
+			seeded.SnapID = revision.SnapID()
+			if declaration, found := info.assertions.declarations[revision.SnapID()]; found {
+				seeded.Name = declaration.SnapName()
+				seeded.Publisher = declaration.PublisherID()
+				if account, found := info.assertions.accounts[declaration.PublisherID()]; found {
+					seeded.Publisher = account.Username()
+				}
+			}
+		}
+		if seeded.Name == "" || seeded.Revision == "" {
+			// snaps are named <name>_<revision>.snap, and snap names can't contain "_"
+			nameRevision := strings.SplitN(strings.TrimSuffix(seeded.File, ".snap"), "_", 2)
+			if seeded.Name == "" {
+				seeded.Name = nameRevision[0]
+			}
+			if seeded.Revision == "" && len(nameRevision) == 2 {
+				seeded.Revision = nameRevision[1]
+			}
+		}
+		seeded.Channel = info.channels[seeded.Name]
+		seeded.Type = seedSnapType(seeded.Name, info.assertions.model)
+		snaps = append(snaps, seeded)
+	}
+	sort.SliceStable(snaps, func(i, j int) bool { return snaps[i].Name < snaps[j].Name })
+	return snaps, nil
+}
+
+// listSnapFiles returns the paths of the .snap files in dir, or nothing if dir can't be read
+func listSnapFiles(dir string) []string {
+	var snapFiles []string
+	files, err := ioutilReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), ".snap") {
+			snapFiles = append(snapFiles, filepath.Join(dir, file.Name()))
+		}
+	}
+	return snapFiles
+}
+
+// readSeedAssertions decodes the assertion streams in assertionFiles
+func readSeedAssertions(assertionFiles []string) (*seedAssertions, error) {
+	assertions := &seedAssertions{
+		revisions:    make(map[string]*asserts.SnapRevision),
+		declarations: make(map[string]*asserts.SnapDeclaration),
+		accounts:     make(map[string]*asserts.Account),
+	}
+	for _, assertionFile := range assertionFiles {
+		assertionBytes, err := ioutilReadFile(assertionFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading assertions: %s", err.Error())
+		}
+		decoder := asserts.NewDecoder(bytes.NewReader(assertionBytes))
+		for {
+			assertion, err := decoder.Decode()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("Error decoding assertions in %s: %s",
+					filepath.Base(assertionFile), err.Error())
+			}
+			switch typedAssertion := assertion.(type) {
+			case *asserts.Model:
+				assertions.model = typedAssertion
+			case *asserts.SnapRevision:
+				assertions.revisions[typedAssertion.SnapSHA3_384()] = typedAssertion
+			case *asserts.SnapDeclaration:
+				assertions.declarations[typedAssertion.SnapID()] = typedAssertion
+			case *asserts.Account:
+				assertions.accounts[typedAssertion.AccountID()] = typedAssertion
+			}
+		}
+	}
+	return assertions, nil
+}
+
+// seedSnapType returns the type of a snap as given by the model, or "app" for snaps
+// that the model doesn't describe
+func seedSnapType(snapName string, model *asserts.Model) string {
+	switch snapName {
+	case "snapd":
+		return "snapd"
+	case "core":
+		return "os"
+	}
+	if model != nil {
+		for _, modelSnap := range modelSnaps(model) {
+			if modelSnap.Name == snapName && modelSnap.SnapType != "" {
+				return modelSnap.SnapType
+			}
+		}
+	}
+	return "app"
+}
+
+// modelSnaps returns the essential and non-essential snaps listed in a model
+func modelSnaps(model *asserts.Model) []*asserts.ModelSnap {
+	return append(model.EssentialSnaps(), model.SnapsWithoutEssential()...)
+}
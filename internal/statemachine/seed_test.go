@@ -0,0 +1,199 @@
+// This file contains unit tests for reading the seed of snap images
+package statemachine
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+	"github.com/snapcore/snapd/asserts"
+	"github.com/snapcore/snapd/asserts/assertstest"
+)
+
+// testSeedSnap is a snap written to the seeds created by writeTestSeed
+type testSeedSnap struct {
+	name     string
+	snapID   string
+	revision int
+}
+
+var testSeedSnaps = []testSeedSnap{
+	{"pc", "UqFziVZDHLSyO3TqSWgNBoAdHbLI4dAH", 130},
+	{"core20", "DLqre5XGLbDqg9jPtiAhRRjDuPVa5X1q", 1234},
+}
+
+// writeTestSeed creates a UC18 or UC20 seed with the snaps in testSeedSnaps, signed by a
+// test store, and an unasserted "hello" snap
+func writeTestSeed(t *testing.T, seedDir string, uc20 bool) {
+	asserter := helper.Asserter{T: t}
+	storeStack := assertstest.NewStoreStack("canonical", nil)
+	timestamp := time.Now().Format(time.RFC3339)
+
+	var assertionsDir, modelPath, localSnapsDir string
+	if uc20 {
+		systemDir := filepath.Join(seedDir, "systems", "20221018")
+		assertionsDir = filepath.Join(systemDir, "assertions")
+		modelPath = filepath.Join(systemDir, "model")
+		localSnapsDir = filepath.Join(systemDir, "snaps")
+		options := "snaps:\n  - name: hello\n    unasserted: hello_x1.snap\n    channel: edge\n"
+		err := os.MkdirAll(systemDir, 0755)
+		asserter.AssertErrNil(err, true)
+		err = ioutil.WriteFile(filepath.Join(systemDir, "options.yaml"), []byte(options), 0644)
+		asserter.AssertErrNil(err, true)
+	} else {
+		assertionsDir = filepath.Join(seedDir, "assertions")
+		modelPath = filepath.Join(assertionsDir, "model")
+		localSnapsDir = filepath.Join(seedDir, "snaps")
+		seedYaml := "snaps:\n" +
+			"  - name: pc\n    channel: 18/stable\n    file: pc_130.snap\n" +
+			"  - name: core20\n    channel: latest/beta\n    file: core20_1234.snap\n" +
+			"  - name: hello\n    unasserted: true\n    file: hello_x1.snap\n"
+		err := os.MkdirAll(seedDir, 0755)
+		asserter.AssertErrNil(err, true)
+		err = ioutil.WriteFile(filepath.Join(seedDir, "seed.yaml"), []byte(seedYaml), 0644)
+		asserter.AssertErrNil(err, true)
+	}
+	for _, dir := range []string{assertionsDir, localSnapsDir, filepath.Join(seedDir, "snaps")} {
+		err := os.MkdirAll(dir, 0755)
+		asserter.AssertErrNil(err, true)
+	}
+	modelBytes, err := ioutil.ReadFile(filepath.Join("testdata", "modelAssertion20"))
+	asserter.AssertErrNil(err, true)
+	err = ioutil.WriteFile(modelPath, modelBytes, 0644)
+	asserter.AssertErrNil(err, true)
+
+	var snapAssertions bytes.Buffer
+	encoder := asserts.NewEncoder(&snapAssertions)
+	err = encoder.Encode(storeStack.TrustedAccount)
+	asserter.AssertErrNil(err, true)
+	for _, seeded := range testSeedSnaps {
+		snapPath := filepath.Join(seedDir, "snaps", seeded.name+"_"+strconv.Itoa(seeded.revision)+".snap")
+		err := ioutil.WriteFile(snapPath, []byte(seeded.name), 0644)
+		asserter.AssertErrNil(err, true)
+		digest, size, err := asserts.SnapFileSHA3_384(snapPath)
+		asserter.AssertErrNil(err, true)
+
+		declaration, err := storeStack.Sign(asserts.SnapDeclarationType, map[string]interface{}{
+			"series":       "16",
+			"snap-id":      seeded.snapID,
+			"snap-name":    seeded.name,
+			"publisher-id": "canonical",
+			"timestamp":    timestamp,
+		}, nil, "")
+		asserter.AssertErrNil(err, true)
+		revision, err := storeStack.Sign(asserts.SnapRevisionType, map[string]interface{}{
+			"snap-sha3-384": digest,
+			"snap-id":       seeded.snapID,
+			"snap-size":     strconv.FormatUint(size, 10),
+			"snap-revision": strconv.Itoa(seeded.revision),
+			"developer-id":  "canonical",
+			"timestamp":     timestamp,
+		}, nil, "")
+		asserter.AssertErrNil(err, true)
+		err = encoder.Encode(declaration)
+		asserter.AssertErrNil(err, true)
+		err = encoder.Encode(revision)
+		asserter.AssertErrNil(err, true)
+	}
+	err = ioutil.WriteFile(filepath.Join(assertionsDir, "snaps"), snapAssertions.Bytes(), 0644)
+	asserter.AssertErrNil(err, true)
+	err = ioutil.WriteFile(filepath.Join(localSnapsDir, "hello_x1.snap"), []byte("hello"), 0644)
+	asserter.AssertErrNil(err, true)
+}
+
+// TestReadSeed ensures that the snaps of UC18 and UC20 seeds are described using the
+// seed metadata and the assertions
+func TestReadSeed(t *testing.T) {
+	testCases := []struct {
+		name     string
+		uc20     bool
+		expected []seedSnap
+	}{
+		{"uc18", false, []seedSnap{
+			{"core20", "1234", "latest/beta", "DLqre5XGLbDqg9jPtiAhRRjDuPVa5X1q", "canonical", "base", "core20_1234.snap"},
+			{"hello", "x1", "", "", "", "app", "hello_x1.snap"},
+			{"pc", "130", "18/stable", "UqFziVZDHLSyO3TqSWgNBoAdHbLI4dAH", "canonical", "gadget", "pc_130.snap"},
+		}},
+		{"uc20", true, []seedSnap{
+			{"core20", "1234", "latest/stable", "DLqre5XGLbDqg9jPtiAhRRjDuPVa5X1q", "canonical", "base", "core20_1234.snap"},
+			{"hello", "x1", "edge", "", "", "app", "hello_x1.snap"},
+			{"pc", "130", "20/stable", "UqFziVZDHLSyO3TqSWgNBoAdHbLI4dAH", "canonical", "gadget", "pc_130.snap"},
+		}},
+	}
+	for _, tc := range testCases {
+		t.Run("test_read_seed_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			seedDir, err := ioutil.TempDir("/tmp", "ubuntu-image-")
+			asserter.AssertErrNil(err, true)
+			defer os.RemoveAll(seedDir)
+			writeTestSeed(t, seedDir, tc.uc20)
+
+			snaps, err := readSeed(seedDir)
+			asserter.AssertErrNil(err, true)
+			if len(snaps) != len(tc.expected) {
+				t.Fatalf("Expected snaps %v, got %v", tc.expected, snaps)
+			}
+			for ii, seeded := range snaps {
+				if seeded != tc.expected[ii] {
+					t.Errorf("Expected snap %v, got %v", tc.expected[ii], seeded)
+				}
+			}
+		})
+	}
+}
+
+// TestFailedReadSeed tests failures when reading a seed
+func TestFailedReadSeed(t *testing.T) {
+	t.Run("test_failed_read_seed", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		seedDir, err := ioutil.TempDir("/tmp", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(seedDir)
+
+		// several systems
+		for _, label := range []string{"20220101", "20220202"} {
+			err = os.MkdirAll(filepath.Join(seedDir, "systems", label), 0755)
+			asserter.AssertErrNil(err, true)
+		}
+		_, err = readSeed(seedDir)
+		asserter.AssertErrContains(err, "expected a single system")
+		err = os.RemoveAll(filepath.Join(seedDir, "systems"))
+		asserter.AssertErrNil(err, true)
+
+		writeTestSeed(t, seedDir, false)
+
+		// mock ioutil.ReadFile
+		ioutilReadFile = mockReadFile
+		defer func() {
+			ioutilReadFile = ioutil.ReadFile
+		}()
+		_, err = readSeed(seedDir)
+		asserter.AssertErrContains(err, "Error reading seed.yaml")
+		ioutilReadFile = ioutil.ReadFile
+
+		// invalid assertions
+		err = ioutil.WriteFile(filepath.Join(seedDir, "assertions", "snaps"), []byte("type: foo\n\n"), 0644)
+		asserter.AssertErrNil(err, true)
+		_, err = readSeed(seedDir)
+		asserter.AssertErrContains(err, "Error decoding assertions in snaps")
+
+		// missing snap files
+		err = os.Remove(filepath.Join(seedDir, "assertions", "snaps"))
+		asserter.AssertErrNil(err, true)
+		err = os.Remove(filepath.Join(seedDir, "snaps", "pc_130.snap"))
+		asserter.AssertErrNil(err, true)
+		_, err = readSeed(seedDir)
+		asserter.AssertErrContains(err, "Error reading seed")
+
+		// invalid seed.yaml
+		err = ioutil.WriteFile(filepath.Join(seedDir, "seed.yaml"), []byte("snaps: foo"), 0644)
+		asserter.AssertErrNil(err, true)
+		_, err = readSeed(seedDir)
+		asserter.AssertErrContains(err, "Error parsing seed.yaml")
+	})
+}
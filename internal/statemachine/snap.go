@@ -15,8 +15,13 @@ var snapStates = []stateFunc{
 	{"calculate_rootfs_size", (*StateMachine).calculateRootfsSize},
 	{"populate_bootfs_contents", (*StateMachine).populateBootfsContents},
 	{"populate_prepare_partitions", (*StateMachine).populatePreparePartitions},
+	{"generate_rootfs_artifacts", (*StateMachine).generateRootfsArtifacts},
 	{"make_disk", (*StateMachine).makeDisk},
+	{"verify_image", (*StateMachine).verifyImage},
+	{"package_cloud_image", (*StateMachine).packageCloudImage},
+	{"export_partitions", (*StateMachine).exportPartitions},
 	{"generate_manifest", (*StateMachine).generateSnapManifest},
+	{"generate_sbom", (*StateMachine).generateSBOM},
 	{"finish", (*StateMachine).finish},
 }
 
@@ -84,28 +84,31 @@ func (stateMachine *StateMachine) populateSnapRootfsContents() error {
 	return nil
 }
 
-// Generate the manifest
+// Generate the manifests of the installed and seeded snaps. With --manifest-json, a JSON
+// manifest with the channel, snap-id, publisher and type of each snap is added
 func (stateMachine *StateMachine) generateSnapManifest() error {
-	// We could use snapd's seed.Open() to generate the manifest here, but
-	// actually it doesn't make things much easier than doing it manually -
-	// like we did in the past. So let's just go with this.
+	if err := stateMachine.setupOutputDir(); err != nil {
+		return err
+	}
+
+	// The snaps are described with the metadata and assertions of the seed, as
+	// file names don't always carry the revision of the snap
+	seedDir := stateMachine.imageSeedDir()
+	info, err := readSeedInfo(seedDir)
+	if err != nil {
+		return err
+	}
 
 	// snaps.manifest
-	outputPath := filepath.Join(stateMachine.commonFlags.OutputDir, "snaps.manifest")
 	snapsDir := filepath.Join(stateMachine.tempDirs.rootfs, "system-data", "var", "lib", "snapd", "snaps")
-	err := WriteSnapManifest(snapsDir, outputPath)
+	snapsManifest := stateMachine.outputName("", "snaps.manifest", ".snaps.manifest")
+	err = stateMachine.writeSnapManifest(info, snapsDir, listSnapFiles(snapsDir), snapsManifest)
 	if err != nil {
 		return err
 	}
 
 	// seed.manifest
-	outputPath = filepath.Join(stateMachine.commonFlags.OutputDir, "seed.manifest")
-	if stateMachine.IsSeeded {
-		snapsDir = filepath.Join(stateMachine.tempDirs.rootfs, "snaps")
-	} else {
-		snapsDir = filepath.Join(stateMachine.tempDirs.rootfs, "system-data", "var", "lib", "snapd", "seed", "snaps")
-	}
-	err = WriteSnapManifest(snapsDir, outputPath)
-
-	return err
+	seedSnapsDir := filepath.Join(seedDir, "snaps")
+	seedManifest := stateMachine.outputName("", "seed.manifest", ".seed.manifest")
+	return stateMachine.writeSnapManifest(info, seedSnapsDir, listSnapFiles(seedSnapsDir), seedManifest)
 }
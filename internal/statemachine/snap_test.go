@@ -3,6 +3,7 @@
 package statemachine
 
 import (
+	"encoding/json"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -10,6 +11,7 @@ import (
 	"testing"
 
 	"github.com/canonical/ubuntu-image/internal/helper"
+	"github.com/snapcore/snapd/osutil"
 )
 
 // TestFailedValidateInputSnap tests a failure in the Setup() function when validating common input
@@ -274,7 +276,7 @@ func TestGenerateSnapManifest(t *testing.T) {
 				}
 			}
 			for manifest, snapList := range testResultMap {
-				manifestPath := filepath.Join(stateMachine.commonFlags.OutputDir, manifest)
+				manifestPath := filepath.Join(stateMachine.tempDirs.staging, manifest)
 				manifestBytes, err := ioutil.ReadFile(manifestPath)
 				asserter.AssertErrNil(err, false)
 				// The order of snaps shouldn't matter
@@ -288,6 +290,114 @@ func TestGenerateSnapManifest(t *testing.T) {
 	}
 }
 
+// TestGenerateSnapManifestFromSeed ensures that the snap manifests describe the snaps with
+// the revisions given by their assertions, and that JSON manifests are only written with
+// --manifest-json
+func TestGenerateSnapManifestFromSeed(t *testing.T) {
+	testCases := []struct {
+		name         string
+		manifestJSON bool
+		artifacts    int
+	}{
+		{"default", false, 2},
+		{"manifest_json", true, 4},
+	}
+	for _, tc := range testCases {
+		t.Run("test_generate_snap_manifest_from_seed_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			workDir, err := ioutil.TempDir("/tmp", "ubuntu-image-")
+			asserter.AssertErrNil(err, true)
+			defer os.RemoveAll(workDir)
+
+			var stateMachine SnapStateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.stateMachineFlags.WorkDir = workDir
+			stateMachine.commonFlags.ManifestJSON = tc.manifestJSON
+			stateMachine.tempDirs.rootfs = filepath.Join(workDir, "rootfs")
+			stateMachine.commonFlags.OutputDir = filepath.Join(workDir, "output")
+
+			snapdDir := filepath.Join(stateMachine.tempDirs.rootfs, "system-data", "var", "lib", "snapd")
+			writeTestSeed(t, filepath.Join(snapdDir, "seed"), false)
+
+			// the installed snaps are the asserted seeded snaps, under a different name
+			err = os.MkdirAll(filepath.Join(snapdDir, "snaps"), 0755)
+			asserter.AssertErrNil(err, true)
+			err = osutil.CopyFile(filepath.Join(snapdDir, "seed", "snaps", "pc_130.snap"),
+				filepath.Join(snapdDir, "snaps", "pc_x1.snap"), 0)
+			asserter.AssertErrNil(err, true)
+
+			err = stateMachine.generateSnapManifest()
+			asserter.AssertErrNil(err, true)
+
+			// the revisions don't keep the ".snap" suffix of the file names
+			testResultMap := map[string]string{
+				"snaps.manifest": "pc 130\n",
+				"seed.manifest":  "core20 1234\nhello x1\npc 130\n",
+			}
+			for manifest, expected := range testResultMap {
+				manifestBytes, err := ioutil.ReadFile(filepath.Join(stateMachine.tempDirs.staging, manifest))
+				asserter.AssertErrNil(err, true)
+				if string(manifestBytes) != expected {
+					t.Errorf("Expected %s to be %q, got %q", manifest, expected, string(manifestBytes))
+				}
+			}
+			if len(stateMachine.Artifacts) != tc.artifacts {
+				t.Errorf("Expected %d manifest artifacts, got %v", tc.artifacts, stateMachine.Artifacts)
+			}
+
+			manifestJSONPath := filepath.Join(stateMachine.tempDirs.staging, "seed.manifest.json")
+			if !tc.manifestJSON {
+				if _, err := os.Stat(manifestJSONPath); err == nil {
+					t.Errorf("Expected no JSON manifest without --manifest-json")
+				}
+				return
+			}
+			manifestJSONBytes, err := ioutil.ReadFile(manifestJSONPath)
+			asserter.AssertErrNil(err, true)
+			var manifestJSON map[string][]seedSnap
+			err = json.Unmarshal(manifestJSONBytes, &manifestJSON)
+			asserter.AssertErrNil(err, true)
+			expected := seedSnap{"pc", "130", "18/stable", "UqFziVZDHLSyO3TqSWgNBoAdHbLI4dAH",
+				"canonical", "gadget", "pc_130.snap"}
+			if len(manifestJSON["snaps"]) != 3 || manifestJSON["snaps"][2] != expected {
+				t.Errorf("Expected the seed JSON manifest to describe %v, got %v", expected, manifestJSON["snaps"])
+			}
+		})
+	}
+}
+
+// TestGenerateSnapManifestUC20 ensures that the seed.manifest of a UC20 seed only lists the
+// snaps of its snaps directory
+func TestGenerateSnapManifestUC20(t *testing.T) {
+	t.Run("test_generate_snap_manifest_uc20", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		workDir, err := ioutil.TempDir("/tmp", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(workDir)
+
+		var stateMachine SnapStateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.stateMachineFlags.WorkDir = workDir
+		stateMachine.IsSeeded = true
+		stateMachine.tempDirs.rootfs = filepath.Join(workDir, "rootfs")
+		stateMachine.commonFlags.OutputDir = filepath.Join(workDir, "output")
+		writeTestSeed(t, stateMachine.tempDirs.rootfs, true)
+
+		err = stateMachine.generateSnapManifest()
+		asserter.AssertErrNil(err, true)
+
+		manifestBytes, err := ioutil.ReadFile(filepath.Join(stateMachine.tempDirs.staging, "seed.manifest"))
+		asserter.AssertErrNil(err, true)
+		if strings.Contains(string(manifestBytes), "hello") {
+			t.Errorf("Expected seed.manifest to only list the snaps directory, got %q",
+				string(manifestBytes))
+		}
+		if len(stateMachine.Artifacts) != 1 || stateMachine.Artifacts[0].Name != "seed.manifest" {
+			t.Errorf("Expected seed.manifest to be the only artifact, got %v", stateMachine.Artifacts)
+		}
+	})
+}
+
 // TestFailedPopulateSnapRootfsContents tests a failure in the PopulateRootfsContents state
 // while building a snap image. This is achieved by mocking functions
 func TestFailedPopulateSnapRootfsContents(t *testing.T) {
@@ -356,14 +466,18 @@ func TestFailedGenerateSnapManifest(t *testing.T) {
 			osCreate = os.Create
 		}()
 
+		workDir, err := ioutil.TempDir("/tmp", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(workDir)
+
 		var stateMachine SnapStateMachine
 		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
-		stateMachine.stateMachineFlags.WorkDir = "/dummy/path"
+		stateMachine.stateMachineFlags.WorkDir = workDir
 		stateMachine.tempDirs.rootfs = "/dummy/path"
 		stateMachine.IsSeeded = false
 		stateMachine.commonFlags.OutputDir = "/dummy/path"
 
-		err := stateMachine.generateSnapManifest()
+		err = stateMachine.generateSnapManifest()
 		asserter.AssertErrContains(err, "Error creating manifest file")
 	})
 }
@@ -9,6 +9,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
@@ -16,10 +17,12 @@ import (
 	"github.com/canonical/ubuntu-image/internal/commands"
 	"github.com/canonical/ubuntu-image/internal/helper"
 	diskfs "github.com/diskfs/go-diskfs"
+	"github.com/google/uuid"
 	"github.com/snapcore/snapd/gadget"
 	"github.com/snapcore/snapd/gadget/quantity"
 	"github.com/snapcore/snapd/osutil"
 	"github.com/snapcore/snapd/osutil/mkfs"
+	"gopkg.in/yaml.v2"
 )
 
 // define some functions that can be mocked by test cases
@@ -41,9 +44,24 @@ var osutilCopySpecialFile = osutil.CopySpecialFile
 var execCommand = exec.Command
 var mkfsMakeWithContent = mkfs.MakeWithContent
 var diskfsCreate = diskfs.Create
+var diskfsOpen = diskfs.Open
+var diskfsOpenWithMode = diskfs.OpenWithMode
+var osStat = os.Stat
 
 var mockableBlockSize string = "1" //used for mocking dd calls
 
+// imageNamePlaceholders are the placeholders that can be used in --image-name
+var imageNamePlaceholders = []string{"volume", "model", "arch", "series", "date", "build-id"}
+var imageNamePlaceholder = regexp.MustCompile(`{([^{}]*)}`)
+
+// used to check whether --output-device is safe to write to
+var procMountsPath = "/proc/mounts"
+var procSwapsPath = "/proc/swaps"
+var sysClassBlockPath = "/sys/class/block"
+
+// grubI386PCDir holds the grub modules used to build El Torito boot images
+var grubI386PCDir = "/usr/lib/grub/i386-pc"
+
 // SmInterface allows different image types to implement their own setup/run/teardown functions
 type SmInterface interface {
 	Setup() error
@@ -62,6 +80,83 @@ type temporaryDirectories struct {
 	rootfs  string
 	unpack  string
 	volumes string
+	staging string
+}
+
+// artifactFormats maps the types of the artifacts to the format of their files
+var artifactFormats = map[string]string{
+	"disk-image":         "raw",
+	"rootfs-tarball":     "tar.gz",
+	"rootfs-squashfs":    "squashfs",
+	"live-iso":           "iso9660",
+	"gce-tarball":        "tar.gz",
+	"azure-vhd":          "vhd",
+	"partition-image":    "raw",
+	"partition-manifest": "json",
+	"partition-ids":      "json",
+	"manifest":           "text",
+	"manifest-json":      "json",
+	"checksums":          "text",
+	"pgp-signature":      "pgp",
+	"pkcs7-signature":    "pkcs7",
+	"provenance":         "json",
+	"spdx-sbom":          "json",
+	"cyclonedx-sbom":     "json",
+}
+
+// listedArtifact is an entry of the artifact list written with --image-file-list-json
+type listedArtifact struct {
+	Path   string `json:"path"`
+	Type   string `json:"type"`
+	Volume string `json:"volume,omitempty"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+	Format string `json:"format"`
+}
+
+// outputArtifact describes a file created by the build in the output directory
+type outputArtifact struct {
+	Name   string // the file name, relative to the output directory
+	Volume string // the gadget volume the artifact was created from, if any
+	Type   string // the kind of artifact, e.g. "disk-image" or "rootfs-tarball"
+}
+
+// exportedPartition describes a single partition image copied to the output directory
+type exportedPartition struct {
+	Image      string `json:"image"`
+	Name       string `json:"name,omitempty"`
+	Role       string `json:"role,omitempty"`
+	Offset     uint64 `json:"offset"`
+	Size       uint64 `json:"size"`
+	MBRType    string `json:"mbr-type,omitempty"`
+	GPTType    string `json:"gpt-type,omitempty"`
+	Filesystem string `json:"filesystem,omitempty"`
+	Label      string `json:"label,omitempty"`
+	SHA256     string `json:"sha256"`
+}
+
+// partitionIDs describes the identifiers of a partition that other tooling can reference
+type partitionIDs struct {
+	Number   int    `json:"number"`
+	Name     string `json:"name,omitempty"`
+	Role     string `json:"role,omitempty"`
+	PartUUID string `json:"partuuid"`
+}
+
+// volumeIDs is written alongside the disk image of a volume, with the identifiers of
+// the disk and of its partitions
+type volumeIDs struct {
+	Volume     string         `json:"volume"`
+	Schema     string         `json:"schema"`
+	DiskID     string         `json:"disk-id"`
+	Partitions []partitionIDs `json:"partitions"`
+}
+
+// exportedVolume is the manifest written alongside the exported partitions of a volume
+type exportedVolume struct {
+	Volume     string              `json:"volume"`
+	Schema     string              `json:"schema,omitempty"`
+	Partitions []exportedPartition `json:"partitions"`
 }
 
 // StateMachine will hold the command line data, track the current state, and handle all function calls
@@ -89,6 +184,27 @@ type StateMachine struct {
 	// image sizes for parsing the --image-size flags
 	ImageSizes  map[string]quantity.Size
 	VolumeOrder []string
+
+	// the disk identifiers of the volumes, from gadget.yaml or --disk-guid
+	DiskIDs map[string]string
+
+	// the logical sector sizes of the volumes, from gadget.yaml or --sector-size
+	SectorSizes map[string]quantity.Size
+
+	// the GPT attributes of the partitions, by volume and structure index, from
+	// gadget.yaml or --gpt-attributes
+	PartitionAttributes map[string]map[int]uint64
+
+	// the files that have been created in the output directory
+	Artifacts []outputArtifact
+
+	// used to expand the --image-name placeholders
+	BuildDate string
+	BuildID   string
+
+	// the seed of the identifiers of --reproducible builds
+	SourceDateEpoch  int64
+	ReproducibleSeed string
 }
 
 // SetCommonOpts stores the common options for all image types in the struct
@@ -155,14 +271,448 @@ func (stateMachine *StateMachine) parseImageSizes() error {
 	return nil
 }
 
-// saveVolumeOrder records the order that the volumes appear in gadget.yaml. This is necessary
-// to preserve backwards compatibility of the command line syntax --image-size <volume_number>:<size>
-func (stateMachine *StateMachine) saveVolumeOrder(gadgetYamlContents string) {
-	// don't bother doing this if --image-size was not used
-	if stateMachine.commonFlags.Size == "" {
-		return
+// defaultSectorSize is the logical sector size of disk images whose volume has no
+// sector-size in gadget.yaml, when --sector-size isn't given
+const defaultSectorSize = 512
+
+// checkSectorSize checks that a logical sector size is supported
+func checkSectorSize(sectorSize quantity.Size) error {
+	if sectorSize != 512 && sectorSize != 4096 {
+		return fmt.Errorf("the sector size must be 512 or 4096 bytes, not %d", sectorSize)
+	}
+	return nil
+}
+
+// gadgetSectorSizes returns the sector-size of the volumes of a gadget.yaml that have
+// one. snapd doesn't read this property, so it is parsed separately
+func gadgetSectorSizes(gadgetYamlBytes []byte) (map[string]quantity.Size, error) {
+	var gadgetYaml struct {
+		Volumes map[string]struct {
+			SectorSize quantity.Size `yaml:"sector-size"`
+		} `yaml:"volumes"`
+	}
+	if err := yaml.Unmarshal(gadgetYamlBytes, &gadgetYaml); err != nil {
+		return nil, fmt.Errorf("Error reading the sector sizes of gadget.yaml: %s", err.Error())
+	}
+	sectorSizes := make(map[string]quantity.Size)
+	for volumeName, volume := range gadgetYaml.Volumes {
+		if volume.SectorSize == 0 {
+			continue
+		}
+		if err := checkSectorSize(volume.SectorSize); err != nil {
+			return nil, fmt.Errorf("Invalid sector-size of volume %s: %s", volumeName, err.Error())
+		}
+		sectorSizes[volumeName] = volume.SectorSize
+	}
+	return sectorSizes, nil
+}
+
+// parseSectorSizes stores the logical sector sizes of the volumes: the sector-size of
+// the volume in gadget.yaml, overridden by --sector-size. Volumes without either use
+// defaultSectorSize, or the sector size of the --output-device
+func (stateMachine *StateMachine) parseSectorSizes(gadgetYamlBytes []byte) error {
+	sectorSizes, err := gadgetSectorSizes(gadgetYamlBytes)
+	if err != nil {
+		return err
+	}
+	if stateMachine.commonFlags.SectorSize != "" {
+		sectorSize, err := quantity.ParseSize(stateMachine.commonFlags.SectorSize)
+		if err == nil {
+			err = checkSectorSize(sectorSize)
+		}
+		if err != nil {
+			return fmt.Errorf("Invalid --sector-size %s: %s", stateMachine.commonFlags.SectorSize,
+				err.Error())
+		}
+		for volumeName := range stateMachine.GadgetInfo.Volumes {
+			sectorSizes[volumeName] = sectorSize
+		}
+	}
+	stateMachine.SectorSizes = sectorSizes
+	return nil
+}
+
+// sectorSize returns the logical sector size of the disk image of a volume
+func (stateMachine *StateMachine) sectorSize(volumeName string) quantity.Size {
+	if sectorSize, found := stateMachine.SectorSizes[volumeName]; found {
+		return sectorSize
+	}
+	return defaultSectorSize
+}
+
+// checkSectorAlignment reports the partitions of a volume whose offset is not a
+// multiple of the sector size, as partition tables give their start in sectors
+func checkSectorAlignment(volume *gadget.Volume, sectorSize quantity.Size,
+	report func(structureNumber int, format string, args ...interface{})) {
+	for _, structureNumber := range partitionStructures(volume, false) {
+		offset := getStructureOffset(volume.Structure[structureNumber])
+		if offset%quantity.Offset(sectorSize) != 0 {
+			report(structureNumber, "offset %d is not a multiple of the %d-byte sectors of the "+
+				"volume", offset, sectorSize)
+		}
+	}
+}
+
+// sectorAlignmentError returns the first partition of a volume that isn't aligned to
+// its sectors as an error
+func sectorAlignmentError(volumeName string, volume *gadget.Volume, sectorSize quantity.Size) error {
+	var err error
+	checkSectorAlignment(volume, sectorSize,
+		func(structureNumber int, format string, args ...interface{}) {
+			if err == nil {
+				err = fmt.Errorf("Error aligning the partitions of volume %s: structure #%d (%q): %s",
+					volumeName, structureNumber, volume.Structure[structureNumber].Name,
+					fmt.Sprintf(format, args...))
+			}
+		})
+	return err
+}
+
+// gptAttributeBits are the names of the single bits of the GPT partition attributes
+var gptAttributeBits = map[string]uint{
+	"required":             0,
+	"no-block-io":          1,
+	"legacy-bios-bootable": 2,
+	"successful":           56,
+}
+
+// gptAttributeFields are the names of the 4-bit fields of the GPT partition
+// attributes that A/B boot firmware uses to pick the partition to boot
+var gptAttributeFields = map[string]uint{
+	"priority": 48,
+	"tries":    52,
+}
+
+// parseGPTAttributes returns the GPT partition attributes described by names of bits,
+// <field>=<value> for priority and tries, and numbers of bits from 0 to 63. Empty
+// attributes are ignored
+func parseGPTAttributes(attributes []string) (uint64, error) {
+	var value uint64
+	for _, attribute := range attributes {
+		attribute = strings.TrimSpace(attribute)
+		if attribute == "" {
+			continue
+		}
+		if bit, found := gptAttributeBits[attribute]; found {
+			value |= 1 << bit
+			continue
+		}
+		splitAttribute := strings.SplitN(attribute, "=", 2)
+		if shift, found := gptAttributeFields[splitAttribute[0]]; found && len(splitAttribute) == 2 {
+			fieldValue, err := strconv.ParseUint(splitAttribute[1], 10, 4)
+			if err != nil {
+				return 0, fmt.Errorf("the value of %s must be between 0 and 15", splitAttribute[0])
+			}
+			value = value&^(0xf<<shift) | fieldValue<<shift
+			continue
+		}
+		bit, err := strconv.ParseUint(attribute, 10, 6)
+		if err != nil {
+			return 0, fmt.Errorf("unknown attribute %q", attribute)
+		}
+		value |= 1 << bit
+	}
+	return value, nil
+}
+
+// formatGPTAttributes returns the GPT partition attributes in the syntax of
+// parseGPTAttributes
+func formatGPTAttributes(value uint64) []string {
+	var attributes []string
+	for bit := uint(0); bit < 64; bit++ {
+		field := ""
+		for name, shift := range gptAttributeFields {
+			if bit == shift {
+				field = name
+			}
+		}
+		if field != "" {
+			if fieldValue := value >> bit & 0xf; fieldValue != 0 {
+				attributes = append(attributes, fmt.Sprintf("%s=%d", field, fieldValue))
+			}
+			bit += 3
+			continue
+		}
+		if value&(1<<bit) == 0 {
+			continue
+		}
+		attribute := strconv.Itoa(int(bit))
+		for name, nameBit := range gptAttributeBits {
+			if bit == nameBit {
+				attribute = name
+			}
+		}
+		attributes = append(attributes, attribute)
+	}
+	return attributes
+}
+
+// gadgetPartitionAttributes returns the GPT attributes of the structures of a
+// gadget.yaml that have some, by volume and structure index. snapd doesn't read this
+// property, so it is parsed separately
+func gadgetPartitionAttributes(gadgetYamlBytes []byte) (map[string]map[int]uint64, error) {
+	var gadgetYaml struct {
+		Volumes map[string]struct {
+			Structure []struct {
+				Attributes []string `yaml:"attributes"`
+			} `yaml:"structure"`
+		} `yaml:"volumes"`
+	}
+	if err := yaml.Unmarshal(gadgetYamlBytes, &gadgetYaml); err != nil {
+		return nil, fmt.Errorf("Error reading the partition attributes of gadget.yaml: %s", err.Error())
+	}
+	partitionAttributes := make(map[string]map[int]uint64)
+	for volumeName, volume := range gadgetYaml.Volumes {
+		for ii, structure := range volume.Structure {
+			if structure.Attributes == nil {
+				continue
+			}
+			attributes, err := parseGPTAttributes(structure.Attributes)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid attributes of structure #%d of volume %s: %s",
+					ii, volumeName, err.Error())
+			}
+			if partitionAttributes[volumeName] == nil {
+				partitionAttributes[volumeName] = make(map[int]uint64)
+			}
+			partitionAttributes[volumeName][ii] = attributes
+		}
+	}
+	return partitionAttributes, nil
+}
+
+// checkPartitionAttributes reports the structures of a volume that have GPT
+// attributes but no GPT partition
+func checkPartitionAttributes(volume *gadget.Volume, attributes map[int]uint64,
+	report func(structureNumber int, format string, args ...interface{})) {
+	partitions := make(map[int]bool)
+	for _, structureNumber := range partitionStructures(volume, false) {
+		partitions[structureNumber] = true
+	}
+	structureNumbers := make([]int, 0, len(attributes))
+	for structureNumber := range attributes {
+		structureNumbers = append(structureNumbers, structureNumber)
+	}
+	sort.Ints(structureNumbers)
+	for _, structureNumber := range structureNumbers {
+		if volume.Schema == "mbr" {
+			report(structureNumber, "attributes are only supported by GPT partition tables")
+		} else if !partitions[structureNumber] {
+			report(structureNumber, "attributes are only supported by structures with a partition")
+		}
+	}
+}
+
+// findStructure returns the index of the structure of a volume given by its name or
+// its index
+func findStructure(volume *gadget.Volume, structure string) (int, bool) {
+	for ii := range volume.Structure {
+		if volume.Structure[ii].Name == structure {
+			return ii, true
+		}
+	}
+	structureNumber, err := strconv.Atoi(structure)
+	if err != nil || structureNumber < 0 || structureNumber >= len(volume.Structure) {
+		return 0, false
+	}
+	return structureNumber, true
+}
+
+// parsePartitionAttributes stores the GPT attributes of the partitions: the
+// attributes of the structures in gadget.yaml, overridden by each
+// [<volume>:]<structure>=<attribute>[,<attribute>...] argument of --gpt-attributes
+func (stateMachine *StateMachine) parsePartitionAttributes(gadgetYamlBytes []byte) error {
+	partitionAttributes, err := gadgetPartitionAttributes(gadgetYamlBytes)
+	if err != nil {
+		return err
+	}
+	for _, argument := range stateMachine.commonFlags.GPTAttributes {
+		splitArgument := strings.SplitN(argument, "=", 2)
+		if len(splitArgument) != 2 {
+			return fmt.Errorf("Argument to --gpt-attributes %s is not in the correct format", argument)
+		}
+		volumeName, structure := "", splitArgument[0]
+		if splitStructure := strings.SplitN(structure, ":", 2); len(splitStructure) == 2 {
+			volumeName, structure = splitStructure[0], splitStructure[1]
+		} else if len(stateMachine.GadgetInfo.Volumes) > 1 {
+			return fmt.Errorf("--gpt-attributes must be given as <volume>:<structure>=<attributes> " +
+				"for gadgets with multiple volumes")
+		} else {
+			for name := range stateMachine.GadgetInfo.Volumes {
+				volumeName = name
+			}
+		}
+		volume, found := stateMachine.GadgetInfo.Volumes[volumeName]
+		if !found {
+			return fmt.Errorf("Volume %s does not exist in gadget.yaml", volumeName)
+		}
+		structureNumber, found := findStructure(volume, structure)
+		if !found {
+			return fmt.Errorf("Structure %s does not exist in volume %s", structure, volumeName)
+		}
+		attributes, err := parseGPTAttributes(strings.Split(splitArgument[1], ","))
+		if err != nil {
+			return fmt.Errorf("Invalid --gpt-attributes %s: %s", argument, err.Error())
+		}
+		if partitionAttributes[volumeName] == nil {
+			partitionAttributes[volumeName] = make(map[int]uint64)
+		}
+		partitionAttributes[volumeName][structureNumber] = attributes
+	}
+
+	for volumeName, attributes := range partitionAttributes {
+		volume := stateMachine.GadgetInfo.Volumes[volumeName]
+		err = nil
+		checkPartitionAttributes(volume, attributes,
+			func(structureNumber int, format string, args ...interface{}) {
+				if err == nil {
+					err = fmt.Errorf("Invalid partition attributes of volume %s: structure #%d (%q): %s",
+						volumeName, structureNumber, volume.Structure[structureNumber].Name,
+						fmt.Sprintf(format, args...))
+				}
+			})
+		if err != nil {
+			return err
+		}
+	}
+	stateMachine.PartitionAttributes = partitionAttributes
+	return nil
+}
+
+// validMBRDiskID matches the 8 hexadecimal digits of an MBR disk identifier
+var validMBRDiskID = regexp.MustCompile(`^[0-9a-f]{8}$`)
+
+// parseDiskIDs stores the disk identifiers of the volumes: the id of the volume in
+// gadget.yaml, overridden by --disk-guid. These are GUIDs for GPT partition tables
+// and 8 hexadecimal digits for MBR partition tables. Invalid ids in gadget.yaml are
+// ignored with a warning, only the ones of --disk-guid are errors. The ids of the
+// structures, used as the GUIDs of GPT partitions, are checked as well
+func (stateMachine *StateMachine) parseDiskIDs() error {
+	stateMachine.DiskIDs = make(map[string]string)
+	// the volumes whose disk id was given with --disk-guid
+	flagIDs := make(map[string]bool)
+	for volumeName, volume := range stateMachine.GadgetInfo.Volumes {
+		if volume.ID != "" {
+			stateMachine.DiskIDs[volumeName] = volume.ID
+		}
+	}
+	if stateMachine.commonFlags.DiskGUID != "" {
+		if !strings.Contains(stateMachine.commonFlags.DiskGUID, ":") {
+			if len(stateMachine.GadgetInfo.Volumes) > 1 {
+				return fmt.Errorf("--disk-guid must be given as <volume>:<GUID> for gadgets " +
+					"with multiple volumes")
+			}
+			for volumeName := range stateMachine.GadgetInfo.Volumes {
+				stateMachine.DiskIDs[volumeName] = stateMachine.commonFlags.DiskGUID
+				flagIDs[volumeName] = true
+			}
+		} else {
+			for _, diskID := range strings.Split(stateMachine.commonFlags.DiskGUID, ",") {
+				splitID := strings.SplitN(diskID, ":", 2)
+				if len(splitID) != 2 {
+					return fmt.Errorf("Argument to --disk-guid %s is not in the correct format", diskID)
+				}
+				if _, found := stateMachine.GadgetInfo.Volumes[splitID[0]]; !found {
+					return fmt.Errorf("Volume %s does not exist in gadget.yaml", splitID[0])
+				}
+				stateMachine.DiskIDs[splitID[0]] = splitID[1]
+				flagIDs[splitID[0]] = true
+			}
+		}
 	}
 
+	for volumeName, volume := range stateMachine.GadgetInfo.Volumes {
+		diskID, found := stateMachine.DiskIDs[volumeName]
+		if volume.Schema == "mbr" {
+			for ii, structure := range volume.Structure {
+				if structure.ID != "" {
+					fmt.Printf("WARNING: volumes:%s:structure:%d:id is ignored, partition "+
+						"GUIDs are only supported by GPT partition tables\n", volumeName, ii)
+				}
+			}
+			if !found {
+				continue
+			}
+			normalizedID := strings.TrimPrefix(strings.ToLower(diskID), "0x")
+			if !validMBRDiskID.MatchString(normalizedID) {
+				if flagIDs[volumeName] {
+					return fmt.Errorf("Invalid disk identifier %q of volume %s: MBR disk "+
+						"identifiers are 8 hexadecimal digits", diskID, volumeName)
+				}
+				fmt.Printf("WARNING: volumes:%s:id %q is ignored, MBR disk identifiers "+
+					"are 8 hexadecimal digits\n", volumeName, diskID)
+				delete(stateMachine.DiskIDs, volumeName)
+				continue
+			}
+			stateMachine.DiskIDs[volumeName] = normalizedID
+			continue
+		}
+		if found {
+			diskGUID, err := uuid.Parse(diskID)
+			if err != nil && flagIDs[volumeName] {
+				return fmt.Errorf("Invalid disk GUID %q of volume %s: %s", diskID, volumeName, err.Error())
+			} else if err != nil {
+				fmt.Printf("WARNING: volumes:%s:id %q is ignored, it is not a valid disk "+
+					"GUID: %s\n", volumeName, diskID, err.Error())
+				delete(stateMachine.DiskIDs, volumeName)
+			} else {
+				stateMachine.DiskIDs[volumeName] = diskGUID.String()
+			}
+		}
+		partitionGUIDs := make(map[uuid.UUID]int)
+		for ii, structure := range volume.Structure {
+			if structure.ID == "" {
+				continue
+			}
+			partitionGUID, err := uuid.Parse(structure.ID)
+			if err != nil {
+				return fmt.Errorf("Invalid partition GUID %q of structure #%d of volume %s: %s",
+					structure.ID, ii, volumeName, err.Error())
+			}
+			if other, found := partitionGUIDs[partitionGUID]; found {
+				return fmt.Errorf("Structures #%d and #%d of volume %s have the same partition "+
+					"GUID %s", other, ii, volumeName, partitionGUID)
+			}
+			partitionGUIDs[partitionGUID] = ii
+			structure.ID = partitionGUID.String()
+			volume.Structure[ii] = structure
+		}
+	}
+	return nil
+}
+
+// implicitLogicalPartitions returns the indexes of the structures of an MBR volume that
+// are logical partitions, including the rootfs structure that postProcessGadgetYaml
+// appends to volumes without a system-data structure if addsRootfs is set
+func implicitLogicalPartitions(volume *gadget.Volume, addsRootfs bool) map[int]bool {
+	structureNumbers := partitionStructures(volume, false)
+	for _, structure := range volume.Structure {
+		addsRootfs = addsRootfs && structure.Role != gadget.SystemData
+	}
+	if addsRootfs {
+		structureNumbers = append(structureNumbers, len(volume.Structure))
+	}
+	logicalPartitions := make(map[int]bool)
+	if volume.Schema == "mbr" && len(structureNumbers) > mbrPrimaryPartitions {
+		for _, structureNumber := range structureNumbers[mbrPrimaryPartitions-1:] {
+			logicalPartitions[structureNumber] = true
+		}
+	}
+	return logicalPartitions
+}
+
+// logicalPartitionOffset returns the offset of a logical partition that follows a
+// structure ending at lastOffset when its offset isn't given in the gadget.yaml: the
+// next MiB boundary that leaves room for its EBR in the sector before it
+func logicalPartitionOffset(lastOffset quantity.Offset, sectorSize quantity.Size) quantity.Offset {
+	return (lastOffset + quantity.Offset(sectorSize) + quantity.OffsetMiB - 1) / quantity.OffsetMiB *
+		quantity.OffsetMiB
+}
+
+// saveVolumeOrder records the order that the volumes appear in gadget.yaml. This is necessary
+// to preserve backwards compatibility of the command line syntax --image-size <volume_number>:<size>,
+// and to pick the same volume in every build when several of them qualify
+func (stateMachine *StateMachine) saveVolumeOrder(gadgetYamlContents string) {
 	indexMap := make(map[string]int)
 	for volumeName := range stateMachine.GadgetInfo.Volumes {
 		searchString := volumeName + ":"
@@ -205,10 +755,15 @@ func (stateMachine *StateMachine) postProcessGadgetYaml() error {
 		if err := osMkdirAll(volumeBaseDir, 0755); err != nil {
 			return fmt.Errorf("Error creating volume dir: %s", err.Error())
 		}
+		logicalPartitions := implicitLogicalPartitions(volume,
+			len(stateMachine.GadgetInfo.Volumes) == 1)
+		// each volume is a separate disk, so its structures start from its beginning
+		lastOffset = 0
 		// look for the rootfs and check if the image is seeded
 		for ii, structure := range volume.Structure {
 			if structure.Role == "" && structure.Label == gadget.SystemBoot {
-				fmt.Printf("WARNING: volumes:%s:structure:%d:filesystem_label "+
+				// on stderr, so that show-layout only prints the layout on stdout
+				fmt.Fprintf(os.Stderr, "WARNING: volumes:%s:structure:%d:filesystem_label "+
 					"used for defining partition roles; use role instead\n",
 					volumeName, ii)
 			} else if structure.Role == gadget.SystemData {
@@ -226,6 +781,9 @@ func (stateMachine *StateMachine) postProcessGadgetYaml() error {
 			if structure.Offset == nil {
 				if structure.Role != "mbr" && lastOffset < quantity.OffsetMiB {
 					offset = quantity.OffsetMiB
+				} else if logicalPartitions[ii] {
+					offset = logicalPartitionOffset(lastOffset,
+						stateMachine.sectorSize(volumeName))
 				} else {
 					offset = lastOffset
 				}
@@ -248,10 +806,17 @@ func (stateMachine *StateMachine) postProcessGadgetYaml() error {
 		//
 		// Since so far we have no knowledge of the rootfs contents, the
 		// size is set to 0, and will be calculated later
+		volume := stateMachine.GadgetInfo.Volumes[lastVolumeName]
+		// the rootfs partition starts on a sector boundary
+		sectorSize := quantity.Offset(stateMachine.sectorSize(lastVolumeName))
+		rootfsOffset := (farthestOffset + sectorSize - 1) / sectorSize * sectorSize
+		if implicitLogicalPartitions(volume, true)[len(volume.Structure)] {
+			rootfsOffset = logicalPartitionOffset(farthestOffset, quantity.Size(sectorSize))
+		}
 		rootfsStructure := gadget.VolumeStructure{
 			Name:        "",
 			Label:       "writable",
-			Offset:      &farthestOffset,
+			Offset:      &rootfsOffset,
 			OffsetWrite: new(gadget.RelativeOffset),
 			Size:        quantity.Size(0),
 			Type:        "83,0FC63DAF-8483-4772-8E79-3D69D8477DE4",
@@ -292,12 +857,25 @@ func (stateMachine *StateMachine) readMetadata() error {
 		stateMachine.GadgetInfo = partialStateMachine.GadgetInfo
 		stateMachine.YamlFilePath = partialStateMachine.YamlFilePath
 		stateMachine.ImageSizes = partialStateMachine.ImageSizes
+		stateMachine.DiskIDs = partialStateMachine.DiskIDs
+		stateMachine.SectorSizes = partialStateMachine.SectorSizes
+		stateMachine.PartitionAttributes = partialStateMachine.PartitionAttributes
 		stateMachine.RootfsSize = partialStateMachine.RootfsSize
 		stateMachine.IsSeeded = partialStateMachine.IsSeeded
 		stateMachine.VolumeOrder = partialStateMachine.VolumeOrder
+		stateMachine.Artifacts = partialStateMachine.Artifacts
+		stateMachine.BuildDate = partialStateMachine.BuildDate
+		stateMachine.BuildID = partialStateMachine.BuildID
+		// the seed of a --reproducible build depends on inputs that are not given again
+		// when resuming, so keep the one of the first run
+		if partialStateMachine.ReproducibleSeed != "" {
+			stateMachine.SourceDateEpoch = partialStateMachine.SourceDateEpoch
+			stateMachine.ReproducibleSeed = partialStateMachine.ReproducibleSeed
+		}
 		stateMachine.tempDirs.rootfs = filepath.Join(stateMachine.stateMachineFlags.WorkDir, "root")
 		stateMachine.tempDirs.unpack = filepath.Join(stateMachine.stateMachineFlags.WorkDir, "unpack")
 		stateMachine.tempDirs.volumes = filepath.Join(stateMachine.stateMachineFlags.WorkDir, "volumes")
+		stateMachine.tempDirs.staging = filepath.Join(stateMachine.stateMachineFlags.WorkDir, "staging")
 
 		// delete all of the stateFuncs that have already run
 		stateMachine.states = stateMachine.states[stateMachine.StepsTaken:]
@@ -321,25 +899,36 @@ func (stateMachine *StateMachine) writeMetadata() error {
 	return nil
 }
 
+// minimumVolumeSize returns the minimum size of a volume whose last structure ends at
+// farthestOffset
+func minimumVolumeSize(farthestOffset quantity.Offset) quantity.Size {
+	return quantity.Size((farthestOffset/quantity.OffsetMiB + 17) * quantity.OffsetMiB)
+}
+
 // handleContentSizes ensures that the sizes of the partitions are large enough and stores
 // safe values in the stateMachine struct for use during make_image
 func (stateMachine *StateMachine) handleContentSizes(farthestOffset quantity.Offset, volumeName string) {
 	// store volume sizes in the stateMachine Struct. These will be used during
 	// the make_image step
-	calculated := quantity.Size((farthestOffset/quantity.OffsetMiB + 17) * quantity.OffsetMiB)
+	calculated := minimumVolumeSize(farthestOffset)
 	volumeSize, found := stateMachine.ImageSizes[volumeName]
 	if !found {
 		stateMachine.ImageSizes[volumeName] = calculated
 	} else {
 		if volumeSize < calculated {
 			fmt.Printf("WARNING: ignoring image size smaller than "+
-				"minimum required size: vol:%s %d < %d",
+				"minimum required size: vol:%s %d < %d\n",
 				volumeName, uint64(volumeSize), uint64(calculated))
 			stateMachine.ImageSizes[volumeName] = calculated
 		} else {
 			stateMachine.ImageSizes[volumeName] = volumeSize
 		}
 	}
+
+	// cloud providers require the images to be aligned
+	if alignment := stateMachine.cloudProfileAlignment(); alignment != 0 {
+		stateMachine.ImageSizes[volumeName] = roundUpSize(stateMachine.ImageSizes[volumeName], alignment)
+	}
 }
 
 // Run iterates through the state functions, stopping when appropriate based on --until and --thru
@@ -6,6 +6,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 
@@ -38,8 +39,14 @@ var allTestStates = []stateFunc{
 	{"prepopulate_bootfs_contents", func(statemachine *StateMachine) error { return nil }},
 	{"populate_bootfs_contents", func(statemachine *StateMachine) error { return nil }},
 	{"populate_prepare_partitions", func(statemachine *StateMachine) error { return nil }},
+	{"generate_rootfs_artifacts", func(statemachine *StateMachine) error { return nil }},
 	{"make_disk", func(statemachine *StateMachine) error { return nil }},
+	{"verify_image", func(statemachine *StateMachine) error { return nil }},
+	{"package_cloud_image", func(statemachine *StateMachine) error { return nil }},
+	{"make_live_iso", func(statemachine *StateMachine) error { return nil }},
+	{"export_partitions", func(statemachine *StateMachine) error { return nil }},
 	{"generate_manifest", func(statemachine *StateMachine) error { return nil }},
+	{"generate_sbom", func(statemachine *StateMachine) error { return nil }},
 	{"finish", (*StateMachine).finish},
 }
 
@@ -78,6 +85,9 @@ func mockMkdirAll(string, os.FileMode) error {
 func mockOpenFile(string, int, os.FileMode) (*os.File, error) {
 	return nil, fmt.Errorf("Test error")
 }
+func mockOpenFileReadOnly(name string, flag int, perm os.FileMode) (*os.File, error) {
+	return os.OpenFile(name, os.O_RDONLY, perm)
+}
 func mockOpenFileAppend(name string, flag int, perm os.FileMode) (*os.File, error) {
 	return os.OpenFile(name, flag|os.O_APPEND, perm)
 }
@@ -102,6 +112,26 @@ func mockCopySpecialFile(string, string) error {
 func mockDiskfsCreate(string, int64, diskfs.Format) (*disk.Disk, error) {
 	return nil, fmt.Errorf("Test error")
 }
+func mockDiskfsOpen(string) (*disk.Disk, error) {
+	return nil, fmt.Errorf("Test error")
+}
+
+// blockDeviceInfo makes regular files look like block devices
+type blockDeviceInfo struct {
+	os.FileInfo
+}
+
+func (blockDeviceInfo) Mode() os.FileMode {
+	return os.ModeDevice
+}
+func mockStatBlockDevice(name string) (os.FileInfo, error) {
+	fileInfo, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return blockDeviceInfo{fileInfo}, nil
+}
+
 func readOnlyDiskfsCreate(diskName string, size int64, format diskfs.Format) (*disk.Disk, error) {
 	diskFile, _ := os.OpenFile(diskName, os.O_RDONLY|os.O_CREATE, 0444)
 	disk := disk.Disk{
@@ -145,13 +175,18 @@ func TestExecHelperProcess(t *testing.T) {
 	// I think the best idea I saw from people is to switch this on test case
 	// instead on the actual arguments. And this makes sense to me
 	switch os.Getenv("TEST_CASE") {
-	case "TestGeneratePackageManifest":
-		fmt.Fprint(os.Stdout, "foo 1.2\nbar 1.4-1ubuntu4.1\nlibbaz 0.1.3ubuntu2\n")
+	case "TestWriteProvenance":
+		fmt.Fprint(os.Stdout, "tool 1.0\nCopyright\n")
 		break
 	case "TestFailedSetupLiveBuildCommands":
 		// throwing an error here simulates the "command" having an error
 		os.Exit(1)
 		break
+	case "TestFailedGenerateRootfsArtifacts", "TestFailedMakeLiveISO", "TestFailedPackageCloudImage",
+		"TestFailedVerifyImage":
+		fmt.Fprint(os.Stderr, "Test Error")
+		os.Exit(1)
+		break
 	}
 }
 
@@ -239,16 +274,19 @@ func TestUntilThru(t *testing.T) {
 // TestInvalidStateMachineArgs tests that invalid state machine command line arguments result in a failure
 func TestInvalidStateMachineArgs(t *testing.T) {
 	testCases := []struct {
-		name   string
-		until  string
-		thru   string
-		resume bool
-		errMsg string
+		name      string
+		until     string
+		thru      string
+		resume    bool
+		imageName string
+		errMsg    string
 	}{
-		{"both_until_and_thru", "make_temporary_directories", "calculate_rootfs_size", false, "cannot specify both --until and --thru"},
-		{"invalid_until_name", "fake step", "", false, "not a valid state name"},
-		{"invalid_thru_name", "", "fake step", false, "not a valid state name"},
-		{"resume_with_no_workdir", "", "", true, "must specify workdir when using --resume flag"},
+		{"both_until_and_thru", "make_temporary_directories", "calculate_rootfs_size", false, "", "cannot specify both --until and --thru"},
+		{"invalid_until_name", "fake step", "", false, "", "not a valid state name"},
+		{"invalid_thru_name", "", "fake step", false, "", "not a valid state name"},
+		{"resume_with_no_workdir", "", "", true, "", "must specify workdir when using --resume flag"},
+		{"unknown_image_name_placeholder", "", "", false, "{model}-{flavor}", "unknown placeholder {flavor}"},
+		{"image_name_with_slash", "", "", false, "images/{model}", "--image-name cannot contain"},
 	}
 
 	for _, tc := range testCases {
@@ -259,6 +297,38 @@ func TestInvalidStateMachineArgs(t *testing.T) {
 			stateMachine.stateMachineFlags.Until = tc.until
 			stateMachine.stateMachineFlags.Thru = tc.thru
 			stateMachine.stateMachineFlags.Resume = tc.resume
+			stateMachine.commonFlags.ImageName = tc.imageName
+
+			err := stateMachine.validateInput()
+			asserter.AssertErrContains(err, tc.errMsg)
+		})
+	}
+}
+
+// TestInvalidOutputDeviceArgs tests invalid combinations of the --output-device flags
+func TestInvalidOutputDeviceArgs(t *testing.T) {
+	testCases := []struct {
+		name         string
+		outputDevice string
+		force        bool
+		noDiskImage  bool
+		cloudProfile string
+		errMsg       string
+	}{
+		{"force_without_device", "", true, false, "", "--force-output-device can only be used with --output-device"},
+		{"device_without_disk_image", "/dev/sdz", false, true, "", "mutually exclusive"},
+		{"missing_device", "/dev/ubuntu-image-missing", false, false, "", "Error finding output device"},
+		{"cloud_profile_without_disk_image", "", false, true, "gce", "--cloud-profile requires a disk image file"},
+	}
+	for _, tc := range testCases {
+		t.Run("test "+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			var stateMachine StateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.commonFlags.OutputDevice = tc.outputDevice
+			stateMachine.commonFlags.ForceDevice = tc.force
+			stateMachine.commonFlags.NoDiskImage = tc.noDiskImage
+			stateMachine.commonFlags.CloudProfile = tc.cloudProfile
 
 			err := stateMachine.validateInput()
 			asserter.AssertErrContains(err, tc.errMsg)
@@ -310,7 +380,7 @@ func TestFunctionErrors(t *testing.T) {
 		newStateFunc  stateFunc
 	}{
 		{"error_state_func", 0, stateFunc{"test_error_state_func", func(stateMachine *StateMachine) error { return fmt.Errorf("Test Error") }}},
-		{"error_write_metadata", 13, stateFunc{"test_error_write_metadata", func(stateMachine *StateMachine) error {
+		{"error_write_metadata", 18, stateFunc{"test_error_write_metadata", func(stateMachine *StateMachine) error {
 			os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
 			return nil
 		}}},
@@ -470,17 +540,329 @@ func TestFailedParseImageSizes(t *testing.T) {
 	}
 }
 
+// TestParseSectorSizes tests that the sector sizes are taken from gadget.yaml and
+// --sector-size
+func TestParseSectorSizes(t *testing.T) {
+	testCases := []struct {
+		name       string
+		gadget     string
+		sectorSize string
+		result     map[string]quantity.Size
+	}{
+		{"gadget_yaml", "gadget-4k.yaml", "", map[string]quantity.Size{"pc": 4096}},
+		{"override", "gadget-4k.yaml", "512", map[string]quantity.Size{"pc": 512}},
+		{"sector_size", "gadget-mbr.yaml", "4096", map[string]quantity.Size{"pc": 4096}},
+		{"none", "gadget-mbr.yaml", "", map[string]quantity.Size{}},
+	}
+	for _, tc := range testCases {
+		t.Run("test_parse_sector_sizes_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			var stateMachine StateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.YamlFilePath = filepath.Join("testdata", tc.gadget)
+			stateMachine.commonFlags.SectorSize = tc.sectorSize
+
+			err := stateMachine.makeTemporaryDirectories()
+			asserter.AssertErrNil(err, true)
+			defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+			err = stateMachine.loadGadgetYaml()
+			asserter.AssertErrNil(err, true)
+
+			if !reflect.DeepEqual(stateMachine.SectorSizes, tc.result) {
+				t.Errorf("Expected sector sizes %v, got %v", tc.result, stateMachine.SectorSizes)
+			}
+			expected, found := tc.result["pc"]
+			if !found {
+				expected = defaultSectorSize
+			}
+			if stateMachine.sectorSize("pc") != expected {
+				t.Errorf("Expected %d-byte sectors, got %d", expected, stateMachine.sectorSize("pc"))
+			}
+		})
+	}
+}
+
+// TestFailedParseSectorSizes tests invalid sector sizes and partitions that are not
+// aligned to the sectors of their volume
+func TestFailedParseSectorSizes(t *testing.T) {
+	t.Run("test_failed_parse_sector_sizes", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine StateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.YamlFilePath = filepath.Join("testdata", "gadget-4k.yaml")
+
+		err := stateMachine.makeTemporaryDirectories()
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+		err = stateMachine.loadGadgetYaml()
+		asserter.AssertErrNil(err, true)
+
+		_, err = gadgetSectorSizes([]byte("volumes:\n  pc:\n    sector-size: 1024\n"))
+		asserter.AssertErrContains(err, "Invalid sector-size of volume pc")
+		_, err = gadgetSectorSizes([]byte("volumes:\n  pc:\n    sector-size: big\n"))
+		asserter.AssertErrContains(err, "Error reading the sector sizes of gadget.yaml")
+		err = stateMachine.parseSectorSizes([]byte("volumes:\n  pc:\n    sector-size: 2048\n"))
+		asserter.AssertErrContains(err, "Invalid sector-size of volume pc")
+
+		stateMachine.commonFlags.SectorSize = "1024"
+		err = stateMachine.parseSectorSizes([]byte{})
+		asserter.AssertErrContains(err, "Invalid --sector-size 1024")
+		stateMachine.commonFlags.SectorSize = ""
+
+		// the boot structure at 2MiB+512 is not aligned to 4096-byte sectors
+		volume := stateMachine.GadgetInfo.Volumes["pc"]
+		offset := 2*quantity.OffsetMiB + 512
+		volume.Structure[2].Offset = &offset
+		err = sectorAlignmentError("pc", volume, 4096)
+		asserter.AssertErrContains(err, "structure #2 (\"boot\"): offset 2097664 is not a multiple "+
+			"of the 4096-byte sectors of the volume")
+		err = sectorAlignmentError("pc", volume, 512)
+		asserter.AssertErrNil(err, true)
+	})
+}
+
+// TestParsePartitionAttributes tests that the GPT attributes of the partitions are
+// taken from gadget.yaml and --gpt-attributes
+func TestParsePartitionAttributes(t *testing.T) {
+	testCases := []struct {
+		name          string
+		gptAttributes []string
+		result        map[int]uint64
+	}{
+		{"gadget_yaml", nil, map[int]uint64{1: 1 << 2, 2: 0xf<<48 | 1<<56, 3: 1<<48 | 3<<52}},
+		{"override_name", []string{"kernel-b=priority=2,successful", "pc:kernel-a=tries=1"},
+			map[int]uint64{1: 1 << 2, 2: 1 << 52, 3: 2<<48 | 1<<56}},
+		{"override_index", []string{"4=required,60", "1="},
+			map[int]uint64{1: 0, 2: 0xf<<48 | 1<<56, 3: 1<<48 | 3<<52, 4: 1 | 1<<60}},
+	}
+	for _, tc := range testCases {
+		t.Run("test_parse_partition_attributes_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			var stateMachine StateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.YamlFilePath = filepath.Join("testdata", "gadget-attributes.yaml")
+			stateMachine.commonFlags.GPTAttributes = tc.gptAttributes
+
+			err := stateMachine.makeTemporaryDirectories()
+			asserter.AssertErrNil(err, true)
+			defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+			err = stateMachine.loadGadgetYaml()
+			asserter.AssertErrNil(err, true)
+
+			if !reflect.DeepEqual(stateMachine.PartitionAttributes["pc"], tc.result) {
+				t.Errorf("Expected partition attributes %v, got %v", tc.result,
+					stateMachine.PartitionAttributes["pc"])
+			}
+			// the attributes are formatted in the syntax they are parsed from
+			for _, value := range tc.result {
+				parsed, err := parseGPTAttributes(formatGPTAttributes(value))
+				asserter.AssertErrNil(err, true)
+				if parsed != value {
+					t.Errorf("Expected the attributes %v to be parsed as %#x, got %#x",
+						formatGPTAttributes(value), value, parsed)
+				}
+			}
+		})
+	}
+	t.Run("test_format_gpt_attributes", func(t *testing.T) {
+		attributes := formatGPTAttributes(1 | 1<<2 | 1<<5 | 0xf<<48 | 3<<52 | 1<<56 | 1<<63)
+		expected := []string{"required", "legacy-bios-bootable", "5", "priority=15", "tries=3",
+			"successful", "63"}
+		if !reflect.DeepEqual(attributes, expected) {
+			t.Errorf("Expected attributes %v, got %v", expected, attributes)
+		}
+	})
+}
+
+// TestFailedParsePartitionAttributes tests invalid GPT attributes and attributes of
+// structures without a GPT partition
+func TestFailedParsePartitionAttributes(t *testing.T) {
+	t.Run("test_failed_parse_partition_attributes", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine StateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.YamlFilePath = filepath.Join("testdata", "gadget-attributes.yaml")
+
+		err := stateMachine.makeTemporaryDirectories()
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+		err = stateMachine.loadGadgetYaml()
+		asserter.AssertErrNil(err, true)
+
+		_, err = parseGPTAttributes([]string{"bootable"})
+		asserter.AssertErrContains(err, "unknown attribute \"bootable\"")
+		_, err = parseGPTAttributes([]string{"64"})
+		asserter.AssertErrContains(err, "unknown attribute \"64\"")
+		_, err = parseGPTAttributes([]string{"priority=16"})
+		asserter.AssertErrContains(err, "the value of priority must be between 0 and 15")
+		_, err = gadgetPartitionAttributes([]byte("volumes:\n  pc:\n    structure:\n" +
+			"      - attributes: [tries=x]\n"))
+		asserter.AssertErrContains(err, "Invalid attributes of structure #0 of volume pc")
+		_, err = gadgetPartitionAttributes([]byte("volumes:\n  pc:\n    structure:\n" +
+			"      - attributes: required\n"))
+		asserter.AssertErrContains(err, "Error reading the partition attributes of gadget.yaml")
+
+		gadgetYamlBytes, err := ioutil.ReadFile(stateMachine.YamlFilePath)
+		asserter.AssertErrNil(err, true)
+		for _, tc := range []struct {
+			gptAttributes string
+			expected      string
+		}{
+			{"kernel-a", "Argument to --gpt-attributes kernel-a is not in the correct format"},
+			{"other:kernel-a=required", "Volume other does not exist in gadget.yaml"},
+			{"kernel-c=required", "Structure kernel-c does not exist in volume pc"},
+			{"5=required", "Structure 5 does not exist in volume pc"},
+			{"kernel-a=tries=20", "Invalid --gpt-attributes kernel-a=tries=20"},
+			{"mbr=required", `structure #0 ("mbr"): attributes are only supported by ` +
+				"structures with a partition"},
+		} {
+			stateMachine.commonFlags.GPTAttributes = []string{tc.gptAttributes}
+			err = stateMachine.parsePartitionAttributes(gadgetYamlBytes)
+			asserter.AssertErrContains(err, tc.expected)
+		}
+
+		// MBR partitions have no attributes
+		stateMachine.commonFlags.GPTAttributes = []string{"BIOS Boot=required"}
+		stateMachine.YamlFilePath = filepath.Join("testdata", "gadget-mbr.yaml")
+		err = stateMachine.loadGadgetYaml()
+		asserter.AssertErrContains(err, `Invalid partition attributes of volume pc: structure #1 `+
+			`("BIOS Boot"): attributes are only supported by GPT partition tables`)
+
+		stateMachine.commonFlags.GPTAttributes = []string{"first=required"}
+		stateMachine.YamlFilePath = filepath.Join("testdata", "gadget-multi.yaml")
+		err = stateMachine.loadGadgetYaml()
+		asserter.AssertErrContains(err, "--gpt-attributes must be given as "+
+			"<volume>:<structure>=<attributes> for gadgets with multiple volumes")
+	})
+}
+
+// TestParseDiskIDs tests that the disk identifiers are taken from gadget.yaml and
+// --disk-guid, and that the partition GUIDs are normalized
+func TestParseDiskIDs(t *testing.T) {
+	testCases := []struct {
+		name     string
+		gadget   string
+		diskGUID string
+		result   map[string]string
+	}{
+		{"gadget_yaml", "gadget-ids.yaml", "",
+			map[string]string{"pc": "6f3a1b2c-9d4e-4f5a-8b6c-7d8e9f0a1b2c"}},
+		{"disk_guid", "gadget-ids.yaml", "0E1D2C3B-4A59-4687-9765-A4B3C2D1E0F9",
+			map[string]string{"pc": "0e1d2c3b-4a59-4687-9765-a4b3c2d1e0f9"}},
+		{"disk_guid_per_volume", "gadget-multi.yaml",
+			"first:0e1d2c3b-4a59-4687-9765-a4b3c2d1e0f9,third:1e1d2c3b-4a59-4687-9765-a4b3c2d1e0f9",
+			map[string]string{"first": "0e1d2c3b-4a59-4687-9765-a4b3c2d1e0f9",
+				"third": "1e1d2c3b-4a59-4687-9765-a4b3c2d1e0f9"}},
+		{"mbr", "gadget-mbr.yaml", "0x1234ABCD", map[string]string{"pc": "1234abcd"}},
+		{"none", "gadget-mbr.yaml", "", map[string]string{}},
+		{"invalid_gadget_yaml_id", "gadget-mbr-id.yaml", "", map[string]string{}},
+		{"disk_guid_over_invalid_gadget_yaml_id", "gadget-mbr-id.yaml", "1234abcd",
+			map[string]string{"pc": "1234abcd"}},
+	}
+	for _, tc := range testCases {
+		t.Run("test_parse_disk_ids_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			var stateMachine StateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.YamlFilePath = filepath.Join("testdata", tc.gadget)
+			stateMachine.commonFlags.DiskGUID = tc.diskGUID
+
+			err := stateMachine.makeTemporaryDirectories()
+			asserter.AssertErrNil(err, true)
+			defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+			err = stateMachine.loadGadgetYaml()
+			asserter.AssertErrNil(err, true)
+
+			if !reflect.DeepEqual(stateMachine.DiskIDs, tc.result) {
+				t.Errorf("Expected disk identifiers %v, got %v", tc.result, stateMachine.DiskIDs)
+			}
+
+			// the identifiers are kept when resuming after load_gadget_yaml
+			err = stateMachine.writeMetadata()
+			asserter.AssertErrNil(err, true)
+			var resumed StateMachine
+			resumed.commonFlags, resumed.stateMachineFlags = helper.InitCommonOpts()
+			resumed.stateMachineFlags.Resume = true
+			resumed.stateMachineFlags.WorkDir = stateMachine.stateMachineFlags.WorkDir
+			err = resumed.readMetadata()
+			asserter.AssertErrNil(err, true)
+			if len(resumed.DiskIDs) != len(tc.result) || (len(tc.result) > 0 &&
+				!reflect.DeepEqual(resumed.DiskIDs, tc.result)) {
+				t.Errorf("Expected disk identifiers %v after resuming, got %v",
+					tc.result, resumed.DiskIDs)
+			}
+			if tc.gadget == "gadget-ids.yaml" {
+				structures := stateMachine.GadgetInfo.Volumes["pc"].Structure
+				if structures[0].ID != "1c2d3e4f-5a6b-4c7d-8e9f-0a1b2c3d4e5f" {
+					t.Errorf("Expected the partition GUID to be normalized, got %s", structures[0].ID)
+				}
+			}
+		})
+	}
+}
+
+// TestFailedParseDiskIDs tests failures in parsing the disk identifiers
+func TestFailedParseDiskIDs(t *testing.T) {
+	testCases := []struct {
+		name        string
+		gadget      string
+		diskGUID    string
+		structureID string
+		errMsg      string
+	}{
+		{"multiple_volumes", "gadget-multi.yaml", "0e1d2c3b-4a59-4687-9765-a4b3c2d1e0f9", "",
+			"--disk-guid must be given as <volume>:<GUID>"},
+		{"wrong_format", "gadget-multi.yaml", "first:0e1d2c3b-4a59-4687-9765-a4b3c2d1e0f9,second", "",
+			"Argument to --disk-guid second is not in the correct format"},
+		{"volume_not_exist", "gadget-multi.yaml", "fifth:0e1d2c3b-4a59-4687-9765-a4b3c2d1e0f9", "",
+			"Volume fifth does not exist in gadget.yaml"},
+		{"invalid_guid", "gadget-ids.yaml", "0e1d2c3b", "",
+			"Invalid disk GUID \"0e1d2c3b\" of volume pc"},
+		{"invalid_mbr_id", "gadget-mbr.yaml", "0e1d2c3b-4a59-4687-9765-a4b3c2d1e0f9", "",
+			"MBR disk identifiers are 8 hexadecimal digits"},
+		{"invalid_partition_guid", "gadget-ids.yaml", "", "not-a-guid",
+			"Invalid partition GUID \"not-a-guid\" of structure #1 of volume pc"},
+		{"duplicate_partition_guid", "gadget-ids.yaml", "", "1C2D3E4F-5A6B-4C7D-8E9F-0A1B2C3D4E5F",
+			"Structures #0 and #1 of volume pc have the same partition GUID"},
+	}
+	for _, tc := range testCases {
+		t.Run("test_failed_parse_disk_ids_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			var stateMachine StateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.YamlFilePath = filepath.Join("testdata", tc.gadget)
+
+			err := stateMachine.makeTemporaryDirectories()
+			asserter.AssertErrNil(err, true)
+			defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+			err = stateMachine.loadGadgetYaml()
+			asserter.AssertErrNil(err, true)
+
+			stateMachine.commonFlags.DiskGUID = tc.diskGUID
+			if tc.structureID != "" {
+				stateMachine.GadgetInfo.Volumes["pc"].Structure[1].ID = tc.structureID
+			}
+			err = stateMachine.parseDiskIDs()
+			asserter.AssertErrContains(err, tc.errMsg)
+		})
+	}
+}
+
 // TestHandleContentSizes ensures that using --image-size with a few different values
 // results in the correct sizes in stateMachine.ImageSizes
 func TestHandleContentSizes(t *testing.T) {
 	testCases := []struct {
-		name   string
-		size   string
-		result map[string]quantity.Size
+		name         string
+		size         string
+		cloudProfile string
+		result       map[string]quantity.Size
 	}{
-		{"size_not_specified", "", map[string]quantity.Size{"pc": 17825792}},
-		{"size_smaller_than_content", "pc:123", map[string]quantity.Size{"pc": 17825792}},
-		{"size_bigger_than_content", "pc:4G", map[string]quantity.Size{"pc": 4 * quantity.SizeGiB}},
+		{"size_not_specified", "", "", map[string]quantity.Size{"pc": 17825792}},
+		{"size_smaller_than_content", "pc:123", "", map[string]quantity.Size{"pc": 17825792}},
+		{"size_bigger_than_content", "pc:4G", "", map[string]quantity.Size{"pc": 4 * quantity.SizeGiB}},
+		{"aws_profile", "", "aws", map[string]quantity.Size{"pc": quantity.SizeGiB}},
+		{"gce_profile", "pc:1025M", "gce", map[string]quantity.Size{"pc": 2 * quantity.SizeGiB}},
+		{"azure_profile", "pc:20000000", "azure", map[string]quantity.Size{"pc": 20 * quantity.SizeMiB}},
 	}
 	for _, tc := range testCases {
 		t.Run("test_handle_content_sizes_"+tc.name, func(t *testing.T) {
@@ -488,6 +870,7 @@ func TestHandleContentSizes(t *testing.T) {
 			var stateMachine StateMachine
 			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
 			stateMachine.commonFlags.Size = tc.size
+			stateMachine.commonFlags.CloudProfile = tc.cloudProfile
 			stateMachine.YamlFilePath = filepath.Join("testdata", "gadget_tree",
 				"meta", "gadget.yaml")
 
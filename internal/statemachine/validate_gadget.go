@@ -0,0 +1,372 @@
+package statemachine
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+	"github.com/snapcore/snapd/gadget"
+	"github.com/snapcore/snapd/gadget/quantity"
+)
+
+// GadgetDiagnostic is a problem found in a gadget.yaml by ValidateGadget
+type GadgetDiagnostic struct {
+	// File is the path of the gadget.yaml
+	File string
+	// Line is the line of the volume or structure in the gadget.yaml, or 0 if unknown
+	Line int
+	// Volume and Structure locate the problem. Structure is -1 for problems of a
+	// whole volume, and Volume is empty for problems of the whole gadget.yaml
+	Volume        string
+	Structure     int
+	StructureName string
+	Message       string
+}
+
+// String formats the diagnostic as "<file>:<line>: volume "<name>", structure #<index>
+// ("<name>"): <message>"
+func (diagnostic GadgetDiagnostic) String() string {
+	var location strings.Builder
+	location.WriteString(diagnostic.File)
+	if diagnostic.Line > 0 {
+		fmt.Fprintf(&location, ":%d", diagnostic.Line)
+	}
+	location.WriteString(": ")
+	if diagnostic.Volume != "" {
+		fmt.Fprintf(&location, "volume %q", diagnostic.Volume)
+		if diagnostic.Structure >= 0 {
+			fmt.Fprintf(&location, ", structure #%d", diagnostic.Structure)
+			if diagnostic.StructureName != "" {
+				fmt.Fprintf(&location, " (%q)", diagnostic.StructureName)
+			}
+		}
+		location.WriteString(": ")
+	}
+	return location.String() + diagnostic.Message
+}
+
+// gadgetYamlLines holds the line numbers of the volumes and structures of a gadget.yaml
+type gadgetYamlLines struct {
+	volumes    map[string]int
+	structures map[string][]int
+}
+
+// findGadgetYamlLines returns the line numbers of the volumes and structures of a
+// gadget.yaml. The yaml library doesn't keep track of them, so the block style used by
+// gadget.yaml files is scanned by indentation
+func findGadgetYamlLines(gadgetYaml string) gadgetYamlLines {
+	lines := gadgetYamlLines{
+		volumes:    make(map[string]int),
+		structures: make(map[string][]int),
+	}
+	volumesIndent, volumeIndent, structureIndent, itemIndent := -1, -1, -1, -1
+	var volumeName string
+	for ii, line := range strings.Split(gadgetYaml, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		indent := len(line) - len(strings.TrimLeft(line, " "))
+		isItem := trimmed == "-" || strings.HasPrefix(trimmed, "- ")
+		key := strings.Trim(strings.SplitN(trimmed, ":", 2)[0], "\"' ")
+
+		if structureIndent >= 0 {
+			if isItem && indent >= structureIndent && (itemIndent < 0 || indent == itemIndent) {
+				itemIndent = indent
+				lines.structures[volumeName] = append(lines.structures[volumeName], ii+1)
+				continue
+			}
+			if indent > structureIndent && !(itemIndent >= 0 && indent < itemIndent) {
+				continue
+			}
+			structureIndent, itemIndent = -1, -1
+		}
+		switch {
+		case volumesIndent < 0 || indent <= volumesIndent:
+			volumesIndent, volumeIndent, volumeName = -1, -1, ""
+			if key == "volumes" && strings.HasSuffix(trimmed, ":") {
+				volumesIndent = indent
+			}
+		case volumeIndent < 0 || indent == volumeIndent:
+			volumeIndent = indent
+			volumeName = key
+			lines.volumes[volumeName] = ii + 1
+		case indent > volumeIndent && key == "structure":
+			structureIndent = indent
+		}
+	}
+	return lines
+}
+
+// line returns the line of a structure, or of its volume if the structure is -1 or unknown
+func (lines gadgetYamlLines) line(volumeName string, structureNumber int) int {
+	if structureNumber >= 0 && structureNumber < len(lines.structures[volumeName]) {
+		return lines.structures[volumeName][structureNumber]
+	}
+	return lines.volumes[volumeName]
+}
+
+// volumeOrder returns the names of the volumes of gadgetInfo in the order of the gadget.yaml
+func (lines gadgetYamlLines) volumeOrder(gadgetInfo *gadget.Info) []string {
+	var volumeNames []string
+	for volumeName := range gadgetInfo.Volumes {
+		volumeNames = append(volumeNames, volumeName)
+	}
+	sort.Slice(volumeNames, func(i, j int) bool {
+		return lines.volumes[volumeNames[i]] < lines.volumes[volumeNames[j]]
+	})
+	return volumeNames
+}
+
+// layoutGadget assigns the offsets of the structures of gadgetInfo and adds the rootfs
+// structure as a build would, in a throwaway volumes directory. It returns the number of
+// structures of each volume that are declared in the gadget.yaml
+func layoutGadget(gadgetInfo *gadget.Info, sectorSizes map[string]quantity.Size) (map[string]int, error) {
+	volumesDir, err := ioutil.TempDir("", "ubuntu-image-layout-")
+	if err != nil {
+		return nil, fmt.Errorf("Error creating temporary directory: %s", err.Error())
+	}
+	defer os.RemoveAll(volumesDir)
+	structureCounts := make(map[string]int)
+	for volumeName, volume := range gadgetInfo.Volumes {
+		structureCounts[volumeName] = len(volume.Structure)
+	}
+	var stateMachine StateMachine
+	stateMachine.GadgetInfo = gadgetInfo
+	stateMachine.SectorSizes = sectorSizes
+	stateMachine.tempDirs.volumes = volumesDir
+	if err := stateMachine.postProcessGadgetYaml(); err != nil {
+		return nil, err
+	}
+	return structureCounts, nil
+}
+
+// gadgetErrorLocation matches the volume and structure that gadget.InfoFromGadgetYaml
+// errors refer to
+var gadgetErrorLocation = regexp.MustCompile(`^invalid volume "([^"]*)": (?:.*?structure #(\d+))?`)
+
+// ValidateGadget checks the meta/gadget.yaml of a gadget tree without building an
+// image. It returns the problems found: errors reported by snapd when loading the
+// gadget.yaml, content that is missing or doesn't fit in its structure, structures
+// or offset-writes that overlap once the offsets are assigned as ubuntu-image does,
+// partitions that don't start on a boundary of the sector-size of their volume,
+// logical partitions of MBR volumes that leave no room for their EBR and GPT
+// attributes of structures that have no GPT partition
+func ValidateGadget(gadgetTree string) ([]GadgetDiagnostic, error) {
+	gadgetYamlPath := filepath.Join(gadgetTree, "meta", "gadget.yaml")
+	gadgetYamlBytes, err := ioutilReadFile(gadgetYamlPath)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading gadget.yaml bytes: %s", err.Error())
+	}
+	lines := findGadgetYamlLines(string(gadgetYamlBytes))
+
+	gadgetInfo, err := gadget.InfoFromGadgetYaml(gadgetYamlBytes, nil)
+	if err != nil {
+		diagnostic := GadgetDiagnostic{File: gadgetYamlPath, Structure: -1, Message: err.Error()}
+		if match := gadgetErrorLocation.FindStringSubmatch(err.Error()); match != nil {
+			structureNumber := -1
+			if match[2] != "" {
+				structureNumber, _ = strconv.Atoi(match[2])
+			}
+			diagnostic.Line = lines.line(match[1], structureNumber)
+		}
+		return []GadgetDiagnostic{diagnostic}, nil
+	}
+
+	sectorSizes, err := gadgetSectorSizes(gadgetYamlBytes)
+	if err != nil {
+		return []GadgetDiagnostic{{File: gadgetYamlPath, Structure: -1, Message: err.Error()}}, nil
+	}
+	partitionAttributes, err := gadgetPartitionAttributes(gadgetYamlBytes)
+	if err != nil {
+		return []GadgetDiagnostic{{File: gadgetYamlPath, Structure: -1, Message: err.Error()}}, nil
+	}
+	structureCounts, err := layoutGadget(gadgetInfo, sectorSizes)
+	if err != nil {
+		return nil, err
+	}
+
+	var diagnostics []GadgetDiagnostic
+	for _, volumeName := range lines.volumeOrder(gadgetInfo) {
+		firstDiagnostic := len(diagnostics)
+		volume := gadgetInfo.Volumes[volumeName]
+		// the structures added by postProcessGadgetYaml aren't in the gadget.yaml
+		structures := volume.Structure[:structureCounts[volumeName]]
+		report := func(structureNumber int, format string, args ...interface{}) {
+			diagnostics = append(diagnostics, GadgetDiagnostic{
+				File:          gadgetYamlPath,
+				Line:          lines.line(volumeName, structureNumber),
+				Volume:        volumeName,
+				Structure:     structureNumber,
+				StructureName: structures[structureNumber].Name,
+				Message:       fmt.Sprintf(format, args...),
+			})
+		}
+		for ii, structure := range structures {
+			for _, problem := range checkStructureContent(gadgetTree, structure) {
+				report(ii, "%s", problem)
+			}
+		}
+		checkStructureOverlaps(structures, report)
+		checkOffsetWrites(structures, report)
+		// the rootfs structure is aligned and leaves room for its EBR
+		reportDeclared := func(structureNumber int, format string, args ...interface{}) {
+			if structureNumber < len(structures) {
+				report(structureNumber, format, args...)
+			}
+		}
+		sectorSize, found := sectorSizes[volumeName]
+		if found {
+			checkSectorAlignment(volume, sectorSize, reportDeclared)
+		} else {
+			sectorSize = defaultSectorSize
+		}
+		checkLogicalPartitions(volume, uint64(sectorSize), false, reportDeclared)
+		checkPartitionAttributes(volume, partitionAttributes[volumeName], report)
+		volumeDiagnostics := diagnostics[firstDiagnostic:]
+		sort.SliceStable(volumeDiagnostics, func(i, j int) bool {
+			return volumeDiagnostics[i].Line < volumeDiagnostics[j].Line
+		})
+	}
+	return diagnostics, nil
+}
+
+// checkStructureContent returns the problems with the content of a structure: images
+// and sources that don't exist in the gadget tree or don't fit in the structure
+func checkStructureContent(gadgetTree string, structure gadget.VolumeStructure) []string {
+	var problems []string
+	if structure.HasFilesystem() {
+		var contentSize quantity.Size
+		for _, content := range structure.Content {
+			if strings.HasPrefix(content.UnresolvedSource, "$") {
+				// content of other snaps, such as $kernel:dtbs, is only known at build time
+				continue
+			}
+			sourceSize, err := helper.Du(filepath.Join(gadgetTree, content.UnresolvedSource))
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("content source %s does not exist",
+					content.UnresolvedSource))
+				continue
+			}
+			contentSize += sourceSize
+		}
+		if structure.Size != 0 && contentSize > structure.Size {
+			problems = append(problems, fmt.Sprintf("content of size %s does not fit in the "+
+				"structure of size %s", contentSize.IECString(), structure.Size.IECString()))
+		}
+		return problems
+	}
+
+	// raw content images are written one after the other, as in copyStructureContent
+	var runningOffset quantity.Offset
+	for _, content := range structure.Content {
+		if content.Offset != nil {
+			runningOffset = *content.Offset
+		}
+		imageInfo, err := osStat(filepath.Join(gadgetTree, content.Image))
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("content image %s does not exist", content.Image))
+			continue
+		}
+		imageSize := quantity.Size(imageInfo.Size())
+		if content.Size != 0 {
+			if imageSize > content.Size {
+				problems = append(problems, fmt.Sprintf("content image %s of size %s is larger "+
+					"than its declared size %s", content.Image, imageSize.IECString(),
+					content.Size.IECString()))
+			}
+			imageSize = content.Size
+		}
+		end := runningOffset + quantity.Offset(imageSize)
+		if end > quantity.Offset(structure.Size) {
+			problems = append(problems, fmt.Sprintf("content image %s of size %s at offset %d "+
+				"does not fit in the structure of size %s", content.Image, imageSize.IECString(),
+				runningOffset, structure.Size.IECString()))
+		}
+		runningOffset = end
+	}
+	return problems
+}
+
+// checkStructureOverlaps reports the structures that start before the end of another
+// structure of the volume
+func checkStructureOverlaps(structures []gadget.VolumeStructure,
+	report func(int, string, ...interface{})) {
+	order := make([]int, len(structures))
+	for ii := range order {
+		order[ii] = ii
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return getStructureOffset(structures[order[i]]) < getStructureOffset(structures[order[j]])
+	})
+	previous := -1
+	var previousEnd quantity.Offset
+	for _, ii := range order {
+		start := getStructureOffset(structures[ii])
+		if previous >= 0 && start < previousEnd {
+			report(ii, "structure at offset %d overlaps with structure #%d (%q), which ends at offset %d",
+				start, previous, structures[previous].Name, previousEnd)
+		}
+		if end := start + quantity.Offset(structures[ii].Size); end > previousEnd {
+			previous, previousEnd = ii, end
+		}
+	}
+}
+
+// checkOffsetWrites reports the offset-writes that are not within the structure they
+// are relative to, or within the volume, and those that overwrite each other. They are
+// located as writeOffsetValues writes them
+func checkOffsetWrites(structures []gadget.VolumeStructure,
+	report func(int, string, ...interface{})) {
+	volume := &gadget.Volume{Structure: structures}
+	var volumeEnd quantity.Offset
+	structureNumbers := make(map[string]int)
+	for ii, structure := range structures {
+		volumeEnd = maxOffset(volumeEnd, getStructureOffset(structure)+quantity.Offset(structure.Size))
+		if structure.Name != "" {
+			structureNumbers[structure.Name] = ii
+		}
+	}
+
+	// the offset-writes of the structure and its content write 4 bytes each
+	writers := make(map[quantity.Offset]string)
+	checkOffsetWrite := func(ii int, writer string, offsetWrite *gadget.RelativeOffset) {
+		if offsetWrite == nil {
+			return
+		}
+		target := offsetWriteLocation(volume, offsetWrite)
+		if offsetWrite.RelativeTo != "" {
+			relativeTo := structures[structureNumbers[offsetWrite.RelativeTo]]
+			if offsetWrite.Offset+4 > quantity.Offset(relativeTo.Size) {
+				report(ii, "offset-write %s of %s is outside of structure %q of size %s",
+					offsetWrite, writer, offsetWrite.RelativeTo, relativeTo.Size.IECString())
+				return
+			}
+		} else if target+4 > volumeEnd {
+			report(ii, "offset-write %s of %s is outside of the volume, which ends at offset %d",
+				offsetWrite, writer, volumeEnd)
+			return
+		}
+		for otherTarget, otherWriter := range writers {
+			if otherTarget < target+4 && target < otherTarget+4 {
+				report(ii, "offset-write %s of %s overwrites the offset-write of %s",
+					offsetWrite, writer, otherWriter)
+				return
+			}
+		}
+		writers[target] = writer
+	}
+	for ii, structure := range structures {
+		writer := fmt.Sprintf("structure #%d", ii)
+		checkOffsetWrite(ii, writer, structure.OffsetWrite)
+		for _, content := range structure.Content {
+			checkOffsetWrite(ii, "content image "+content.Image+" of "+writer, content.OffsetWrite)
+		}
+	}
+}
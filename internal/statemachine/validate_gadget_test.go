@@ -0,0 +1,133 @@
+// This file contains unit tests for the validation of gadget trees
+package statemachine
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+)
+
+// TestValidateGadget ensures that the problems of a gadget tree are reported with
+// the line of the volume or structure in the gadget.yaml
+func TestValidateGadget(t *testing.T) {
+	type expectedDiagnostic struct {
+		line    int
+		message string
+	}
+	testCases := []struct {
+		name       string
+		gadgetTree string
+		expected   []expectedDiagnostic
+	}{
+		{"valid", "gadget_tree", nil},
+		{"problems", "gadget_tree_problems", []expectedDiagnostic{
+			{5, `volume "pc", structure #0 ("mbr"): content image pc-boot.img of size 512 B at offset 0 does not fit`},
+			{10, `volume "pc", structure #1 ("BIOS Boot"): content image missing-core.img does not exist`},
+			{10, `offset-write mbr+438 of structure #1 is outside of structure "mbr"`},
+			{16, `volume "pc", structure #2 ("EFI System"): content of size`},
+			{16, `structure at offset 1572864 overlaps with structure #1 ("BIOS Boot")`},
+		}},
+		{"offset_writes", "gadget_tree_offset_writes", []expectedDiagnostic{
+			{10, `volume "data", structure #1 ("second"): offset-write 102 of structure #1 overwrites the offset-write of structure #0`},
+			{10, `offset-write 4194304 of content image pc-boot.img of structure #1 is outside of the volume`},
+		}},
+		{"invalid_structure", "gadget_tree_bad_type", []expectedDiagnostic{
+			{8, `invalid volume "pc": invalid structure #1 ("BIOS Boot"): invalid type`},
+		}},
+		{"invalid_yaml", "gadget_tree_invalid", []expectedDiagnostic{
+			{0, "cannot parse gadget metadata"},
+		}},
+	}
+	for _, tc := range testCases {
+		t.Run("test_validate_gadget_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			gadgetTree := filepath.Join("testdata", tc.gadgetTree)
+			diagnostics, err := ValidateGadget(gadgetTree)
+			asserter.AssertErrNil(err, true)
+			if len(diagnostics) != len(tc.expected) {
+				t.Fatalf("Expected %d diagnostics, got %v", len(tc.expected), diagnostics)
+			}
+			for ii, expected := range tc.expected {
+				if diagnostics[ii].Line != expected.line ||
+					!strings.Contains(diagnostics[ii].String(), expected.message) {
+					t.Errorf("Expected diagnostic at line %d containing %q, got %q",
+						expected.line, expected.message, diagnostics[ii])
+				}
+				if !strings.HasPrefix(diagnostics[ii].String(),
+					filepath.Join(gadgetTree, "meta", "gadget.yaml")) {
+					t.Errorf("Expected the diagnostic to start with the gadget.yaml path, got %q",
+						diagnostics[ii])
+				}
+			}
+		})
+	}
+}
+
+// TestFindGadgetYamlLines ensures that the lines of the volumes and structures are
+// found in both indentation styles of lists
+func TestFindGadgetYamlLines(t *testing.T) {
+	t.Run("test_find_gadget_yaml_lines", func(t *testing.T) {
+		lines := findGadgetYamlLines(`# a comment
+volumes:
+  pc:
+    bootloader: grub
+    structure:
+      - name: mbr
+        content:
+          - image: pc-boot.img
+
+      -
+        name: BIOS Boot
+  "data":
+    structure:
+    - name: first
+    - name: second
+    schema: gpt
+defaults:
+  structure:
+    - name: ignored
+`)
+		if lines.volumes["pc"] != 3 || lines.volumes["data"] != 12 || len(lines.volumes) != 2 {
+			t.Errorf("Unexpected volume lines %v", lines.volumes)
+		}
+		if lines.line("pc", 0) != 6 || lines.line("pc", 1) != 10 || lines.line("pc", 2) != 3 ||
+			lines.line("data", 1) != 15 || lines.line("data", -1) != 12 {
+			t.Errorf("Unexpected structure lines %v", lines.structures)
+		}
+	})
+}
+
+// TestFailedValidateGadget tests failures when validating gadget trees
+func TestFailedValidateGadget(t *testing.T) {
+	t.Run("test_failed_validate_gadget", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		_, err := ValidateGadget(filepath.Join("testdata", "missing"))
+		asserter.AssertErrContains(err, "Error reading gadget.yaml bytes")
+
+		// mock os.MkdirAll
+		osMkdirAll = mockMkdirAll
+		defer func() {
+			osMkdirAll = os.MkdirAll
+		}()
+		_, err = ValidateGadget(filepath.Join("testdata", "gadget_tree"))
+		asserter.AssertErrContains(err, "Error creating volume dir")
+		osMkdirAll = os.MkdirAll
+
+		// mock os.Stat
+		osStat = func(string) (os.FileInfo, error) {
+			return nil, errors.New("Test error")
+		}
+		defer func() {
+			osStat = os.Stat
+		}()
+		diagnostics, err := ValidateGadget(filepath.Join("testdata", "gadget_tree"))
+		asserter.AssertErrNil(err, true)
+		if len(diagnostics) != 2 || !strings.Contains(diagnostics[0].Message, "does not exist") {
+			t.Errorf("Expected the missing content images to be reported, got %v", diagnostics)
+		}
+	})
+}
@@ -0,0 +1,185 @@
+package statemachine
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/snapcore/snapd/gadget"
+	"github.com/snapcore/snapd/gadget/quantity"
+)
+
+// fsckCommands are the commands checking the filesystems of the partitions without
+// modifying them
+var fsckCommands = map[string][]string{
+	"ext2": {"e2fsck", "-f", "-n"},
+	"ext3": {"e2fsck", "-f", "-n"},
+	"ext4": {"e2fsck", "-f", "-n"},
+	"vfat": {"fsck.vfat", "-n"},
+}
+
+// verifyVolume checks the disk image at imgPath against the laid out volume and
+// returns the problems that were found
+func (stateMachine *StateMachine) verifyVolume(volumeName string, volume *gadget.Volume,
+	imgPath string) ([]string, error) {
+	sectorSize := stateMachine.sectorSize(volumeName)
+	if stateMachine.commonFlags.OutputDevice != "" {
+		// the images written to a device use its sector size
+		sectorSize = 0
+	}
+	report, err := InspectImage(imgPath, int64(sectorSize))
+	if err != nil {
+		return nil, err
+	}
+	report.compareWithVolume(volume, quantity.Size(report.SectorSize),
+		stateMachine.PartitionAttributes[volumeName], stateMachine.IsSeeded)
+	problems := report.Mismatches
+
+	imgFile, err := osOpenFile(imgPath, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening disk image: %s", err.Error())
+	}
+	defer imgFile.Close()
+	contentProblems, err := stateMachine.checkRawContent(volume, report.SectorSize, imgFile)
+	if err != nil {
+		return nil, err
+	}
+	problems = append(problems, contentProblems...)
+	offsetWriteProblems, err := checkOffsetWriteValues(volume, report.SectorSize, imgFile)
+	if err != nil {
+		return nil, err
+	}
+	problems = append(problems, offsetWriteProblems...)
+
+	// a partition table mismatch makes the filesystem checks meaningless
+	if len(report.Mismatches) > 0 {
+		return problems, nil
+	}
+	fsckProblems, err := stateMachine.checkFilesystems(volumeName, volume, report, imgPath)
+	if err != nil {
+		return nil, err
+	}
+	return append(problems, fsckProblems...), nil
+}
+
+// checkRawContent compares the raw content of the structures without a filesystem
+// with the gadget files they were copied from. The bytes holding offset-write values
+// are skipped, as make_disk writes over them
+func (stateMachine *StateMachine) checkRawContent(volume *gadget.Volume, sectorSize int64,
+	imgFile *os.File) ([]string, error) {
+	offsetWrites := make(map[int64]bool)
+	for _, offsetWrite := range volumeOffsetWrites(volume, quantity.Size(sectorSize)) {
+		for ii := int64(0); ii < 4; ii++ {
+			offsetWrites[int64(offsetWrite.location)+ii] = true
+		}
+	}
+
+	var problems []string
+	for structureNumber, structure := range volume.Structure {
+		if structure.Filesystem != "" || shouldSkipStructure(structure, stateMachine.IsSeeded) {
+			continue
+		}
+		// the content is laid out as in copyStructureContent
+		var runningOffset quantity.Offset = 0
+		for _, content := range structure.Content {
+			if content.Offset != nil {
+				runningOffset = *content.Offset
+			}
+			contentOffset := runningOffset
+			runningOffset += quantity.Offset(content.Size)
+			if uint64(contentOffset) >= uint64(structure.Size) {
+				continue
+			}
+			expected, err := ioutilReadFile(filepath.Join(stateMachine.tempDirs.unpack,
+				"gadget", content.Image))
+			if err != nil {
+				return nil, fmt.Errorf("Error reading content of structure %q: %s",
+					structure.Name, err.Error())
+			}
+			if available := uint64(structure.Size) - uint64(contentOffset); uint64(len(expected)) > available {
+				expected = expected[:available]
+			}
+			start := int64(getStructureOffset(structure)) + int64(contentOffset)
+			found := make([]byte, len(expected))
+			if _, err := imgFile.ReadAt(found, start); err != nil {
+				problems = append(problems, fmt.Sprintf("structure #%d (%q): content %s "+
+					"could not be read from the image: %s", structureNumber, structure.Name,
+					content.Image, err.Error()))
+				continue
+			}
+			for ii := range expected {
+				if expected[ii] != found[ii] && !offsetWrites[start+int64(ii)] {
+					problems = append(problems, fmt.Sprintf("structure #%d (%q): content %s "+
+						"differs from the image at byte %d", structureNumber, structure.Name,
+						content.Image, start+int64(ii)))
+					break
+				}
+			}
+		}
+	}
+	return problems, nil
+}
+
+// checkOffsetWriteValues checks that the offsets of the structures and content images, in
+// sectors, are written where their offset-write properties point to, as in writeOffsetValues
+func checkOffsetWriteValues(volume *gadget.Volume, sectorSize int64, imgFile *os.File) ([]string, error) {
+	var problems []string
+	for _, offsetWrite := range volumeOffsetWrites(volume, quantity.Size(sectorSize)) {
+		valueBytes := make([]byte, 4)
+		if _, err := imgFile.ReadAt(valueBytes, int64(offsetWrite.location)); err != nil {
+			return nil, fmt.Errorf("Error reading offset-write value at %d: %s",
+				offsetWrite.location, err.Error())
+		}
+		structure := volume.Structure[offsetWrite.structure]
+		writer := fmt.Sprintf("structure #%d (%q)", offsetWrite.structure, structure.Name)
+		if offsetWrite.content >= 0 {
+			writer = fmt.Sprintf("%s content %s", writer, structure.Content[offsetWrite.content].Image)
+		}
+		if found := binary.LittleEndian.Uint32(valueBytes); uint64(found) != offsetWrite.value {
+			problems = append(problems, fmt.Sprintf("%s: expected offset-write value %d at "+
+				"byte %d, found %d", writer, offsetWrite.value, offsetWrite.location, found))
+		}
+	}
+	return problems, nil
+}
+
+// checkFilesystems copies the filesystem partitions out of the disk image and checks
+// them with a read-only fsck
+func (stateMachine *StateMachine) checkFilesystems(volumeName string, volume *gadget.Volume,
+	report *ImageReport, imgPath string) ([]string, error) {
+	var problems []string
+	for jj, structureNumber := range partitionStructures(volume, stateMachine.IsSeeded) {
+		structure := volume.Structure[structureNumber]
+		fsckCommand, found := fsckCommands[structure.Filesystem]
+		if !found {
+			continue
+		}
+		partition := report.Partitions[jj]
+		partImg := filepath.Join(stateMachine.tempDirs.volumes, volumeName,
+			"verify"+strconv.Itoa(structureNumber)+".img")
+		ddArgs := []string{
+			"if=" + imgPath,
+			"of=" + partImg,
+			"bs=" + strconv.FormatInt(report.SectorSize, 10),
+			"skip=" + strconv.FormatInt(partition.Start/report.SectorSize, 10),
+			"count=" + strconv.FormatInt(partition.Size/report.SectorSize, 10),
+			"conv=sparse",
+		}
+		if err := helperCopyBlob(ddArgs); err != nil {
+			return nil, fmt.Errorf("Error copying partition %d out of the disk image: %s",
+				partition.Number, err.Error())
+		}
+		fsckArgs := append(append([]string{}, fsckCommand[1:]...), partImg)
+		output, err := execCommand(fsckCommand[0], fsckArgs...).CombinedOutput()
+		osRemoveAll(partImg)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("structure #%d (%q): %s reported errors "+
+				"in the %s filesystem: %s", structureNumber, structure.Name, fsckCommand[0],
+				structure.Filesystem, strings.TrimSpace(string(output))))
+		}
+	}
+	return problems, nil
+}